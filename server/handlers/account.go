@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultDeletionGrace = 72 * time.Hour
+	// a purge that has been running this long is assumed to have crashed
+	purgeStaleAfter = time.Hour
+	purgeRetryDelay = 10 * time.Minute
+)
+
+// userDataCollections hold documents keyed by user_id that are removed when
+// an account is purged. audit_log is deliberately kept.
+var userDataCollections = []string{
+	"files",
+	"folders",
+	"user_storage",
+	"quota_reservations",
+	"storage_snapshots",
+	"sessions",
+	"api_tokens",
+	"identities",
+	"oidc_link_requests",
+	"exports",
+	"notifications",
+	"upload_policies",
+	"user_keys",
+	"vault_members",
+	"vault_keys",
+}
+
+// RequestAccountDeletion schedules the account for purging after a grace
+// period (ACCOUNT_DELETION_GRACE, default 72h). It requires re-authentication
+// and, when enabled, a second factor.
+func RequestAccountDeletion(c *gin.Context) {
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	c.ShouldBindJSON(&req)
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var user models.User
+	if err := utils.GetCollection("users").FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !reauthenticate(c, &user, req.Password) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Re-authentication required"})
+		return
+	}
+
+	if user.TwoFactor != nil && user.TwoFactor.Enabled && !verifySecondFactor(c, &user, req.Code, req.RecoveryCode) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid verification code"})
+		return
+	}
+
+	collection := utils.GetCollection("account_deletions")
+	var existing models.AccountDeletion
+	err := collection.FindOne(c, bson.M{
+		"user_id": userID,
+		"status":  bson.M{"$in": []string{models.DeletionScheduled, models.DeletionRunning}},
+	}).Decode(&existing)
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account deletion already scheduled", "deletion": existing})
+		return
+	}
+
+	now := time.Now()
+	deletion := models.AccountDeletion{
+		ID:          primitive.NewObjectID(),
+		UserID:      userID,
+		Status:      models.DeletionScheduled,
+		RequestedAt: now,
+		PurgeAfter:  now.Add(deletionGracePeriod()),
+	}
+
+	if _, err := collection.InsertOne(c, deletion); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not schedule account deletion"})
+		return
+	}
+
+	// automation shouldn't keep writing into an account that is going away
+	utils.GetCollection("api_tokens").UpdateMany(c, bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revoked_at": now}})
+
+	recordAudit(c, userID, "account.deletion_requested", map[string]interface{}{
+		"deletion_id": deletion.ID,
+		"purge_after": deletion.PurgeAfter,
+	})
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Account scheduled for deletion",
+		"deletion": deletion,
+	})
+}
+
+// GetAccountDeletion returns the pending deletion, if any
+func GetAccountDeletion(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var deletion models.AccountDeletion
+	err := utils.GetCollection("account_deletions").FindOne(c, bson.M{
+		"user_id": userID,
+		"status":  bson.M{"$in": []string{models.DeletionScheduled, models.DeletionRunning}},
+	}).Decode(&deletion)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No account deletion scheduled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deletion": deletion})
+}
+
+// CancelAccountDeletion cancels a deletion that is still in its grace period
+func CancelAccountDeletion(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var deletion models.AccountDeletion
+	err := utils.GetCollection("account_deletions").FindOneAndUpdate(c, bson.M{
+		"user_id": userID,
+		"status":  models.DeletionScheduled,
+	}, bson.M{"$set": bson.M{"status": models.DeletionCancelled}}).Decode(&deletion)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No cancellable account deletion"})
+		return
+	}
+
+	recordAudit(c, userID, "account.deletion_cancelled", map[string]interface{}{"deletion_id": deletion.ID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deletion cancelled"})
+}
+
+// StartAccountPurgeWorker periodically purges accounts whose grace period is over
+func StartAccountPurgeWorker(ctx context.Context) {
+	runPeriodically(ctx, "account purge", time.Minute, func(ctx context.Context) error {
+		for {
+			deletion, err := claimAccountDeletion(ctx)
+			if err == mongo.ErrNoDocuments {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			counts, err := purgeAccount(ctx, deletion.UserID)
+			if err != nil {
+				log.Printf("Purge of user %s failed, will retry: %v", deletion.UserID.Hex(), err)
+				utils.GetCollection("account_deletions").UpdateOne(ctx, bson.M{"_id": deletion.ID}, bson.M{
+					"$set": bson.M{
+						"status":      models.DeletionScheduled,
+						"purge_after": time.Now().Add(purgeRetryDelay),
+						"error":       err.Error(),
+					},
+				})
+				continue
+			}
+
+			now := time.Now()
+			utils.GetCollection("account_deletions").UpdateOne(ctx, bson.M{"_id": deletion.ID}, bson.M{
+				"$set":   bson.M{"status": models.DeletionCompleted, "completed_at": now},
+				"$unset": bson.M{"error": ""},
+			})
+			recordAudit(ctx, deletion.UserID, "account.purged", map[string]interface{}{
+				"deletion_id": deletion.ID,
+				"removed":     counts,
+			})
+			log.Printf("Purged account %s: %v", deletion.UserID.Hex(), counts)
+		}
+	})
+}
+
+// claimAccountDeletion atomically takes the next due deletion (or one whose
+// worker died) so only one instance purges a given account
+func claimAccountDeletion(ctx context.Context) (*models.AccountDeletion, error) {
+	now := time.Now()
+
+	var deletion models.AccountDeletion
+	err := utils.GetCollection("account_deletions").FindOneAndUpdate(ctx, bson.M{
+		"$or": []bson.M{
+			{"status": models.DeletionScheduled, "purge_after": bson.M{"$lte": now}},
+			{"status": models.DeletionRunning, "started_at": bson.M{"$lte": now.Add(-purgeStaleAfter)}},
+		},
+	}, bson.M{
+		"$set": bson.M{"status": models.DeletionRunning, "started_at": now},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&deletion)
+	if err != nil {
+		return nil, err
+	}
+	return &deletion, nil
+}
+
+// purgeAccount removes every storage object and document belonging to the
+// user. It is idempotent so a failed purge can simply run again.
+func purgeAccount(ctx context.Context, userID primitive.ObjectID) (map[string]int64, error) {
+	counts := map[string]int64{}
+
+	var user models.User
+	if err := utils.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil && err != mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("could not load user: %v", err)
+	}
+
+	// objects referenced by file records first, then anything else under the user's prefix
+	cursor, err := utils.GetCollection("files").Find(ctx, bson.M{"user_id": userID},
+		options.Find().SetProjection(bson.M{"path": 1, "blob_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("could not list files: %v", err)
+	}
+	var files []models.File
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, fmt.Errorf("could not decode files: %v", err)
+	}
+	for _, file := range files {
+		if file.BlobID != "" {
+			// shared content: drop the reference exactly once, together
+			// with the record
+			err := utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+				result, err := utils.GetCollection("files").DeleteOne(sessCtx, bson.M{"_id": file.ID})
+				if err != nil || result.DeletedCount == 0 {
+					return err
+				}
+				return releaseBlob(sessCtx, file.BlobID)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("could not delete file %s: %v", file.ID.Hex(), err)
+			}
+			continue
+		}
+		if err := deleteObjectIfExists(ctx, file.Path); err != nil {
+			return nil, err
+		}
+		counts["objects"]++
+	}
+
+	err = utils.ListGCSObjects(ctx, fmt.Sprintf("users/%s/", userID.Hex()), func(attrs *storage.ObjectAttrs) error {
+		counts["objects"]++
+		return deleteObjectIfExists(ctx, attrs.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// other members lose access to the user's vaults along with them
+	var vaults []models.Folder
+	if err := findAll(ctx, "folders", bson.M{"user_id": userID, "vault": bson.M{"$exists": true}}, &vaults); err != nil {
+		return nil, err
+	}
+	for _, vault := range vaults {
+		if err := deleteVaultRecords(ctx, vault.ID); err != nil {
+			return nil, fmt.Errorf("could not purge vault %s: %v", vault.ID.Hex(), err)
+		}
+	}
+
+	for _, name := range userDataCollections {
+		result, err := utils.GetCollection(name).DeleteMany(ctx, bson.M{"user_id": userID})
+		if err != nil {
+			return nil, fmt.Errorf("could not purge %s: %v", name, err)
+		}
+		counts[name] = result.DeletedCount
+	}
+
+	if user.Email != "" {
+		utils.GetCollection("login_attempts").DeleteMany(ctx, bson.M{"email": normalizeEmail(user.Email)})
+	}
+
+	if _, err := utils.GetCollection("users").DeleteOne(ctx, bson.M{"_id": userID}); err != nil {
+		return nil, fmt.Errorf("could not delete user: %v", err)
+	}
+
+	return counts, nil
+}
+
+func deleteObjectIfExists(ctx context.Context, path string) error {
+	if err := utils.DeleteFromGCS(ctx, path); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return err
+	}
+	return nil
+}
+
+func deletionGracePeriod() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE")); err == nil && d >= 0 {
+		return d
+	}
+	return defaultDeletionGrace
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestDeletionGracePeriod(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", defaultDeletionGrace},
+		{"24h", 24 * time.Hour},
+		// no grace at all is allowed, e.g. for test deployments
+		{"0s", 0},
+		{"-1h", defaultDeletionGrace},
+		{"three days", defaultDeletionGrace},
+	}
+	for _, tt := range tests {
+		t.Setenv("ACCOUNT_DELETION_GRACE", tt.env)
+		if got := deletionGracePeriod(); got != tt.want {
+			t.Errorf("ACCOUNT_DELETION_GRACE=%q: grace = %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+// TestClaimAccountDeletion claims every due deletion in the database, so it
+// expects a test database without other scheduled deletions
+func TestClaimAccountDeletion(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	collection := utils.GetCollection("account_deletions")
+
+	now := time.Now()
+	stale, fresh := now.Add(-2*purgeStaleAfter), now.Add(-time.Minute)
+	deletions := map[string]models.AccountDeletion{
+		"due":          {Status: models.DeletionScheduled, PurgeAfter: now.Add(-time.Minute)},
+		"in grace":     {Status: models.DeletionScheduled, PurgeAfter: now.Add(time.Hour)},
+		"crashed":      {Status: models.DeletionRunning, StartedAt: &stale},
+		"running":      {Status: models.DeletionRunning, StartedAt: &fresh},
+		"already done": {Status: models.DeletionCompleted, PurgeAfter: now.Add(-time.Hour)},
+	}
+	names := map[primitive.ObjectID]string{}
+	for name, deletion := range deletions {
+		deletion.ID = primitive.NewObjectID()
+		deletion.UserID = primitive.NewObjectID()
+		if _, err := collection.InsertOne(ctx, deletion); err != nil {
+			t.Fatal(err)
+		}
+		names[deletion.ID] = name
+		t.Cleanup(func() { collection.DeleteOne(ctx, bson.M{"_id": deletion.ID}) })
+	}
+
+	claimed := map[string]bool{}
+	for {
+		deletion, err := claimAccountDeletion(ctx)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deletion.Status != models.DeletionRunning || deletion.StartedAt == nil || time.Since(*deletion.StartedAt) > time.Minute {
+			t.Errorf("claimed deletion %+v is not marked running from now", deletion)
+		}
+		if name, ok := names[deletion.ID]; ok {
+			if claimed[name] {
+				t.Fatalf("%s deletion claimed twice", name)
+			}
+			claimed[name] = true
+		}
+	}
+
+	for name := range deletions {
+		want := name == "due" || name == "crashed"
+		if claimed[name] != want {
+			t.Errorf("%s deletion claimed = %v, want %v", name, claimed[name], want)
+		}
+	}
+}
+
+func TestPurgeAccount(t *testing.T) {
+	testStorage(t)
+	ctx := context.Background()
+
+	userID, otherID := primitive.NewObjectID(), primitive.NewObjectID()
+	email := userID.Hex() + "@example.com"
+	now := time.Now()
+
+	insert := func(collection string, doc interface{}) {
+		t.Helper()
+		if _, err := utils.GetCollection(collection).InsertOne(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("users", models.User{ID: userID, Email: email})
+
+	// content shared with another user's file through a blob
+	sum := "test-" + userID.Hex()
+	insert("blobs", models.Blob{ID: sum, State: models.BlobReady, RefCount: 2, CreatedAt: now, UpdatedAt: now})
+	insert("files", models.File{ID: primitive.NewObjectID(), UserID: userID, Name: "shared.txt", BlobID: sum, CreatedAt: now})
+
+	// content of the user's own
+	objectPath := "users/" + userID.Hex() + "/own.txt"
+	if _, err := utils.UploadToGCS(ctx, objectPath, strings.NewReader("own"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	insert("files", models.File{ID: primitive.NewObjectID(), UserID: userID, Name: "own.txt", Path: objectPath, CreatedAt: now})
+
+	// a vault the user owns, shared with someone else
+	vaultID := primitive.NewObjectID()
+	insert("folders", models.Folder{ID: vaultID, UserID: userID, Vault: &models.FolderVault{KeyVersion: 1}, CreatedAt: now})
+	insert("vault_members", models.VaultMember{ID: primitive.NewObjectID(), VaultID: vaultID, UserID: otherID, Role: models.VaultRoleMember})
+	insert("vault_keys", models.VaultKey{ID: primitive.NewObjectID(), VaultID: vaultID, UserID: otherID, KeyVersion: 1})
+
+	insert("sessions", models.Session{ID: primitive.NewObjectID(), UserID: userID, CreatedAt: now})
+	insert("login_attempts", loginAttempt{Key: email, Email: email, Failures: 1, ExpiresAt: now.Add(time.Hour)})
+	insert("audit_log", models.AuditEntry{ID: primitive.NewObjectID(), UserID: userID, Action: "account.deletion_requested", CreatedAt: now})
+
+	t.Cleanup(func() {
+		utils.GetCollection("blobs").DeleteOne(ctx, bson.M{"_id": sum})
+		utils.GetCollection("audit_log").DeleteMany(ctx, bson.M{"user_id": userID})
+		utils.GetCollection("vault_members").DeleteMany(ctx, bson.M{"vault_id": vaultID})
+		utils.GetCollection("vault_keys").DeleteMany(ctx, bson.M{"vault_id": vaultID})
+		deleteObjectIfExists(ctx, objectPath)
+		purgeAccount(ctx, userID)
+	})
+
+	// purging twice must be as good as once: a failed purge is retried
+	for run := 1; run <= 2; run++ {
+		if _, err := purgeAccount(ctx, userID); err != nil {
+			t.Fatalf("purge %d: %v", run, err)
+		}
+	}
+
+	for _, name := range append(userDataCollections, "users") {
+		filter := bson.M{"user_id": userID}
+		if name == "users" {
+			filter = bson.M{"_id": userID}
+		}
+		if n, _ := utils.GetCollection(name).CountDocuments(ctx, filter); n != 0 {
+			t.Errorf("%d documents of the user left in %s", n, name)
+		}
+	}
+	for _, name := range []string{"vault_members", "vault_keys"} {
+		if n, _ := utils.GetCollection(name).CountDocuments(ctx, bson.M{"vault_id": vaultID}); n != 0 {
+			t.Errorf("%d %s of the user's vault left", n, name)
+		}
+	}
+	if n, _ := utils.GetCollection("login_attempts").CountDocuments(ctx, bson.M{"email": email}); n != 0 {
+		t.Error("login attempts of the user left")
+	}
+	if n, _ := utils.GetCollection("audit_log").CountDocuments(ctx, bson.M{"user_id": userID}); n != 1 {
+		t.Errorf("%d audit entries kept, want 1", n)
+	}
+
+	var blob models.Blob
+	if err := utils.GetCollection("blobs").FindOne(ctx, bson.M{"_id": sum}).Decode(&blob); err != nil {
+		t.Fatal(err)
+	}
+	if blob.RefCount != 1 {
+		t.Errorf("shared blob ref_count = %d, want 1: released once for the user's file", blob.RefCount)
+	}
+
+	if reader, err := utils.DownloadFromGCS(ctx, objectPath); err == nil {
+		reader.Close()
+		t.Error("the user's object is still stored")
+	}
+}
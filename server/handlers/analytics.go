@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// snapshots are taken once per UTC day; checking hourly catches the new
+	// day soon after midnight
+	snapshotInterval  = time.Hour
+	snapshotBatchSize = 500
+
+	defaultAnalyticsTop  = 10
+	maxAnalyticsTop      = 100
+	defaultAnalyticsDays = 30
+	maxAnalyticsDays     = 365
+)
+
+// ageBuckets are the age groups files are counted in, newest first
+var ageBuckets = []struct {
+	Key    string
+	MaxAge time.Duration
+}{
+	{"last_7_days", 7 * 24 * time.Hour},
+	{"last_30_days", 30 * 24 * time.Hour},
+	{"last_90_days", 90 * 24 * time.Hour},
+	{"last_year", 365 * 24 * time.Hour},
+}
+
+const ageOlder = "older"
+
+// usageGroup is the bytes and number of files in one group
+type usageGroup struct {
+	Key   string `bson:"_id" json:"key"`
+	Bytes int64  `bson:"bytes" json:"bytes"`
+	Count int64  `bson:"count" json:"count"`
+}
+
+// folderUsage is the usage of a top-level folder and everything below it.
+// FolderID is nil for files that aren't in any folder.
+type folderUsage struct {
+	FolderID *primitive.ObjectID `json:"folder_id"`
+	Name     string              `json:"name"`
+	Bytes    int64               `json:"bytes"`
+	Count    int64               `json:"count"`
+}
+
+// GetStorageAnalytics breaks the caller's usage down by type family,
+// top-level folder and age, lists their largest files and returns the daily
+// usage series
+func GetStorageAnalytics(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	top := int64(defaultAnalyticsTop)
+	if n, err := strconv.ParseInt(c.Query("top"), 10, 64); err == nil && n > 0 && n <= maxAnalyticsTop {
+		top = n
+	}
+	days := defaultAnalyticsDays
+	if n, err := strconv.Atoi(c.Query("days")); err == nil && n > 0 && n <= maxAnalyticsDays {
+		days = n
+	}
+
+	now := time.Now()
+	var breakdown struct {
+		ByType   []usageGroup `bson:"by_type"`
+		ByFolder []struct {
+			FolderID *primitive.ObjectID `bson:"_id"`
+			Bytes    int64               `bson:"bytes"`
+			Count    int64               `bson:"count"`
+		} `bson:"by_folder"`
+		ByAge   []usageGroup  `bson:"by_age"`
+		Largest []models.File `bson:"largest"`
+	}
+
+	cursor, err := utils.GetCollection("files").Aggregate(c, []bson.M{
+		{"$match": bson.M{"user_id": userID}},
+		{"$facet": bson.M{
+			"by_type":   usageByPipeline(typeFamilyExpr()),
+			"by_folder": usageByPipeline("$folder_id"),
+			"by_age":    usageByPipeline(ageBucketExpr(now)),
+			"largest": []bson.M{
+				{"$sort": bson.M{"size": -1}},
+				{"$limit": top},
+				{"$project": bson.M{
+					"name":           1,
+					"original_name":  1,
+					"size":           1,
+					"content_type":   1,
+					"folder_id":      1,
+					"vault_id":       1,
+					"encrypted_name": 1,
+					"created_at":     1,
+					"updated_at":     1,
+				}},
+			},
+		}},
+	})
+	if err == nil {
+		if cursor.Next(c) {
+			err = cursor.Decode(&breakdown)
+		}
+		cursor.Close(c)
+	}
+	if err != nil {
+		log.Printf("Could not aggregate storage analytics for user %s: %v", userID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve storage analytics"})
+		return
+	}
+
+	// usage per folder is rolled up into the top-level folder it is under
+	var folders []models.Folder
+	if err := findAll(c, "folders", bson.M{"user_id": userID}, &folders); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve storage analytics"})
+		return
+	}
+	topLevel := topLevelFolders(folders)
+	rolled := map[primitive.ObjectID]*folderUsage{}
+	root := &folderUsage{}
+	for _, group := range breakdown.ByFolder {
+		usage := root
+		if group.FolderID != nil {
+			folder, ok := topLevel[*group.FolderID]
+			if !ok {
+				// files of a deleted folder, left for the scrubber
+				continue
+			}
+			usage = rolled[folder.ID]
+			if usage == nil {
+				id := folder.ID
+				usage = &folderUsage{FolderID: &id, Name: folder.Name}
+				rolled[folder.ID] = usage
+			}
+		}
+		usage.Bytes += group.Bytes
+		usage.Count += group.Count
+	}
+	byFolder := []folderUsage{}
+	if root.Count > 0 {
+		byFolder = append(byFolder, *root)
+	}
+	for _, usage := range rolled {
+		byFolder = append(byFolder, *usage)
+	}
+	sort.Slice(byFolder, func(i, j int) bool { return byFolder[i].Bytes > byFolder[j].Bytes })
+
+	sort.Slice(breakdown.ByType, func(i, j int) bool { return breakdown.ByType[i].Bytes > breakdown.ByType[j].Bytes })
+
+	// every bucket is returned, in order, even when empty
+	byAge := make([]usageGroup, 0, len(ageBuckets)+1)
+	for _, key := range ageBucketKeys() {
+		group := usageGroup{Key: key}
+		for _, found := range breakdown.ByAge {
+			if found.Key == key {
+				group = found
+			}
+		}
+		byAge = append(byAge, group)
+	}
+
+	history := []models.StorageSnapshot{}
+	since := snapshotDate(now).AddDate(0, 0, -days)
+	if err := findAll(c, "storage_snapshots", bson.M{"user_id": userID, "date": bson.M{"$gt": since}}, &history); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve storage analytics"})
+		return
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Date.Before(history[j].Date) })
+
+	largest := breakdown.Largest
+	if largest == nil {
+		largest = []models.File{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"by_type":       nonNilGroups(breakdown.ByType),
+		"by_folder":     byFolder,
+		"by_age":        byAge,
+		"largest_files": largest,
+		"history":       history,
+	})
+}
+
+// usageByPipeline sums bytes and files per value of key
+func usageByPipeline(key interface{}) []bson.M {
+	return []bson.M{{"$group": bson.M{
+		"_id":   key,
+		"bytes": bson.M{"$sum": "$size"},
+		"count": bson.M{"$sum": 1},
+	}}}
+}
+
+// typeFamilyExpr groups by the part of the content type before the slash.
+// Vault content is ciphertext whatever it was before, so it is its own group.
+func typeFamilyExpr() bson.M {
+	family := bson.M{"$arrayElemAt": bson.A{
+		bson.M{"$split": bson.A{bson.M{"$ifNull": bson.A{"$content_type", ""}}, "/"}}, 0,
+	}}
+	return bson.M{"$switch": bson.M{
+		"branches": bson.A{
+			bson.M{"case": bson.M{"$gt": bson.A{"$vault_id", nil}}, "then": "encrypted"},
+			bson.M{"case": bson.M{"$eq": bson.A{family, ""}}, "then": "other"},
+		},
+		"default": family,
+	}}
+}
+
+// ageBucketExpr names the age bucket a file's creation time falls in
+func ageBucketExpr(now time.Time) bson.M {
+	branches := bson.A{}
+	for _, bucket := range ageBuckets {
+		branches = append(branches, bson.M{
+			"case": bson.M{"$gte": bson.A{"$created_at", now.Add(-bucket.MaxAge)}},
+			"then": bucket.Key,
+		})
+	}
+	return bson.M{"$switch": bson.M{"branches": branches, "default": ageOlder}}
+}
+
+func ageBucketKeys() []string {
+	keys := make([]string, 0, len(ageBuckets)+1)
+	for _, bucket := range ageBuckets {
+		keys = append(keys, bucket.Key)
+	}
+	return append(keys, ageOlder)
+}
+
+func nonNilGroups(groups []usageGroup) []usageGroup {
+	if groups == nil {
+		return []usageGroup{}
+	}
+	return groups
+}
+
+// topLevelFolders maps every folder to the top-level folder it is under,
+// itself for top-level folders
+func topLevelFolders(folders []models.Folder) map[primitive.ObjectID]models.Folder {
+	byID := make(map[primitive.ObjectID]models.Folder, len(folders))
+	for _, folder := range folders {
+		byID[folder.ID] = folder
+	}
+
+	topLevel := make(map[primitive.ObjectID]models.Folder, len(folders))
+	for _, folder := range folders {
+		current := folder
+		// the depth bound guards against a corrupt parent cycle
+		for depth := 0; current.ParentID != nil && depth < len(folders); depth++ {
+			parent, ok := byID[*current.ParentID]
+			if !ok {
+				break
+			}
+			current = parent
+		}
+		topLevel[folder.ID] = current
+	}
+	return topLevel
+}
+
+// snapshotDate is the day a snapshot taken at t belongs to
+func snapshotDate(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// StartStorageSnapshots records a daily snapshot of every user's usage
+// counters. Only the first run of a day writes, so instances can all run it.
+func StartStorageSnapshots(ctx context.Context) {
+	runPeriodically(ctx, "storage snapshots", snapshotInterval, recordStorageSnapshots)
+}
+
+func recordStorageSnapshots(ctx context.Context) error {
+	now := time.Now()
+	date := snapshotDate(now)
+	snapshots := utils.GetCollection("storage_snapshots")
+
+	// a run that finished today leaves nothing to do
+	users, err := utils.GetCollection("user_storage").CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	taken, err := snapshots.CountDocuments(ctx, bson.M{"date": date})
+	if err != nil {
+		return err
+	}
+	if taken >= users {
+		return nil
+	}
+
+	cursor, err := utils.GetCollection("user_storage").Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	recorded := 0
+	batch := make([]mongo.WriteModel, 0, snapshotBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// first write of the day wins, so the snapshot is the usage as of
+		// shortly after midnight
+		result, err := snapshots.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false))
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		if result != nil {
+			recorded += int(result.UpsertedCount)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var storage models.UserStorage
+		if err := cursor.Decode(&storage); err != nil {
+			return err
+		}
+		batch = append(batch, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"user_id": storage.UserID, "date": date}).
+			SetUpdate(bson.M{"$setOnInsert": models.StorageSnapshot{
+				ID:          primitive.NewObjectID(),
+				UserID:      storage.UserID,
+				Date:        date,
+				UsedSpace:   storage.UsedSpace,
+				FileCount:   storage.FileCount,
+				FolderCount: storage.FolderCount,
+				CreatedAt:   now,
+			}}).
+			SetUpsert(true))
+		if len(batch) == snapshotBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if recorded > 0 {
+		log.Printf("Recorded %d storage snapshot(s) for %s", recorded, date.Format("2006-01-02"))
+	}
+	return nil
+}
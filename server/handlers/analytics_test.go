@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTopLevelFolders(t *testing.T) {
+	top, child, grandchild := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	orphan, gone := primitive.NewObjectID(), primitive.NewObjectID()
+	loopA, loopB := primitive.NewObjectID(), primitive.NewObjectID()
+
+	folders := []models.Folder{
+		{ID: grandchild, ParentID: &child},
+		{ID: child, ParentID: &top},
+		{ID: top},
+		{ID: orphan, ParentID: &gone},
+		{ID: loopA, ParentID: &loopB},
+		{ID: loopB, ParentID: &loopA},
+	}
+	topLevel := topLevelFolders(folders)
+
+	tests := []struct {
+		folder primitive.ObjectID
+		want   primitive.ObjectID
+	}{
+		{top, top},
+		{child, top},
+		{grandchild, top},
+		// a missing parent leaves the folder as the top it can reach
+		{orphan, orphan},
+	}
+	for _, tt := range tests {
+		if got := topLevel[tt.folder].ID; got != tt.want {
+			t.Errorf("top of %s = %s, want %s", tt.folder.Hex(), got.Hex(), tt.want.Hex())
+		}
+	}
+	// a parent cycle ends somewhere in the cycle instead of looping
+	if got := topLevel[loopA].ID; got != loopA && got != loopB {
+		t.Errorf("top of a cycle = %s", got.Hex())
+	}
+}
+
+func TestSnapshotDate(t *testing.T) {
+	east := time.FixedZone("UTC+9", 9*3600)
+	tests := []struct {
+		at   time.Time
+		want time.Time
+	}{
+		{time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 10, 23, 59, 59, 0, time.UTC), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)},
+		// the day is the UTC one, not the local one
+		{time.Date(2024, 3, 10, 8, 0, 0, 0, east), time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := snapshotDate(tt.at); !got.Equal(tt.want) {
+			t.Errorf("snapshotDate(%v) = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestAgeBucketKeys(t *testing.T) {
+	want := []string{"last_7_days", "last_30_days", "last_90_days", "last_year", ageOlder}
+	if got := ageBucketKeys(); !slices.Equal(got, want) {
+		t.Errorf("ageBucketKeys() = %q, want %q", got, want)
+	}
+	for i := 1; i < len(ageBuckets); i++ {
+		if ageBuckets[i].MaxAge <= ageBuckets[i-1].MaxAge {
+			t.Errorf("bucket %s is not older than %s", ageBuckets[i].Key, ageBuckets[i-1].Key)
+		}
+	}
+}
+
+func TestGetStorageAnalytics(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+	now := time.Now()
+
+	top := models.Folder{ID: primitive.NewObjectID(), UserID: userID, Name: "Photos"}
+	child := models.Folder{ID: primitive.NewObjectID(), UserID: userID, Name: "2024", ParentID: &top.ID}
+	for _, folder := range []models.Folder{top, child} {
+		if _, err := utils.GetCollection("folders").InsertOne(ctx, folder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vaultID := primitive.NewObjectID()
+	files := []interface{}{
+		models.File{ID: primitive.NewObjectID(), UserID: userID, Name: "a.png", Size: 300, ContentType: "image/png", FolderID: &child.ID, CreatedAt: now},
+		models.File{ID: primitive.NewObjectID(), UserID: userID, Name: "b.jpg", Size: 200, ContentType: "image/jpeg", FolderID: &top.ID, CreatedAt: now.AddDate(0, 0, -10)},
+		models.File{ID: primitive.NewObjectID(), UserID: userID, Name: "notes.txt", Size: 50, ContentType: "text/plain", CreatedAt: now.AddDate(-2, 0, 0)},
+		models.File{ID: primitive.NewObjectID(), UserID: userID, Name: "sealed", Size: 1000, ContentType: "image/png", VaultID: &vaultID, CreatedAt: now.AddDate(0, 0, -100)},
+	}
+	if _, err := utils.GetCollection("files").InsertMany(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+
+	today := snapshotDate(now)
+	snapshots := []interface{}{
+		models.StorageSnapshot{ID: primitive.NewObjectID(), UserID: userID, Date: today, UsedSpace: 1550},
+		models.StorageSnapshot{ID: primitive.NewObjectID(), UserID: userID, Date: today.AddDate(0, 0, -2), UsedSpace: 1000},
+		// outside the requested days
+		models.StorageSnapshot{ID: primitive.NewObjectID(), UserID: userID, Date: today.AddDate(0, 0, -20), UsedSpace: 10},
+	}
+	if _, err := utils.GetCollection("storage_snapshots").InsertMany(ctx, snapshots); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, name := range []string{"folders", "files", "storage_snapshots"} {
+			utils.GetCollection(name).DeleteMany(ctx, bson.M{"user_id": userID})
+		}
+	})
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/storage/analytics?top=2&days=7", nil)
+	c.Set("userID", userID.Hex())
+	GetStorageAnalytics(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	var got struct {
+		ByType   []usageGroup             `json:"by_type"`
+		ByFolder []folderUsage            `json:"by_folder"`
+		ByAge    []usageGroup             `json:"by_age"`
+		Largest  []models.File            `json:"largest_files"`
+		History  []models.StorageSnapshot `json:"history"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	wantTypes := []usageGroup{{"encrypted", 1000, 1}, {"image", 500, 2}, {"text", 50, 1}}
+	if !slices.Equal(got.ByType, wantTypes) {
+		t.Errorf("by type %+v, want %+v", got.ByType, wantTypes)
+	}
+
+	// the vault file isn't in a folder, so it counts towards the root
+	if len(got.ByFolder) != 2 {
+		t.Fatalf("by folder %+v, want the root and Photos", got.ByFolder)
+	}
+	if f := got.ByFolder[0]; f.FolderID != nil || f.Bytes != 1050 || f.Count != 2 {
+		t.Errorf("root usage %+v, want 1050 bytes in 2 files", f)
+	}
+	if f := got.ByFolder[1]; f.FolderID == nil || *f.FolderID != top.ID || f.Name != "Photos" || f.Bytes != 500 || f.Count != 2 {
+		t.Errorf("Photos usage %+v, want its subfolder rolled in", f)
+	}
+
+	wantAges := []usageGroup{{"last_7_days", 300, 1}, {"last_30_days", 200, 1}, {"last_90_days", 0, 0}, {"last_year", 1000, 1}, {ageOlder, 50, 1}}
+	if !slices.Equal(got.ByAge, wantAges) {
+		t.Errorf("by age %+v, want %+v", got.ByAge, wantAges)
+	}
+
+	if len(got.Largest) != 2 || got.Largest[0].Name != "sealed" || got.Largest[1].Name != "a.png" {
+		t.Errorf("largest files %+v, want sealed then a.png", got.Largest)
+	}
+
+	if len(got.History) != 2 || got.History[0].UsedSpace != 1000 || got.History[1].UsedSpace != 1550 {
+		t.Errorf("history %+v, want the last two snapshots oldest first", got.History)
+	}
+}
+
+// TestRecordStorageSnapshots snapshots every user's usage, so it expects a
+// test database without other usage counters
+func TestRecordStorageSnapshots(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+	t.Cleanup(func() {
+		utils.GetCollection("user_storage").DeleteOne(ctx, bson.M{"user_id": userID})
+		utils.GetCollection("storage_snapshots").DeleteMany(ctx, bson.M{"user_id": userID})
+	})
+
+	if err := updateUserStorage(ctx, userID, 400, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordStorageSnapshots(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// later changes the same day leave the day's snapshot as it was
+	if err := updateUserStorage(ctx, userID, 100, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordStorageSnapshots(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshots []models.StorageSnapshot
+	if err := findAll(ctx, "storage_snapshots", bson.M{"user_id": userID}, &snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("%d snapshots for one day, want 1", len(snapshots))
+	}
+	s := snapshots[0]
+	if !s.Date.Equal(snapshotDate(time.Now())) || s.UsedSpace != 400 || s.FileCount != 2 || s.FolderCount != 1 {
+		t.Errorf("snapshot %+v, want today's first usage", s)
+	}
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errUnsupportedEntry = errors.New("unsupported compression method or encrypted entry")
+
+// GetArchiveEntries lists the entries of a stored ZIP without downloading it.
+// Only the central directory at the end of the object is read.
+func GetArchiveEntries(c *gin.Context) {
+	file, zr, ok := openStoredZip(c)
+	if !ok {
+		return
+	}
+
+	entries := make([]gin.H, 0, len(zr.File))
+	for _, f := range zr.File {
+		entries = append(entries, gin.H{
+			"name":            f.Name,
+			"size":            f.UncompressedSize64,
+			"compressed_size": f.CompressedSize64,
+			"modified":        f.Modified,
+			"is_dir":          f.FileInfo().IsDir(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"file_id": file.ID,
+		"entries": entries,
+	})
+}
+
+// DownloadArchiveEntry streams a single entry of a stored ZIP
+func DownloadArchiveEntry(c *gin.Context) {
+	name := c.Query("path")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Entry path is required"})
+		return
+	}
+
+	file, zr, ok := openStoredZip(c)
+	if !ok {
+		return
+	}
+
+	entry := findZipEntry(zr, name)
+	if entry == nil || entry.FileInfo().IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Entry not found"})
+		return
+	}
+
+	reader, err := openStoredZipEntry(c, file, entry)
+	if err != nil {
+		if errors.Is(err, errUnsupportedEntry) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Entry uses an unsupported compression method or is encrypted"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read entry"})
+		return
+	}
+	defer reader.Close()
+
+	base := path.Base(entry.Name)
+	c.Header("Content-Disposition", contentDisposition("attachment", base))
+	c.Header("Content-Type", contentTypeForName(base))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Length", fmt.Sprintf("%d", entry.UncompressedSize64))
+
+	if _, err := io.Copy(c.Writer, reader); err != nil {
+		log.Printf("Error streaming entry %q of file %s: %v", entry.Name, file.ID.Hex(), err)
+	}
+}
+
+// ExtractArchiveEntries copies selected entries of a stored ZIP into a folder
+// as new files. Directory entries bring everything beneath them along.
+func ExtractArchiveEntries(c *gin.Context) {
+	var req struct {
+		Entries  []string `json:"entries" binding:"required,min=1"`
+		FolderID string   `json:"folder_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	folderID, ok := resolveFolderParam(c, userID, req.FolderID)
+	if !ok {
+		return
+	}
+
+	file, zr, ok := openStoredZip(c)
+	if !ok {
+		return
+	}
+
+	limits, err := userLimits(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not extract archive"})
+		return
+	}
+
+	imp, err := newArchiveImport(c, userID, folderID, limits)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+
+	selected := map[string]bool{}
+	for _, name := range req.Entries {
+		selected[strings.TrimPrefix(name, "/")] = true
+	}
+
+	var stopErr error
+	for _, f := range zr.File {
+		if !entrySelected(selected, f.Name) {
+			continue
+		}
+		entry := f
+		err := imp.addZipEntry(c, entry, func() (io.ReadCloser, error) {
+			return openStoredZipEntry(c, file, entry)
+		})
+		if err != nil {
+			stopErr = err
+			break
+		}
+	}
+
+	response := gin.H{
+		"message": "Extraction finished",
+		"summary": imp.summary(),
+		"report":  imp.report,
+	}
+	if stopErr != nil {
+		response["message"] = "Extraction stopped early"
+		response["error"] = stopErr.Error()
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// openStoredZip loads the :id file and parses its central directory. On
+// failure it writes the response and returns false.
+func openStoredZip(c *gin.Context) (*models.File, *zip.Reader, bool) {
+	fileObjID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return nil, nil, false
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var file models.File
+	err = utils.GetCollection("files").FindOne(c, bson.M{
+		"_id":        fileObjID,
+		"user_id":    userID,
+		"trashed_at": bson.M{"$exists": false},
+	}).Decode(&file)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, nil, false
+	}
+	if rejectBlockedContent(c, &file) {
+		return nil, nil, false
+	}
+
+	zr, err := zip.NewReader(newFileReaderAt(c, &file), file.Size)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is not a readable ZIP archive"})
+		return nil, nil, false
+	}
+
+	return &file, zr, true
+}
+
+// openStoredZipEntry reads one entry with a single ranged read over its
+// compressed bytes rather than going through the block-cached ReaderAt
+func openStoredZipEntry(ctx context.Context, file *models.File, f *zip.File) (io.ReadCloser, error) {
+	// bit 0 of the general purpose flags marks an encrypted entry
+	if f.Flags&0x1 != 0 || (f.Method != zip.Store && f.Method != zip.Deflate) {
+		return nil, errUnsupportedEntry
+	}
+
+	offset, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := openFileRange(ctx, file, offset, int64(f.CompressedSize64))
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = raw
+	if f.Method == zip.Deflate {
+		r = flate.NewReader(raw)
+	}
+
+	return &zipEntryReader{
+		r:      io.LimitReader(r, int64(f.UncompressedSize64)+1),
+		closer: raw,
+		hash:   crc32.NewIEEE(),
+		entry:  f,
+	}, nil
+}
+
+// zipEntryReader checks size and CRC-32 against the central directory once
+// the entry has been read to the end
+type zipEntryReader struct {
+	r      io.Reader
+	closer io.Closer
+	hash   hash.Hash32
+	n      uint64
+	entry  *zip.File
+}
+
+func (z *zipEntryReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	z.hash.Write(p[:n])
+	z.n += uint64(n)
+
+	if z.n > z.entry.UncompressedSize64 {
+		return n, zip.ErrFormat
+	}
+	if err == io.EOF {
+		if z.n != z.entry.UncompressedSize64 {
+			return n, io.ErrUnexpectedEOF
+		}
+		if z.entry.CRC32 != 0 && z.hash.Sum32() != z.entry.CRC32 {
+			return n, zip.ErrChecksum
+		}
+	}
+	return n, err
+}
+
+func (z *zipEntryReader) Close() error {
+	return z.closer.Close()
+}
+
+func findZipEntry(zr *zip.Reader, name string) *zip.File {
+	name = strings.TrimPrefix(name, "/")
+	for _, f := range zr.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// entrySelected matches an entry by exact name or by a selected directory prefix
+func entrySelected(selected map[string]bool, name string) bool {
+	if selected[name] || selected[strings.TrimSuffix(name, "/")] {
+		return true
+	}
+	for dir := path.Dir(strings.TrimSuffix(name, "/")); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if selected[dir] || selected[dir+"/"] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import "testing"
+
+func TestEntrySelected(t *testing.T) {
+	selected := map[string]bool{
+		"readme.txt":       true,
+		"docs":             true,
+		"photos/2024/":     true,
+		"src/main.go":      true,
+		"deep/nested/dir/": true,
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"readme.txt", true},
+		{"docs/", true},
+		{"docs/a.txt", true},
+		{"docs/sub/b.txt", true},
+		{"photos/2024/", true},
+		{"photos/2024/beach.jpg", true},
+		{"deep/nested/dir/x/y/z.txt", true},
+		{"src/main.go", true},
+
+		{"readme.txt.bak", false},
+		{"docsx/a.txt", false},
+		{"photos/2023/beach.jpg", false},
+		{"photos/", false},
+		{"photos/cover.jpg", false},
+		{"src/util.go", false},
+		{"other/docs/a.txt", false},
+		{"deep/nested/file.txt", false},
+	}
+	for _, tt := range tests {
+		if got := entrySelected(selected, tt.name); got != tt.want {
+			t.Errorf("entrySelected(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
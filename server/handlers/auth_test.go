@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBindRegistrationIgnoresPrivilegedFields(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body := `{
+		"username": "mallory",
+		"email": "mallory@example.com",
+		"password": "hunter22",
+		"role": "admin",
+		"plan_id": "enterprise",
+		"email_verified": true,
+		"google_id": "123",
+		"auth_provider": "google"
+	}`
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	user, err := bindRegistration(c)
+	if err != nil {
+		t.Fatalf("bindRegistration: %v", err)
+	}
+
+	if user.Role != "" {
+		t.Errorf("Role = %q, want empty", user.Role)
+	}
+	if user.PlanID != "" {
+		t.Errorf("PlanID = %q, want empty", user.PlanID)
+	}
+	if user.EmailVerified || user.GoogleID != "" || user.AuthProvider != "" {
+		t.Errorf("provider fields were taken from the request: %+v", user)
+	}
+	if user.Username != "mallory" || user.Email != "mallory@example.com" {
+		t.Errorf("got username %q, email %q", user.Username, user.Email)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("hunter22")); err != nil {
+		t.Errorf("password was not hashed: %v", err)
+	}
+}
+
+func TestBindRegistrationRequiresEmailAndPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, body := range []string{
+		`{"password": "hunter22"}`,
+		`{"email": "not-an-email", "password": "hunter22"}`,
+		`{"email": "user@example.com"}`,
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		if _, err := bindRegistration(c); err == nil {
+			t.Errorf("bindRegistration(%s) succeeded, want an error", body)
+		}
+	}
+}
+
+func TestBindRegistrationNormalizesEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"email": "Mallory@Example.COM", "password": "hunter22"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	user, err := bindRegistration(c)
+	if err != nil {
+		t.Fatalf("bindRegistration: %v", err)
+	}
+	if user.Email != "mallory@example.com" {
+		t.Errorf("Email = %q, want mallory@example.com", user.Email)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for in, want := range map[string]string{
+		"user@example.com":     "user@example.com",
+		"User@Example.com":     "user@example.com",
+		"  user@example.com\n": "user@example.com",
+		" USER@EXAMPLE.COM ":   "user@example.com",
+		"":                     "",
+	} {
+		if got := normalizeEmail(in); got != want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// how long to wait for another request storing or removing the same content
+	blobWaitAttempts = 20
+	blobWaitDelay    = 500 * time.Millisecond
+
+	blobGCInterval = time.Hour
+	// unreferenced blobs are kept this long so a re-upload soon after the
+	// last delete is still a metadata-only insert
+	blobGCGrace = time.Hour
+	// uploads or deletions that haven't finished by then were abandoned
+	blobStaleAfter = time.Hour
+	blobGCBatch    = 500
+)
+
+var (
+	errBlobBusy = errors.New("identical content is being stored or removed, try again")
+	// the blob was collected between ensureBlob and the transaction
+	errBlobGone = errors.New("blob is no longer available")
+)
+
+// blobPath is where a blob's content lives; the prefix spreads blobs out
+func blobPath(sum string) string {
+	return fmt.Sprintf("blobs/%s/%s", sum[:2], sum)
+}
+
+// ensureBlob returns the ready blob for content with the given SHA-256,
+// uploading the content first if no blob has it yet. It doesn't take a
+// reference; takeBlobRef does that in the transaction that saves the file.
+func ensureBlob(ctx context.Context, sum string, size int64, contentType string, content io.ReadSeeker) (*models.Blob, error) {
+	collection := utils.GetCollection("blobs")
+
+	for attempt := 0; ; attempt++ {
+		var existing models.Blob
+		err := collection.FindOne(ctx, bson.M{"_id": sum, "state": models.BlobReady}).Decode(&existing)
+		if err == nil {
+			return &existing, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+
+		created, err := uploadBlob(ctx, sum, size, contentType, content)
+		if err == nil {
+			return created, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		// another request is uploading or removing the same content
+		if attempt >= blobWaitAttempts {
+			return nil, errBlobBusy
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(blobWaitDelay):
+		}
+	}
+}
+
+// uploadBlob claims the content address, stores the content and marks the
+// blob ready, still unreferenced. Claiming first means only one request ever
+// writes a given blob's object.
+func uploadBlob(ctx context.Context, sum string, size int64, contentType string, content io.ReadSeeker) (*models.Blob, error) {
+	encryption, dataKey, err := newFileEncryption(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create data key: %v", err)
+	}
+
+	now := time.Now()
+	blob := models.Blob{
+		ID:          sum,
+		Path:        blobPath(sum),
+		Size:        size,
+		ContentType: contentType,
+		State:       models.BlobUploading,
+		Encryption:  encryption,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if utils.GetScanner() != nil {
+		blob.ScanStatus = models.ScanPending
+	}
+
+	collection := utils.GetCollection("blobs")
+	if _, err := collection.InsertOne(ctx, blob); err != nil {
+		return nil, err
+	}
+
+	if err := storeObject(ctx, blob.Path, content, size, contentType, dataKey); err != nil {
+		collection.DeleteOne(ctx, bson.M{"_id": sum, "state": models.BlobUploading})
+		return nil, err
+	}
+
+	// if the file is never saved the collector removes the blob again
+	now = time.Now()
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": sum}, bson.M{
+		"$set": bson.M{"state": models.BlobReady, "updated_at": now, "unreferenced_at": now},
+	})
+	if err != nil {
+		// the blob stays "uploading" and the collector cleans it up
+		return nil, fmt.Errorf("could not mark blob ready: %v", err)
+	}
+
+	blob.State = models.BlobReady
+	blob.UpdatedAt = now
+	blob.UnreferencedAt = &now
+	return &blob, nil
+}
+
+// takeBlobRef adds a reference to a ready blob. It returns errBlobGone if
+// the collector claimed the blob first.
+func takeBlobRef(ctx context.Context, sum string) error {
+	result, err := utils.GetCollection("blobs").UpdateOne(ctx, bson.M{
+		"_id":   sum,
+		"state": models.BlobReady,
+	}, bson.M{
+		"$inc":   bson.M{"ref_count": 1},
+		"$set":   bson.M{"updated_at": time.Now()},
+		"$unset": bson.M{"unreferenced_at": ""},
+	})
+	if err != nil {
+		return fmt.Errorf("could not reference blob %s: %v", sum, err)
+	}
+	if result.MatchedCount == 0 {
+		return errBlobGone
+	}
+	return nil
+}
+
+// storeObject uploads content to path, encrypting it when dataKey is set
+func storeObject(ctx context.Context, path string, content io.ReadSeeker, size int64, contentType string, dataKey []byte) error {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("could not rewind file: %v", err)
+	}
+
+	var reader io.Reader = content
+	if dataKey != nil {
+		encrypted, err := utils.NewEncryptingReader(content, dataKey, contentStream, size)
+		if err != nil {
+			return fmt.Errorf("could not encrypt file: %v", err)
+		}
+		reader = encrypted
+		contentType = "application/octet-stream"
+	}
+
+	if _, err := utils.UploadToGCS(ctx, path, reader, contentType); err != nil {
+		return fmt.Errorf("could not upload file to storage: %v", err)
+	}
+	return nil
+}
+
+// releaseBlob drops one reference, noting when the last one went. The
+// content itself is removed later by the collector.
+func releaseBlob(ctx context.Context, sum string) error {
+	now := time.Now()
+	refCount := bson.M{"$subtract": bson.A{"$ref_count", 1}}
+
+	result, err := utils.GetCollection("blobs").UpdateOne(ctx, bson.M{"_id": sum}, []bson.M{{
+		"$set": bson.M{
+			"ref_count":       refCount,
+			"updated_at":      now,
+			"unreferenced_at": bson.M{"$cond": bson.A{bson.M{"$lte": bson.A{refCount, 0}}, now, "$$REMOVE"}},
+		},
+	}})
+	if err != nil {
+		return fmt.Errorf("could not release blob %s: %v", sum, err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("could not release blob %s: not found", sum)
+	}
+	return nil
+}
+
+// StartBlobCollector removes blobs nothing references any more, along with
+// uploads and deletions that were abandoned halfway
+func StartBlobCollector(ctx context.Context) {
+	runPeriodically(ctx, "blob collector", blobGCInterval, collectBlobs)
+}
+
+func collectBlobs(ctx context.Context) error {
+	collection := utils.GetCollection("blobs")
+	now := time.Now()
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"$or": []bson.M{
+			{"state": models.BlobReady, "ref_count": bson.M{"$lte": 0}, "unreferenced_at": bson.M{"$lte": now.Add(-blobGCGrace)}},
+			{"state": models.BlobUploading, "created_at": bson.M{"$lte": now.Add(-blobStaleAfter)}},
+			{"state": models.BlobDeleting, "updated_at": bson.M{"$lte": now.Add(-blobStaleAfter)}},
+		},
+	}, options.Find().SetLimit(blobGCBatch))
+	if err != nil {
+		return err
+	}
+	var blobs []models.Blob
+	if err := cursor.All(ctx, &blobs); err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, blob := range blobs {
+		// the claim only succeeds if nothing touched the blob since we read
+		// it; uploads can't take a reference once it is "deleting"
+		result, err := collection.UpdateOne(ctx, bson.M{
+			"_id":        blob.ID,
+			"state":      blob.State,
+			"updated_at": blob.UpdatedAt,
+			"ref_count":  bson.M{"$lte": 0},
+		}, bson.M{
+			"$set": bson.M{"state": models.BlobDeleting, "updated_at": time.Now()},
+		})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+
+		if err := deleteObjectIfExists(ctx, blob.Path); err != nil {
+			log.Printf("Could not delete blob %s: %v", blob.ID, err)
+			continue
+		}
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": blob.ID, "state": models.BlobDeleting}); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		log.Printf("Blob collector removed %d unreferenced blob(s)", removed)
+	}
+	return nil
+}
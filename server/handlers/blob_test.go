@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBlobReferenceCounting(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	collection := utils.GetCollection("blobs")
+
+	now := time.Now()
+	sum := "test-" + primitive.NewObjectID().Hex()
+	_, err := collection.InsertOne(ctx, models.Blob{
+		ID:             sum,
+		State:          models.BlobReady,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		UnreferencedAt: &now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { collection.DeleteOne(ctx, bson.M{"_id": sum}) })
+
+	load := func() models.Blob {
+		t.Helper()
+		var blob models.Blob
+		if err := collection.FindOne(ctx, bson.M{"_id": sum}).Decode(&blob); err != nil {
+			t.Fatal(err)
+		}
+		return blob
+	}
+
+	steps := []struct {
+		name             string
+		op               func(context.Context, string) error
+		wantRefs         int64
+		wantUnreferenced bool
+	}{
+		{"first reference", takeBlobRef, 1, false},
+		{"second reference", takeBlobRef, 2, false},
+		{"one released", releaseBlob, 1, false},
+		{"last released", releaseBlob, 0, true},
+		{"referenced again", takeBlobRef, 1, false},
+	}
+	for _, step := range steps {
+		if err := step.op(ctx, sum); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		blob := load()
+		if blob.RefCount != step.wantRefs {
+			t.Errorf("%s: ref_count = %d, want %d", step.name, blob.RefCount, step.wantRefs)
+		}
+		if (blob.UnreferencedAt != nil) != step.wantUnreferenced {
+			t.Errorf("%s: unreferenced_at = %v, want set %v", step.name, blob.UnreferencedAt, step.wantUnreferenced)
+		}
+	}
+
+	// once the collector claims a blob, uploads must store their own copy
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": sum}, bson.M{"$set": bson.M{"state": models.BlobDeleting}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := takeBlobRef(ctx, sum); !errors.Is(err, errBlobGone) {
+		t.Errorf("takeBlobRef on a deleting blob: error = %v, want errBlobGone", err)
+	}
+	if refs := load().RefCount; refs != 1 {
+		t.Errorf("ref_count = %d after a refused reference, want 1", refs)
+	}
+
+	if err := releaseBlob(ctx, "test-missing-"+sum); err == nil {
+		t.Error("releaseBlob of a missing blob succeeded")
+	}
+}
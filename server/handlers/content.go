@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+)
+
+var errQuarantined = errors.New("file is quarantined")
+
+// openFileContent returns a reader over the stored bytes of file. Everything
+// that needs a file's content goes through here rather than to GCS directly,
+// which is also what keeps quarantined content from being read and decrypts
+// encrypted files.
+func openFileContent(ctx context.Context, file *models.File) (io.ReadCloser, error) {
+	if file.Quarantined() {
+		return nil, errQuarantined
+	}
+	var reader io.ReadCloser
+	var err error
+	if file.Encryption != nil {
+		reader, err = openEncryptedRange(ctx, file, 0, file.Size)
+	} else {
+		reader, err = utils.DownloadFromGCS(ctx, file.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// whole reads are verified against the stored checksums
+	return newIntegrityReader(ctx, file, reader), nil
+}
+
+// openFileRange is openFileContent for length bytes starting at offset
+func openFileRange(ctx context.Context, file *models.File, offset, length int64) (io.ReadCloser, error) {
+	if file.Quarantined() {
+		return nil, errQuarantined
+	}
+	if file.Encryption != nil {
+		return openEncryptedRange(ctx, file, offset, length)
+	}
+	return utils.DownloadRangeFromGCS(ctx, file.Path, offset, length)
+}
+
+// rejectBlockedContent writes a 403 for an infected file, or a 409 for one
+// whose malware scan hasn't finished or failed (see scanFailOpen), and
+// returns true
+func rejectBlockedContent(c *gin.Context, file *models.File) bool {
+	switch {
+	case file.Quarantined():
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":       "File is quarantined",
+			"scan_status": file.ScanStatus,
+			"signature":   file.ScanSignature,
+		})
+	case file.AwaitingScan():
+		c.JSON(http.StatusConflict, gin.H{
+			"error":       "File is still being scanned for malware, try again shortly",
+			"scan_status": file.ScanStatus,
+		})
+	case file.Unscanned() && !scanFailOpen():
+		c.JSON(http.StatusConflict, gin.H{
+			"error":       "File could not be scanned for malware and is withheld",
+			"scan_status": file.ScanStatus,
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// fileReaderAt adapts ranged reads of a stored file to io.ReaderAt. Reads are
+// served from fixed-size blocks and the last block is kept, so the many small
+// sequential reads archive/zip makes over the central directory cost one
+// request per block instead of one each.
+type fileReaderAt struct {
+	ctx   context.Context
+	file  *models.File
+	block []byte
+	start int64
+}
+
+const readerAtBlockSize = 64 * 1024
+
+func newFileReaderAt(ctx context.Context, file *models.File) *fileReaderAt {
+	return &fileReaderAt{ctx: ctx, file: file, start: -1}
+}
+
+func (r *fileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.file.Size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < r.file.Size {
+		if r.start < 0 || off < r.start || off >= r.start+int64(len(r.block)) {
+			if err := r.fill(off); err != nil {
+				return n, err
+			}
+		}
+		copied := copy(p[n:], r.block[off-r.start:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *fileReaderAt) fill(off int64) error {
+	start := off - off%readerAtBlockSize
+	length := int64(readerAtBlockSize)
+	if start+length > r.file.Size {
+		length = r.file.Size - start
+	}
+
+	reader, err := openFileRange(r.ctx, r.file, start, length)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	block := make([]byte, length)
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return err
+	}
+	r.block = block
+	r.start = start
+	return nil
+}
+
+// inlineContentTypes may be shown in the browser with ?inline=true. Anything
+// else is always sent as an attachment.
+var inlineContentTypes = map[string]bool{
+	"application/pdf":  true,
+	"image/png":        true,
+	"image/jpeg":       true,
+	"image/gif":        true,
+	"image/webp":       true,
+	"image/avif":       true,
+	"image/bmp":        true,
+	"image/svg+xml":    true,
+	"audio/mpeg":       true,
+	"audio/ogg":        true,
+	"audio/wav":        true,
+	"audio/flac":       true,
+	"audio/aac":        true,
+	"audio/mp4":        true,
+	"video/mp4":        true,
+	"video/webm":       true,
+	"video/ogg":        true,
+	"text/plain":       true,
+	"text/csv":         true,
+	"text/html":        true,
+	"application/json": true,
+}
+
+// activeContentCSP is sent with HTML and SVG so scripts, forms and external
+// loads are blocked even when the document is opened directly
+const activeContentCSP = "default-src 'none'; img-src data:; style-src 'unsafe-inline'; media-src data:; sandbox"
+
+// serveFileContent streams a file with a sniffed Content-Type, honouring a
+// single-range Range header so audio and video can seek. The file is shown
+// inline only when asked for and its real type is on the allowlist.
+func serveFileContent(c *gin.Context, file *models.File, inline bool) {
+	contentType := "application/octet-stream"
+	if file.Size > 0 {
+		head, err := readFileHead(c, file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not download file"})
+			return
+		}
+		contentType = utils.DetectContentType(head)
+	}
+	mediaType := utils.BaseMediaType(contentType)
+
+	disposition := "attachment"
+	if inline && inlineContentTypes[mediaType] {
+		disposition = "inline"
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", contentDisposition(disposition, file.OriginalName))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Accept-Ranges", "bytes")
+	setDigestHeaders(c, file)
+	if mediaType == "text/html" || mediaType == "image/svg+xml" {
+		c.Header("Content-Security-Policy", activeContentCSP)
+	}
+
+	start, length, ok := parseByteRange(c.GetHeader("Range"), file.Size)
+	if !ok {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+		c.Status(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	var reader io.ReadCloser
+	var err error
+	status := http.StatusOK
+	if length >= 0 {
+		reader, err = openFileRange(c, file, start, length)
+		status = http.StatusPartialContent
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, file.Size))
+	} else {
+		reader, err = openFileContent(c, file)
+		length = file.Size
+	}
+	if err != nil {
+		c.Writer.Header().Del("Content-Range")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not download file"})
+		return
+	}
+	defer reader.Close()
+
+	c.Header("Content-Length", strconv.FormatInt(length, 10))
+	c.Status(status)
+
+	if _, err := io.Copy(c.Writer, reader); err != nil {
+		// headers are already sent, so only log; on an integrity failure
+		// the digest headers let the client notice too
+		log.Printf("Error streaming file %s: %v", file.ID.Hex(), err)
+	}
+}
+
+func readFileHead(ctx context.Context, file *models.File) ([]byte, error) {
+	length := int64(utils.SniffLength)
+	if file.Size < length {
+		length = file.Size
+	}
+
+	reader, err := openFileRange(ctx, file, 0, length)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// parseByteRange understands a single "bytes=" range. It returns length -1
+// when the whole file should be sent (no header, or one we don't support),
+// and ok false when the range can't be satisfied.
+func parseByteRange(header string, size int64) (start, length int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, -1, true
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, -1, true
+	}
+
+	if first == "" {
+		// suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, -1, true
+		}
+		if size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, -1, true
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, -1, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// contentDisposition builds the header with an ASCII fallback filename and
+// an RFC 5987 filename* carrying the real UTF-8 name
+func contentDisposition(disposition, filename string) string {
+	var fallback strings.Builder
+	for _, r := range filename {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			// control characters never belong in a header
+		case r == '"' || r == '\\' || r > 0x7e:
+			fallback.WriteRune('_')
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+
+	value := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback.String())
+	if fallback.String() != filename {
+		value += "; filename*=UTF-8''" + rfc5987Escape(filename)
+	}
+	return value
+}
+
+// rfc5987Escape percent-encodes everything outside RFC 5987 attr-char
+func rfc5987Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
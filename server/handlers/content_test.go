@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		size       int64
+		wantStart  int64
+		wantLength int64
+		wantOK     bool
+	}{
+		{"", 100, 0, -1, true},
+		{"bytes=0-9", 100, 0, 10, true},
+		{"bytes=90-", 100, 90, 10, true},
+		{"bytes=99-99", 100, 99, 1, true},
+		{"bytes=50-500", 100, 50, 50, true},
+		{"bytes=-10", 100, 90, 10, true},
+		{"bytes=-500", 100, 0, 100, true},
+		{" bytes=0-9", 100, 0, -1, true},
+		{"bytes= 0-9 ", 100, 0, 10, true},
+
+		// unsatisfiable
+		{"bytes=100-", 100, 0, 0, false},
+		{"bytes=200-300", 100, 0, 0, false},
+		{"bytes=-10", 0, 0, 0, false},
+		{"bytes=0-", 0, 0, 0, false},
+
+		// ignored: the whole file is sent
+		{"items=0-9", 100, 0, -1, true},
+		{"bytes=0-9,20-29", 100, 0, -1, true},
+		{"bytes=9-0", 100, 0, -1, true},
+		{"bytes=-0", 100, 0, -1, true},
+		{"bytes=-", 100, 0, -1, true},
+		{"bytes=a-b", 100, 0, -1, true},
+		{"bytes=5", 100, 0, -1, true},
+		{"bytes=-5-", 100, 0, -1, true},
+	}
+	for _, tt := range tests {
+		start, length, ok := parseByteRange(tt.header, tt.size)
+		if start != tt.wantStart || length != tt.wantLength || ok != tt.wantOK {
+			t.Errorf("parseByteRange(%q, %d) = (%d, %d, %v), want (%d, %d, %v)",
+				tt.header, tt.size, start, length, ok, tt.wantStart, tt.wantLength, tt.wantOK)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition string
+		filename    string
+		want        string
+	}{
+		{"attachment", "report.pdf", `attachment; filename="report.pdf"`},
+		{"inline", "my photo.jpg", `inline; filename="my photo.jpg"`},
+		{"attachment", `say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"attachment", `a\b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%5Cb.txt`},
+		{"attachment", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"attachment", "日本.txt", `attachment; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`},
+		// header injection
+		{"attachment", "evil\r\nSet-Cookie: a=b.txt", `attachment; filename="evilSet-Cookie: a=b.txt"; filename*=UTF-8''evil%0D%0ASet-Cookie%3A%20a%3Db.txt`},
+		{"attachment", "semi;colon.txt", `attachment; filename="semi;colon.txt"`},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.disposition, tt.filename); got != tt.want {
+			t.Errorf("contentDisposition(%q, %q) =\n %s\nwant\n %s", tt.disposition, tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestRejectBlockedContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		status   string
+		failOpen string
+		want     int // 0 when the content is served
+	}{
+		{"", "", 0}, // stored while scanning was disabled
+		{models.ScanClean, "", 0},
+		{models.ScanInfected, "", http.StatusForbidden},
+		{models.ScanInfected, "true", http.StatusForbidden},
+		{models.ScanPending, "", http.StatusConflict},
+		{models.ScanPending, "true", http.StatusConflict},
+		{models.ScanError, "", http.StatusConflict},
+		{models.ScanError, "true", 0},
+		{models.ScanSkipped, "", http.StatusConflict},
+		{models.ScanSkipped, "1", http.StatusConflict},
+		{models.ScanSkipped, "true", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("SCAN_FAIL_OPEN", tt.failOpen)
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+
+		got := 0
+		if rejectBlockedContent(c, &models.File{ScanStatus: tt.status}) {
+			got = w.Code
+		}
+		if got != tt.want {
+			t.Errorf("scan status %q with SCAN_FAIL_OPEN=%q: status %d, want %d", tt.status, tt.failOpen, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"context"
+	"image"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// images whose aHash and dHash both differ in at most this many bits
+	// are grouped as looking alike
+	defaultSimilarDistance = 5
+	maxSimilarDistance     = 10
+	// comparing images is quadratic, so only the newest ones are compared
+	maxSimilarCandidates = 5000
+	maxDuplicateRemovals = 1000
+	duplicateLoadBatch   = 1000
+
+	perceptualHashBackfillInterval = 10 * time.Minute
+	perceptualHashBackfillBatch    = 100
+)
+
+// duplicateGroup is a set of files with the same content, or images that
+// look alike. Reclaimable is what keeping only one frees of the quota once
+// the others are purged from the trash.
+type duplicateGroup struct {
+	SHA256      string        `json:"sha256,omitempty"`
+	Files       []models.File `json:"files"`
+	Reclaimable int64         `json:"reclaimable"`
+}
+
+// GetDuplicates groups the caller's files that have identical content, and
+// images that look alike, across all their folders. Vault files are left
+// out: their ciphertext never matches and the server can't see the images.
+func GetDuplicates(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	distance := defaultSimilarDistance
+	if n, err := strconv.Atoi(c.Query("distance")); err == nil && n >= 0 && n <= maxSimilarDistance {
+		distance = n
+	}
+
+	identical, err := identicalFiles(c, userID)
+	if err != nil {
+		log.Printf("Could not find duplicate files for user %s: %v", userID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not find duplicates"})
+		return
+	}
+
+	similar, err := similarImages(c, userID, distance)
+	if err != nil {
+		log.Printf("Could not find similar images for user %s: %v", userID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not find duplicates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"identical": identical,
+		"similar":   similar,
+		"distance":  distance,
+	})
+}
+
+// identicalFiles groups files by content hash. Files from before SHA-256 was
+// recorded are grouped by their legacy hash. Only IDs are grouped, so large
+// accounts stay within the aggregation memory limit; the files are loaded
+// for the groups that have duplicates.
+func identicalFiles(c *gin.Context, userID primitive.ObjectID) ([]duplicateGroup, error) {
+	cursor, err := utils.GetCollection("files").Aggregate(c, []bson.M{
+		{"$match": bson.M{
+			"user_id":    userID,
+			"vault_id":   bson.M{"$exists": false},
+			"trashed_at": bson.M{"$exists": false},
+			"$or":        []bson.M{{"sha256": bson.M{"$exists": true}}, {"hash": bson.M{"$exists": true}}},
+		}},
+		{"$group": bson.M{
+			"_id":   bson.M{"$ifNull": bson.A{"$sha256", bson.M{"$concat": bson.A{"md5:", "$hash"}}}},
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []struct {
+		IDs []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cursor.All(c, &results); err != nil {
+		return nil, err
+	}
+
+	var ids []primitive.ObjectID
+	for _, result := range results {
+		ids = append(ids, result.IDs...)
+	}
+	byID := make(map[primitive.ObjectID]models.File, len(ids))
+	for start := 0; start < len(ids); start += duplicateLoadBatch {
+		batch := ids[start:min(start+duplicateLoadBatch, len(ids))]
+		var files []models.File
+		filter := bson.M{"_id": bson.M{"$in": batch}, "user_id": userID, "trashed_at": bson.M{"$exists": false}}
+		if err := findAll(c, "files", filter, &files); err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			byID[file.ID] = file
+		}
+	}
+
+	groups := make([]duplicateGroup, 0, len(results))
+	for _, result := range results {
+		files := make([]models.File, 0, len(result.IDs))
+		for _, id := range result.IDs {
+			// files deleted since the aggregation are simply missing
+			if file, ok := byID[id]; ok {
+				files = append(files, file)
+			}
+		}
+		if len(files) < 2 {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt.Before(files[j].CreatedAt) })
+		groups = append(groups, newDuplicateGroup(files, files[0].SHA256))
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Reclaimable > groups[j].Reclaimable })
+	return groups, nil
+}
+
+// similarImages groups images whose perceptual hashes are within distance
+// bits of each other, directly or through other images in the group.
+// Groups whose files are all identical are already listed as such.
+func similarImages(c *gin.Context, userID primitive.ObjectID, distance int) ([]duplicateGroup, error) {
+	var images []models.File
+	cursor, err := utils.GetCollection("files").Find(c, bson.M{
+		"user_id":    userID,
+		"vault_id":   bson.M{"$exists": false},
+		"trashed_at": bson.M{"$exists": false},
+		"ahash":      bson.M{"$exists": true},
+		"dhash":      bson.M{"$exists": true},
+	}, options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(maxSimilarCandidates))
+	if err == nil {
+		err = cursor.All(c, &images)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := images[:0]
+	hashes := make([][2]uint64, 0, len(images))
+	for _, file := range images {
+		aHash, aErr := utils.ParseImageHash(file.AHash)
+		dHash, dErr := utils.ParseImageHash(file.DHash)
+		if aErr != nil || dErr != nil {
+			log.Printf("Ignoring invalid perceptual hash of file %s", file.ID.Hex())
+			continue
+		}
+		candidates = append(candidates, file)
+		hashes = append(hashes, [2]uint64{aHash, dHash})
+	}
+	images = candidates
+
+	// union-find over every pair that looks alike
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if utils.HashDistance(hashes[i][0], hashes[j][0]) <= distance &&
+				utils.HashDistance(hashes[i][1], hashes[j][1]) <= distance {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := map[int][]models.File{}
+	for i := range images {
+		root := find(i)
+		members[root] = append(members[root], images[i])
+	}
+
+	groups := []duplicateGroup{}
+	for _, files := range members {
+		if len(files) < 2 || allIdentical(files) {
+			continue
+		}
+		// oldest first, like the identical groups
+		sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt.Before(files[j].CreatedAt) })
+		groups = append(groups, newDuplicateGroup(files, ""))
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Reclaimable > groups[j].Reclaimable })
+	return groups, nil
+}
+
+func newDuplicateGroup(files []models.File, sha256 string) duplicateGroup {
+	group := duplicateGroup{SHA256: sha256, Files: files}
+	var largest int64
+	for _, file := range files {
+		group.Reclaimable += file.Size
+		largest = max(largest, file.Size)
+	}
+	// keeping the largest copy is the worst case
+	group.Reclaimable -= largest
+	return group
+}
+
+func allIdentical(files []models.File) bool {
+	for _, file := range files[1:] {
+		if !sameContent(&files[0], &file) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameContent reports whether two files are known to have the same bytes
+func sameContent(a, b *models.File) bool {
+	if a.SHA256 != "" && b.SHA256 != "" {
+		return a.SHA256 == b.SHA256
+	}
+	return a.Hash != "" && a.Hash == b.Hash
+}
+
+// looksAlike reports whether two images are within the largest distance
+// the finder offers
+func looksAlike(a, b *models.File) bool {
+	if a.AHash == "" || a.DHash == "" || b.AHash == "" || b.DHash == "" {
+		return false
+	}
+	for _, pair := range [][2]string{{a.AHash, b.AHash}, {a.DHash, b.DHash}} {
+		x, err := utils.ParseImageHash(pair[0])
+		if err != nil {
+			return false
+		}
+		y, err := utils.ParseImageHash(pair[1])
+		if err != nil {
+			return false
+		}
+		if utils.HashDistance(x, y) > maxSimilarDistance {
+			return false
+		}
+	}
+	return true
+}
+
+// StartPerceptualHashBackfill hashes images that were processed before
+// perceptual hashes were computed at upload
+func StartPerceptualHashBackfill(ctx context.Context) {
+	runPeriodically(ctx, "perceptual hash backfill", perceptualHashBackfillInterval, backfillPerceptualHashes)
+}
+
+func backfillPerceptualHashes(ctx context.Context) error {
+	collection := utils.GetCollection("files")
+	cursor, err := collection.Find(ctx, bson.M{
+		"processed_at":     bson.M{"$exists": true},
+		"thumbnail_status": models.ThumbnailReady,
+		"content_type":     bson.M{"$regex": "^image/"},
+		"ahash":            bson.M{"$exists": false},
+		"phash_error":      bson.M{"$exists": false},
+		"vault_id":         bson.M{"$exists": false},
+		"scan_status":      bson.M{"$ne": models.ScanInfected},
+	}, options.Find().SetLimit(perceptualHashBackfillBatch))
+	if err != nil {
+		return err
+	}
+	var files []models.File
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+
+	hashed := 0
+	for i := range files {
+		file := &files[i]
+		img, err := decodeStoredImage(ctx, file)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Could not hash image %s: %v", file.ID.Hex(), err)
+			collection.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{"$set": bson.M{"phash_error": err.Error()}})
+			continue
+		}
+		setPerceptualHashes(ctx, file, img)
+		hashed++
+	}
+	if hashed > 0 {
+		log.Printf("Backfilled perceptual hashes of %d image(s)", hashed)
+	}
+	return nil
+}
+
+// decodeStoredImage reads and decodes a stored image file
+func decodeStoredImage(ctx context.Context, file *models.File) (image.Image, error) {
+	data, err := readThumbnailSource(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	return utils.DecodeImage(data)
+}
+
+// ResolveDuplicates keeps one file of each group and moves the rest to the
+// trash, where they can be restored until they are purged. Each file to
+// trash must be identical to, or look like, the one kept, so a stale or
+// mistaken request can't touch unrelated files.
+func ResolveDuplicates(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var req struct {
+		Groups []struct {
+			Keep  string   `json:"keep" binding:"required"`
+			Trash []string `json:"trash" binding:"required"`
+		} `json:"groups" binding:"required,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	total := 0
+	for _, group := range req.Groups {
+		total += len(group.Trash)
+	}
+	if total == 0 || total > maxDuplicateRemovals {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Between 1 and 1000 files can be trashed at once"})
+		return
+	}
+
+	type skipped struct {
+		FileID string `json:"file_id"`
+		Reason string `json:"reason"`
+	}
+	trashed := []primitive.ObjectID{}
+	skips := []skipped{}
+	var bytes int64
+
+	collection := utils.GetCollection("files")
+	for _, group := range req.Groups {
+		keepID, err := primitive.ObjectIDFromHex(group.Keep)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID", "file_id": group.Keep})
+			return
+		}
+		var keep models.File
+		err = collection.FindOne(c, bson.M{
+			"_id":        keepID,
+			"user_id":    userID,
+			"vault_id":   bson.M{"$exists": false},
+			"trashed_at": bson.M{"$exists": false},
+		}).Decode(&keep)
+		if err != nil {
+			for _, id := range group.Trash {
+				skips = append(skips, skipped{FileID: id, Reason: "file to keep not found"})
+			}
+			continue
+		}
+
+		for _, id := range group.Trash {
+			fileID, err := primitive.ObjectIDFromHex(id)
+			if err != nil || fileID == keepID {
+				skips = append(skips, skipped{FileID: id, Reason: "invalid file ID"})
+				continue
+			}
+			var file models.File
+			err = collection.FindOne(c, bson.M{
+				"_id":        fileID,
+				"user_id":    userID,
+				"vault_id":   bson.M{"$exists": false},
+				"trashed_at": bson.M{"$exists": false},
+			}).Decode(&file)
+			if err != nil {
+				skips = append(skips, skipped{FileID: id, Reason: "file not found"})
+				continue
+			}
+			if !sameContent(&keep, &file) && !looksAlike(&keep, &file) {
+				skips = append(skips, skipped{FileID: id, Reason: "not a duplicate of the file kept"})
+				continue
+			}
+
+			moved, err := trashFile(c, userID, file.ID)
+			if err != nil {
+				log.Printf("Could not trash duplicate %s: %v", file.ID.Hex(), err)
+				skips = append(skips, skipped{FileID: id, Reason: "could not trash file"})
+				continue
+			}
+			if !moved {
+				skips = append(skips, skipped{FileID: id, Reason: "file not found"})
+				continue
+			}
+			trashed = append(trashed, file.ID)
+			bytes += file.Size
+		}
+	}
+
+	if len(trashed) > 0 {
+		recordAudit(c, userID, "files.duplicates_trashed", map[string]interface{}{
+			"files": trashed,
+			"bytes": bytes,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"trashed":     trashed,
+		"skipped":     skips,
+		"bytes":       bytes,
+		"purge_after": time.Now().Add(trashRetentionPeriod()),
+	})
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Encryption streams. A file's content and its derived objects share the
+// file's data key, so each gets its own nonce space.
+const (
+	contentStream uint32 = iota
+	thumbnailSmallStream
+	thumbnailMediumStream
+	thumbnailLargeStream
+)
+
+var thumbnailStreams = map[string]uint32{
+	"small":  thumbnailSmallStream,
+	"medium": thumbnailMediumStream,
+	"large":  thumbnailLargeStream,
+}
+
+const (
+	rewrapInterval  = time.Hour
+	rewrapBatchSize = 200
+)
+
+// newFileEncryption creates and wraps a data key for a new file. It returns
+// nil for both when encryption at rest is disabled.
+func newFileEncryption(ctx context.Context) (*models.FileEncryption, []byte, error) {
+	kms := utils.GetKMS()
+	if kms == nil {
+		return nil, nil, nil
+	}
+
+	dataKey, err := utils.NewDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID, wrapped, err := kms.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &models.FileEncryption{
+		Algorithm:  utils.EncryptionAlgorithm,
+		ChunkSize:  utils.EncryptionChunkSize,
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+	}, dataKey, nil
+}
+
+// fileDataKey unwraps the data key of an encrypted file
+func fileDataKey(ctx context.Context, file *models.File) ([]byte, error) {
+	return unwrapDataKey(ctx, file.Encryption)
+}
+
+// unwrapDataKey unwraps the data key of any encrypted object
+func unwrapDataKey(ctx context.Context, enc *models.FileEncryption) ([]byte, error) {
+	if enc.Algorithm != utils.EncryptionAlgorithm || enc.ChunkSize != utils.EncryptionChunkSize {
+		return nil, fmt.Errorf("unsupported encryption %s/%d", enc.Algorithm, enc.ChunkSize)
+	}
+	return utils.UnwrapDataKey(ctx, enc.KeyID, enc.WrappedKey)
+}
+
+// openEncryptedRange fetches the chunks covering a plaintext range of an
+// encrypted file and decrypts just those
+func openEncryptedRange(ctx context.Context, file *models.File, offset, length int64) (io.ReadCloser, error) {
+	if length < 0 || offset+length > file.Size {
+		length = file.Size - offset
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	dataKey, err := fileDataKey(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := utils.EncryptedRange(file.Size, offset, length)
+	raw, err := utils.DownloadRangeFromGCS(ctx, file.Path, chunks.Offset, chunks.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := utils.NewDecryptingReader(raw, dataKey, contentStream, file.Size, chunks.First, chunks.Last)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, plain, chunks.Skip); err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	return &decryptedReader{Reader: io.LimitReader(plain, length), raw: raw}, nil
+}
+
+type decryptedReader struct {
+	io.Reader
+	raw io.Closer
+}
+
+func (r *decryptedReader) Close() error {
+	return r.raw.Close()
+}
+
+// GetEncryptionStatus shows which KMS keys the stored data keys are wrapped
+// with, so an admin can tell when a rotation has finished
+func GetEncryptionStatus(c *gin.Context) {
+	kms := utils.GetKMS()
+	if kms == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+
+	activeKeyID, err := kms.ActiveKeyID(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reach KMS"})
+		return
+	}
+
+	collection := utils.GetCollection("files")
+	cursor, err := collection.Aggregate(c, []bson.M{
+		{"$match": bson.M{"encryption": bson.M{"$exists": true}}},
+		{"$group": bson.M{"_id": "$encryption.key_id", "count": bson.M{"$sum": 1}}},
+		{"$sort": bson.M{"_id": 1}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve encryption status"})
+		return
+	}
+	var keys []struct {
+		KeyID string `bson:"_id" json:"key_id"`
+		Count int64  `bson:"count" json:"count"`
+	}
+	if err := cursor.All(c, &keys); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve encryption status"})
+		return
+	}
+
+	unencrypted, err := collection.CountDocuments(c, bson.M{"encryption": bson.M{"$exists": false}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve encryption status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":           true,
+		"active_key_id":     activeKeyID,
+		"files_by_key":      keys,
+		"unencrypted_files": unencrypted,
+		"rewrap_running":    rewrapRunning.Load(),
+	})
+}
+
+// RewrapDataKeys starts re-wrapping every data key that isn't wrapped with
+// the active KMS key, instead of waiting for the hourly job
+func RewrapDataKeys(c *gin.Context) {
+	if utils.GetKMS() == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Encryption at rest is not enabled"})
+		return
+	}
+	if rewrapRunning.Load() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Re-wrap already running"})
+		return
+	}
+
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+	recordAudit(c, adminID, "admin.data_keys_rewrap", nil)
+
+	go func() {
+		if err := rewrapDataKeys(context.Background()); err != nil {
+			log.Printf("Data key re-wrap failed: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Re-wrap started"})
+}
+
+// StartKeyRewrapWorker moves data keys onto the active KMS key after a
+// rotation. Only the small wrapped keys change; content is not re-encrypted.
+func StartKeyRewrapWorker(ctx context.Context) {
+	if utils.GetKMS() == nil {
+		return
+	}
+	runPeriodically(ctx, "data key rewrap", rewrapInterval, rewrapDataKeys)
+}
+
+var rewrapRunning atomic.Bool
+
+func rewrapDataKeys(ctx context.Context) error {
+	if !rewrapRunning.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer rewrapRunning.Store(false)
+
+	kms := utils.GetKMS()
+	activeKeyID, err := kms.ActiveKeyID(ctx)
+	if err != nil {
+		return err
+	}
+
+	collection := utils.GetCollection("files")
+	filter := bson.M{
+		"encryption":        bson.M{"$exists": true},
+		"encryption.key_id": bson.M{"$ne": activeKeyID},
+	}
+
+	rewrapped, failed := 0, 0
+	for ctx.Err() == nil {
+		// files that failed stay behind the cursor position, so skip past them
+		cursor, err := collection.Find(ctx, filter, options.Find().
+			SetProjection(bson.M{"_id": 1, "blob_id": 1, "encryption": 1}).
+			SetSort(bson.M{"_id": 1}).
+			SetSkip(int64(failed)).
+			SetLimit(rewrapBatchSize))
+		if err != nil {
+			return err
+		}
+		var files []models.File
+		if err := cursor.All(ctx, &files); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+
+		for _, file := range files {
+			if err := rewrapFile(ctx, kms, &file); err != nil {
+				log.Printf("Could not re-wrap data key of file %s: %v", file.ID.Hex(), err)
+				failed++
+				continue
+			}
+			rewrapped++
+		}
+	}
+
+	if rewrapped > 0 || failed > 0 {
+		log.Printf("Re-wrapped %d data key(s) with %s, %d failed", rewrapped, activeKeyID, failed)
+	}
+	return nil
+}
+
+func rewrapFile(ctx context.Context, kms utils.KMS, file *models.File) error {
+	if file.BlobID != "" {
+		return rewrapBlob(ctx, kms, file.BlobID)
+	}
+
+	old := file.Encryption
+	dataKey, err := kms.Unwrap(ctx, old.KeyID, old.WrappedKey)
+	if err != nil {
+		return err
+	}
+	keyID, wrapped, err := kms.Wrap(ctx, dataKey)
+	if err != nil {
+		return err
+	}
+
+	// only replace the key we unwrapped, in case another instance got there first
+	_, err = utils.GetCollection("files").UpdateOne(ctx, bson.M{
+		"_id":                    file.ID,
+		"encryption.key_id":      old.KeyID,
+		"encryption.wrapped_key": old.WrappedKey,
+	}, bson.M{"$set": bson.M{
+		"encryption.key_id":       keyID,
+		"encryption.wrapped_key":  wrapped,
+		"encryption.rewrapped_at": time.Now(),
+	}})
+	return err
+}
+
+// rewrapBlob re-wraps a blob's data key if that is still needed and copies
+// the result to every file that shares the blob
+func rewrapBlob(ctx context.Context, kms utils.KMS, blobID string) error {
+	blobs := utils.GetCollection("blobs")
+
+	var blob models.Blob
+	if err := blobs.FindOne(ctx, bson.M{"_id": blobID}).Decode(&blob); err != nil {
+		return err
+	}
+	if blob.Encryption == nil {
+		return fmt.Errorf("blob %s is not encrypted", blobID)
+	}
+
+	activeKeyID, err := kms.ActiveKeyID(ctx)
+	if err != nil {
+		return err
+	}
+
+	enc := *blob.Encryption
+	if enc.KeyID != activeKeyID {
+		dataKey, err := kms.Unwrap(ctx, enc.KeyID, enc.WrappedKey)
+		if err != nil {
+			return err
+		}
+		keyID, wrapped, err := kms.Wrap(ctx, dataKey)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		result, err := blobs.UpdateOne(ctx, bson.M{
+			"_id":                    blobID,
+			"encryption.wrapped_key": enc.WrappedKey,
+		}, bson.M{"$set": bson.M{
+			"encryption.key_id":       keyID,
+			"encryption.wrapped_key":  wrapped,
+			"encryption.rewrapped_at": now,
+		}})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			return fmt.Errorf("blob %s was re-wrapped concurrently", blobID)
+		}
+		enc.KeyID, enc.WrappedKey, enc.RewrappedAt = keyID, wrapped, &now
+	}
+
+	// files carry a copy of the blob's key so reads don't need the blob
+	_, err = utils.GetCollection("files").UpdateMany(ctx, bson.M{"blob_id": blobID}, bson.M{
+		"$set": bson.M{"encryption": enc},
+	})
+	return err
+}
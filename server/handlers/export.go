@@ -0,0 +1,545 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultExportTTL = 7 * 24 * time.Hour
+	// an export running this long is assumed to have crashed
+	exportStaleAfter = 2 * time.Hour
+)
+
+// RequestExport queues a new personal data export
+func RequestExport(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	collection := utils.GetCollection("exports")
+
+	var existing models.Export
+	err := collection.FindOne(c, bson.M{
+		"user_id": userID,
+		"status":  bson.M{"$in": []string{models.ExportPending, models.ExportRunning}},
+	}).Decode(&existing)
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "An export is already in progress", "export": existing})
+		return
+	}
+
+	export := models.Export{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Status:    models.ExportPending,
+		CreatedAt: time.Now(),
+	}
+	if _, err := collection.InsertOne(c, export); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create export"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Export started. You will be notified when it is ready",
+		"export":  export,
+	})
+}
+
+// GetExports lists the user's exports
+func GetExports(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	cursor, err := utils.GetCollection("exports").Find(c, bson.M{"user_id": userID},
+		options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve exports"})
+		return
+	}
+	defer cursor.Close(c)
+
+	exports := []models.Export{}
+	if err = cursor.All(c, &exports); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not decode exports"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"exports": exports})
+}
+
+// DownloadExport streams a finished export archive
+func DownloadExport(c *gin.Context) {
+	exportObjID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid export ID"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var export models.Export
+	err = utils.GetCollection("exports").FindOne(c, bson.M{"_id": exportObjID, "user_id": userID}).Decode(&export)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+
+	if export.Status != models.ExportReady || export.ExpiresAt == nil || time.Now().After(*export.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Export is not available", "status": export.Status})
+		return
+	}
+
+	reader, err := openExportArchive(c, &export)
+	if err != nil {
+		log.Printf("Could not open export %s: %v", export.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not download export"})
+		return
+	}
+	defer reader.Close()
+
+	c.Header("Content-Disposition", contentDisposition("attachment", fmt.Sprintf("driftbox-export-%s.zip", export.CreatedAt.Format("2006-01-02"))))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Length", fmt.Sprintf("%d", export.Size))
+
+	if _, err := io.Copy(c.Writer, reader); err != nil {
+		log.Printf("Error streaming export %s: %v", export.ID.Hex(), err)
+	}
+}
+
+// openExportArchive reads a stored export, decrypting it when it is
+// encrypted at rest
+func openExportArchive(ctx context.Context, export *models.Export) (io.ReadCloser, error) {
+	stored, err := utils.DownloadFromGCS(ctx, export.Path)
+	if err != nil || export.Encryption == nil {
+		return stored, err
+	}
+
+	dataKey, err := unwrapDataKey(ctx, export.Encryption)
+	if err != nil {
+		stored.Close()
+		return nil, err
+	}
+	chunks := utils.EncryptedRange(export.Size, 0, export.Size)
+	plain, err := utils.NewDecryptingReader(stored, dataKey, contentStream, export.Size, chunks.First, chunks.Last)
+	if err != nil {
+		stored.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{plain, stored}, nil
+}
+
+// StartExportWorker builds queued exports and removes expired ones
+func StartExportWorker(ctx context.Context) {
+	runPeriodically(ctx, "exports", 30*time.Second, func(ctx context.Context) error {
+		expireExports(ctx)
+
+		for {
+			export, err := claimExport(ctx)
+			if err == mongo.ErrNoDocuments {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			runExport(ctx, export)
+		}
+	})
+}
+
+func claimExport(ctx context.Context) (*models.Export, error) {
+	now := time.Now()
+
+	var export models.Export
+	err := utils.GetCollection("exports").FindOneAndUpdate(ctx, bson.M{
+		"$or": []bson.M{
+			{"status": models.ExportPending},
+			{"status": models.ExportRunning, "started_at": bson.M{"$lte": now.Add(-exportStaleAfter)}},
+		},
+	}, bson.M{
+		"$set": bson.M{"status": models.ExportRunning, "started_at": now},
+	}, options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}).SetReturnDocument(options.After)).Decode(&export)
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func runExport(ctx context.Context, export *models.Export) {
+	collection := utils.GetCollection("exports")
+	objectPath := fmt.Sprintf("users/%s/exports/%s.zip", export.UserID.Hex(), export.ID.Hex())
+
+	// the archive holds every file the user owns, so it is encrypted at rest
+	// like they are
+	encryption, dataKey, err := newFileEncryption(ctx)
+	var size int64
+	var fileCount, failed int
+	if err == nil {
+		size, fileCount, failed, err = uploadExportArchive(ctx, export.UserID, objectPath, dataKey)
+	}
+	if err != nil {
+		log.Printf("Export %s failed: %v", export.ID.Hex(), err)
+		collection.UpdateOne(ctx, bson.M{"_id": export.ID}, bson.M{
+			"$set": bson.M{"status": models.ExportFailed, "error": err.Error()},
+		})
+		notifyUser(ctx, export.UserID, "export_failed", "Your data export failed",
+			"We could not build your data export. Please try again.", "", nil)
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(exportTTL())
+	collection.UpdateOne(ctx, bson.M{"_id": export.ID}, bson.M{
+		"$set": bson.M{
+			"status":       models.ExportReady,
+			"path":         objectPath,
+			"size":         size,
+			"file_count":   fileCount,
+			"failed_count": failed,
+			"encryption":   encryption,
+			"completed_at": now,
+			"expires_at":   expiresAt,
+		},
+	})
+
+	// an encrypted archive can only be read through the proxy route. A
+	// plaintext one is fetched straight from the bucket with a signed URL
+	// when signing is configured.
+	link := fmt.Sprintf("/api/account/exports/%s/download", export.ID.Hex())
+	if encryption == nil {
+		if signed, err := utils.GenerateSignedURL(ctx, objectPath, time.Until(expiresAt)); err == nil {
+			link = signed
+		}
+	}
+
+	message := fmt.Sprintf("Your export with %d files is ready to download until %s.", fileCount, expiresAt.Format(time.RFC1123))
+	if failed > 0 {
+		message += fmt.Sprintf(" %d of them could not be read; manifest.json lists which.", failed)
+	}
+	notifyUser(ctx, export.UserID, "export_ready", "Your data export is ready", message, link, &expiresAt)
+}
+
+// uploadExportArchive streams the ZIP straight into the bucket without
+// buffering it on disk or in memory, encrypting it when dataKey is set. The
+// size returned is that of the ZIP itself.
+func uploadExportArchive(ctx context.Context, userID primitive.ObjectID, objectPath string, dataKey []byte) (int64, int, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	counter := &countingReader{r: pr}
+
+	var fileCount, failed int
+	go func() {
+		var err error
+		fileCount, failed, err = writeExportArchive(ctx, pw, userID)
+		if err != nil {
+			// cancel first so the bucket writer aborts instead of committing a partial object
+			cancel()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var archive io.Reader = counter
+	contentType := "application/zip"
+	if dataKey != nil {
+		encrypted, err := utils.NewStreamEncryptingReader(counter, dataKey, contentStream)
+		if err != nil {
+			pr.CloseWithError(err)
+			return 0, 0, 0, err
+		}
+		archive = encrypted
+		contentType = "application/octet-stream"
+	}
+
+	if _, err := utils.UploadToGCS(ctx, objectPath, archive, contentType); err != nil {
+		pr.CloseWithError(err)
+		return 0, 0, 0, err
+	}
+	return counter.n, fileCount, failed, nil
+}
+
+// exportManifest is written as manifest.json at the root of the archive
+type exportManifest struct {
+	ExportedAt time.Time             `json:"exported_at"`
+	Profile    gin.H                 `json:"profile"`
+	Identities []models.Identity     `json:"identities"`
+	Folders    []models.Folder       `json:"folders"`
+	Files      []exportManifestEntry `json:"files"`
+	Favorites  []primitive.ObjectID  `json:"favorites"`
+}
+
+type exportManifestEntry struct {
+	models.File
+	ArchivePath string `json:"archive_path,omitempty"`
+	// set when the content could not be exported; a partial copy may still
+	// be at ArchivePath
+	Error string `json:"error,omitempty"`
+}
+
+// writeExportArchive writes the archive and reports how many files it lists
+// and how many of those could not be read
+func writeExportArchive(ctx context.Context, w io.Writer, userID primitive.ObjectID) (int, int, error) {
+	var user models.User
+	if err := utils.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		return 0, 0, fmt.Errorf("could not load user: %v", err)
+	}
+
+	var folders []models.Folder
+	if err := findAll(ctx, "folders", bson.M{"user_id": userID}, &folders); err != nil {
+		return 0, 0, err
+	}
+	// vault files are ciphertext under placeholder names that only the
+	// vault members' keys can open, so they stay out of the export
+	var files []models.File
+	if err := findAll(ctx, "files", bson.M{
+		"user_id":    userID,
+		"vault_id":   bson.M{"$exists": false},
+		"trashed_at": bson.M{"$exists": false},
+	}, &files); err != nil {
+		return 0, 0, err
+	}
+	var identities []models.Identity
+	if err := findAll(ctx, "identities", bson.M{"user_id": userID}, &identities); err != nil {
+		return 0, 0, err
+	}
+
+	folderDirs := map[primitive.ObjectID]string{}
+	for _, folder := range folders {
+		folderDirs[folder.ID] = archiveDir(folder.Path)
+	}
+
+	zw := zip.NewWriter(w)
+	manifest := exportManifest{
+		ExportedAt: time.Now(),
+		Profile: gin.H{
+			"id":            user.ID,
+			"username":      user.Username,
+			"email":         user.Email,
+			"auth_provider": user.AuthProvider,
+			"picture":       user.Picture,
+			"two_factor":    user.TwoFactor != nil && user.TwoFactor.Enabled,
+		},
+		Identities: identities,
+		Folders:    folders,
+		Files:      []exportManifestEntry{},
+		Favorites:  []primitive.ObjectID{},
+	}
+
+	used := map[string]bool{}
+	failed := 0
+	for i := range files {
+		file := &files[i]
+
+		dir := "files"
+		if file.FolderID != nil {
+			if folderDir, ok := folderDirs[*file.FolderID]; ok {
+				dir = path.Join("files", folderDir)
+			}
+		}
+		// content that isn't served (quarantined, not yet scanned, or
+		// unscanned unless scanning fails open) stays out of the archive;
+		// the manifest still lists it
+		entry := exportManifestEntry{File: *file}
+		if file.AwaitingScan() {
+			entry.Error = "not yet scanned for malware"
+			failed++
+		} else if file.Unscanned() && !scanFailOpen() {
+			entry.Error = "could not be scanned for malware"
+			failed++
+		} else if !file.Quarantined() {
+			entry.ArchivePath = uniqueArchivePath(used, path.Join(dir, sanitizeArchiveName(file.Name)))
+			written, fileErr, err := addFileToArchive(ctx, zw, file, entry.ArchivePath)
+			if err != nil {
+				return 0, 0, fmt.Errorf("could not add %s: %v", file.ID.Hex(), err)
+			}
+			if fileErr != nil {
+				log.Printf("Could not export file %s: %v", file.ID.Hex(), fileErr)
+				entry.Error = exportFileError(fileErr)
+				if !written {
+					entry.ArchivePath = ""
+				}
+				failed++
+			}
+		}
+
+		manifest.Files = append(manifest.Files, entry)
+		if file.IsFavorite {
+			manifest.Favorites = append(manifest.Favorites, file.ID)
+		}
+	}
+
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return 0, 0, err
+	}
+	encoder := json.NewEncoder(mw)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return 0, 0, err
+	}
+
+	return len(files), failed, zw.Close()
+}
+
+// addFileToArchive copies a file's content into the archive. A problem with
+// the file itself is returned as fileErr, with written telling whether an
+// entry was started, so the export can go on without it; err means the
+// archive itself can't be written any more.
+func addFileToArchive(ctx context.Context, zw *zip.Writer, file *models.File, archivePath string) (written bool, fileErr, err error) {
+	reader, err := openFileContent(ctx, file)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, nil, ctx.Err()
+		}
+		return false, err, nil
+	}
+	defer reader.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     archivePath,
+		Method:   zip.Deflate,
+		Modified: file.UpdatedAt,
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	source := &readErrorReader{r: reader}
+	if _, err := io.Copy(w, source); err != nil {
+		if source.err != nil && ctx.Err() == nil {
+			return true, source.err, nil
+		}
+		return true, nil, err
+	}
+	return true, nil, nil
+}
+
+// exportFileError is what the manifest says about a file that could not be
+// exported; details stay in the server log
+func exportFileError(err error) string {
+	if errors.Is(err, errIntegrity) {
+		return "content does not match its checksum"
+	}
+	return "content could not be read"
+}
+
+// archiveDir turns a folder path like "/Photos/2024" into safe zip path segments
+func archiveDir(folderPath string) string {
+	var parts []string
+	for _, part := range strings.Split(folderPath, "/") {
+		if part != "" {
+			parts = append(parts, sanitizeArchiveName(part))
+		}
+	}
+	return path.Join(parts...)
+}
+
+func sanitizeArchiveName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// uniqueArchivePath appends " (n)" before the extension when two files would
+// land on the same path
+func uniqueArchivePath(used map[string]bool, p string) string {
+	candidate := p
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for n := 1; used[candidate]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+// expireExports deletes archives past their expiry
+func expireExports(ctx context.Context) {
+	collection := utils.GetCollection("exports")
+
+	var expired []models.Export
+	if err := findAll(ctx, "exports", bson.M{
+		"status":     models.ExportReady,
+		"expires_at": bson.M{"$lte": time.Now()},
+	}, &expired); err != nil {
+		log.Printf("Could not list expired exports: %v", err)
+		return
+	}
+
+	for _, export := range expired {
+		if err := deleteObjectIfExists(ctx, export.Path); err != nil {
+			log.Printf("Could not delete expired export %s: %v", export.ID.Hex(), err)
+			continue
+		}
+		collection.UpdateOne(ctx, bson.M{"_id": export.ID}, bson.M{"$set": bson.M{"status": models.ExportExpired}})
+	}
+}
+
+func exportTTL() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("EXPORT_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultExportTTL
+}
+
+// findAll decodes every document in collection matching filter into results
+func findAll(ctx context.Context, collection string, filter bson.M, results interface{}) error {
+	cursor, err := utils.GetCollection(collection).Find(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("could not query %s: %v", collection, err)
+	}
+	if err := cursor.All(ctx, results); err != nil {
+		return fmt.Errorf("could not decode %s: %v", collection, err)
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readErrorReader remembers a read error so it can be told apart from a
+// failed write on the other side of an io.Copy
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestArchiveDir(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"/Photos", "Photos"},
+		{"/Photos/2024/", "Photos/2024"},
+		{"/../etc", "_/etc"},
+		{"/a/./b", "a/_/b"},
+		{`/back\slash`, "back_slash"},
+		{"/nul\x00byte", "nulbyte"},
+	}
+	for _, tt := range tests {
+		if got := archiveDir(tt.path); got != tt.want {
+			t.Errorf("archiveDir(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeArchiveName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"a/b.txt", "a_b.txt"},
+		{`a\b.txt`, "a_b.txt"},
+		{"", "_"},
+		{".", "_"},
+		{"..", "_"},
+		{"\x00", "_"},
+		{"...", "..."},
+	}
+	for _, tt := range tests {
+		if got := sanitizeArchiveName(tt.name); got != tt.want {
+			t.Errorf("sanitizeArchiveName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueArchivePath(t *testing.T) {
+	used := map[string]bool{}
+	for _, tt := range []struct{ path, want string }{
+		{"files/a.txt", "files/a.txt"},
+		{"files/a.txt", "files/a (1).txt"},
+		{"files/a.txt", "files/a (2).txt"},
+		{"files/a (1).txt", "files/a (1) (1).txt"},
+		{"files/README", "files/README"},
+		{"files/README", "files/README (1)"},
+	} {
+		if got := uniqueArchivePath(used, tt.path); got != tt.want {
+			t.Errorf("uniqueArchivePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestExportFileError(t *testing.T) {
+	if got := exportFileError(fmt.Errorf("reading: %w", errIntegrity)); got != "content does not match its checksum" {
+		t.Errorf("integrity failure reported as %q", got)
+	}
+	// details such as object paths stay out of the manifest
+	if got := exportFileError(errors.New("gs://bucket/users/x: 503")); got != "content could not be read" {
+		t.Errorf("read failure reported as %q", got)
+	}
+}
+
+func TestExportTTL(t *testing.T) {
+	for env, want := range map[string]time.Duration{
+		"":     defaultExportTTL,
+		"48h":  48 * time.Hour,
+		"0s":   defaultExportTTL,
+		"-1h":  defaultExportTTL,
+		"week": defaultExportTTL,
+	} {
+		t.Setenv("EXPORT_TTL", env)
+		if got := exportTTL(); got != want {
+			t.Errorf("EXPORT_TTL=%q: ttl = %v, want %v", env, got, want)
+		}
+	}
+}
+
+func TestReadErrorReader(t *testing.T) {
+	failure := errors.New("read failed")
+	r := &readErrorReader{r: io.MultiReader(bytes.NewReader([]byte("abc")), &failingReader{failure})}
+	if _, err := io.Copy(io.Discard, r); !errors.Is(err, failure) {
+		t.Fatalf("copy error = %v, want the read failure", err)
+	}
+	if r.err != failure {
+		t.Errorf("remembered error = %v, want the read failure", r.err)
+	}
+
+	r = &readErrorReader{r: bytes.NewReader([]byte("abc"))}
+	io.Copy(io.Discard, r)
+	if r.err != nil {
+		t.Errorf("EOF remembered as a read error: %v", r.err)
+	}
+}
+
+type failingReader struct{ err error }
+
+func (r *failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+// TestWriteExportArchiveManifest exports files whose content is never read:
+// the ones left out of the archive, and one whose object doesn't exist
+func TestWriteExportArchiveManifest(t *testing.T) {
+	testMongo(t)
+	t.Setenv("SCAN_FAIL_OPEN", "")
+	ctx := context.Background()
+
+	userID := primitive.NewObjectID()
+	now := time.Now()
+	if _, err := utils.GetCollection("users").InsertOne(ctx, models.User{ID: userID, Email: userID.Hex() + "@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	folderID := primitive.NewObjectID()
+	if _, err := utils.GetCollection("folders").InsertOne(ctx, models.Folder{ID: folderID, UserID: userID, Name: "Docs", Path: "/Docs"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		utils.GetCollection("users").DeleteOne(ctx, bson.M{"_id": userID})
+		utils.GetCollection("folders").DeleteMany(ctx, bson.M{"user_id": userID})
+		utils.GetCollection("files").DeleteMany(ctx, bson.M{"user_id": userID})
+	})
+
+	vaultID := primitive.NewObjectID()
+	files := map[string]models.File{
+		"infected.exe": {ScanStatus: models.ScanInfected},
+		"pending.txt":  {ScanStatus: models.ScanPending},
+		"skipped.iso":  {ScanStatus: models.ScanSkipped},
+		"missing.txt":  {ScanStatus: models.ScanClean, FolderID: &folderID, Path: "test/missing-" + userID.Hex(), IsFavorite: true},
+		"vault.bin":    {VaultID: &vaultID},
+		"trashed.txt":  {TrashedAt: &now},
+	}
+	for name, file := range files {
+		file.ID = primitive.NewObjectID()
+		file.UserID = userID
+		file.Name = name
+		if _, err := utils.GetCollection("files").InsertOne(ctx, file); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = file
+	}
+
+	var buf bytes.Buffer
+	count, failed, err := writeExportArchive(ctx, &buf, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || failed != 3 {
+		t.Errorf("exported %d files with %d failures, want 4 with 3", count, failed)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest exportManifest
+	for _, f := range zr.File {
+		if f.Name != "manifest.json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(rc).Decode(&manifest)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries := map[string]exportManifestEntry{}
+	for _, entry := range manifest.Files {
+		entries[entry.Name] = entry
+	}
+	wantErrors := map[string]string{
+		"infected.exe": "",
+		"pending.txt":  "not yet scanned for malware",
+		"skipped.iso":  "could not be scanned for malware",
+		"missing.txt":  "content could not be read",
+	}
+	if len(entries) != len(wantErrors) {
+		t.Errorf("manifest lists %d files, want %d: vault and trashed files stay out", len(entries), len(wantErrors))
+	}
+	for name, want := range wantErrors {
+		entry, ok := entries[name]
+		if !ok {
+			t.Errorf("%s missing from the manifest", name)
+			continue
+		}
+		if entry.Error != want {
+			t.Errorf("%s: manifest error %q, want %q", name, entry.Error, want)
+		}
+		if name != "missing.txt" && entry.ArchivePath != "" {
+			t.Errorf("%s was put in the archive at %s", name, entry.ArchivePath)
+		}
+	}
+	if len(manifest.Favorites) != 1 || manifest.Favorites[0] != files["missing.txt"].ID {
+		t.Errorf("favorites = %v, want only missing.txt", manifest.Favorites)
+	}
+	if len(manifest.Folders) != 1 || manifest.Profile["email"] != userID.Hex()+"@example.com" {
+		t.Errorf("manifest profile or folders incomplete: %v, %d folders", manifest.Profile, len(manifest.Folders))
+	}
+}
@@ -1,12 +1,11 @@
 package handlers
 
 import (
-	"crypto/md5"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"path/filepath"
 	"time"
 
 	"github.com/ayushsarode/DriftBox/models"
@@ -14,13 +13,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-const (
-	MaxFileSize    = 50 * 1024 * 1024       // 50MB in bytes
-	MaxStorageSize = 2 * 1024 * 1024 * 1024 // 2GB in bytes
-)
+// maxMultipartMemory is how much of a multipart form is kept in memory; the
+// rest goes to temp files. File size limits come from the user's plan.
+const maxMultipartMemory = 50 * 1024 * 1024 // 50MB in bytes
 
 func UploadFile(c *gin.Context) {
 	userIDInterface, exists := c.Get("userID")
@@ -36,13 +35,7 @@ func UploadFile(c *gin.Context) {
 		return
 	}
 
-	storage, err := getUserStorage(c, userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check storage usage"})
-		return
-	}
-
-	err = c.Request.ParseMultipartForm(MaxFileSize)
+	err = c.Request.ParseMultipartForm(maxMultipartMemory)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large or invalid form data"})
 		return
@@ -55,108 +48,120 @@ func UploadFile(c *gin.Context) {
 	}
 	defer file.Close()
 
-	if fileHeader.Size > MaxFileSize {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File size exceeds 50MB limit"})
+	folderID, ok := resolveFolderParam(c, userID, c.PostForm("folder_id"))
+	if !ok {
 		return
 	}
 
-	if storage.UsedSpace+fileHeader.Size > MaxStorageSize {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":         "Upload would exceed 2GB storage limit",
-			"current_usage": storage.UsedSpace,
-			"max_storage":   MaxStorageSize,
-		})
+	expected, ok := uploadChecksums(c, fileHeader.Header)
+	if !ok {
 		return
 	}
 
-	folderIDStr := c.PostForm("folder_id")
-	var folderID *primitive.ObjectID
-	if folderIDStr != "" {
-		folderObjID, err := primitive.ObjectIDFromHex(folderIDStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
-			return
-		}
+	fileRecord, err := saveFile(c, fileUpload{
+		UserID:      userID,
+		FolderID:    folderID,
+		Name:        fileHeader.Filename,
+		ContentType: fileHeader.Header.Get("Content-Type"),
+		Size:        fileHeader.Size,
+		Content:     file,
+		Expected:    expected,
+	})
+	if err != nil {
+		respondSaveFileError(c, userID, err)
+		return
+	}
 
-		folderCollection := utils.GetCollection("folders")
-		var folder models.Folder
-		err = folderCollection.FindOne(c, bson.M{
-			"_id":     folderObjID,
-			"user_id": userID,
-		}).Decode(&folder)
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "File uploaded successfully",
+		"file":    fileRecord,
+	})
+}
 
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
-			return
-		}
-		folderID = &folderObjID
+// resolveFolderParam checks that a folder_id parameter names one of the
+// user's regular folders. An empty value means the root. On failure it
+// writes the response and returns false.
+func resolveFolderParam(c *gin.Context, userID primitive.ObjectID, folderIDStr string) (*primitive.ObjectID, bool) {
+	if folderIDStr == "" {
+		return nil, true
 	}
 
-	fileID := primitive.NewObjectID()
-	ext := filepath.Ext(fileHeader.Filename)
-	gcsFileName := fmt.Sprintf("users/%s/files/%s%s", userIDString, fileID.Hex(), ext)
-
-	file.Seek(0, 0)
-	hash := md5.New()
-	_, err = io.Copy(hash, file)
+	folderObjID, err := primitive.ObjectIDFromHex(folderIDStr)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not calculate file hash"})
-		return
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder ID"})
+		return nil, false
 	}
-	fileHash := fmt.Sprintf("%x", hash.Sum(nil))
 
-	fileCollection := utils.GetCollection("files")
-	var existingFile models.File
-	err = fileCollection.FindOne(c, bson.M{
-		"hash":    fileHash,
+	folderCollection := utils.GetCollection("folders")
+	var folder models.Folder
+	err = folderCollection.FindOne(c, bson.M{
+		"_id":     folderObjID,
 		"user_id": userID,
-	}).Decode(&existingFile)
-
-	if err == nil {
-		c.JSON(http.StatusConflict, gin.H{
-			"error":         "File already exists",
-			"existing_file": existingFile,
-		})
-		return
-	}
+	}).Decode(&folder)
 
-	file.Seek(0, 0)
-	gcsURL, err := utils.UploadToGCS(c, gcsFileName, file, fileHeader.Header.Get("Content-Type"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Could not upload file to storage: %v", err)})
-		return
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return nil, false
 	}
-
-	fileRecord := models.File{
-		ID:           fileID,
-		Name:         fileHeader.Filename,
-		OriginalName: fileHeader.Filename,
-		Size:         fileHeader.Size,
-		ContentType:  fileHeader.Header.Get("Content-Type"),
-		UserID:       userID,
-		FolderID:     folderID,
-		Path:         gcsFileName,
-		URL:          gcsURL,
-		Hash:         fileHash,
-		IsFavorite:   false,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+	if folder.Vault != nil {
+		// plaintext must never land in a vault
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Encrypted vaults only accept files uploaded through the vault API"})
+		return nil, false
 	}
+	return &folderObjID, true
+}
 
-	_, err = fileCollection.InsertOne(c, fileRecord)
+// uploadChecksums reads the checksums a client sent for a multipart file,
+// from the file part's headers or else the request's. On a malformed header
+// it writes the response and returns false.
+func uploadChecksums(c *gin.Context, partHeader map[string][]string) (expectedChecksums, bool) {
+	expected, err := parseChecksumHeaders(partHeader, c.Request.Header)
 	if err != nil {
-		utils.DeleteFromGCS(c, gcsFileName)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save file record"})
-		return
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid checksum header", "reason": err.Error()})
+		return expected, false
 	}
+	return expected, true
+}
 
-	// Update user storage stats
-	updateUserStorage(c, userID, fileHeader.Size, 0, 1)
-
-	c.JSON(http.StatusCreated, gin.H{
-		"message": "File uploaded successfully",
-		"file":    fileRecord,
-	})
+// respondSaveFileError maps saveFile errors onto the upload responses
+func respondSaveFileError(c *gin.Context, userID primitive.ObjectID, err error) {
+	var policy *uploadPolicyError
+	var mismatch *checksumMismatchError
+	switch {
+	case errors.As(err, &policy):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":  "File type not allowed",
+			"reason": policy.Reason,
+		})
+	case errors.As(err, &mismatch):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":     "File content does not match the checksum provided",
+			"algorithm": mismatch.Algorithm,
+			"expected":  mismatch.Expected,
+			"actual":    mismatch.Actual,
+		})
+	case errors.Is(err, errVaultGone):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found"})
+	case errors.Is(err, errBlobBusy):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Could not upload file, try again"})
+	case errors.Is(err, errFileTooLarge):
+		response := gin.H{"error": "File size exceeds your plan's limit"}
+		if limits, err := userLimits(c, userID); err == nil {
+			response["max_file_size"] = limits.MaxFileSize
+		}
+		c.JSON(http.StatusBadRequest, response)
+	case errors.Is(err, errStorageFull):
+		response := gin.H{"error": "Upload would exceed your plan's storage limit"}
+		if storage, err := getUserStorage(c, userID); err == nil {
+			response["max_storage"] = storage.MaxSpace
+			response["current_usage"] = storage.UsedSpace
+			response["reserved"] = storage.ReservedSpace
+		}
+		c.JSON(http.StatusBadRequest, response)
+	default:
+		log.Printf("Upload failed for user %s: %v", userID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not upload file"})
+	}
 }
 
 // GetFiles retrieves files for the authenticated user
@@ -166,7 +171,7 @@ func GetFiles(c *gin.Context) {
 	userID, _ := primitive.ObjectIDFromHex(userIDString)
 
 	folderID := c.Query("folder_id")
-	filter := bson.M{"user_id": userID}
+	filter := bson.M{"user_id": userID, "trashed_at": bson.M{"$exists": false}}
 
 	if folderID != "" {
 		folderObjID, err := primitive.ObjectIDFromHex(folderID)
@@ -217,8 +222,9 @@ func DownloadFile(c *gin.Context) {
 	collection := utils.GetCollection("files")
 	var file models.File
 	err = collection.FindOne(c, bson.M{
-		"_id":     fileObjID,
-		"user_id": userID,
+		"_id":        fileObjID,
+		"user_id":    userID,
+		"trashed_at": bson.M{"$exists": false},
 	}).Decode(&file)
 
 	if err != nil {
@@ -226,7 +232,20 @@ func DownloadFile(c *gin.Context) {
 		return
 	}
 
-	// Check if signed URL is explicitly requested
+	if rejectBlockedContent(c, &file) {
+		return
+	}
+
+	// Check if signed URL is explicitly requested. Encrypted files can only
+	// be read through the API, so they always use the proxy.
+	if c.Query("redirect") == "true" && file.Encryption != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"download_url": fmt.Sprintf("/api/files/%s/download", fileID),
+			"expires_in":   "session",
+			"method":       "proxy",
+		})
+		return
+	}
 	if c.Query("redirect") == "true" {
 		// Try to generate signed URL for redirect
 		signedURL, err := utils.GenerateSignedURL(c, file.Path, time.Hour)
@@ -249,25 +268,9 @@ func DownloadFile(c *gin.Context) {
 		return
 	}
 
-	// Default behavior: Direct proxy download through our server
-	reader, err := utils.DownloadFromGCS(c, file.Path)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not download file"})
-		return
-	}
-	defer reader.Close()
-
-	// Set appropriate headers for file download
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", file.OriginalName))
-	c.Header("Content-Type", file.ContentType)
-	c.Header("Content-Length", fmt.Sprintf("%d", file.Size))
-
-	// Stream the file directly to the client
-	_, err = io.Copy(c.Writer, reader)
-	if err != nil {
-		// Log error but don't send JSON response as headers are already sent
-		fmt.Printf("Error streaming file: %v\n", err)
-	}
+	// Default behavior: Direct proxy download through our server.
+	// ?inline=true lets the browser display allowlisted types.
+	serveFileContent(c, &file, c.Query("inline") == "true")
 }
 
 // DeleteFile deletes a file from GCS and database
@@ -283,7 +286,7 @@ func DeleteFile(c *gin.Context) {
 	userIDString := userIDInterface.(string)
 	userID, _ := primitive.ObjectIDFromHex(userIDString)
 
-	// Find file record
+	// Find file record; files in the trash can be deleted for good too
 	collection := utils.GetCollection("files")
 	var file models.File
 	err = collection.FindOne(c, bson.M{
@@ -296,27 +299,13 @@ func DeleteFile(c *gin.Context) {
 		return
 	}
 
-	// Delete file from database first
-	_, err = collection.DeleteOne(c, bson.M{
-		"_id":     fileObjID,
-		"user_id": userID,
-	})
-
-	if err != nil {
+	// Delete the record, then the stored content
+	if _, err := removeFile(c, &file, bson.M{"_id": fileObjID, "user_id": userID}); err != nil {
+		log.Printf("Could not delete file %s: %v", file.ID.Hex(), err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete file record"})
 		return
 	}
 
-	// Delete file from Google Cloud Storage
-	err = utils.DeleteFromGCS(c, file.Path)
-	if err != nil {
-		// Log error but don't fail the request since DB record is already deleted
-		fmt.Printf("Warning: Could not delete file from GCS: %v\n", err)
-	}
-
-	// Update user storage stats
-	updateUserStorage(c, userID, -file.Size, 0, -1)
-
 	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
 }
 
@@ -339,12 +328,6 @@ func GetStorageInfo(c *gin.Context) {
 		return
 	}
 
-	// Recalculate storage from actual files and folders
-	err = recalculateUserStorage(c, userID)
-	if err != nil {
-		log.Printf("Warning: Could not recalculate storage: %v", err)
-	}
-
 	storage, err := getUserStorage(c, userID)
 	if err != nil {
 		log.Printf("ERROR: Could not get storage for user %s: %v", userIDString, err)
@@ -360,9 +343,17 @@ func GetStorageInfo(c *gin.Context) {
 		usagePercentage = float64(storage.UsedSpace) / float64(storage.MaxSpace) * 100
 	}
 
+	plan, overrides, err := userPlan(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve storage info"})
+		return
+	}
+
 	response := gin.H{
 		"storage":          storage,
 		"usage_percentage": usagePercentage,
+		"plan":             plan,
+		"limits":           overrides.Apply(plan.PlanLimits),
 	}
 
 	log.Printf("Sending storage response: %+v", response)
@@ -370,108 +361,162 @@ func GetStorageInfo(c *gin.Context) {
 }
 
 // Helper function to get user storage information
-func getUserStorage(c *gin.Context, userID primitive.ObjectID) (*models.UserStorage, error) {
+func getUserStorage(ctx context.Context, userID primitive.ObjectID) (*models.UserStorage, error) {
 	collection := utils.GetCollection("user_storage")
 	var storage models.UserStorage
 
 	log.Printf("Looking up storage for user: %s", userID.Hex())
-	err := collection.FindOne(c, bson.M{"user_id": userID}).Decode(&storage)
+	err := collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&storage)
 	if err != nil {
 		log.Printf("Storage record not found for user %s, creating new one: %v", userID.Hex(), err)
 		// Create default storage record if it doesn't exist
 		storage = models.UserStorage{
 			UserID:      userID,
 			UsedSpace:   0,
-			MaxSpace:    MaxStorageSize,
 			FileCount:   0,
 			FolderCount: 0,
 			UpdatedAt:   time.Now(),
 		}
 
-		result, insertErr := collection.InsertOne(c, storage)
-		if insertErr != nil {
+		result, insertErr := collection.InsertOne(ctx, storage)
+		if mongo.IsDuplicateKeyError(insertErr) {
+			// created concurrently
+			if err := collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&storage); err != nil {
+				return nil, err
+			}
+		} else if insertErr != nil {
 			log.Printf("Failed to create storage record for user %s: %v", userID.Hex(), insertErr)
 			return nil, insertErr
+		} else {
+			log.Printf("Created new storage record for user %s: %v", userID.Hex(), result.InsertedID)
 		}
-		log.Printf("Created new storage record for user %s: %v", userID.Hex(), result.InsertedID)
 	} else {
 		log.Printf("Found existing storage record for user %s: %+v", userID.Hex(), storage)
-		log.Printf("Storage values - UsedSpace: %d, MaxSpace: %d", storage.UsedSpace, storage.MaxSpace)
-
-		// Fix any storage records with invalid MaxSpace
-		if storage.MaxSpace <= 0 {
-			log.Printf("Fixing invalid MaxSpace for user %s", userID.Hex())
-			storage.MaxSpace = MaxStorageSize
-			collection.UpdateOne(c, bson.M{"user_id": userID}, bson.M{
-				"$set": bson.M{"max_space": MaxStorageSize, "updated_at": time.Now()},
-			})
-		}
 	}
 
+	// the limit isn't stored with the counters, it follows the user's plan
+	limits, err := userLimits(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	storage.MaxSpace = limits.MaxStorage
+
 	return &storage, nil
 }
 
-// recalculateUserStorage recalculates storage from actual files and folders
-func recalculateUserStorage(c *gin.Context, userID primitive.ObjectID) error {
-	// Calculate total file size
-	fileCollection := utils.GetCollection("files")
-	pipeline := []bson.M{
-		{"$match": bson.M{"user_id": userID}},
-		{"$group": bson.M{
-			"_id":       nil,
-			"totalSize": bson.M{"$sum": "$size"},
-			"fileCount": bson.M{"$sum": 1},
-		}},
-	}
+// recalculateUserStorage recalculates storage from actual files and folders.
+// The counters are kept exact by the transactions that change them, so this
+// is only needed to repair counters from before those existed.
+func recalculateUserStorage(ctx context.Context, userID primitive.ObjectID) error {
+	// a transaction reads a consistent snapshot, and conflicts with
+	// uploads and deletions that change the counters meanwhile
+	return utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		// Calculate total file size
+		fileCollection := utils.GetCollection("files")
+		pipeline := []bson.M{
+			{"$match": bson.M{"user_id": userID}},
+			{"$group": bson.M{
+				"_id":       nil,
+				"totalSize": bson.M{"$sum": "$size"},
+				"fileCount": bson.M{"$sum": 1},
+			}},
+		}
 
-	cursor, err := fileCollection.Aggregate(c, pipeline)
-	if err != nil {
-		return fmt.Errorf("could not aggregate file sizes: %v", err)
-	}
-	defer cursor.Close(c)
+		cursor, err := fileCollection.Aggregate(sessCtx, pipeline)
+		if err != nil {
+			return fmt.Errorf("could not aggregate file sizes: %v", err)
+		}
+		defer cursor.Close(sessCtx)
 
-	var result struct {
-		TotalSize int64 `bson:"totalSize"`
-		FileCount int   `bson:"fileCount"`
-	}
+		var result struct {
+			TotalSize int64 `bson:"totalSize"`
+			FileCount int   `bson:"fileCount"`
+		}
 
-	if cursor.Next(c) {
-		if err := cursor.Decode(&result); err != nil {
-			return fmt.Errorf("could not decode aggregation result: %v", err)
+		if cursor.Next(sessCtx) {
+			if err := cursor.Decode(&result); err != nil {
+				return fmt.Errorf("could not decode aggregation result: %v", err)
+			}
 		}
-	}
 
-	// Count folders
-	folderCollection := utils.GetCollection("folders")
-	folderCount, err := folderCollection.CountDocuments(c, bson.M{"user_id": userID})
-	if err != nil {
-		return fmt.Errorf("could not count folders: %v", err)
-	}
-
-	// Update storage record
-	storageCollection := utils.GetCollection("user_storage")
-	_, err = storageCollection.UpdateOne(
-		c,
-		bson.M{"user_id": userID},
-		bson.M{
-			"$set": bson.M{
-				"used_space":   result.TotalSize,
-				"file_count":   result.FileCount,
-				"folder_count": int(folderCount),
-				"updated_at":   time.Now(),
+		// Count folders
+		folderCollection := utils.GetCollection("folders")
+		folderCount, err := folderCollection.CountDocuments(sessCtx, bson.M{"user_id": userID})
+		if err != nil {
+			return fmt.Errorf("could not count folders: %v", err)
+		}
+
+		// Bytes held by uploads in progress
+		reservations, err := utils.GetCollection("quota_reservations").Aggregate(sessCtx, []bson.M{
+			{"$match": bson.M{"user_id": userID}},
+			{"$group": bson.M{"_id": nil, "reserved": bson.M{"$sum": "$size"}}},
+		})
+		if err != nil {
+			return fmt.Errorf("could not aggregate reservations: %v", err)
+		}
+		defer reservations.Close(sessCtx)
+
+		var reserved struct {
+			Reserved int64 `bson:"reserved"`
+		}
+		if reservations.Next(sessCtx) {
+			if err := reservations.Decode(&reserved); err != nil {
+				return fmt.Errorf("could not decode reservations: %v", err)
+			}
+		}
+
+		// Update storage record
+		storageCollection := utils.GetCollection("user_storage")
+		_, err = storageCollection.UpdateOne(
+			sessCtx,
+			bson.M{"user_id": userID},
+			bson.M{
+				"$set": bson.M{
+					"used_space":     result.TotalSize,
+					"reserved_space": reserved.Reserved,
+					"file_count":     result.FileCount,
+					"folder_count":   int(folderCount),
+					"updated_at":     time.Now(),
+				},
 			},
-		},
-		options.Update().SetUpsert(true),
-	)
+			options.Update().SetUpsert(true),
+		)
+
+		if err != nil {
+			return fmt.Errorf("could not update storage record: %v", err)
+		}
+
+		log.Printf("Recalculated storage for user %s - Size: %d bytes, Files: %d, Folders: %d",
+			userID.Hex(), result.TotalSize, result.FileCount, int(folderCount))
+		return nil
+	})
+}
 
+// RecalculateUserStorage lets an admin rebuild a user's usage counters from
+// their files and folders
+func RecalculateUserStorage(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
 	if err != nil {
-		return fmt.Errorf("could not update storage record: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := recalculateUserStorage(c, userID); err != nil {
+		log.Printf("Could not recalculate storage for user %s: %v", userID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not recalculate storage"})
+		return
 	}
 
-	fmt.Printf("DEBUG: Recalculated storage for user %s - Size: %d bytes, Files: %d, Folders: %d\n",
-		userID.Hex(), result.TotalSize, result.FileCount, int(folderCount))
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+	recordAudit(c, adminID, "admin.storage_recalculated", map[string]interface{}{"user_id": userID.Hex()})
 
-	return nil
+	storage, err := getUserStorage(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve storage info"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"storage": storage})
 }
 
 // ToggleFavorite toggles the favorite status of a file
@@ -505,8 +550,9 @@ func ToggleFavorite(c *gin.Context) {
 	collection := utils.GetCollection("files")
 	var file models.File
 	err = collection.FindOne(c, bson.M{
-		"_id":     fileObjID,
-		"user_id": userID,
+		"_id":        fileObjID,
+		"user_id":    userID,
+		"trashed_at": bson.M{"$exists": false},
 	}).Decode(&file)
 
 	if err != nil {
@@ -553,6 +599,7 @@ func GetFavoriteFiles(c *gin.Context) {
 	cursor, err := collection.Find(c, bson.M{
 		"user_id":     userID,
 		"is_favorite": true,
+		"trashed_at":  bson.M{"$exists": false},
 	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve favorite files"})
@@ -1,6 +1,10 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"time"
 
@@ -9,6 +13,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errFolderNotFound = errors.New("folder not found")
+	errVaultNotEmpty  = errors.New("vault is not empty")
 )
 
 // CreateFolder creates a new folder for the authenticated user
@@ -65,6 +76,10 @@ func CreateFolder(c *gin.Context) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Parent folder not found"})
 			return
 		}
+		if parentFolder.Vault != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Encrypted vaults can't contain folders"})
+			return
+		}
 
 		folder.ParentID = &parentID
 		folder.Path = parentFolder.Path + "/" + folderRequest.Name
@@ -86,16 +101,18 @@ func CreateFolder(c *gin.Context) {
 		return
 	}
 
-	// Create folder
-	_, err = collection.InsertOne(c, folder)
+	// Create folder and update user storage stats together
+	err = utils.WithTransaction(c, func(sessCtx mongo.SessionContext) error {
+		if _, err := collection.InsertOne(sessCtx, folder); err != nil {
+			return err
+		}
+		return updateUserStorage(sessCtx, userID, 0, 1, 0)
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create folder"})
 		return
 	}
 
-	// Update user storage stats
-	updateUserStorage(c, userID, 0, 1, 0)
-
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Folder created successfully",
 		"folder":  folder,
@@ -168,54 +185,68 @@ func DeleteFolder(c *gin.Context) {
 		return
 	}
 
-	// Delete folder
-	_, err = collection.DeleteOne(c, bson.M{
-		"_id":     folderObjID,
-		"user_id": userID,
+	// Delete folder, its vault membership and update user storage stats together
+	err = utils.WithTransaction(c, func(sessCtx mongo.SessionContext) error {
+		if folder.Vault != nil {
+			// members can't reach files of a deleted vault any more, so
+			// they have to be deleted first
+			files, err := utils.GetCollection("files").CountDocuments(sessCtx, bson.M{"vault_id": folder.ID})
+			if err != nil {
+				return err
+			}
+			if files > 0 {
+				return errVaultNotEmpty
+			}
+		}
+		result, err := collection.DeleteOne(sessCtx, bson.M{
+			"_id":     folderObjID,
+			"user_id": userID,
+		})
+		if err != nil {
+			return err
+		}
+		if result.DeletedCount == 0 {
+			return errFolderNotFound
+		}
+		if folder.Vault != nil {
+			if err := deleteVaultRecords(sessCtx, folder.ID); err != nil {
+				return err
+			}
+		}
+		return updateUserStorage(sessCtx, userID, 0, -1, 0)
 	})
-
+	if errors.Is(err, errVaultNotEmpty) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Vault is not empty, delete its files first"})
+		return
+	}
+	if errors.Is(err, errFolderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
 	if err != nil {
+		log.Printf("Could not delete folder %s: %v", folder.ID.Hex(), err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete folder"})
 		return
 	}
 
-	// Update user storage stats
-	updateUserStorage(c, userID, 0, -1, 0)
-
 	c.JSON(http.StatusOK, gin.H{"message": "Folder deleted successfully"})
 }
 
-// Helper function to update user storage statistics
-func updateUserStorage(c *gin.Context, userID primitive.ObjectID, sizeChange int64, folderChange int, fileChange int) {
-	collection := utils.GetCollection("user_storage")
-
-	// Try to find existing storage record
-	var storage models.UserStorage
-	err := collection.FindOne(c, bson.M{"user_id": userID}).Decode(&storage)
-
+// updateUserStorage adjusts the user's usage counters. Callers run it in
+// the transaction that makes the change, so the counters stay exact.
+func updateUserStorage(ctx context.Context, userID primitive.ObjectID, sizeChange int64, folderChange int, fileChange int) error {
+	_, err := utils.GetCollection("user_storage").UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{
+		"$inc": bson.M{
+			"used_space":   sizeChange,
+			"file_count":   fileChange,
+			"folder_count": folderChange,
+		},
+		"$set": bson.M{
+			"updated_at": time.Now(),
+		},
+	}, options.Update().SetUpsert(true))
 	if err != nil {
-		// Create new storage record
-		storage = models.UserStorage{
-			UserID:      userID,
-			UsedSpace:   sizeChange,
-			MaxSpace:    2147483648, // 2GB in bytes
-			FileCount:   fileChange,
-			FolderCount: folderChange,
-			UpdatedAt:   time.Now(),
-		}
-		collection.InsertOne(c, storage)
-	} else {
-		// Update existing record
-		update := bson.M{
-			"$inc": bson.M{
-				"used_space":   sizeChange,
-				"file_count":   fileChange,
-				"folder_count": folderChange,
-			},
-			"$set": bson.M{
-				"updated_at": time.Now(),
-			},
-		}
-		collection.UpdateOne(c, bson.M{"user_id": userID}, update)
+		return fmt.Errorf("could not update storage usage: %v", err)
 	}
+	return nil
 }
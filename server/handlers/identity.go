@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+const (
+	linkRequestTTL = 10 * time.Minute
+	// linkCookie binds a link request to the browser that started it
+	linkCookie = "oauth_link"
+	// accounts without a password re-authenticate by having logged in recently
+	reauthMaxAge = 10 * time.Minute
+)
+
+// GetIdentities lists the external logins linked to the current user
+func GetIdentities(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var user models.User
+	if err := utils.GetCollection("users").FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	cursor, err := utils.GetCollection("identities").Find(c, bson.M{"user_id": userID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve identities"})
+		return
+	}
+	defer cursor.Close(c)
+
+	identities := []models.Identity{}
+	if err = cursor.All(c, &identities); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not decode identities"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"identities":   identities,
+		"has_password": user.Password != "",
+	})
+}
+
+// StartIdentityLink begins an explicit link of an external provider to the
+// signed-in account. The caller must re-authenticate first.
+func StartIdentityLink(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	c.ShouldBindJSON(&req)
+
+	providerName := c.Param("provider")
+	provider, ok := utils.GetOIDCProvider(providerName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var user models.User
+	if err := utils.GetCollection("users").FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !reauthenticate(c, &user, req.Password) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Re-authentication required"})
+		return
+	}
+
+	link := models.OIDCLinkRequest{
+		State:     generateRandomState(),
+		UserID:    userID,
+		Provider:  providerName,
+		Nonce:     generateRandomState(),
+		Verifier:  oauth2.GenerateVerifier(),
+		ExpiresAt: time.Now().Add(linkRequestTTL),
+	}
+	if _, err := utils.GetCollection("oidc_link_requests").InsertOne(c, link); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start link"})
+		return
+	}
+
+	c.SetCookie(linkCookie, linkBinding(&link), int(linkRequestTTL.Seconds()), "/", "", false, true)
+	c.JSON(http.StatusOK, gin.H{"auth_url": provider.AuthCodeURL(link.State, link.Nonce, link.Verifier)})
+}
+
+// UnlinkIdentity removes an external login, refusing to remove the last way
+// the user can sign in
+func UnlinkIdentity(c *gin.Context) {
+	identityObjID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity ID"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var user models.User
+	if err := utils.GetCollection("users").FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	collection := utils.GetCollection("identities")
+	var identity models.Identity
+	err = collection.FindOne(c, bson.M{"_id": identityObjID, "user_id": userID}).Decode(&identity)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+		return
+	}
+
+	if user.Password == "" {
+		count, err := collection.CountDocuments(c, bson.M{"user_id": userID})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not check remaining logins"})
+			return
+		}
+		if count <= 1 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove your only way to sign in"})
+			return
+		}
+	}
+
+	if _, err := collection.DeleteOne(c, bson.M{"_id": identityObjID, "user_id": userID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not unlink identity"})
+		return
+	}
+
+	// drop the legacy pointer too, otherwise the next Google login would relink it
+	if identity.Provider == "google" && user.GoogleID == identity.Subject {
+		utils.GetCollection("users").UpdateOne(c, bson.M{"_id": userID}, bson.M{"$unset": bson.M{"google_id": ""}})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Identity unlinked"})
+}
+
+var (
+	errNoLinkRequest  = errors.New("no link request for this state")
+	errLinkNotStarted = errors.New("link was not started in this browser")
+)
+
+// consumeLinkRequest claims the link request for state. The browser must
+// carry the cookie StartIdentityLink set, otherwise anyone could send a
+// victim through their own link URL and attach the victim's provider account
+// to theirs. It returns errNoLinkRequest when state belongs to a login.
+func consumeLinkRequest(c *gin.Context, providerName, state string) (*models.OIDCLinkRequest, error) {
+	if state == "" {
+		return nil, errNoLinkRequest
+	}
+
+	filter := bson.M{
+		"_id":        state,
+		"provider":   providerName,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	collection := utils.GetCollection("oidc_link_requests")
+
+	var link models.OIDCLinkRequest
+	err := collection.FindOne(c, filter).Decode(&link)
+	if err == mongo.ErrNoDocuments {
+		return nil, errNoLinkRequest
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !linkCookieMatches(c, &link) {
+		return nil, errLinkNotStarted
+	}
+
+	c.SetCookie(linkCookie, "", -1, "/", "", false, true)
+	if err := collection.FindOneAndDelete(c, filter).Err(); err != nil {
+		// used by a concurrent callback
+		return nil, errNoLinkRequest
+	}
+	return &link, nil
+}
+
+// linkBinding is the value of the link cookie: a hash of the request's
+// secrets, so the cookie alone is no use to anyone who reads it
+func linkBinding(link *models.OIDCLinkRequest) string {
+	sum := sha256.Sum256([]byte(link.State + "\x00" + link.Nonce + "\x00" + link.Verifier))
+	return hex.EncodeToString(sum[:])
+}
+
+func linkCookieMatches(c *gin.Context, link *models.OIDCLinkRequest) bool {
+	cookie, err := c.Cookie(linkCookie)
+	return err == nil && subtle.ConstantTimeCompare([]byte(cookie), []byte(linkBinding(link))) == 1
+}
+
+func finishIdentityLink(c *gin.Context, provider *utils.OIDCProvider, link *models.OIDCLinkRequest) {
+	claims, err := provider.Exchange(c, c.Query("code"), link.Nonce, link.Verifier)
+	if err != nil {
+		log.Printf("OIDC link exchange with %s failed: %v", provider.Name, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to verify login with provider"})
+		return
+	}
+
+	var existing models.Identity
+	err = utils.GetCollection("identities").FindOne(c, bson.M{
+		"provider": provider.Name,
+		"subject":  claims.Subject,
+	}).Decode(&existing)
+	if err == nil {
+		if existing.UserID == link.UserID {
+			c.JSON(http.StatusOK, gin.H{"message": "Identity already linked", "identity": existing})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "This login is already linked to another account"})
+		return
+	}
+	if err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not look up identity"})
+		return
+	}
+
+	identity, err := createIdentity(c, link.UserID, provider.Name, claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not link identity"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Identity linked", "identity": identity})
+}
+
+// reauthenticate confirms the caller is the account owner before a sensitive
+// change: their password when the account has one, otherwise a recent login
+func reauthenticate(c *gin.Context, user *models.User, password string) bool {
+	if user.Password != "" {
+		return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+	}
+
+	authTime, ok := c.Get("authTime")
+	return ok && time.Since(authTime.(time.Time)) < reauthMaxAge
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// callbackContext builds the context of an OIDC callback, optionally
+// carrying the link cookie
+func callbackContext(cookie string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/auth/oidc/test/callback", nil)
+	if cookie != "" {
+		c.Request.AddCookie(&http.Cookie{Name: linkCookie, Value: cookie})
+	}
+	return c, w
+}
+
+func TestLinkCookieMatches(t *testing.T) {
+	link := &models.OIDCLinkRequest{State: "state", Nonce: "nonce", Verifier: "verifier"}
+	other := &models.OIDCLinkRequest{State: "state", Nonce: "nonce", Verifier: "other"}
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   bool
+	}{
+		{"no cookie", "", false},
+		{"matching", linkBinding(link), true},
+		{"another request's", linkBinding(other), false},
+		{"raw state", "state", false},
+	}
+	for _, tt := range tests {
+		c, _ := callbackContext(tt.cookie)
+		if got := linkCookieMatches(c, link); got != tt.want {
+			t.Errorf("%s: linkCookieMatches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter22"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		given    string
+		authTime *time.Time
+		want     bool
+	}{
+		{"right password", string(hash), "hunter22", nil, true},
+		{"wrong password", string(hash), "hunter2", nil, false},
+		{"recent login does not replace the password", string(hash), "", ptrTime(time.Now()), false},
+		{"passwordless, recent login", "", "", ptrTime(time.Now().Add(-time.Minute)), true},
+		{"passwordless, old login", "", "", ptrTime(time.Now().Add(-time.Hour)), false},
+		{"passwordless, unknown login time", "", "", nil, false},
+	}
+	for _, tt := range tests {
+		c, _ := callbackContext("")
+		if tt.authTime != nil {
+			c.Set("authTime", *tt.authTime)
+		}
+		user := &models.User{Password: tt.password}
+		if got := reauthenticate(c, user, tt.given); got != tt.want {
+			t.Errorf("%s: reauthenticate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func ptrTime(t time.Time) *time.Time {
+	return &t
+}
+
+func TestConsumeLinkRequestRequiresCookie(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	collection := utils.GetCollection("oidc_link_requests")
+
+	link := models.OIDCLinkRequest{
+		State:     "test-" + primitive.NewObjectID().Hex(),
+		UserID:    primitive.NewObjectID(),
+		Provider:  "test",
+		Nonce:     "nonce",
+		Verifier:  "verifier",
+		ExpiresAt: time.Now().Add(linkRequestTTL),
+	}
+	if _, err := collection.InsertOne(ctx, link); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { collection.DeleteOne(ctx, bson.M{"_id": link.State}) })
+
+	// a victim sent through the attacker's auth URL has no cookie
+	c, _ := callbackContext("")
+	if _, err := consumeLinkRequest(c, "test", link.State); !errors.Is(err, errLinkNotStarted) {
+		t.Fatalf("callback without cookie: error = %v, want errLinkNotStarted", err)
+	}
+	c, _ = callbackContext(linkBinding(&models.OIDCLinkRequest{State: link.State}))
+	if _, err := consumeLinkRequest(c, "test", link.State); !errors.Is(err, errLinkNotStarted) {
+		t.Fatalf("callback with the wrong cookie: error = %v, want errLinkNotStarted", err)
+	}
+
+	c, w := callbackContext(linkBinding(&link))
+	got, err := consumeLinkRequest(c, "test", link.State)
+	if err != nil {
+		t.Fatalf("callback with cookie: %v", err)
+	}
+	if got.UserID != link.UserID {
+		t.Errorf("link request for user %s, want %s", got.UserID.Hex(), link.UserID.Hex())
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != linkCookie || cookies[0].MaxAge >= 0 {
+		t.Errorf("link cookie was not cleared: %v", cookies)
+	}
+
+	// each request is used once
+	c, _ = callbackContext(linkBinding(&link))
+	if _, err := consumeLinkRequest(c, "test", link.State); !errors.Is(err, errNoLinkRequest) {
+		t.Errorf("second callback: error = %v, want errNoLinkRequest", err)
+	}
+}
+
+func TestUnlinkIdentityKeepsLastLogin(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+
+	userID := primitive.NewObjectID()
+	if _, err := utils.GetCollection("users").InsertOne(ctx, models.User{ID: userID, Email: userID.Hex() + "@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	for i, id := range []primitive.ObjectID{first, second} {
+		_, err := utils.GetCollection("identities").InsertOne(ctx, models.Identity{
+			ID: id, UserID: userID, Provider: "test", Subject: userID.Hex() + string(rune('a'+i)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		utils.GetCollection("users").DeleteOne(ctx, bson.M{"_id": userID})
+		utils.GetCollection("identities").DeleteMany(ctx, bson.M{"user_id": userID})
+	})
+
+	unlink := func(id primitive.ObjectID) int {
+		c, w := callbackContext("")
+		c.Set("userID", userID.Hex())
+		c.Params = gin.Params{{Key: "id", Value: id.Hex()}}
+		UnlinkIdentity(c)
+		return w.Code
+	}
+
+	if code := unlink(first); code != http.StatusOK {
+		t.Errorf("unlinking one of two logins: status %d, want 200", code)
+	}
+	// a passwordless account must keep one way to sign in
+	if code := unlink(second); code != http.StatusConflict {
+		t.Errorf("unlinking the last login: status %d, want 409", code)
+	}
+	if code := unlink(first); code != http.StatusNotFound {
+		t.Errorf("unlinking an unlinked identity: status %d, want 404", code)
+	}
+}
@@ -0,0 +1,497 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxImportEntries = 10000
+	// entries (or tar.gz streams) that expand more than this are treated as bombs
+	maxCompressionRatio = 100
+	// below this size the ratio check is skipped, tiny files compress absurdly well
+	compressionRatioMinSize = 1024 * 1024
+)
+
+const (
+	importImported = "imported"
+	importSkipped  = "skipped"
+	importFailed   = "failed"
+)
+
+var (
+	errUnsafePath  = errors.New("unsafe path")
+	errArchiveBomb = errors.New("archive expands beyond the allowed limits")
+	errVaultTarget = errors.New("folder is an encrypted vault")
+)
+
+// importResult is one line of the per-entry import report
+type importResult struct {
+	Path     string              `json:"path"`
+	Status   string              `json:"status"`
+	FileID   *primitive.ObjectID `json:"file_id,omitempty"`
+	FolderID *primitive.ObjectID `json:"folder_id,omitempty"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// archiveImport extracts entries into a folder tree, creating folders as
+// needed and running each file through saveFile
+type archiveImport struct {
+	userID   primitive.ObjectID
+	root     *primitive.ObjectID
+	rootPath string
+	// the user's plan; no entry may exceed its file size limit and the
+	// whole archive may not expand beyond the storage limit
+	limits models.PlanLimits
+	// folder IDs by directory path relative to root
+	folders  map[string]*primitive.ObjectID
+	entries  int
+	expanded int64
+	report   []importResult
+}
+
+func newArchiveImport(ctx context.Context, userID primitive.ObjectID, root *primitive.ObjectID, limits models.PlanLimits) (*archiveImport, error) {
+	imp := &archiveImport{
+		userID:  userID,
+		root:    root,
+		limits:  limits,
+		folders: map[string]*primitive.ObjectID{"": root},
+		report:  []importResult{},
+	}
+
+	if root != nil {
+		var folder models.Folder
+		if err := utils.GetCollection("folders").FindOne(ctx, bson.M{"_id": *root, "user_id": userID}).Decode(&folder); err != nil {
+			return nil, err
+		}
+		imp.rootPath = folder.Path
+	}
+	return imp, nil
+}
+
+// ImportArchive unpacks an uploaded ZIP or tar.gz into a folder
+func ImportArchive(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	limits, err := userLimits(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not import archive"})
+		return
+	}
+
+	// archives themselves may be as large as the whole quota
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limits.MaxStorage)
+	if err := c.Request.ParseMultipartForm(maxMultipartMemory); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Archive too large or invalid form data"})
+		return
+	}
+	defer c.Request.MultipartForm.RemoveAll()
+
+	archive, header, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No archive provided"})
+		return
+	}
+	defer archive.Close()
+
+	folderID, ok := resolveFolderParam(c, userID, c.PostForm("folder_id"))
+	if !ok {
+		return
+	}
+
+	imp, err := newArchiveImport(c, userID, folderID, limits)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+
+	name := strings.ToLower(header.Filename)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		err = imp.importZip(c, archive, header.Size)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		err = imp.importTarGz(c, archive, header.Size)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported archive type, expected .zip or .tar.gz"})
+		return
+	}
+
+	if err != nil && !errors.Is(err, errArchiveBomb) && !errors.Is(err, errStorageFull) {
+		log.Printf("Import for user %s stopped: %v", userID.Hex(), err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "Could not read archive",
+			"report": imp.report,
+		})
+		return
+	}
+
+	response := gin.H{
+		"message": "Import finished",
+		"summary": imp.summary(),
+		"report":  imp.report,
+	}
+	if err != nil {
+		response["message"] = "Import stopped early"
+		response["error"] = err.Error()
+	}
+
+	recordAudit(c, userID, "files.imported", map[string]interface{}{
+		"archive": header.Filename,
+		"summary": imp.summary(),
+	})
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (imp *archiveImport) importZip(ctx context.Context, r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if err := imp.addZipEntry(ctx, f, f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addZipEntry imports a single ZIP entry, reading it through open. Only errors
+// that should abort the whole archive are returned; everything else goes into
+// the report.
+func (imp *archiveImport) addZipEntry(ctx context.Context, f *zip.File, open func() (io.ReadCloser, error)) error {
+	if f.FileInfo().IsDir() {
+		return imp.addDir(ctx, f.Name)
+	}
+	if !f.Mode().IsRegular() {
+		imp.skip(f.Name, "not a regular file")
+		return nil
+	}
+
+	if f.UncompressedSize64 > uint64(imp.limits.MaxFileSize) {
+		imp.skip(f.Name, errFileTooLarge.Error())
+		return nil
+	}
+	if f.UncompressedSize64 > compressionRatioMinSize &&
+		f.UncompressedSize64 > f.CompressedSize64*maxCompressionRatio {
+		imp.fail(f.Name, errArchiveBomb)
+		return nil
+	}
+
+	rc, err := open()
+	if err != nil {
+		imp.fail(f.Name, err)
+		return nil
+	}
+	defer rc.Close()
+
+	return imp.addFile(ctx, f.Name, rc)
+}
+
+func (imp *archiveImport) importTarGz(ctx context.Context, r io.Reader, size int64) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	// the ratio check has to cover the whole stream since tar entries
+	// don't carry a compressed size
+	tr := tar.NewReader(&ratioLimitedReader{r: gz, limit: ratioLimit(size, imp.limits.MaxStorage)})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := imp.addDir(ctx, hdr.Name); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if hdr.Size > imp.limits.MaxFileSize {
+				imp.skip(hdr.Name, errFileTooLarge.Error())
+				continue
+			}
+			if err := imp.addFile(ctx, hdr.Name, tr); err != nil {
+				return err
+			}
+		default:
+			imp.skip(hdr.Name, "not a regular file")
+		}
+	}
+}
+
+func (imp *archiveImport) addDir(ctx context.Context, name string) error {
+	dir, err := cleanArchivePath(name)
+	if err != nil {
+		imp.fail(name, err)
+		return nil
+	}
+	if dir == "." {
+		// the archive's own root, which many archivers write as "./"
+		return nil
+	}
+	if err := imp.countEntry(); err != nil {
+		return err
+	}
+	if _, err := imp.ensureFolder(ctx, dir); err != nil {
+		imp.fail(name, err)
+	}
+	return nil
+}
+
+// addFile spools one entry to a temp file, capped at the file size limit, and
+// saves it
+func (imp *archiveImport) addFile(ctx context.Context, name string, r io.Reader) error {
+	clean, err := cleanArchivePath(name)
+	if err == nil && clean == "." {
+		err = errUnsafePath
+	}
+	if err != nil {
+		imp.fail(name, err)
+		return nil
+	}
+	if err := imp.countEntry(); err != nil {
+		return err
+	}
+
+	dir, base := path.Split(clean)
+	folderID, err := imp.ensureFolder(ctx, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		imp.fail(name, err)
+		return nil
+	}
+
+	tmp, err := os.CreateTemp("", "driftbox-import-*")
+	if err != nil {
+		return fmt.Errorf("could not create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	written, err := io.Copy(tmp, io.LimitReader(r, imp.limits.MaxFileSize+1))
+	imp.expanded += written
+	if errors.Is(err, errArchiveBomb) {
+		imp.fail(name, err)
+		return err
+	}
+	if err != nil {
+		imp.fail(name, err)
+		return nil
+	}
+	if written > imp.limits.MaxFileSize {
+		imp.skip(name, errFileTooLarge.Error())
+		return nil
+	}
+	if imp.expanded > imp.limits.MaxStorage {
+		imp.fail(name, errArchiveBomb)
+		return errArchiveBomb
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		imp.fail(name, err)
+		return nil
+	}
+
+	file, err := saveFile(ctx, fileUpload{
+		UserID:      imp.userID,
+		FolderID:    folderID,
+		Name:        base,
+		ContentType: contentTypeForName(base),
+		Size:        written,
+		Content:     tmp,
+	})
+
+	switch {
+	case errors.Is(err, errStorageFull):
+		// nothing after this will fit either
+		imp.fail(name, err)
+		return err
+	case err != nil:
+		imp.fail(name, err)
+	default:
+		imp.report = append(imp.report, importResult{
+			Path:     name,
+			Status:   importImported,
+			FileID:   &file.ID,
+			FolderID: file.FolderID,
+		})
+	}
+	return nil
+}
+
+// ensureFolder returns the folder for dir (relative to the import root),
+// reusing existing folders with the same name and creating missing ones.
+// Plaintext is never imported into an existing vault of the same name.
+func (imp *archiveImport) ensureFolder(ctx context.Context, dir string) (*primitive.ObjectID, error) {
+	if id, ok := imp.folders[dir]; ok {
+		return id, nil
+	}
+
+	parentDir, name := path.Split(dir)
+	parentDir = strings.TrimSuffix(parentDir, "/")
+	parentID, err := imp.ensureFolder(ctx, parentDir)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := utils.GetCollection("folders")
+
+	var existing models.Folder
+	err = collection.FindOne(ctx, bson.M{
+		"name":      name,
+		"user_id":   imp.userID,
+		"parent_id": parentID,
+	}).Decode(&existing)
+	if err == nil && existing.Vault != nil {
+		return nil, errVaultTarget
+	}
+	if err == nil {
+		imp.folders[dir] = &existing.ID
+		return &existing.ID, nil
+	}
+
+	now := time.Now()
+	folder := models.Folder{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		UserID:    imp.userID,
+		ParentID:  parentID,
+		Path:      imp.rootPath + "/" + dir,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err = utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		if _, err := collection.InsertOne(sessCtx, folder); err != nil {
+			return err
+		}
+		return updateUserStorage(sessCtx, imp.userID, 0, 1, 0)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create folder: %v", err)
+	}
+
+	imp.folders[dir] = &folder.ID
+	return &folder.ID, nil
+}
+
+func (imp *archiveImport) countEntry() error {
+	imp.entries++
+	if imp.entries > maxImportEntries {
+		return fmt.Errorf("%w: more than %d entries", errArchiveBomb, maxImportEntries)
+	}
+	return nil
+}
+
+func (imp *archiveImport) skip(name, reason string) {
+	imp.report = append(imp.report, importResult{Path: name, Status: importSkipped, Error: reason})
+}
+
+func (imp *archiveImport) fail(name string, err error) {
+	imp.report = append(imp.report, importResult{Path: name, Status: importFailed, Error: err.Error()})
+}
+
+func (imp *archiveImport) summary() map[string]int {
+	summary := map[string]int{importImported: 0, importSkipped: 0, importFailed: 0}
+	for _, result := range imp.report {
+		summary[result.Status]++
+	}
+	return summary
+}
+
+// cleanArchivePath normalises an entry name and rejects anything that could
+// escape the target folder (zip-slip): absolute paths, drive letters and "..".
+// Entries naming the archive root itself ("." or "./") clean to ".".
+func cleanArchivePath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return "", errUnsafePath
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errUnsafePath
+		}
+		if strings.ContainsRune(part, 0) {
+			return "", errUnsafePath
+		}
+	}
+
+	if name == "" {
+		return "", errUnsafePath
+	}
+	return path.Clean(name), nil
+}
+
+// contentTypeForName guesses a Content-Type from the file extension
+func contentTypeForName(name string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// ratioLimit is how far a stream of compressedSize bytes may expand, never
+// more than maxExpanded in total
+func ratioLimit(compressedSize, maxExpanded int64) int64 {
+	limit := compressedSize * maxCompressionRatio
+	if limit < compressionRatioMinSize {
+		limit = compressionRatioMinSize
+	}
+	if limit > maxExpanded {
+		limit = maxExpanded
+	}
+	return limit
+}
+
+// ratioLimitedReader fails with errArchiveBomb once more than limit bytes
+// have been decompressed
+type ratioLimitedReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (l *ratioLimitedReader) Read(p []byte) (int, error) {
+	if l.n >= l.limit {
+		// a stream of exactly limit bytes is still fine
+		var probe [1]byte
+		if n, err := l.r.Read(probe[:]); n == 0 && err != nil {
+			return 0, err
+		}
+		return 0, errArchiveBomb
+	}
+	if remaining := l.limit - l.n; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
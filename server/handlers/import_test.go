@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCleanArchivePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"photo.jpg", "photo.jpg", false},
+		{"docs/2024/report.pdf", "docs/2024/report.pdf", false},
+		{"docs/", "docs", false},
+		{"./docs//a.txt", "docs/a.txt", false},
+		{`windows\style\path.txt`, "windows/style/path.txt", false},
+		{"a/./b", "a/b", false},
+		{"..foo/bar", "..foo/bar", false},
+		// the archive root, skipped by the import
+		{".", ".", false},
+		{"./", ".", false},
+
+		// zip-slip
+		{"../etc/passwd", "", true},
+		{"docs/../../etc/passwd", "", true},
+		{"docs/../a.txt", "", true},
+		{`..\evil.exe`, "", true},
+		{"/etc/passwd", "", true},
+		{`\windows\system32`, "", true},
+		{"C:/Windows/evil.dll", "", true},
+		{`C:\Windows\evil.dll`, "", true},
+		{"nul\x00byte.txt", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := cleanArchivePath(tt.name)
+		if tt.wantErr {
+			if !errors.Is(err, errUnsafePath) {
+				t.Errorf("cleanArchivePath(%q) = (%q, %v), want errUnsafePath", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("cleanArchivePath(%q) = (%q, %v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestRatioLimit(t *testing.T) {
+	const max = 10 * 1024 * 1024 * 1024
+
+	tests := []struct {
+		name        string
+		compressed  int64
+		maxExpanded int64
+		want        int64
+	}{
+		{"small archives get the minimum", 100, max, compressionRatioMinSize},
+		{"empty archive", 0, max, compressionRatioMinSize},
+		{"ratio applies above the minimum", 1024 * 1024, max, 1024 * 1024 * maxCompressionRatio},
+		{"capped by the storage left", 1024 * 1024, 5 * 1024 * 1024, 5 * 1024 * 1024},
+		{"cap wins over the minimum", 100, 1000, 1000},
+	}
+	for _, tt := range tests {
+		if got := ratioLimit(tt.compressed, tt.maxExpanded); got != tt.want {
+			t.Errorf("%s: ratioLimit(%d, %d) = %d, want %d", tt.name, tt.compressed, tt.maxExpanded, got, tt.want)
+		}
+	}
+}
+
+func TestRatioLimitedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limit   int64
+		wantErr error
+	}{
+		{"under the limit", 99, 100, nil},
+		{"exactly the limit", 100, 100, nil},
+		{"one byte over", 101, 100, errArchiveBomb},
+		{"far over", 10000, 100, errArchiveBomb},
+		{"empty", 0, 100, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &ratioLimitedReader{r: strings.NewReader(strings.Repeat("a", tt.size)), limit: tt.limit}
+			n, err := io.Copy(io.Discard, r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if n > tt.limit {
+				t.Errorf("read %d bytes past a limit of %d", n, tt.limit)
+			}
+		})
+	}
+}
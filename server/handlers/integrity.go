@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errIntegrity = errors.New("stored content does not match its checksum")
+)
+
+// contentHashes identify an upload's content. SHA-256 is stored as hex (it
+// is also the blob address) and CRC32C as base64 of the big-endian value,
+// the way GCS reports it.
+type contentHashes struct {
+	SHA256 string
+	CRC32C string
+}
+
+// expectedChecksums are what the client says the upload hashes to. Empty
+// fields weren't provided.
+type expectedChecksums struct {
+	SHA256 string
+	CRC32C string
+}
+
+// checksumMismatchError is returned by saveFile when the content doesn't
+// match a checksum the client sent
+type checksumMismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch", e.Algorithm)
+}
+
+// hashContent reads content from the start and checks it against expected
+func hashContent(content io.ReadSeeker, expected expectedChecksums) (contentHashes, error) {
+	var hashes contentHashes
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return hashes, fmt.Errorf("could not rewind file: %v", err)
+	}
+
+	sha := sha256.New()
+	crc := crc32.New(crc32cTable)
+	if _, err := io.Copy(io.MultiWriter(sha, crc), content); err != nil {
+		return hashes, fmt.Errorf("could not calculate file hash: %v", err)
+	}
+	hashes.SHA256 = hex.EncodeToString(sha.Sum(nil))
+	hashes.CRC32C = base64.StdEncoding.EncodeToString(crc.Sum(nil))
+
+	if expected.SHA256 != "" && expected.SHA256 != hashes.SHA256 {
+		return hashes, &checksumMismatchError{Algorithm: "sha-256", Expected: expected.SHA256, Actual: hashes.SHA256}
+	}
+	if expected.CRC32C != "" && expected.CRC32C != hashes.CRC32C {
+		return hashes, &checksumMismatchError{Algorithm: "crc32c", Expected: expected.CRC32C, Actual: hashes.CRC32C}
+	}
+	return hashes, nil
+}
+
+// parseChecksumHeaders reads the client's checksums from Repr-Digest
+// (RFC 9530, "sha-256=:<base64>:") or the older Digest header (RFC 3230,
+// "sha-256=<base64>"). sha-256 and crc32c are understood; other algorithms
+// are ignored. The first header set that has any wins, so a multipart
+// file part's own headers can be passed ahead of the request's.
+func parseChecksumHeaders(headerSets ...map[string][]string) (expectedChecksums, error) {
+	var expected expectedChecksums
+	for _, headers := range headerSets {
+		h := http.Header(headers)
+		for _, name := range []string{"Repr-Digest", "Digest"} {
+			value := h.Get(name)
+			if value == "" {
+				continue
+			}
+			for _, member := range strings.Split(value, ",") {
+				alg, encoded, found := strings.Cut(strings.TrimSpace(member), "=")
+				if !found {
+					return expected, fmt.Errorf("malformed %s header", name)
+				}
+				raw, err := base64.StdEncoding.DecodeString(strings.Trim(strings.TrimSpace(encoded), ":"))
+				if err != nil {
+					return expected, fmt.Errorf("malformed %s header", name)
+				}
+
+				switch strings.ToLower(strings.TrimSpace(alg)) {
+				case "sha-256":
+					if len(raw) != sha256.Size {
+						return expected, fmt.Errorf("malformed sha-256 digest")
+					}
+					expected.SHA256 = hex.EncodeToString(raw)
+				case "crc32c":
+					if len(raw) != 4 {
+						return expected, fmt.Errorf("malformed crc32c digest")
+					}
+					expected.CRC32C = base64.StdEncoding.EncodeToString(raw)
+				}
+			}
+			if expected != (expectedChecksums{}) {
+				return expected, nil
+			}
+		}
+	}
+	return expected, nil
+}
+
+// encodeCRC32C formats a CRC32C the way it is stored
+func encodeCRC32C(value uint32) string {
+	raw := make([]byte, 4)
+	binary.BigEndian.PutUint32(raw, value)
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// setDigestHeaders describes the whole file, also on partial responses.
+// Files from before SHA-256 was tracked get none until they are migrated.
+func setDigestHeaders(c *gin.Context, file *models.File) {
+	if file.SHA256 == "" {
+		return
+	}
+	raw, err := hex.DecodeString(file.SHA256)
+	if err != nil {
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	c.Header("Repr-Digest", fmt.Sprintf("sha-256=:%s:", encoded))
+
+	digest := "sha-256=" + encoded
+	if file.CRC32C != "" {
+		digest += ",crc32c=" + file.CRC32C
+	}
+	c.Header("Digest", digest)
+}
+
+// integrityReader hashes content as it is read in full. At the end it checks
+// the result against the record, or fills the hashes in for records that
+// predate SHA-256 once the content matches the MD5 they still carry.
+type integrityReader struct {
+	io.ReadCloser
+	ctx  context.Context
+	file *models.File
+	sha  hash.Hash
+	crc  hash.Hash32
+	md5  hash.Hash // only while migrating a legacy record
+	n    int64
+	done bool
+}
+
+func newIntegrityReader(ctx context.Context, file *models.File, r io.ReadCloser) io.ReadCloser {
+	reader := &integrityReader{
+		ReadCloser: r,
+		ctx:        ctx,
+		file:       file,
+		sha:        sha256.New(),
+		crc:        crc32.New(crc32cTable),
+	}
+	if file.SHA256 == "" && file.Hash != "" {
+		reader.md5 = md5.New()
+	}
+	return reader
+}
+
+func (r *integrityReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.sha.Write(p[:n])
+	r.crc.Write(p[:n])
+	if r.md5 != nil {
+		r.md5.Write(p[:n])
+	}
+	r.n += int64(n)
+
+	if err == io.EOF && !r.done {
+		r.done = true
+		if verr := r.finish(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+func (r *integrityReader) finish() error {
+	sum := hex.EncodeToString(r.sha.Sum(nil))
+	crcValue := encodeCRC32C(r.crc.Sum32())
+
+	if r.n != r.file.Size {
+		log.Printf("Integrity check failed for file %s: read %d bytes, expected %d", r.file.ID.Hex(), r.n, r.file.Size)
+		return errIntegrity
+	}
+
+	if r.file.SHA256 == "" {
+		// lazy migration of a record from before SHA-256. Content that no
+		// longer matches its MD5 must not get fresh checksums: they would
+		// bless the corruption and drop the only evidence of it.
+		if r.md5 != nil {
+			if legacy := hex.EncodeToString(r.md5.Sum(nil)); legacy != r.file.Hash {
+				log.Printf("Integrity check failed for file %s: md5 %s, expected %s", r.file.ID.Hex(), legacy, r.file.Hash)
+				return errIntegrity
+			}
+		}
+		_, err := utils.GetCollection("files").UpdateOne(r.ctx, bson.M{
+			"_id":    r.file.ID,
+			"sha256": bson.M{"$exists": false},
+		}, bson.M{
+			"$set":   bson.M{"sha256": sum, "crc32c": crcValue},
+			"$unset": bson.M{"hash": ""},
+		})
+		if err != nil {
+			log.Printf("Could not record checksums for file %s: %v", r.file.ID.Hex(), err)
+		}
+		r.file.SHA256, r.file.CRC32C, r.file.Hash = sum, crcValue, ""
+		return nil
+	}
+
+	if sum != r.file.SHA256 || (r.file.CRC32C != "" && crcValue != r.file.CRC32C) {
+		log.Printf("Integrity check failed for file %s: sha-256 %s, expected %s", r.file.ID.Hex(), sum, r.file.SHA256)
+		return errIntegrity
+	}
+	return nil
+}
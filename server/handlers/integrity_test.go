@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func readThroughIntegrity(file *models.File, content string) error {
+	r := newIntegrityReader(context.Background(), file, io.NopCloser(strings.NewReader(content)))
+	_, err := io.ReadAll(r)
+	return err
+}
+
+func TestIntegrityReaderChecksRecordedHashes(t *testing.T) {
+	content := "hello, world"
+	sum := sha256.Sum256([]byte(content))
+
+	tests := []struct {
+		name    string
+		file    models.File
+		content string
+		wantErr bool
+	}{
+		{"match", models.File{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(content))}, content, false},
+		{"wrong sha-256", models.File{SHA256: strings.Repeat("0", 64), Size: int64(len(content))}, content, true},
+		{"truncated", models.File{SHA256: hex.EncodeToString(sum[:]), Size: int64(len(content))}, content[:5], true},
+		{"wrong crc32c", models.File{SHA256: hex.EncodeToString(sum[:]), CRC32C: "AAAAAA==", Size: int64(len(content))}, content, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.file.ID = primitive.NewObjectID()
+			err := readThroughIntegrity(&tt.file, tt.content)
+			if tt.wantErr != errors.Is(err, errIntegrity) {
+				t.Errorf("err = %v, want integrity error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIntegrityReaderRefusesToMigrateCorruptLegacyContent(t *testing.T) {
+	original := md5.Sum([]byte("original content"))
+	file := models.File{
+		ID:   primitive.NewObjectID(),
+		Hash: hex.EncodeToString(original[:]),
+		Size: int64(len("corrupt content!")),
+	}
+
+	// the mismatch is caught before any checksum is recorded
+	if err := readThroughIntegrity(&file, "corrupt content!"); !errors.Is(err, errIntegrity) {
+		t.Fatalf("err = %v, want errIntegrity", err)
+	}
+	if file.SHA256 != "" || file.Hash == "" {
+		t.Errorf("record was migrated: sha256 %q, hash %q", file.SHA256, file.Hash)
+	}
+}
+
+func TestParseChecksumHeaders(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello, world"))
+	sha := base64.StdEncoding.EncodeToString(sum[:])
+	shaHex := hex.EncodeToString(sum[:])
+	crc := encodeCRC32C(crc32.Checksum([]byte("hello, world"), crc32cTable))
+
+	tests := []struct {
+		name    string
+		headers []map[string][]string
+		want    expectedChecksums
+		wantErr bool
+	}{
+		{"none", []map[string][]string{{}}, expectedChecksums{}, false},
+		{"repr-digest", []map[string][]string{{"Repr-Digest": {"sha-256=:" + sha + ":"}}}, expectedChecksums{SHA256: shaHex}, false},
+		{"digest", []map[string][]string{{"Digest": {"sha-256=" + sha}}}, expectedChecksums{SHA256: shaHex}, false},
+		{"both algorithms", []map[string][]string{{"Digest": {"SHA-256=" + sha + ", crc32c=" + crc}}}, expectedChecksums{SHA256: shaHex, CRC32C: crc}, false},
+		{"crc32c only", []map[string][]string{{"Repr-Digest": {"crc32c=:" + crc + ":"}}}, expectedChecksums{CRC32C: crc}, false},
+		{"unknown algorithm ignored", []map[string][]string{{"Repr-Digest": {"sha-512=:" + base64.StdEncoding.EncodeToString(make([]byte, 64)) + ":"}}}, expectedChecksums{}, false},
+		{"falls back to digest", []map[string][]string{{
+			"Repr-Digest": {"sha-512=:" + base64.StdEncoding.EncodeToString(make([]byte, 64)) + ":"},
+			"Digest":      {"sha-256=" + sha},
+		}}, expectedChecksums{SHA256: shaHex}, false},
+		{"repr-digest wins", []map[string][]string{{
+			"Repr-Digest": {"sha-256=:" + sha + ":"},
+			"Digest":      {"crc32c=" + crc},
+		}}, expectedChecksums{SHA256: shaHex}, false},
+		{"part headers win", []map[string][]string{
+			{"Digest": {"crc32c=" + crc}},
+			{"Digest": {"sha-256=" + sha}},
+		}, expectedChecksums{CRC32C: crc}, false},
+		{"request headers used when the part has none", []map[string][]string{
+			{"Content-Type": {"text/plain"}},
+			{"Repr-Digest": {"sha-256=:" + sha + ":"}},
+		}, expectedChecksums{SHA256: shaHex}, false},
+
+		{"no value", []map[string][]string{{"Digest": {"sha-256"}}}, expectedChecksums{}, true},
+		{"not base64", []map[string][]string{{"Digest": {"sha-256=not-base64!"}}}, expectedChecksums{}, true},
+		{"short sha-256", []map[string][]string{{"Digest": {"sha-256=" + base64.StdEncoding.EncodeToString(sum[:16])}}}, expectedChecksums{}, true},
+		{"hex sha-256", []map[string][]string{{"Digest": {"sha-256=" + shaHex}}}, expectedChecksums{}, true},
+		{"long crc32c", []map[string][]string{{"Digest": {"crc32c=" + base64.StdEncoding.EncodeToString(make([]byte, 8))}}}, expectedChecksums{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChecksumHeaders(tt.headers...)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseChecksumHeaders = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseChecksumHeaders = (%+v, %v), want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashContent(t *testing.T) {
+	content := "hello, world"
+	sum := sha256.Sum256([]byte(content))
+	crc := encodeCRC32C(crc32.Checksum([]byte(content), crc32cTable))
+
+	tests := []struct {
+		name     string
+		expected expectedChecksums
+		wantAlg  string
+	}{
+		{"nothing expected", expectedChecksums{}, ""},
+		{"both match", expectedChecksums{SHA256: hex.EncodeToString(sum[:]), CRC32C: crc}, ""},
+		{"sha-256 mismatch", expectedChecksums{SHA256: strings.Repeat("0", 64)}, "sha-256"},
+		{"crc32c mismatch", expectedChecksums{CRC32C: "AAAAAA=="}, "crc32c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(content)
+			r.Seek(5, io.SeekStart) // hashing starts from the beginning regardless
+
+			hashes, err := hashContent(r, tt.expected)
+			if hashes.SHA256 != hex.EncodeToString(sum[:]) || hashes.CRC32C != crc {
+				t.Errorf("hashes = %+v", hashes)
+			}
+			var mismatch *checksumMismatchError
+			switch {
+			case tt.wantAlg == "" && err != nil:
+				t.Errorf("err = %v", err)
+			case tt.wantAlg != "" && (!errors.As(err, &mismatch) || mismatch.Algorithm != tt.wantAlg):
+				t.Errorf("err = %v, want a %s mismatch", err, tt.wantAlg)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// runPeriodically runs fn every interval in the background until ctx is done.
+// Jobs must be safe to run on several instances at once; they claim work
+// with atomic updates rather than relying on a single scheduler.
+func runPeriodically(ctx context.Context, name string, interval time.Duration, fn func(context.Context) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := fn(ctx); err != nil {
+				log.Printf("Background job %s failed: %v", name, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// recordAudit appends an entry to the audit_log collection. Failures are only
+// logged: the audited action has already happened.
+func recordAudit(ctx context.Context, userID primitive.ObjectID, action string, details map[string]interface{}) {
+	entry := models.AuditEntry{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Action:    action,
+		Details:   details,
+		CreatedAt: time.Now(),
+	}
+
+	if _, err := utils.GetCollection("audit_log").InsertOne(ctx, entry); err != nil {
+		log.Printf("Could not write audit entry %s for user %s: %v", action, userID.Hex(), err)
+	}
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// GetJWKS publishes the public halves of the token signing keys so other
+// services can verify DriftBox tokens
+func GetJWKS(c *gin.Context) {
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(utils.JWKSMaxAge.Seconds())))
+	c.JSON(http.StatusOK, utils.PublicJWKS())
+}
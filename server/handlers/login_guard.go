@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/middleware"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// failures from one client allowed before each attempt has to wait
+	loginFreeAttempts = 3
+	// failures from one client before it is locked out of the account
+	loginLockoutThreshold = 10
+	// failures from all clients together before the account is locked for
+	// everyone. Far above the per-client limit, so a single attacker can't
+	// lock the owner out; it only stops guessing spread over many addresses.
+	loginAccountLockoutThreshold = 100
+	loginLockoutDuration         = 15 * time.Minute
+	loginMaxDelay                = time.Minute
+	// failure counters are forgotten after this much quiet time
+	loginFailureWindow = time.Hour
+)
+
+// loginAttempt tracks consecutive failed logins in the login_attempts
+// collection, so the limits hold across instances. There is one counter per
+// account and client address, keyed by loginClientKey, and one per account,
+// keyed by the normalized email.
+type loginAttempt struct {
+	Key           string     `bson:"_id"`
+	Email         string     `bson:"email"`
+	Failures      int        `bson:"failures"`
+	LastFailureAt time.Time  `bson:"last_failure_at"`
+	LockedUntil   *time.Time `bson:"locked_until,omitempty"`
+	ExpiresAt     time.Time  `bson:"expires_at"`
+}
+
+// loginClientKey identifies the failures of one client address against one
+// account
+func loginClientKey(email, clientIP string) string {
+	return normalizeEmail(email) + "|" + clientIP
+}
+
+// checkLoginAllowed enforces the progressive delay and lockout for email
+// from the requesting client, and the account-wide lockout. It writes the
+// 429 response and returns false when the attempt is refused.
+func checkLoginAllowed(c *gin.Context, email string) bool {
+	clientKey := loginClientKey(email, c.ClientIP())
+	var attempts []loginAttempt
+	err := findAll(c, "login_attempts", bson.M{"_id": bson.M{"$in": []string{clientKey, normalizeEmail(email)}}}, &attempts)
+	if err != nil {
+		return true
+	}
+
+	now := time.Now()
+	for _, attempt := range attempts {
+		if attempt.LockedUntil != nil && now.Before(*attempt.LockedUntil) {
+			middleware.AbortTooManyRequests(c, attempt.LockedUntil.Sub(now))
+			return false
+		}
+		if attempt.Key != clientKey {
+			continue
+		}
+		if next := attempt.LastFailureAt.Add(loginDelay(attempt.Failures)); now.Before(next) {
+			middleware.AbortTooManyRequests(c, next.Sub(now))
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordLoginFailure bumps the client's and the account's failure counters
+// and locks whichever reaches its threshold
+func recordLoginFailure(c *gin.Context, email string) {
+	bumpLoginFailures(c, loginClientKey(email, c.ClientIP()), email, loginLockoutThreshold)
+	bumpLoginFailures(c, normalizeEmail(email), email, loginAccountLockoutThreshold)
+}
+
+func bumpLoginFailures(c *gin.Context, key, email string, threshold int) {
+	collection := utils.GetCollection("login_attempts")
+	now := time.Now()
+
+	var attempt loginAttempt
+	err := collection.FindOneAndUpdate(c, bson.M{"_id": key}, bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{"email": normalizeEmail(email), "last_failure_at": now, "expires_at": now.Add(loginFailureWindow)},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&attempt)
+	if err != nil {
+		log.Printf("Could not record failed login: %v", err)
+		return
+	}
+
+	if attempt.Failures%threshold == 0 {
+		lockedUntil := now.Add(loginLockoutDuration)
+		collection.UpdateOne(c, bson.M{"_id": key}, bson.M{"$set": bson.M{
+			"locked_until": lockedUntil,
+			"expires_at":   lockedUntil.Add(loginFailureWindow),
+		}})
+		log.Printf("Locked logins for %s until %s after %d failures", key, lockedUntil.Format(time.RFC3339), attempt.Failures)
+	}
+}
+
+// clearLoginFailures resets the counters after a successful login
+func clearLoginFailures(c *gin.Context, email string) {
+	utils.GetCollection("login_attempts").DeleteMany(c, bson.M{"_id": bson.M{
+		"$in": []string{loginClientKey(email, c.ClientIP()), normalizeEmail(email)},
+	}})
+}
+
+// loginDelay doubles the wait for every failure past the free attempts
+func loginDelay(failures int) time.Duration {
+	if failures < loginFreeAttempts {
+		return 0
+	}
+	delay := time.Second << (failures - loginFreeAttempts)
+	if delay > loginMaxDelay || delay <= 0 {
+		return loginMaxDelay
+	}
+	return delay
+}
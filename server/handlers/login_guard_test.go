@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{loginFreeAttempts - 1, 0},
+		{loginFreeAttempts, time.Second},
+		{loginFreeAttempts + 1, 2 * time.Second},
+		{loginFreeAttempts + 5, 32 * time.Second},
+		{loginFreeAttempts + 6, loginMaxDelay},
+		{loginFreeAttempts + 70, loginMaxDelay}, // would overflow the shift
+	}
+	for _, tt := range tests {
+		if got := loginDelay(tt.failures); got != tt.want {
+			t.Errorf("loginDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginClientKeySeparatesClients(t *testing.T) {
+	if loginClientKey(" User@Example.com", "10.0.0.1") != loginClientKey("user@example.com", "10.0.0.1") {
+		t.Error("the same account from the same client has two counters")
+	}
+	if loginClientKey("user@example.com", "10.0.0.1") == loginClientKey("user@example.com", "10.0.0.2") {
+		t.Error("two clients share a counter")
+	}
+}
+
+// loginContext builds a login request from clientIP
+func loginContext(clientIP string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/login", nil)
+	c.Request.RemoteAddr = clientIP + ":40000"
+	return c, w
+}
+
+func TestLoginLockout(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	email := primitive.NewObjectID().Hex() + "@example.com"
+	t.Cleanup(func() {
+		utils.GetCollection("login_attempts").DeleteMany(ctx, bson.M{"email": email})
+	})
+
+	allowed := func(clientIP string) bool {
+		c, w := loginContext(clientIP)
+		ok := checkLoginAllowed(c, email)
+		if !ok && w.Code != http.StatusTooManyRequests {
+			t.Errorf("refused login: status %d, want 429", w.Code)
+		}
+		return ok
+	}
+	fail := func(clientIP string, times int) {
+		for i := 0; i < times; i++ {
+			c, _ := loginContext(clientIP)
+			recordLoginFailure(c, email)
+		}
+	}
+
+	fail("10.0.0.1", loginLockoutThreshold)
+	if allowed("10.0.0.1") {
+		t.Error("client past the lockout threshold can still try")
+	}
+	// the attacker must not lock the owner out
+	if !allowed("10.0.0.2") {
+		t.Error("another client is locked out by the first one's failures")
+	}
+
+	// guessing spread over many addresses locks the account for everyone
+	for i := 1; i*loginLockoutThreshold < loginAccountLockoutThreshold; i++ {
+		fail(fmt.Sprintf("10.0.1.%d", i), loginLockoutThreshold)
+	}
+	if allowed("10.0.0.2") {
+		t.Error("account is not locked after failures from many clients")
+	}
+
+	c, _ := loginContext("10.0.0.2")
+	clearLoginFailures(c, email)
+	if !allowed("10.0.0.2") {
+		t.Error("counters not cleared after a successful login")
+	}
+}
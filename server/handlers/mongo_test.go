@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ayushsarode/DriftBox/utils"
+)
+
+var (
+	testMongoOnce sync.Once
+	testMongoErr  error
+
+	testStorageOnce sync.Once
+	testStorageErr  error
+)
+
+// testMongo connects to the replica set named by MONGO_TEST_URI and skips
+// the test when it is unset. Transactions need a replica set, so a single
+// mongod must run with --replSet. Tests share the driftbox database and only
+// touch, and clean up, documents they created themselves.
+func testMongo(t *testing.T) {
+	t.Helper()
+
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	testMongoOnce.Do(func() {
+		os.Setenv("MONGO_URI", uri)
+		testMongoErr = utils.InitDB()
+	})
+	if testMongoErr != nil {
+		t.Fatalf("could not connect to MongoDB: %v", testMongoErr)
+	}
+}
+
+// testStorage is testMongo for tests that also read or write stored objects.
+// It skips unless GCS_TEST_BUCKET names a bucket the test may write to,
+// using the same credentials as the server. Objects are written under
+// prefixes unique to each test and removed by it.
+func testStorage(t *testing.T) {
+	t.Helper()
+	testMongo(t)
+
+	bucket := os.Getenv("GCS_TEST_BUCKET")
+	if bucket == "" {
+		t.Skip("GCS_TEST_BUCKET not set")
+	}
+	testStorageOnce.Do(func() {
+		os.Setenv("GCS_BUCKET_NAME", bucket)
+		testStorageErr = utils.InitGCS()
+	})
+	if testStorageErr != nil {
+		t.Fatalf("could not connect to GCS: %v", testStorageErr)
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetNotifications lists the user's notifications, newest first
+func GetNotifications(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	filter := bson.M{"user_id": userID}
+	if c.Query("unread") == "true" {
+		filter["read"] = false
+	}
+
+	cursor, err := utils.GetCollection("notifications").Find(c, filter,
+		options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(100))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve notifications"})
+		return
+	}
+	defer cursor.Close(c)
+
+	notifications := []models.Notification{}
+	if err = cursor.All(c, &notifications); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not decode notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications})
+}
+
+// MarkNotificationRead marks a single notification as read
+func MarkNotificationRead(c *gin.Context) {
+	notificationObjID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	result, err := utils.GetCollection("notifications").UpdateOne(c,
+		bson.M{"_id": notificationObjID, "user_id": userID},
+		bson.M{"$set": bson.M{"read": true}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update notification"})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
+
+// notifyUser stores an in-app notification; failures are logged only
+func notifyUser(ctx context.Context, userID primitive.ObjectID, kind, title, message, link string, expiresAt *time.Time) {
+	notification := models.Notification{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Type:      kind,
+		Title:     title,
+		Message:   message,
+		Link:      link,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	if _, err := utils.GetCollection("notifications").InsertOne(ctx, notification); err != nil {
+		log.Printf("Could not notify user %s (%s): %v", userID.Hex(), kind, err)
+	}
+}
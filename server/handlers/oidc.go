@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+)
+
+// oidc cookies only need to survive the round trip to the IdP
+const oidcCookieMaxAge = 300
+
+// GetAuthProviders lists the external login providers configured on this server
+func GetAuthProviders(c *gin.Context) {
+	providers := []gin.H{}
+	for _, p := range utils.ListOIDCProviders() {
+		providers = append(providers, gin.H{
+			"name":         p.Name,
+			"display_name": p.DisplayName,
+			"login_url":    fmt.Sprintf("/auth/oidc/%s", p.Name),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
+
+// OIDCLogin starts the authorization code flow for any configured provider
+func OIDCLogin(c *gin.Context) {
+	startOIDCLogin(c, c.Param("provider"))
+}
+
+// OIDCCallback completes the authorization code flow for any configured provider
+func OIDCCallback(c *gin.Context) {
+	finishOIDCLogin(c, c.Param("provider"))
+}
+
+func startOIDCLogin(c *gin.Context, providerName string) {
+	provider, ok := utils.GetOIDCProvider(providerName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+		return
+	}
+
+	// Generate random state, nonce and PKCE verifier
+	state := generateRandomState()
+	nonce := generateRandomState()
+	verifier := oauth2.GenerateVerifier()
+
+	// Store them in short-lived cookies until the callback
+	c.SetCookie("oauth_state", state, oidcCookieMaxAge, "/", "", false, true)
+	c.SetCookie("oauth_nonce", nonce, oidcCookieMaxAge, "/", "", false, true)
+	c.SetCookie("oauth_verifier", verifier, oidcCookieMaxAge, "/", "", false, true)
+
+	url := provider.AuthCodeURL(state, nonce, verifier)
+	c.JSON(http.StatusOK, gin.H{"auth_url": url})
+}
+
+func finishOIDCLogin(c *gin.Context, providerName string) {
+	provider, ok := utils.GetOIDCProvider(providerName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+		return
+	}
+
+	// Verify state parameter. A state created by StartIdentityLink belongs
+	// to a signed-in user attaching this provider rather than to a login.
+	state := c.Query("state")
+	link, err := consumeLinkRequest(c, providerName, state)
+	switch {
+	case err == nil:
+		finishIdentityLink(c, provider, link)
+		return
+	case errors.Is(err, errLinkNotStarted):
+		log.Printf("Link callback for provider %s without the link cookie", providerName)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state parameter"})
+		return
+	case !errors.Is(err, errNoLinkRequest):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not look up link request"})
+		return
+	}
+
+	storedState, err := c.Cookie("oauth_state")
+	if err != nil || state == "" || state != storedState {
+		log.Printf("State verification failed for provider %s: %v", providerName, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state parameter"})
+		return
+	}
+
+	nonce, _ := c.Cookie("oauth_nonce")
+	verifier, _ := c.Cookie("oauth_verifier")
+
+	// Clear the flow cookies
+	c.SetCookie("oauth_state", "", -1, "/", "", false, true)
+	c.SetCookie("oauth_nonce", "", -1, "/", "", false, true)
+	c.SetCookie("oauth_verifier", "", -1, "/", "", false, true)
+
+	claims, err := provider.Exchange(c, c.Query("code"), nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC exchange with %s failed: %v", providerName, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to verify login with provider"})
+		return
+	}
+
+	user, status, err := findOrCreateOIDCUser(c, providerName, claims)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	respondWithLogin(c, user, providerName)
+}
+
+// findOrCreateOIDCUser maps verified provider claims onto a DriftBox account.
+// Known identities log straight in. A new identity whose email belongs to an
+// existing account is only attached automatically when both sides have
+// verified that address; otherwise the owner has to sign in and link it
+// explicitly, so nobody can take over a password account through an IdP.
+func findOrCreateOIDCUser(c *gin.Context, providerName string, claims *utils.OIDCClaims) (*models.User, int, error) {
+	users := utils.GetCollection("users")
+	identities := utils.GetCollection("identities")
+
+	var identity models.Identity
+	err := identities.FindOne(c, bson.M{"provider": providerName, "subject": claims.Subject}).Decode(&identity)
+	if err == nil {
+		var user models.User
+		if err := users.FindOne(c, bson.M{"_id": identity.UserID}).Decode(&user); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("Could not load linked account")
+		}
+		identities.UpdateOne(c, bson.M{"_id": identity.ID}, bson.M{"$set": bson.M{"last_login_at": time.Now()}})
+		return &user, http.StatusOK, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Could not look up identity")
+	}
+
+	// Google logins from before identities existed are recorded on the user
+	if providerName == "google" {
+		var legacyUser models.User
+		if err := users.FindOne(c, bson.M{"google_id": claims.Subject}).Decode(&legacyUser); err == nil {
+			if _, err := createIdentity(c, legacyUser.ID, providerName, claims); err != nil {
+				return nil, http.StatusInternalServerError, fmt.Errorf("Could not migrate identity")
+			}
+			return &legacyUser, http.StatusOK, nil
+		}
+	}
+
+	email := normalizeEmail(claims.Email)
+	if email == "" || !claims.EmailVerified {
+		return nil, http.StatusForbidden, fmt.Errorf("Provider did not return a verified email address")
+	}
+
+	var existingUser models.User
+	err = users.FindOne(c, bson.M{"email": email}).Decode(&existingUser)
+	if err == nil {
+		if !existingUser.EmailVerified {
+			return nil, http.StatusConflict, fmt.Errorf("An account with this email already exists. Sign in and link %s from your account settings", providerName)
+		}
+
+		log.Printf("Linking %s identity to user %s by verified email", providerName, existingUser.ID.Hex())
+		if _, err := createIdentity(c, existingUser.ID, providerName, claims); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("Could not link identity")
+		}
+		return &existingUser, http.StatusOK, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Could not look up user")
+	}
+
+	username := claims.Name
+	if username == "" {
+		username = claims.PreferredUsername
+	}
+	if username == "" {
+		username = strings.Split(email, "@")[0]
+	}
+
+	newUser := models.User{
+		ID:            primitive.NewObjectID(),
+		Username:      username,
+		Email:         email,
+		EmailVerified: true,
+		Picture:       claims.Picture,
+		AuthProvider:  providerName,
+	}
+
+	if _, err := users.InsertOne(c, newUser); mongo.IsDuplicateKeyError(err) {
+		// an account with this email was created since the lookup above
+		return nil, http.StatusConflict, fmt.Errorf("An account with this email already exists. Sign in and link %s from your account settings", providerName)
+	} else if err != nil {
+		log.Printf("Failed to create user: %v", err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("Could not create user")
+	}
+
+	if _, err := createIdentity(c, newUser.ID, providerName, claims); err != nil {
+		users.DeleteOne(c, bson.M{"_id": newUser.ID})
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, http.StatusConflict, fmt.Errorf("This login is already linked to an account")
+		}
+		return nil, http.StatusInternalServerError, fmt.Errorf("Could not create user")
+	}
+
+	log.Printf("Created user %s from %s login", newUser.ID.Hex(), providerName)
+	return &newUser, http.StatusOK, nil
+}
+
+func createIdentity(c *gin.Context, userID primitive.ObjectID, providerName string, claims *utils.OIDCClaims) (*models.Identity, error) {
+	now := time.Now()
+	identity := models.Identity{
+		ID:            primitive.NewObjectID(),
+		UserID:        userID,
+		Provider:      providerName,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		CreatedAt:     now,
+		LastLoginAt:   &now,
+	}
+
+	if _, err := utils.GetCollection("identities").InsertOne(c, identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func generateRandomState() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.URLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	outboxInterval   = time.Minute
+	outboxMaxBackoff = 6 * time.Hour
+	// an upload's object is removed this long after it was stored unless
+	// the file record was saved, which cancels the intent
+	orphanUploadDelay = time.Hour
+)
+
+// newDeleteIntent removes path from the bucket once due
+func newDeleteIntent(path string, delay time.Duration) models.StorageIntent {
+	now := time.Now()
+	return models.StorageIntent{
+		ID:            primitive.NewObjectID(),
+		Action:        models.IntentDeleteObject,
+		Path:          path,
+		NextAttemptAt: now.Add(delay),
+		CreatedAt:     now,
+	}
+}
+
+// queueIntents records intents, normally inside the transaction that makes
+// them necessary
+func queueIntents(ctx context.Context, intents ...models.StorageIntent) error {
+	if len(intents) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(intents))
+	for i, intent := range intents {
+		docs[i] = intent
+	}
+	if _, err := utils.GetCollection("storage_intents").InsertMany(ctx, docs); err != nil {
+		return fmt.Errorf("could not queue storage intents: %v", err)
+	}
+	return nil
+}
+
+// cancelIntent drops an intent that is no longer needed
+func cancelIntent(ctx context.Context, id primitive.ObjectID) error {
+	_, err := utils.GetCollection("storage_intents").DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// runIntents carries out committed intents right away. Failures are left to
+// the outbox worker.
+func runIntents(ctx context.Context, intents ...models.StorageIntent) {
+	for _, intent := range intents {
+		if _, err := runIntent(ctx, bson.M{"_id": intent.ID}); err != nil {
+			log.Printf("Storage intent %s failed, will retry: %v", intent.ID.Hex(), err)
+		}
+	}
+}
+
+// runIntent claims an intent matching filter and carries it out. Claiming
+// pushes the next attempt back, so other instances leave it alone meanwhile.
+// It reports false when nothing matched; an intent whose transaction was
+// never committed, or that already ran, doesn't exist.
+func runIntent(ctx context.Context, filter bson.M) (bool, error) {
+	collection := utils.GetCollection("storage_intents")
+
+	var intent models.StorageIntent
+	err := collection.FindOneAndUpdate(ctx, filter, []bson.M{{
+		"$set": bson.M{
+			"attempts":        bson.M{"$add": bson.A{"$attempts", 1}},
+			"next_attempt_at": time.Now().Add(outboxMaxBackoff),
+		},
+	}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&intent)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch intent.Action {
+	case models.IntentDeleteObject:
+		err = deleteObjectIfExists(ctx, intent.Path)
+	default:
+		err = fmt.Errorf("unknown storage intent %q", intent.Action)
+	}
+
+	if err != nil {
+		collection.UpdateOne(ctx, bson.M{"_id": intent.ID}, bson.M{"$set": bson.M{
+			"next_attempt_at": time.Now().Add(outboxBackoff(intent.Attempts)),
+			"last_error":      err.Error(),
+		}})
+		return true, err
+	}
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": intent.ID}); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// outboxBackoff doubles from a minute up to outboxMaxBackoff
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// StartOutboxWorker retries storage intents that couldn't be carried out
+// right after their transaction, or whose instance died first
+func StartOutboxWorker(ctx context.Context) {
+	runPeriodically(ctx, "storage outbox", outboxInterval, processDueIntents)
+}
+
+func processDueIntents(ctx context.Context) error {
+	done, failed := 0, 0
+	for ctx.Err() == nil {
+		found, err := runIntent(ctx, bson.M{"next_attempt_at": bson.M{"$lte": time.Now()}})
+		if !found {
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			log.Printf("Storage intent failed: %v", err)
+			failed++
+			continue
+		}
+		done++
+	}
+
+	if done > 0 || failed > 0 {
+		log.Printf("Storage outbox ran %d intent(s), %d failed", done, failed)
+	}
+	return nil
+}
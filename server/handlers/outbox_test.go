@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, outboxMaxBackoff},
+		{1000, outboxMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestNewDeleteIntent(t *testing.T) {
+	intent := newDeleteIntent("users/a/files/b", orphanUploadDelay)
+	if intent.Action != models.IntentDeleteObject || intent.Path != "users/a/files/b" || intent.ID.IsZero() {
+		t.Errorf("intent %+v", intent)
+	}
+	if delay := intent.NextAttemptAt.Sub(intent.CreatedAt); delay != orphanUploadDelay {
+		t.Errorf("due after %v, want %v", delay, orphanUploadDelay)
+	}
+}
+
+// loadIntent returns the stored intent, or nil once it is gone
+func loadIntent(t *testing.T, id primitive.ObjectID) *models.StorageIntent {
+	t.Helper()
+	var intent models.StorageIntent
+	err := utils.GetCollection("storage_intents").FindOne(context.Background(), bson.M{"_id": id}).Decode(&intent)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &intent
+}
+
+func TestQueuedIntentsFollowTheTransaction(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	rolledBack := newDeleteIntent("test/rolled-back", 0)
+	committed := newDeleteIntent("test/committed", time.Hour)
+	t.Cleanup(func() {
+		utils.GetCollection("storage_intents").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": []primitive.ObjectID{rolledBack.ID, committed.ID}}})
+	})
+
+	errAbort := errors.New("abort")
+	err := utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		if err := queueIntents(sessCtx, rolledBack); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("transaction: %v, want it aborted", err)
+	}
+	if loadIntent(t, rolledBack.ID) != nil {
+		t.Error("intent of an aborted transaction was stored")
+	}
+	// nothing to run either
+	if found, err := runIntent(ctx, bson.M{"_id": rolledBack.ID}); found || err != nil {
+		t.Errorf("running it: found %v, %v", found, err)
+	}
+
+	err = utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		return queueIntents(sessCtx, committed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadIntent(t, committed.ID) == nil {
+		t.Fatal("intent of a committed transaction is missing")
+	}
+	if err := cancelIntent(ctx, committed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if loadIntent(t, committed.ID) != nil {
+		t.Error("cancelled intent still stored")
+	}
+}
+
+func TestRunIntentBacksOff(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	intent := newDeleteIntent("test/unknown", 0)
+	intent.Action = "unknown"
+	if err := queueIntents(ctx, intent); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cancelIntent(ctx, intent.ID) })
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		before := time.Now()
+		found, err := runIntent(ctx, bson.M{"_id": intent.ID})
+		if !found || err == nil {
+			t.Fatalf("attempt %d: found %v, %v; want a failure", attempt, found, err)
+		}
+		stored := loadIntent(t, intent.ID)
+		if stored == nil {
+			t.Fatalf("attempt %d: failed intent removed", attempt)
+		}
+		if stored.Attempts != attempt || stored.LastError == "" {
+			t.Errorf("attempt %d: %d attempts recorded, last error %q", attempt, stored.Attempts, stored.LastError)
+		}
+		want := before.Add(outboxBackoff(attempt))
+		if stored.NextAttemptAt.Before(want.Add(-time.Second)) || stored.NextAttemptAt.After(want.Add(time.Second)) {
+			t.Errorf("attempt %d: next attempt at %v, want about %v", attempt, stored.NextAttemptAt, want)
+		}
+	}
+}
+
+func TestRemoveFileRunsItsIntents(t *testing.T) {
+	testStorage(t)
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+	t.Cleanup(func() { utils.GetCollection("user_storage").DeleteOne(ctx, bson.M{"user_id": userID}) })
+
+	if err := updateUserStorage(ctx, userID, 100, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	file := &models.File{
+		ID:         primitive.NewObjectID(),
+		UserID:     userID,
+		Size:       100,
+		Thumbnails: []string{"small"},
+	}
+	file.Path = fmt.Sprintf("users/%s/files/%s", userID.Hex(), file.ID.Hex())
+	if _, err := utils.GetCollection("files").InsertOne(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.GetCollection("files").DeleteOne(ctx, bson.M{"_id": file.ID}) })
+
+	// the objects were never written, which deleting them tolerates
+	deleted, err := removeFile(ctx, file, bson.M{"_id": file.ID})
+	if err != nil || !deleted {
+		t.Fatalf("removeFile: %v, %v", deleted, err)
+	}
+
+	var usage models.UserStorage
+	if err := utils.GetCollection("user_storage").FindOne(ctx, bson.M{"user_id": userID}).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.UsedSpace != 0 || usage.FileCount != 0 {
+		t.Errorf("usage %d bytes in %d files after removing the only file", usage.UsedSpace, usage.FileCount)
+	}
+	left, err := utils.GetCollection("storage_intents").CountDocuments(ctx, bson.M{
+		"path": bson.M{"$in": []string{file.Path, thumbnailPath(file, "small")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d intent(s) left after they ran", left)
+	}
+
+	if deleted, err := removeFile(ctx, file, bson.M{"_id": file.ID}); err != nil || deleted {
+		t.Errorf("removing it again: %v, %v; want nothing removed", deleted, err)
+	}
+	if err := utils.GetCollection("user_storage").FindOne(ctx, bson.M{"user_id": userID}).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.UsedSpace != 0 || usage.FileCount != 0 {
+		t.Errorf("usage changed by a removal that found nothing: %d bytes in %d files", usage.UsedSpace, usage.FileCount)
+	}
+}
@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var planIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+var errPlanNotFound = errors.New("plan not found")
+
+type planRequest struct {
+	ID          string `json:"id"`
+	Name        string `json:"name" binding:"required"`
+	MaxStorage  int64  `json:"max_storage" binding:"required"`
+	MaxFileSize int64  `json:"max_file_size" binding:"required"`
+	IsDefault   bool   `json:"is_default"`
+}
+
+func (r *planRequest) limits() models.PlanLimits {
+	return models.PlanLimits{
+		MaxStorage:  r.MaxStorage,
+		MaxFileSize: r.MaxFileSize,
+	}
+}
+
+// validPlanLimits reports whether limits make sense: sizes positive
+func validPlanLimits(limits models.PlanLimits) bool {
+	return limits.MaxStorage > 0 && limits.MaxFileSize > 0
+}
+
+// findPlan loads a plan by ID. An empty ID, or one whose plan was deleted,
+// gives the default plan.
+func findPlan(ctx context.Context, planID string) (*models.Plan, error) {
+	plans := utils.GetCollection("plans")
+
+	var plan models.Plan
+	if planID != "" {
+		err := plans.FindOne(ctx, bson.M{"_id": planID}).Decode(&plan)
+		if err == nil {
+			return &plan, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+	}
+
+	err := plans.FindOne(ctx, bson.M{"is_default": true}).Decode(&plan)
+	if err == mongo.ErrNoDocuments {
+		plan = models.DefaultPlan
+		return &plan, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// userPlan returns the plan assigned to a user and their overrides
+func userPlan(ctx context.Context, userID primitive.ObjectID) (*models.Plan, *models.PlanOverrides, error) {
+	var user models.User
+	err := utils.GetCollection("users").FindOne(ctx, bson.M{"_id": userID},
+		options.FindOne().SetProjection(bson.M{"plan_id": 1, "plan_overrides": 1})).Decode(&user)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, nil, err
+	}
+
+	plan, err := findPlan(ctx, user.PlanID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, user.PlanOverrides, nil
+}
+
+// userLimits returns the user's effective limits: their plan with any
+// overrides applied. Every limit check reads them from here.
+func userLimits(ctx context.Context, userID primitive.ObjectID) (models.PlanLimits, error) {
+	plan, overrides, err := userPlan(ctx, userID)
+	if err != nil {
+		return models.PlanLimits{}, err
+	}
+	return overrides.Apply(plan.PlanLimits), nil
+}
+
+// GetPlan shows the caller their plan and the limits that apply to them
+func GetPlan(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	plan, overrides, err := userPlan(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve plan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plan":   plan,
+		"limits": overrides.Apply(plan.PlanLimits),
+	})
+}
+
+// GetPlans lists the plans users can be assigned to
+func GetPlans(c *gin.Context) {
+	plans := []models.Plan{}
+	cursor, err := utils.GetCollection("plans").Find(c, bson.M{}, options.Find().SetSort(bson.M{"max_storage": 1}))
+	if err == nil {
+		err = cursor.All(c, &plans)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve plans"})
+		return
+	}
+
+	defaultPlan, err := findPlan(c, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve plans"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"plans": plans, "default": defaultPlan})
+}
+
+// CreatePlan adds a plan
+func CreatePlan(c *gin.Context) {
+	var req planRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !planIDPattern.MatchString(req.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan ID must be lowercase letters, digits and dashes"})
+		return
+	}
+
+	now := time.Now()
+	plan := models.Plan{
+		ID:         req.ID,
+		Name:       req.Name,
+		PlanLimits: req.limits(),
+		IsDefault:  req.IsDefault,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if !validPlanLimits(plan.PlanLimits) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sizes must be positive"})
+		return
+	}
+
+	err := utils.WithTransaction(c, func(sessCtx mongo.SessionContext) error {
+		if plan.IsDefault {
+			if err := clearDefaultPlan(sessCtx, plan.ID); err != nil {
+				return err
+			}
+		}
+		_, err := utils.GetCollection("plans").InsertOne(sessCtx, plan)
+		return err
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A plan with this ID already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("Could not create plan %s: %v", plan.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create plan"})
+		return
+	}
+
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+	recordAudit(c, adminID, "admin.plan_created", map[string]interface{}{"plan_id": plan.ID})
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Plan created", "plan": plan})
+}
+
+// UpdatePlan changes a plan's name and limits. Users on the plan get the
+// new limits right away.
+func UpdatePlan(c *gin.Context) {
+	var req planRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limits := req.limits()
+	if !validPlanLimits(limits) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sizes must be positive"})
+		return
+	}
+
+	planID := c.Param("id")
+	var plan models.Plan
+	err := utils.WithTransaction(c, func(sessCtx mongo.SessionContext) error {
+		if req.IsDefault {
+			if err := clearDefaultPlan(sessCtx, planID); err != nil {
+				return err
+			}
+		}
+		err := utils.GetCollection("plans").FindOneAndUpdate(sessCtx, bson.M{"_id": planID}, bson.M{"$set": bson.M{
+			"name":          req.Name,
+			"max_storage":   limits.MaxStorage,
+			"max_file_size": limits.MaxFileSize,
+			"is_default":    req.IsDefault,
+			"updated_at":    time.Now(),
+		}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&plan)
+		if err == mongo.ErrNoDocuments {
+			return errPlanNotFound
+		}
+		return err
+	})
+	if errors.Is(err, errPlanNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Could not update plan %s: %v", planID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update plan"})
+		return
+	}
+
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+	recordAudit(c, adminID, "admin.plan_updated", map[string]interface{}{"plan_id": plan.ID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Plan updated", "plan": plan})
+}
+
+// DeletePlan removes a plan nobody is assigned to
+func DeletePlan(c *gin.Context) {
+	planID := c.Param("id")
+
+	assigned, err := utils.GetCollection("users").CountDocuments(c, bson.M{"plan_id": planID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete plan"})
+		return
+	}
+	if assigned > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Plan is still assigned to users", "users": assigned})
+		return
+	}
+
+	result, err := utils.GetCollection("plans").DeleteOne(c, bson.M{"_id": planID, "is_default": bson.M{"$ne": true}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete plan"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found, or it is the default plan"})
+		return
+	}
+
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+	recordAudit(c, adminID, "admin.plan_deleted", map[string]interface{}{"plan_id": planID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Plan deleted"})
+}
+
+// clearDefaultPlan unmarks the current default unless it is planID
+func clearDefaultPlan(ctx context.Context, planID string) error {
+	_, err := utils.GetCollection("plans").UpdateMany(ctx,
+		bson.M{"is_default": true, "_id": bson.M{"$ne": planID}},
+		bson.M{"$set": bson.M{"is_default": false, "updated_at": time.Now()}})
+	return err
+}
+
+// GetUserPlan shows a user's plan, overrides and effective limits
+func GetUserPlan(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	count, err := utils.GetCollection("users").CountDocuments(c, bson.M{"_id": userID})
+	if err != nil || count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	plan, overrides, err := userPlan(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve plan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plan":      plan,
+		"overrides": overrides,
+		"limits":    overrides.Apply(plan.PlanLimits),
+	})
+}
+
+// UpdateUserPlan assigns a user's plan (empty for the default) and replaces
+// their overrides (none to clear them)
+func UpdateUserPlan(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req struct {
+		PlanID    string                `json:"plan_id"`
+		Overrides *models.PlanOverrides `json:"overrides"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	plan, err := findPlan(c, req.PlanID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve plan"})
+		return
+	}
+	if req.PlanID != "" && plan.ID != req.PlanID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	}
+
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+
+	set := bson.M{}
+	unset := bson.M{}
+	if req.PlanID != "" {
+		set["plan_id"] = req.PlanID
+	} else {
+		unset["plan_id"] = ""
+	}
+	if req.Overrides != nil && *req.Overrides != (models.PlanOverrides{}) {
+		if !validPlanLimits(req.Overrides.Apply(plan.PlanLimits)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Sizes must be positive"})
+			return
+		}
+		req.Overrides.UpdatedBy = adminID
+		req.Overrides.UpdatedAt = time.Now()
+		set["plan_overrides"] = req.Overrides
+	} else {
+		req.Overrides = nil
+		unset["plan_overrides"] = ""
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	result, err := utils.GetCollection("users").UpdateOne(c, bson.M{"_id": userID}, update)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update plan"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	recordAudit(c, adminID, "admin.user_plan_updated", map[string]interface{}{
+		"user_id":   userID.Hex(),
+		"plan_id":   plan.ID,
+		"overrides": req.Overrides != nil,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Plan updated",
+		"plan":      plan,
+		"overrides": req.Overrides,
+		"limits":    req.Overrides.Apply(plan.PlanLimits),
+	})
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/ayushsarode/DriftBox/models"
+)
+
+func TestValidPlanLimits(t *testing.T) {
+	valid := models.DefaultPlan.PlanLimits
+
+	tests := []struct {
+		name   string
+		modify func(l *models.PlanLimits)
+		want   bool
+	}{
+		{"default plan", func(l *models.PlanLimits) {}, true},
+		{"zero storage", func(l *models.PlanLimits) { l.MaxStorage = 0 }, false},
+		{"zero file size", func(l *models.PlanLimits) { l.MaxFileSize = 0 }, false},
+		{"negative storage", func(l *models.PlanLimits) { l.MaxStorage = -1 }, false},
+		{"negative file size", func(l *models.PlanLimits) { l.MaxFileSize = -1 }, false},
+	}
+	for _, tt := range tests {
+		limits := valid
+		tt.modify(&limits)
+		if got := validPlanLimits(limits); got != tt.want {
+			t.Errorf("%s: validPlanLimits = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlanIDPattern(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"free", true},
+		{"pro-2024", true},
+		{"0", true},
+		{"", false},
+		{"-pro", false},
+		{"Pro", false},
+		{"pro plan", false},
+		{"pro_plan", false},
+		{"a234567890123456789012345678901x", true},
+		{"a234567890123456789012345678901xy", false},
+	}
+	for _, tt := range tests {
+		if got := planIDPattern.MatchString(tt.id); got != tt.want {
+			t.Errorf("planIDPattern.MatchString(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	processingWorkers = 2
+	// how long a worker may hold a file before another instance retries it
+	processingLease = 10 * time.Minute
+	// files the sweep picks up that were never queued (full queue, restart)
+	processingSweepDelay = time.Minute
+	processingSweepBatch = 100
+)
+
+// processingQueue feeds newly stored files to the background workers. It is
+// only a fast path: the sweep finds anything that never made it onto it.
+var processingQueue = make(chan primitive.ObjectID, 256)
+
+// queueFileProcessing schedules post-upload work for a file without blocking
+func queueFileProcessing(fileID primitive.ObjectID) {
+	select {
+	case processingQueue <- fileID:
+	default:
+		// the sweep will get to it
+	}
+}
+
+// StartFileProcessor runs the post-upload pipeline: malware scan, then
+// thumbnails and previews
+func StartFileProcessor(ctx context.Context) {
+	for i := 0; i < processingWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case fileID := <-processingQueue:
+					processFile(ctx, fileID)
+				}
+			}
+		}()
+	}
+
+	runPeriodically(ctx, "file processing sweep", time.Minute, sweepUnprocessedFiles)
+}
+
+func sweepUnprocessedFiles(ctx context.Context) error {
+	now := time.Now()
+	cursor, err := utils.GetCollection("files").Find(ctx, bson.M{
+		"processed_at": bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"processing_lease": bson.M{"$exists": false}, "created_at": bson.M{"$lte": now.Add(-processingSweepDelay)}},
+			{"processing_lease": bson.M{"$lte": now}},
+		},
+	}, options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(processingSweepBatch))
+	if err != nil {
+		return err
+	}
+
+	var files []models.File
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		processFile(ctx, file.ID)
+	}
+	return nil
+}
+
+// processFile runs every stage for one file. The lease keeps two workers from
+// processing the same file at once.
+func processFile(ctx context.Context, fileID primitive.ObjectID) {
+	collection := utils.GetCollection("files")
+	now := time.Now()
+
+	var file models.File
+	err := collection.FindOneAndUpdate(ctx, bson.M{
+		"_id":          fileID,
+		"processed_at": bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"processing_lease": bson.M{"$exists": false}},
+			{"processing_lease": bson.M{"$lte": now}},
+		},
+	}, bson.M{
+		"$set": bson.M{"processing_lease": now.Add(processingLease)},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return
+	}
+	if err != nil {
+		log.Printf("Could not claim file %s for processing: %v", fileID.Hex(), err)
+		return
+	}
+
+	// the parsers run on untrusted content, so a crafted file that panics one
+	// fails its own processing instead of taking the server down. It is
+	// marked processed so the sweep doesn't retry it forever.
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Processing file %s panicked: %v\n%s", file.ID.Hex(), r, debug.Stack())
+			collection.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{
+				"$set":   bson.M{"thumbnail_status": models.ThumbnailFailed, "processed_at": time.Now()},
+				"$unset": bson.M{"processing_lease": ""},
+			})
+		}
+	}()
+
+	// the scan runs first so infected content is never processed further
+	if scanFile(ctx, &file) {
+		collection.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{
+			"$set": bson.M{"processing_lease": time.Now().Add(scanRetryDelay)},
+		})
+		return
+	}
+
+	if !file.Quarantined() {
+		generateThumbnails(ctx, &file)
+	}
+
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{
+		"$set":   bson.M{"processed_at": time.Now()},
+		"$unset": bson.M{"processing_lease": ""},
+	})
+	if err != nil {
+		log.Printf("Could not mark file %s processed: %v", file.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// uploads that haven't finished by then were abandoned
+	reservationTimeout       = 30 * time.Minute
+	reservationSweepInterval = time.Minute
+)
+
+// reserveQuota holds size bytes of the user's quota for an upload. The
+// check and the hold are one conditional update, so concurrent uploads
+// can't overshoot maxStorage between them. It returns errStorageFull when
+// the bytes don't fit.
+func reserveQuota(ctx context.Context, userID primitive.ObjectID, size, maxStorage int64) (*models.QuotaReservation, error) {
+	// makes sure the counters exist
+	if _, err := getUserStorage(ctx, userID); err != nil {
+		return nil, fmt.Errorf("could not check storage usage: %v", err)
+	}
+
+	now := time.Now()
+	reservation := models.QuotaReservation{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Size:      size,
+		CreatedAt: now,
+		ExpiresAt: now.Add(reservationTimeout),
+	}
+
+	err := utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		result, err := utils.GetCollection("user_storage").UpdateOne(sessCtx, bson.M{
+			"user_id": userID,
+			"$expr": bson.M{"$lte": bson.A{
+				bson.M{"$add": bson.A{"$used_space", bson.M{"$ifNull": bson.A{"$reserved_space", 0}}, size}},
+				maxStorage,
+			}},
+		}, bson.M{
+			"$inc": bson.M{"reserved_space": size},
+			"$set": bson.M{"updated_at": now},
+		})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return errStorageFull
+		}
+		_, err = utils.GetCollection("quota_reservations").InsertOne(sessCtx, reservation)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &reservation, nil
+}
+
+// commitReservation turns the reservation into used space. It runs in the
+// transaction that saves the upload. A reservation that already expired is
+// still charged; only the hold is gone.
+func commitReservation(ctx context.Context, reservation *models.QuotaReservation) error {
+	result, err := utils.GetCollection("quota_reservations").DeleteOne(ctx, bson.M{"_id": reservation.ID})
+	if err != nil {
+		return err
+	}
+	held := int64(0)
+	if result.DeletedCount == 1 {
+		held = reservation.Size
+	}
+
+	_, err = utils.GetCollection("user_storage").UpdateOne(ctx, bson.M{"user_id": reservation.UserID}, bson.M{
+		"$inc": bson.M{"used_space": reservation.Size, "reserved_space": -held},
+		"$set": bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		return fmt.Errorf("could not update storage usage: %v", err)
+	}
+	return nil
+}
+
+// releaseReservation gives the reserved bytes back, exactly once
+func releaseReservation(ctx context.Context, reservation *models.QuotaReservation) error {
+	return utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		result, err := utils.GetCollection("quota_reservations").DeleteOne(sessCtx, bson.M{"_id": reservation.ID})
+		if err != nil || result.DeletedCount == 0 {
+			return err
+		}
+		_, err = utils.GetCollection("user_storage").UpdateOne(sessCtx, bson.M{"user_id": reservation.UserID}, bson.M{
+			"$inc": bson.M{"reserved_space": -reservation.Size},
+			"$set": bson.M{"updated_at": time.Now()},
+		})
+		return err
+	})
+}
+
+// StartReservationSweeper releases reservations of uploads that never
+// finished, e.g. because their instance died
+func StartReservationSweeper(ctx context.Context) {
+	runPeriodically(ctx, "quota reservation sweeper", reservationSweepInterval, releaseExpiredReservations)
+}
+
+func releaseExpiredReservations(ctx context.Context) error {
+	cursor, err := utils.GetCollection("quota_reservations").Find(ctx,
+		bson.M{"expires_at": bson.M{"$lte": time.Now()}},
+		options.Find().SetLimit(500))
+	if err != nil {
+		return err
+	}
+	var reservations []models.QuotaReservation
+	if err := cursor.All(ctx, &reservations); err != nil {
+		return err
+	}
+
+	for i := range reservations {
+		if err := releaseReservation(ctx, &reservations[i]); err != nil {
+			log.Printf("Could not release quota reservation %s: %v", reservations[i].ID.Hex(), err)
+		}
+	}
+	if len(reservations) > 0 {
+		log.Printf("Released %d expired quota reservation(s)", len(reservations))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestQuotaReservations(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+
+	userID := primitive.NewObjectID()
+	t.Cleanup(func() {
+		utils.GetCollection("user_storage").DeleteOne(ctx, bson.M{"user_id": userID})
+		utils.GetCollection("quota_reservations").DeleteMany(ctx, bson.M{"user_id": userID})
+	})
+
+	const maxStorage = 100
+	usage := func() (used, reserved int64) {
+		t.Helper()
+		var storage models.UserStorage
+		if err := utils.GetCollection("user_storage").FindOne(ctx, bson.M{"user_id": userID}).Decode(&storage); err != nil {
+			t.Fatal(err)
+		}
+		return storage.UsedSpace, storage.ReservedSpace
+	}
+	reserve := func(size int64) *models.QuotaReservation {
+		t.Helper()
+		reservation, err := reserveQuota(ctx, userID, size, maxStorage)
+		if err != nil {
+			t.Fatalf("reserveQuota(%d): %v", size, err)
+		}
+		return reservation
+	}
+
+	first := reserve(60)
+	if _, err := reserveQuota(ctx, userID, 41, maxStorage); !errors.Is(err, errStorageFull) {
+		t.Fatalf("reservation over the limit: error = %v, want errStorageFull", err)
+	}
+	if _, reserved := usage(); reserved != 60 {
+		t.Errorf("reserved = %d after a refused reservation, want 60", reserved)
+	}
+	second := reserve(40)
+
+	// released bytes can be reserved again, and only come back once
+	if err := releaseReservation(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseReservation(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if used, reserved := usage(); used != 0 || reserved != 40 {
+		t.Errorf("after release: used %d, reserved %d, want 0 and 40", used, reserved)
+	}
+	third := reserve(60)
+
+	// a committed reservation becomes used space
+	if err := commitReservation(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if used, reserved := usage(); used != 40 || reserved != 60 {
+		t.Errorf("after commit: used %d, reserved %d, want 40 and 60", used, reserved)
+	}
+	if _, err := reserveQuota(ctx, userID, 1, maxStorage); !errors.Is(err, errStorageFull) {
+		t.Errorf("reservation with used and reserved space at the limit: error = %v, want errStorageFull", err)
+	}
+
+	// an expired reservation released by the sweeper is still charged on commit
+	if err := releaseReservation(ctx, third); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitReservation(ctx, third); err != nil {
+		t.Fatal(err)
+	}
+	if used, reserved := usage(); used != 100 || reserved != 0 {
+		t.Errorf("after late commit: used %d, reserved %d, want 100 and 0", used, reserved)
+	}
+}
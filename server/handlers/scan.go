@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	maxScanAttempts = 3
+	scanRetryDelay  = 5 * time.Minute
+)
+
+// scanFailOpen reports whether content the scanner gave no verdict on (see
+// models.File.Unscanned) is served anyway. By default it is withheld, like
+// content still awaiting its scan.
+func scanFailOpen() bool {
+	return os.Getenv("SCAN_FAIL_OPEN") == "true"
+}
+
+// scanFile runs the malware scan stage. It returns true when the scan failed
+// in a way worth retrying later; after maxScanAttempts the file is marked
+// with the error instead.
+func scanFile(ctx context.Context, file *models.File) bool {
+	if file.ScanStatus != models.ScanPending {
+		return false
+	}
+
+	collection := utils.GetCollection("files")
+
+	scanner := utils.GetScanner()
+	if scanner == nil {
+		// scanning was turned off after this file was queued
+		skipScan(ctx, file, "scanning disabled")
+		return false
+	}
+
+	result, err := scanContent(ctx, scanner, file)
+	if errors.Is(err, utils.ErrScanTooLarge) {
+		// retrying won't help; the file is marked as unscanned
+		skipScan(ctx, file, err.Error())
+		recordBlobScan(ctx, file)
+		return false
+	}
+	if err != nil {
+		file.ScanAttempts++
+		log.Printf("Scan of file %s failed (attempt %d): %v", file.ID.Hex(), file.ScanAttempts, err)
+
+		update := bson.M{"scan_attempts": file.ScanAttempts, "scan_error": err.Error()}
+		retry := file.ScanAttempts < maxScanAttempts
+		if !retry {
+			file.ScanStatus = models.ScanError
+			update["scan_status"] = models.ScanError
+		}
+		collection.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{"$set": update})
+		return retry
+	}
+
+	now := time.Now()
+	file.ScannedAt = &now
+
+	if !result.Infected {
+		file.ScanStatus = models.ScanClean
+		collection.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{
+			"$set":   bson.M{"scan_status": models.ScanClean, "scanned_at": now},
+			"$unset": bson.M{"scan_error": ""},
+		})
+		recordBlobScan(ctx, file)
+		return false
+	}
+
+	file.ScanStatus = models.ScanInfected
+	file.ScanSignature = result.Signature
+	file.QuarantinedAt = &now
+	collection.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{
+		"$set": bson.M{
+			"scan_status":    models.ScanInfected,
+			"scan_signature": result.Signature,
+			"scanned_at":     now,
+			"quarantined_at": now,
+		},
+		"$unset": bson.M{"scan_error": ""},
+	})
+
+	announceQuarantine(ctx, file)
+	recordBlobScan(ctx, file)
+	quarantineBlobFiles(ctx, file)
+
+	return false
+}
+
+// skipScan marks a file that won't be scanned, distinguishable from clean
+// files. It is only served when scanFailOpen allows it.
+func skipScan(ctx context.Context, file *models.File, reason string) {
+	file.ScanStatus = models.ScanSkipped
+	_, err := utils.GetCollection("files").UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{
+		"$set": bson.M{"scan_status": models.ScanSkipped, "scan_error": reason},
+	})
+	if err != nil {
+		log.Printf("Could not mark scan of file %s skipped: %v", file.ID.Hex(), err)
+	}
+}
+
+// announceQuarantine tells the owner and the audit log about a file that
+// was just quarantined
+func announceQuarantine(ctx context.Context, file *models.File) {
+	log.Printf("Quarantined file %s of user %s: %s", file.ID.Hex(), file.UserID.Hex(), file.ScanSignature)
+	recordAudit(ctx, file.UserID, "file.quarantined", map[string]interface{}{
+		"file_id":   file.ID,
+		"name":      file.Name,
+		"signature": file.ScanSignature,
+	})
+	notifyUser(ctx, file.UserID, "file_quarantined", "A file was quarantined",
+		fmt.Sprintf("%q was found to contain %s and has been quarantined. It can no longer be downloaded.", file.Name, file.ScanSignature),
+		"", nil)
+}
+
+// recordBlobScan stores a verdict on the file's blob so later uploads of the
+// same content inherit it instead of being scanned again
+func recordBlobScan(ctx context.Context, file *models.File) {
+	if file.BlobID == "" {
+		return
+	}
+	_, err := utils.GetCollection("blobs").UpdateOne(ctx, bson.M{"_id": file.BlobID}, bson.M{"$set": bson.M{
+		"scan_status":    file.ScanStatus,
+		"scan_signature": file.ScanSignature,
+		"scanned_at":     file.ScannedAt,
+	}})
+	if err != nil {
+		log.Printf("Could not record scan result on blob %s: %v", file.BlobID, err)
+	}
+}
+
+// quarantineBlobFiles quarantines every other file sharing infected content
+func quarantineBlobFiles(ctx context.Context, file *models.File) {
+	if file.BlobID == "" {
+		return
+	}
+
+	var others []models.File
+	err := findAll(ctx, "files", bson.M{
+		"blob_id":     file.BlobID,
+		"_id":         bson.M{"$ne": file.ID},
+		"scan_status": bson.M{"$ne": models.ScanInfected},
+	}, &others)
+	if err != nil {
+		log.Printf("Could not find files sharing blob %s: %v", file.BlobID, err)
+		return
+	}
+
+	for _, other := range others {
+		result, err := utils.GetCollection("files").UpdateOne(ctx, bson.M{
+			"_id":         other.ID,
+			"scan_status": bson.M{"$ne": models.ScanInfected},
+		}, bson.M{
+			"$set": bson.M{
+				"scan_status":    models.ScanInfected,
+				"scan_signature": file.ScanSignature,
+				"scanned_at":     file.ScannedAt,
+				"quarantined_at": file.QuarantinedAt,
+			},
+			"$unset": bson.M{"scan_error": ""},
+		})
+		if err != nil || result.ModifiedCount == 0 {
+			continue
+		}
+		other.ScanSignature = file.ScanSignature
+		announceQuarantine(ctx, &other)
+	}
+}
+
+// inheritBlobScan gives a new file the verdict already known for its
+// content. Files of unscanned content are queued for scanning as usual.
+func inheritBlobScan(file *models.File, blob *models.Blob) {
+	switch blob.ScanStatus {
+	case models.ScanClean:
+		file.ScanStatus = models.ScanClean
+		file.ScannedAt = blob.ScannedAt
+	case models.ScanSkipped:
+		file.ScanStatus = models.ScanSkipped
+	case models.ScanInfected:
+		now := time.Now()
+		file.ScanStatus = models.ScanInfected
+		file.ScanSignature = blob.ScanSignature
+		file.ScannedAt = blob.ScannedAt
+		file.QuarantinedAt = &now
+	default:
+		if utils.GetScanner() != nil {
+			file.ScanStatus = models.ScanPending
+		}
+	}
+}
+
+func scanContent(ctx context.Context, scanner utils.Scanner, file *models.File) (utils.ScanResult, error) {
+	reader, err := openFileContent(ctx, file)
+	if err != nil {
+		return utils.ScanResult{}, err
+	}
+	defer reader.Close()
+
+	return scanner.Scan(ctx, reader)
+}
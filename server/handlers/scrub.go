@@ -0,0 +1,796 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// how often instances check whether a scrub is due
+	scrubCheckInterval   = time.Hour
+	defaultScrubInterval = 24 * time.Hour
+
+	scrubFileBatch   = 200
+	scrubObjectBatch = 500
+	// objects this new may belong to an upload that hasn't saved its record yet
+	scrubObjectGrace = time.Hour
+	// a run without a heartbeat for this long died with its instance
+	scrubStaleAfter = 30 * time.Minute
+
+	scrubRepairLimit = 1000
+)
+
+// repair actions an admin can apply to open issues
+const (
+	scrubDeleteOrphans  = "delete_orphans"
+	scrubReparentToRoot = "reparent_to_root"
+	scrubDismiss        = "dismiss"
+)
+
+// scrubPrefixes are the parts of the bucket records point into
+var scrubPrefixes = []string{"users/", "blobs/"}
+
+var thumbnailObjectPattern = regexp.MustCompile(`^users/[0-9a-f]{24}/files/([0-9a-f]{24})\.thumb_([a-z]+)\.jpg$`)
+
+var errScrubRunning = errors.New("a scrub is already running")
+
+// StartStorageScrubber verifies every file's object against its record and
+// looks for objects and files nothing refers to any more. Findings go to the
+// scrub_issues collection for an admin to review.
+func StartStorageScrubber(ctx context.Context) {
+	runPeriodically(ctx, "storage scrubber", scrubCheckInterval, func(ctx context.Context) error {
+		due, err := scrubDue(ctx)
+		if err != nil || !due {
+			return err
+		}
+		run, err := startScrubRun(ctx)
+		if errors.Is(err, errScrubRunning) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return runScrub(ctx, run)
+	})
+}
+
+func scrubInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SCRUB_INTERVAL")); err == nil && d > 0 {
+		return d
+	}
+	return defaultScrubInterval
+}
+
+func scrubDue(ctx context.Context) (bool, error) {
+	var last models.ScrubRun
+	err := utils.GetCollection("scrub_runs").FindOne(ctx, bson.M{},
+		options.FindOne().SetSort(bson.M{"started_at": -1})).Decode(&last)
+	if err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Since(last.StartedAt) >= scrubInterval(), nil
+}
+
+// startScrubRun records a new run. A unique index on running runs makes
+// sure only one instance scrubs at a time.
+func startScrubRun(ctx context.Context) (*models.ScrubRun, error) {
+	runs := utils.GetCollection("scrub_runs")
+	now := time.Now()
+
+	_, err := runs.UpdateMany(ctx, bson.M{
+		"status":       models.ScrubRunning,
+		"heartbeat_at": bson.M{"$lt": now.Add(-scrubStaleAfter)},
+	}, bson.M{"$set": bson.M{
+		"status":      models.ScrubFailed,
+		"finished_at": now,
+		"error":       "abandoned",
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	run := models.ScrubRun{
+		ID:          primitive.NewObjectID(),
+		Status:      models.ScrubRunning,
+		StartedAt:   now,
+		HeartbeatAt: now,
+	}
+	if _, err := runs.InsertOne(ctx, run); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, errScrubRunning
+		}
+		return nil, err
+	}
+	return &run, nil
+}
+
+type scrubber struct {
+	run *models.ScrubRun
+	// what was found on each blob so far, so content shared by many files is
+	// only checked once per run
+	blobs map[string]*models.ScrubIssue
+}
+
+func runScrub(ctx context.Context, run *models.ScrubRun) error {
+	s := &scrubber{run: run, blobs: map[string]*models.ScrubIssue{}}
+
+	err := s.checkFiles(ctx)
+	if err == nil {
+		err = s.checkObjects(ctx)
+	}
+
+	now := time.Now()
+	update := bson.M{
+		"status":          models.ScrubCompleted,
+		"finished_at":     now,
+		"heartbeat_at":    now,
+		"files_checked":   run.FilesChecked,
+		"objects_checked": run.ObjectsChecked,
+		"issues_found":    run.IssuesFound,
+	}
+	if err != nil {
+		update["status"] = models.ScrubFailed
+		update["error"] = err.Error()
+	}
+	if _, uerr := utils.GetCollection("scrub_runs").UpdateOne(ctx, bson.M{"_id": run.ID}, bson.M{"$set": update}); uerr != nil {
+		log.Printf("Could not record scrub run %s: %v", run.ID.Hex(), uerr)
+	}
+	if err != nil {
+		return err
+	}
+
+	// a complete run saw everything, so what it didn't report again is gone
+	resolved, err := utils.GetCollection("scrub_issues").UpdateMany(ctx, bson.M{
+		"status": models.ScrubIssueOpen,
+		"run_id": bson.M{"$ne": run.ID},
+	}, bson.M{"$set": bson.M{
+		"status":      models.ScrubIssueResolved,
+		"resolved_at": now,
+		"resolution":  "no longer found",
+	}})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Storage scrub checked %d file(s) and %d object(s): %d issue(s), %d resolved",
+		run.FilesChecked, run.ObjectsChecked, run.IssuesFound, resolved.ModifiedCount)
+	return nil
+}
+
+func (s *scrubber) heartbeat(ctx context.Context) error {
+	_, err := utils.GetCollection("scrub_runs").UpdateOne(ctx, bson.M{"_id": s.run.ID}, bson.M{"$set": bson.M{
+		"heartbeat_at":    time.Now(),
+		"files_checked":   s.run.FilesChecked,
+		"objects_checked": s.run.ObjectsChecked,
+		"issues_found":    s.run.IssuesFound,
+	}})
+	return err
+}
+
+// checkFiles walks the files collection in _id order
+func (s *scrubber) checkFiles(ctx context.Context) error {
+	collection := utils.GetCollection("files")
+	filter := bson.M{}
+
+	for {
+		cursor, err := collection.Find(ctx, filter, options.Find().
+			SetSort(bson.M{"_id": 1}).
+			SetLimit(scrubFileBatch))
+		if err != nil {
+			return err
+		}
+		var files []models.File
+		if err := cursor.All(ctx, &files); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return nil
+		}
+
+		missingFolders, err := missingFolderIDs(ctx, files)
+		if err != nil {
+			return err
+		}
+
+		for i := range files {
+			file := &files[i]
+			s.run.FilesChecked++
+
+			if file.FolderID != nil && missingFolders[*file.FolderID] {
+				if err := s.report(ctx, models.ScrubIssue{
+					Key:      fmt.Sprintf("%s:%s", models.ScrubOrphanFile, file.ID.Hex()),
+					Kind:     models.ScrubOrphanFile,
+					FileID:   &file.ID,
+					UserID:   &file.UserID,
+					FolderID: file.FolderID,
+					Detail:   "folder no longer exists",
+				}); err != nil {
+					return err
+				}
+			}
+
+			if err := s.checkFileObject(ctx, file); err != nil {
+				return err
+			}
+		}
+
+		filter = bson.M{"_id": bson.M{"$gt": files[len(files)-1].ID}}
+		if err := s.heartbeat(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func missingFolderIDs(ctx context.Context, files []models.File) (map[primitive.ObjectID]bool, error) {
+	missing := map[primitive.ObjectID]bool{}
+	var ids []primitive.ObjectID
+	for _, file := range files {
+		if file.FolderID != nil && !missing[*file.FolderID] {
+			missing[*file.FolderID] = true
+			ids = append(ids, *file.FolderID)
+		}
+	}
+	if len(ids) == 0 {
+		return missing, nil
+	}
+
+	var folders []models.Folder
+	if err := findAll(ctx, "folders", bson.M{"_id": bson.M{"$in": ids}}, &folders); err != nil {
+		return nil, err
+	}
+	for _, folder := range folders {
+		delete(missing, folder.ID)
+	}
+	return missing, nil
+}
+
+func (s *scrubber) checkFileObject(ctx context.Context, file *models.File) error {
+	var issue *models.ScrubIssue
+	if cached, ok := s.blobs[file.BlobID]; ok && file.BlobID != "" {
+		issue = cached
+	} else {
+		var err error
+		if issue, err = verifyFileObject(ctx, file); err != nil {
+			return err
+		}
+		if file.BlobID != "" {
+			s.blobs[file.BlobID] = issue
+		}
+	}
+	if issue == nil {
+		return nil
+	}
+
+	if issue.Kind == models.ScrubMissingObject {
+		// the file may have been deleted since this batch was read
+		exists, err := utils.GetCollection("files").CountDocuments(ctx, bson.M{"_id": file.ID})
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return nil
+		}
+	}
+
+	found := *issue
+	found.Key = fmt.Sprintf("%s:%s", issue.Kind, file.ID.Hex())
+	found.FileID = &file.ID
+	found.UserID = &file.UserID
+	found.ObjectPath = file.Path
+	return s.report(ctx, found)
+}
+
+// verifyFileObject checks that a file's object exists with the size and
+// checksum its record says. It returns an error only when storage can't be
+// asked at all.
+func verifyFileObject(ctx context.Context, file *models.File) (*models.ScrubIssue, error) {
+	attrs, err := utils.StatGCSObject(ctx, file.Path)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return &models.ScrubIssue{Kind: models.ScrubMissingObject}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	storedSize := file.Size
+	if file.Encryption != nil {
+		storedSize = utils.EncryptedSize(file.Size)
+	}
+	if attrs.Size != storedSize {
+		return &models.ScrubIssue{
+			Kind:     models.ScrubSizeMismatch,
+			Expected: strconv.FormatInt(storedSize, 10),
+			Actual:   strconv.FormatInt(attrs.Size, 10),
+		}, nil
+	}
+
+	if file.Encryption == nil && file.CRC32C != "" {
+		// GCS keeps the CRC32C of what it stores, so plaintext objects
+		// don't have to be read
+		if actual := encodeCRC32C(attrs.CRC32C); actual != file.CRC32C {
+			return &models.ScrubIssue{
+				Kind:     models.ScrubChecksumMismatch,
+				Expected: "crc32c=" + file.CRC32C,
+				Actual:   "crc32c=" + actual,
+			}, nil
+		}
+		return nil, nil
+	}
+	if file.Quarantined() {
+		// infected content is never read back
+		return nil, nil
+	}
+
+	// encrypted objects (whose stored checksum covers the ciphertext) and
+	// records from before checksums are verified by reading them, which
+	// also fills in the checksums of the latter
+	reader, err := openFileContent(ctx, file)
+	if err != nil {
+		return &models.ScrubIssue{Kind: models.ScrubUnreadable, Detail: err.Error()}, nil
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		if errors.Is(err, errIntegrity) {
+			return &models.ScrubIssue{
+				Kind:     models.ScrubChecksumMismatch,
+				Expected: "sha-256=" + file.SHA256,
+			}, nil
+		}
+		return &models.ScrubIssue{Kind: models.ScrubUnreadable, Detail: err.Error()}, nil
+	}
+	return nil, nil
+}
+
+// checkObjects lists the bucket for objects no record refers to
+func (s *scrubber) checkObjects(ctx context.Context) error {
+	cutoff := time.Now().Add(-scrubObjectGrace)
+
+	var batch []string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		orphans, err := unreferencedObjects(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, name := range orphans {
+			if err := s.report(ctx, models.ScrubIssue{
+				Key:        fmt.Sprintf("%s:%s", models.ScrubOrphanObject, name),
+				Kind:       models.ScrubOrphanObject,
+				ObjectPath: name,
+			}); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return s.heartbeat(ctx)
+	}
+
+	for _, prefix := range scrubPrefixes {
+		err := utils.ListGCSObjects(ctx, prefix, func(attrs *storage.ObjectAttrs) error {
+			if attrs.Updated.After(cutoff) {
+				return nil
+			}
+			s.run.ObjectsChecked++
+			batch = append(batch, attrs.Name)
+			if len(batch) >= scrubObjectBatch {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// unreferencedObjects returns the names no file, thumbnail, blob or export
+// refers to
+func unreferencedObjects(ctx context.Context, names []string) ([]string, error) {
+	referenced := map[string]bool{}
+
+	for _, name := range []string{"files", "blobs", "exports"} {
+		var docs []struct {
+			Path string `bson:"path"`
+		}
+		err := findAll(ctx, name, bson.M{"path": bson.M{"$in": names}}, &docs)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			referenced[doc.Path] = true
+		}
+	}
+
+	var thumbnailFileIDs []primitive.ObjectID
+	for _, name := range names {
+		if match := thumbnailObjectPattern.FindStringSubmatch(name); match != nil {
+			if id, err := primitive.ObjectIDFromHex(match[1]); err == nil {
+				thumbnailFileIDs = append(thumbnailFileIDs, id)
+			}
+		}
+	}
+	if len(thumbnailFileIDs) > 0 {
+		var files []models.File
+		err := findAll(ctx, "files", bson.M{"_id": bson.M{"$in": thumbnailFileIDs}}, &files)
+		if err != nil {
+			return nil, err
+		}
+		for i := range files {
+			for _, size := range files[i].Thumbnails {
+				referenced[thumbnailPath(&files[i], size)] = true
+			}
+		}
+	}
+
+	var orphans []string
+	for _, name := range names {
+		if !referenced[name] {
+			orphans = append(orphans, name)
+		}
+	}
+	return orphans, nil
+}
+
+// report records an issue, or refreshes the open issue with the same key
+func (s *scrubber) report(ctx context.Context, issue models.ScrubIssue) error {
+	s.run.IssuesFound++
+	now := time.Now()
+
+	insert := bson.M{
+		"_id":           primitive.NewObjectID(),
+		"kind":          issue.Kind,
+		"first_seen_at": now,
+	}
+	if issue.FileID != nil {
+		insert["file_id"] = issue.FileID
+	}
+	if issue.UserID != nil {
+		insert["user_id"] = issue.UserID
+	}
+	if issue.FolderID != nil {
+		insert["folder_id"] = issue.FolderID
+	}
+	if issue.ObjectPath != "" {
+		insert["object_path"] = issue.ObjectPath
+	}
+
+	_, err := utils.GetCollection("scrub_issues").UpdateOne(ctx, bson.M{
+		"key":    issue.Key,
+		"status": models.ScrubIssueOpen,
+	}, bson.M{
+		"$set": bson.M{
+			"run_id":       s.run.ID,
+			"last_seen_at": now,
+			"expected":     issue.Expected,
+			"actual":       issue.Actual,
+			"detail":       issue.Detail,
+		},
+		"$setOnInsert": insert,
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// GetScrubStatus shows recent scrub runs and the open issues by kind
+func GetScrubStatus(c *gin.Context) {
+	runs := []models.ScrubRun{}
+	cursor, err := utils.GetCollection("scrub_runs").Find(c, bson.M{},
+		options.Find().SetSort(bson.M{"started_at": -1}).SetLimit(10))
+	if err == nil {
+		err = cursor.All(c, &runs)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve scrub runs"})
+		return
+	}
+
+	cursor, err = utils.GetCollection("scrub_issues").Aggregate(c, []bson.M{
+		{"$match": bson.M{"status": models.ScrubIssueOpen}},
+		{"$group": bson.M{"_id": "$kind", "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve scrub issues"})
+		return
+	}
+	var counts []struct {
+		Kind  string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	if err := cursor.All(c, &counts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve scrub issues"})
+		return
+	}
+	openIssues := gin.H{}
+	for _, count := range counts {
+		openIssues[count.Kind] = count.Count
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"interval":    scrubInterval().String(),
+		"runs":        runs,
+		"open_issues": openIssues,
+	})
+}
+
+// StartScrub runs the scrubber now instead of waiting for the next due run
+func StartScrub(c *gin.Context) {
+	run, err := startScrubRun(c)
+	if errors.Is(err, errScrubRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Scrub already running"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start scrub"})
+		return
+	}
+
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+	recordAudit(c, adminID, "admin.scrub_started", map[string]interface{}{"run_id": run.ID.Hex()})
+
+	go func() {
+		if err := runScrub(context.Background(), run); err != nil {
+			log.Printf("Storage scrub %s failed: %v", run.ID.Hex(), err)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Scrub started", "run": run})
+}
+
+// GetScrubIssues lists scrub findings, open ones by default
+func GetScrubIssues(c *gin.Context) {
+	filter := bson.M{"status": models.ScrubIssueOpen}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+	if kind := c.Query("kind"); kind != "" {
+		filter["kind"] = kind
+	}
+	if runID := c.Query("run_id"); runID != "" {
+		runObjID, err := primitive.ObjectIDFromHex(runID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+			return
+		}
+		filter["run_id"] = runObjID
+	}
+
+	limit := int64(100)
+	if n, err := strconv.ParseInt(c.Query("limit"), 10, 64); err == nil && n > 0 && n <= 500 {
+		limit = n
+	}
+
+	cursor, err := utils.GetCollection("scrub_issues").Find(c, filter,
+		options.Find().SetSort(bson.M{"last_seen_at": -1}).SetLimit(limit))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve scrub issues"})
+		return
+	}
+	defer cursor.Close(c)
+
+	issues := []models.ScrubIssue{}
+	if err := cursor.All(c, &issues); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not decode scrub issues"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"issues": issues})
+}
+
+// scrubRepairKinds are the issue kinds each action applies to
+var scrubRepairKinds = map[string][]string{
+	scrubDeleteOrphans:  {models.ScrubOrphanObject, models.ScrubOrphanFile},
+	scrubReparentToRoot: {models.ScrubOrphanFile},
+	scrubDismiss: {
+		models.ScrubMissingObject, models.ScrubSizeMismatch, models.ScrubChecksumMismatch,
+		models.ScrubUnreadable, models.ScrubOrphanObject, models.ScrubOrphanFile,
+	},
+}
+
+// RepairScrubIssues applies a repair to open issues: deleting orphaned
+// objects and files, moving orphaned files to the root, or dismissing
+// issues. Without issue_ids it applies to every open issue the action
+// covers, optionally narrowed by kind.
+func RepairScrubIssues(c *gin.Context) {
+	var request struct {
+		Action   string   `json:"action" binding:"required"`
+		Kind     string   `json:"kind"`
+		IssueIDs []string `json:"issue_ids"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	kinds, ok := scrubRepairKinds[request.Action]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown repair action"})
+		return
+	}
+	filter := bson.M{"status": models.ScrubIssueOpen, "kind": bson.M{"$in": kinds}}
+	if request.Kind != "" {
+		filter["kind"] = request.Kind
+		if !slices.Contains(kinds, request.Kind) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Action does not apply to this kind of issue"})
+			return
+		}
+	}
+	if len(request.IssueIDs) > 0 {
+		ids := make([]primitive.ObjectID, 0, len(request.IssueIDs))
+		for _, id := range request.IssueIDs {
+			objID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid issue ID"})
+				return
+			}
+			ids = append(ids, objID)
+		}
+		filter["_id"] = bson.M{"$in": ids}
+	}
+
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+
+	var issues []models.ScrubIssue
+	cursor, err := utils.GetCollection("scrub_issues").Find(c, filter,
+		options.Find().SetSort(bson.M{"_id": 1}).SetLimit(scrubRepairLimit))
+	if err == nil {
+		err = cursor.All(c, &issues)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve scrub issues"})
+		return
+	}
+
+	repaired, failed := 0, 0
+	skipped := []gin.H{}
+	for i := range issues {
+		issue := &issues[i]
+		status, resolution, err := repairScrubIssue(c, issue, request.Action)
+		if err != nil {
+			log.Printf("Could not repair scrub issue %s: %v", issue.ID.Hex(), err)
+			failed++
+			continue
+		}
+		if status == models.ScrubIssueOpen {
+			skipped = append(skipped, gin.H{"id": issue.ID, "reason": resolution})
+			continue
+		}
+
+		now := time.Now()
+		_, err = utils.GetCollection("scrub_issues").UpdateOne(c, bson.M{
+			"_id":    issue.ID,
+			"status": models.ScrubIssueOpen,
+		}, bson.M{"$set": bson.M{
+			"status":      status,
+			"resolved_at": now,
+			"resolved_by": adminID,
+			"resolution":  resolution,
+		}})
+		if err != nil {
+			log.Printf("Could not update scrub issue %s: %v", issue.ID.Hex(), err)
+			failed++
+			continue
+		}
+		if status == models.ScrubIssueResolved {
+			skipped = append(skipped, gin.H{"id": issue.ID, "reason": resolution})
+			continue
+		}
+		repaired++
+	}
+
+	recordAudit(c, adminID, "admin.scrub_repair", map[string]interface{}{
+		"action":   request.Action,
+		"kind":     request.Kind,
+		"repaired": repaired,
+		"failed":   failed,
+	})
+
+	remaining, _ := utils.GetCollection("scrub_issues").CountDocuments(c, filter)
+	c.JSON(http.StatusOK, gin.H{
+		"repaired":  repaired,
+		"skipped":   skipped,
+		"failed":    failed,
+		"remaining": remaining,
+	})
+}
+
+// repairScrubIssue applies action to one issue after checking the problem
+// still exists. It returns the status the issue should get and why: open
+// when the action was refused, resolved when there was nothing left to do.
+func repairScrubIssue(ctx context.Context, issue *models.ScrubIssue, action string) (string, string, error) {
+	if action == scrubDismiss {
+		return models.ScrubIssueDismissed, scrubDismiss, nil
+	}
+
+	switch issue.Kind {
+	case models.ScrubOrphanObject:
+		orphans, err := unreferencedObjects(ctx, []string{issue.ObjectPath})
+		if err != nil {
+			return "", "", err
+		}
+		if len(orphans) == 0 {
+			return models.ScrubIssueResolved, "object is referenced again", nil
+		}
+		if err := deleteObjectIfExists(ctx, issue.ObjectPath); err != nil {
+			return "", "", err
+		}
+		return models.ScrubIssueRepaired, "deleted object", nil
+
+	case models.ScrubOrphanFile:
+		files := utils.GetCollection("files")
+		var file models.File
+		err := files.FindOne(ctx, bson.M{"_id": issue.FileID}).Decode(&file)
+		if err == mongo.ErrNoDocuments {
+			return models.ScrubIssueResolved, "file no longer exists", nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if file.FolderID == nil {
+			return models.ScrubIssueResolved, "file is no longer in a folder", nil
+		}
+		folders, err := utils.GetCollection("folders").CountDocuments(ctx, bson.M{"_id": file.FolderID})
+		if err != nil {
+			return "", "", err
+		}
+		if folders > 0 {
+			return models.ScrubIssueResolved, "folder exists", nil
+		}
+
+		// both updates only apply if the file wasn't moved meanwhile
+		filter := bson.M{"_id": file.ID, "folder_id": file.FolderID}
+		if action == scrubReparentToRoot {
+			if file.VaultID != nil {
+				// ciphertext with a placeholder name is no use outside its vault
+				return models.ScrubIssueOpen, "vault files can only be deleted", nil
+			}
+			result, err := files.UpdateOne(ctx, filter, bson.M{
+				"$unset": bson.M{"folder_id": ""},
+				"$set":   bson.M{"updated_at": time.Now()},
+			})
+			if err != nil {
+				return "", "", err
+			}
+			if result.ModifiedCount == 0 {
+				return models.ScrubIssueResolved, "file was moved", nil
+			}
+			return models.ScrubIssueRepaired, "moved to root", nil
+		}
+
+		deleted, err := removeFile(ctx, &file, filter)
+		if err != nil {
+			return "", "", err
+		}
+		if !deleted {
+			return models.ScrubIssueResolved, "file was moved", nil
+		}
+		return models.ScrubIssueRepaired, "deleted file", nil
+	}
+
+	return "", "", fmt.Errorf("no repair for %s issues", issue.Kind)
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestScrubInterval(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", defaultScrubInterval},
+		{"6h", 6 * time.Hour},
+		{"daily", defaultScrubInterval},
+		{"-1h", defaultScrubInterval},
+		{"0s", defaultScrubInterval},
+	}
+	for _, tt := range tests {
+		t.Setenv("SCRUB_INTERVAL", tt.env)
+		if got := scrubInterval(); got != tt.want {
+			t.Errorf("SCRUB_INTERVAL=%q: %v, want %v", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestThumbnailObjectPattern(t *testing.T) {
+	file := &models.File{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID()}
+
+	match := thumbnailObjectPattern.FindStringSubmatch(thumbnailPath(file, "small"))
+	if match == nil || match[1] != file.ID.Hex() {
+		t.Fatalf("thumbnail path not recognised: %q", match)
+	}
+	for _, name := range []string{
+		fmt.Sprintf("users/%s/files/%s", file.UserID.Hex(), file.ID.Hex()),
+		fmt.Sprintf("users/%s/files/%s.thumb_small.png", file.UserID.Hex(), file.ID.Hex()),
+		fmt.Sprintf("blobs/%s.thumb_small.jpg", file.ID.Hex()),
+	} {
+		if thumbnailObjectPattern.MatchString(name) {
+			t.Errorf("%q taken for a thumbnail", name)
+		}
+	}
+}
+
+func TestScrubRepairKinds(t *testing.T) {
+	if kinds := scrubRepairKinds[scrubReparentToRoot]; !slices.Equal(kinds, []string{models.ScrubOrphanFile}) {
+		t.Errorf("reparenting applies to %q, want only orphaned files", kinds)
+	}
+	for _, kind := range scrubRepairKinds[scrubDeleteOrphans] {
+		if kind != models.ScrubOrphanFile && kind != models.ScrubOrphanObject {
+			t.Errorf("deleting applies to %s issues", kind)
+		}
+	}
+	// anything the scrubber reports can be dismissed
+	for _, kinds := range scrubRepairKinds {
+		for _, kind := range kinds {
+			if !slices.Contains(scrubRepairKinds[scrubDismiss], kind) {
+				t.Errorf("%s issues can't be dismissed", kind)
+			}
+		}
+	}
+}
+
+// testScrubFile stores a file record for a user and removes it afterwards
+func testScrubFile(t *testing.T, file models.File) *models.File {
+	t.Helper()
+	ctx := context.Background()
+	file.ID = primitive.NewObjectID()
+	if file.Path == "" {
+		file.Path = fmt.Sprintf("users/%s/files/%s", file.UserID.Hex(), file.ID.Hex())
+	}
+	file.CreatedAt = time.Now()
+	file.UpdatedAt = file.CreatedAt
+	if _, err := utils.GetCollection("files").InsertOne(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.GetCollection("files").DeleteOne(ctx, bson.M{"_id": file.ID}) })
+	return &file
+}
+
+func TestScrubReportKeepsOneOpenIssue(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	key := "test:" + primitive.NewObjectID().Hex()
+	t.Cleanup(func() { utils.GetCollection("scrub_issues").DeleteMany(ctx, bson.M{"key": key}) })
+
+	first := &scrubber{run: &models.ScrubRun{ID: primitive.NewObjectID()}}
+	second := &scrubber{run: &models.ScrubRun{ID: primitive.NewObjectID()}}
+	issue := models.ScrubIssue{Key: key, Kind: models.ScrubOrphanObject, ObjectPath: "users/x"}
+
+	if err := first.report(ctx, issue); err != nil {
+		t.Fatal(err)
+	}
+	var reported models.ScrubIssue
+	if err := utils.GetCollection("scrub_issues").FindOne(ctx, bson.M{"key": key}).Decode(&reported); err != nil {
+		t.Fatal(err)
+	}
+	issue.Detail = "seen again"
+	if err := second.report(ctx, issue); err != nil {
+		t.Fatal(err)
+	}
+
+	var issues []models.ScrubIssue
+	if err := findAll(ctx, "scrub_issues", bson.M{"key": key}, &issues); err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 {
+		t.Fatalf("%d issues for one problem, want 1", len(issues))
+	}
+	got := issues[0]
+	if got.Status != models.ScrubIssueOpen || got.RunID != second.run.ID || got.Detail != "seen again" {
+		t.Errorf("issue %+v not refreshed by the later run", got)
+	}
+	if got.ID != reported.ID || !got.FirstSeenAt.Equal(reported.FirstSeenAt) {
+		t.Errorf("issue replaced: first seen %v, want %v from the first report", got.FirstSeenAt, reported.FirstSeenAt)
+	}
+	if first.run.IssuesFound != 1 || second.run.IssuesFound != 1 {
+		t.Errorf("runs counted %d and %d issues, want 1 each", first.run.IssuesFound, second.run.IssuesFound)
+	}
+}
+
+func TestMissingFolderIDs(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+
+	existing := models.Folder{ID: primitive.NewObjectID(), UserID: userID, Name: "kept"}
+	if _, err := utils.GetCollection("folders").InsertOne(ctx, existing); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.GetCollection("folders").DeleteOne(ctx, bson.M{"_id": existing.ID}) })
+
+	gone := primitive.NewObjectID()
+	files := []models.File{
+		{FolderID: &existing.ID},
+		{FolderID: &gone},
+		{FolderID: &gone},
+		{},
+	}
+	missing, err := missingFolderIDs(ctx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || !missing[gone] {
+		t.Errorf("missing folders %v, want only %s", missing, gone.Hex())
+	}
+}
+
+func TestUnreferencedObjects(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	file := testScrubFile(t, models.File{UserID: primitive.NewObjectID(), Thumbnails: []string{"small"}})
+
+	stray := fmt.Sprintf("users/%s/files/%s", file.UserID.Hex(), primitive.NewObjectID().Hex())
+	names := []string{
+		file.Path,
+		thumbnailPath(file, "small"),
+		thumbnailPath(file, "large"),
+		stray,
+	}
+	orphans, err := unreferencedObjects(ctx, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{thumbnailPath(file, "large"), stray}; !slices.Equal(orphans, want) {
+		t.Errorf("orphans %q, want %q", orphans, want)
+	}
+}
+
+func TestRepairOrphanFile(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	userID, gone := primitive.NewObjectID(), primitive.NewObjectID()
+
+	vaultFile := testScrubFile(t, models.File{UserID: userID, FolderID: &gone, VaultID: &gone})
+	issue := &models.ScrubIssue{Kind: models.ScrubOrphanFile, FileID: &vaultFile.ID}
+	status, reason, err := repairScrubIssue(ctx, issue, scrubReparentToRoot)
+	if err != nil || status != models.ScrubIssueOpen {
+		t.Errorf("reparenting a vault file: %s (%s, %v), want it refused", status, reason, err)
+	}
+
+	file := testScrubFile(t, models.File{UserID: userID, FolderID: &gone})
+	issue = &models.ScrubIssue{Kind: models.ScrubOrphanFile, FileID: &file.ID}
+	status, reason, err = repairScrubIssue(ctx, issue, scrubReparentToRoot)
+	if err != nil || status != models.ScrubIssueRepaired {
+		t.Fatalf("reparenting: %s (%s, %v), want repaired", status, reason, err)
+	}
+	var moved models.File
+	if err := utils.GetCollection("files").FindOne(ctx, bson.M{"_id": file.ID}).Decode(&moved); err != nil {
+		t.Fatal(err)
+	}
+	if moved.FolderID != nil {
+		t.Errorf("file still in folder %s", moved.FolderID.Hex())
+	}
+
+	// the problem is gone, so repeating the repair has nothing to do
+	status, reason, err = repairScrubIssue(ctx, issue, scrubReparentToRoot)
+	if err != nil || status != models.ScrubIssueResolved {
+		t.Errorf("repeating the repair: %s (%s, %v), want resolved", status, reason, err)
+	}
+
+	missing := primitive.NewObjectID()
+	issue = &models.ScrubIssue{Kind: models.ScrubOrphanFile, FileID: &missing}
+	if status, _, err := repairScrubIssue(ctx, issue, scrubDeleteOrphans); err != nil || status != models.ScrubIssueResolved {
+		t.Errorf("deleting a file that is gone: %s (%v), want resolved", status, err)
+	}
+	if status, _, err := repairScrubIssue(ctx, issue, scrubDismiss); err != nil || status != models.ScrubIssueDismissed {
+		t.Errorf("dismissing: %s (%v), want dismissed", status, err)
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// startSession records a login and returns the JWT bound to it
+func startSession(c *gin.Context, userID primitive.ObjectID, method string) (string, error) {
+	now := time.Now()
+	userAgent := c.Request.UserAgent()
+
+	session := models.Session{
+		ID:         primitive.NewObjectID(),
+		UserID:     userID,
+		Method:     method,
+		UserAgent:  userAgent,
+		Device:     describeDevice(userAgent),
+		IP:         c.ClientIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(utils.MaxTokenLifetime),
+	}
+
+	if _, err := utils.GetCollection("sessions").InsertOne(c, session); err != nil {
+		return "", err
+	}
+
+	return utils.GenerateToken(userID.Hex(), session.ID.Hex(), session.ExpiresAt)
+}
+
+// GetSessions lists the user's active sessions, flagging the one making the request
+func GetSessions(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+	currentSessionID, _ := c.Get("sessionID")
+
+	cursor, err := utils.GetCollection("sessions").Find(c, bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}, options.Find().SetSort(bson.M{"last_seen_at": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve sessions"})
+		return
+	}
+	defer cursor.Close(c)
+
+	var sessions []models.Session
+	if err = cursor.All(c, &sessions); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not decode sessions"})
+		return
+	}
+
+	response := []gin.H{}
+	for _, session := range sessions {
+		response = append(response, gin.H{
+			"id":           session.ID,
+			"method":       session.Method,
+			"device":       session.Device,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt,
+			"last_seen_at": session.LastSeenAt,
+			"expires_at":   session.ExpiresAt,
+			"current":      session.ID.Hex() == currentSessionID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": response})
+}
+
+// RevokeSession signs a single session out
+func RevokeSession(c *gin.Context) {
+	sessionObjID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	result, err := utils.GetCollection("sessions").UpdateOne(c, bson.M{
+		"_id":        sessionObjID,
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke session"})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeOtherSessions signs out everywhere except the current session
+func RevokeOtherSessions(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+	currentSessionID, _ := c.Get("sessionID")
+	currentObjID, _ := primitive.ObjectIDFromHex(currentSessionID.(string))
+
+	result, err := utils.GetCollection("sessions").UpdateMany(c, bson.M{
+		"user_id":    userID,
+		"_id":        bson.M{"$ne": currentObjID},
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Other sessions revoked",
+		"revoked": result.ModifiedCount,
+	})
+}
+
+// Logout revokes the session making the request. Tokens issued before
+// sessions existed have nothing to revoke; the client is told so, and when
+// the token stops working, rather than being told it was logged out.
+func Logout(c *gin.Context) {
+	currentSessionID, _ := c.Get("sessionID")
+	if currentSessionID == "" {
+		expiresAt := c.GetTime("legacyTokenExpiresAt")
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      fmt.Sprintf("This token predates sessions and can't be revoked; it expires at %s", expiresAt.UTC().Format(time.RFC3339)),
+			"expires_at": expiresAt,
+		})
+		return
+	}
+	sessionObjID, err := primitive.ObjectIDFromHex(currentSessionID.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session"})
+		return
+	}
+
+	_, err = utils.GetCollection("sessions").UpdateOne(c, bson.M{"_id": sessionObjID},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// describeDevice turns a User-Agent into a short label like "Firefox on Linux"
+func describeDevice(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"edg/", "Edge"},
+		{"opr/", "Opera"},
+		{"firefox/", "Firefox"},
+		{"chrome/", "Chrome"},
+		{"safari/", "Safari"},
+		{"curl/", "curl"},
+		{"python-requests", "Python"},
+		{"go-http-client", "Go client"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	os := ""
+	for _, o := range []struct{ token, name string }{
+		{"windows", "Windows"},
+		{"android", "Android"},
+		{"iphone", "iOS"},
+		{"ipad", "iPadOS"},
+		{"mac os x", "macOS"},
+		{"cros", "ChromeOS"},
+		{"linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			os = o.name
+			break
+		}
+	}
+
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLogoutLegacyToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/logout", nil)
+	expiresAt := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.Set("sessionID", "")
+	c.Set("legacyTokenExpiresAt", expiresAt)
+
+	Logout(c)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want 409", w.Code)
+	}
+	var body struct {
+		Error     string    `json:"error"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if !body.ExpiresAt.Equal(expiresAt) || !strings.Contains(body.Error, "2026-05-01T12:00:00Z") {
+		t.Errorf("response %s does not say when the token expires", w.Body.String())
+	}
+}
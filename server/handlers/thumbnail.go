@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultThumbnailSize = "medium"
+	// larger sources aren't read into memory to render a preview
+	maxThumbnailSource = 50 * 1024 * 1024 // 50MB in bytes
+)
+
+// errThumbnailSourceTooLarge is returned for content over maxThumbnailSource
+var errThumbnailSourceTooLarge = errors.New("file too large to preview")
+
+// GetThumbnail serves a generated thumbnail, or for a PDF a preview of its
+// largest embedded image
+func GetThumbnail(c *gin.Context) {
+	fileObjID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	size := c.DefaultQuery("size", defaultThumbnailSize)
+	if _, ok := utils.ThumbnailSizes[size]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid size, expected small, medium or large"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var file models.File
+	err = utils.GetCollection("files").FindOne(c, bson.M{
+		"_id":        fileObjID,
+		"user_id":    userID,
+		"trashed_at": bson.M{"$exists": false},
+	}).Decode(&file)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if rejectBlockedContent(c, &file) {
+		return
+	}
+
+	if !hasThumbnail(&file, size) {
+		status := file.ThumbnailStatus
+		if status == "" {
+			status = models.ThumbnailPending
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnail not available", "status": status})
+		return
+	}
+
+	data, err := loadThumbnail(c, &file, size)
+	if err != nil {
+		log.Printf("Could not load %s thumbnail for %s: %v", size, file.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load thumbnail"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(http.StatusOK, "image/jpeg", data)
+}
+
+// loadThumbnail reads a stored thumbnail, decrypting it if the file is
+// encrypted
+func loadThumbnail(ctx context.Context, file *models.File, size string) ([]byte, error) {
+	reader, err := utils.DownloadFromGCS(ctx, thumbnailPath(file, size))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil || file.Encryption == nil {
+		return data, err
+	}
+
+	dataKey, err := fileDataKey(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	return utils.DecryptBytes(dataKey, thumbnailStreams[size], data)
+}
+
+// generateThumbnails renders every thumbnail size for images, and for PDFs
+// that embed an image on their first page, and records which ones exist.
+// Images also get their perceptual hashes.
+func generateThumbnails(ctx context.Context, file *models.File) {
+	collection := utils.GetCollection("files")
+	setStatus := func(status string, sizes []string) {
+		update := bson.M{"thumbnail_status": status}
+		if sizes != nil {
+			update["thumbnails"] = sizes
+		}
+		collection.UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{"$set": update})
+	}
+
+	kind := thumbnailSource(file)
+	if kind == "" {
+		setStatus(models.ThumbnailUnsupported, nil)
+		return
+	}
+
+	data, err := readThumbnailSource(ctx, file)
+	if err == errThumbnailSourceTooLarge {
+		setStatus(models.ThumbnailUnsupported, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not read file %s for thumbnails: %v", file.ID.Hex(), err)
+		setStatus(models.ThumbnailFailed, nil)
+		return
+	}
+
+	var img image.Image
+	if kind == "pdf" {
+		img, err = utils.PDFEmbeddedImage(data)
+	} else {
+		img, err = utils.DecodeImage(data)
+	}
+	if err != nil {
+		// undecodable content and PDFs without an embedded image are not
+		// worth retrying
+		setStatus(models.ThumbnailUnsupported, nil)
+		return
+	}
+
+	if kind == "image" {
+		setPerceptualHashes(ctx, file, img)
+	}
+
+	// thumbnails of encrypted files are encrypted with the file's data key
+	var dataKey []byte
+	if file.Encryption != nil {
+		if dataKey, err = fileDataKey(ctx, file); err != nil {
+			log.Printf("Could not unwrap data key of %s for thumbnails: %v", file.ID.Hex(), err)
+			setStatus(models.ThumbnailFailed, nil)
+			return
+		}
+	}
+
+	var sizes []string
+	for size, edge := range utils.ThumbnailSizes {
+		var buf bytes.Buffer
+		if err := utils.EncodeThumbnail(&buf, img, edge); err != nil {
+			log.Printf("Could not encode %s thumbnail for %s: %v", size, file.ID.Hex(), err)
+			continue
+		}
+		var thumbnail io.Reader = &buf
+		objectType := "image/jpeg"
+		if dataKey != nil {
+			sealed, err := utils.EncryptBytes(dataKey, thumbnailStreams[size], buf.Bytes())
+			if err != nil {
+				log.Printf("Could not encrypt %s thumbnail for %s: %v", size, file.ID.Hex(), err)
+				continue
+			}
+			thumbnail = bytes.NewReader(sealed)
+			objectType = "application/octet-stream"
+		}
+		if _, err := utils.UploadToGCS(ctx, thumbnailPath(file, size), thumbnail, objectType); err != nil {
+			log.Printf("Could not store %s thumbnail for %s: %v", size, file.ID.Hex(), err)
+			continue
+		}
+		sizes = append(sizes, size)
+	}
+
+	if len(sizes) == 0 {
+		setStatus(models.ThumbnailFailed, nil)
+		return
+	}
+	setStatus(models.ThumbnailReady, sizes)
+}
+
+// readThumbnailSource reads a file's content for decoding. Larger files are
+// refused rather than decoded truncated.
+func readThumbnailSource(ctx context.Context, file *models.File) ([]byte, error) {
+	reader, err := openFileContent(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxThumbnailSource+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxThumbnailSource {
+		return nil, errThumbnailSourceTooLarge
+	}
+	return data, nil
+}
+
+// thumbnailSource returns "image" or "pdf" for content we can render, or ""
+func thumbnailSource(file *models.File) string {
+	contentType := strings.ToLower(file.ContentType)
+	ext := strings.ToLower(filepath.Ext(file.Name))
+
+	switch {
+	case contentType == "application/pdf" || ext == ".pdf":
+		return "pdf"
+	case contentType == "image/jpeg", contentType == "image/png", contentType == "image/gif", contentType == "image/webp":
+		return "image"
+	case ext == ".jpg", ext == ".jpeg", ext == ".png", ext == ".gif", ext == ".webp":
+		return "image"
+	}
+	return ""
+}
+
+// thumbnailPath places derived objects next to the file they belong to
+func thumbnailPath(file *models.File, size string) string {
+	return fmt.Sprintf("users/%s/files/%s.thumb_%s.jpg", file.UserID.Hex(), file.ID.Hex(), size)
+}
+
+func hasThumbnail(file *models.File, size string) bool {
+	for _, s := range file.Thumbnails {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// setPerceptualHashes records the hashes the duplicate finder compares
+// images by
+func setPerceptualHashes(ctx context.Context, file *models.File, img image.Image) {
+	_, err := utils.GetCollection("files").UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{"$set": bson.M{
+		"ahash": utils.FormatImageHash(utils.AverageHash(img)),
+		"dhash": utils.FormatImageHash(utils.DifferenceHash(img)),
+	}})
+	if err != nil {
+		log.Printf("Could not record perceptual hashes of %s: %v", file.ID.Hex(), err)
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestThumbnailSource(t *testing.T) {
+	tests := []struct {
+		contentType string
+		name        string
+		want        string
+	}{
+		{"image/jpeg", "photo", "image"},
+		{"IMAGE/PNG", "photo", "image"},
+		{"image/webp", "", "image"},
+		{"application/octet-stream", "photo.JPG", "image"},
+		{"application/pdf", "scan", "pdf"},
+		{"", "scan.PDF", "pdf"},
+		{"image/svg+xml", "logo.svg", ""},
+		{"image/tiff", "scan.tiff", ""},
+		{"text/plain", "notes.txt", ""},
+	}
+	for _, tt := range tests {
+		file := &models.File{ContentType: tt.contentType, Name: tt.name}
+		if got := thumbnailSource(file); got != tt.want {
+			t.Errorf("thumbnailSource(%q, %q) = %q, want %q", tt.contentType, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHasThumbnail(t *testing.T) {
+	file := &models.File{Thumbnails: []string{"small", "large"}}
+	for size, want := range map[string]bool{"small": true, "medium": false, "large": true, "": false} {
+		if got := hasThumbnail(file, size); got != want {
+			t.Errorf("hasThumbnail(%q) = %v, want %v", size, got, want)
+		}
+	}
+}
+
+func TestThumbnailPathStaysUnderTheUser(t *testing.T) {
+	file := &models.File{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID()}
+	want := "users/" + file.UserID.Hex() + "/files/" + file.ID.Hex() + ".thumb_small.jpg"
+	if got := thumbnailPath(file, "small"); got != want {
+		t.Errorf("thumbnailPath = %q, want %q", got, want)
+	}
+}
+
+// TestProcessFile runs the pipeline on a file nothing can be rendered from,
+// so no content is read
+func TestProcessFile(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	collection := utils.GetCollection("files")
+
+	file := models.File{
+		ID:          primitive.NewObjectID(),
+		UserID:      primitive.NewObjectID(),
+		Name:        "notes.txt",
+		ContentType: "text/plain",
+		CreatedAt:   time.Now(),
+	}
+	leased := file
+	leased.ID = primitive.NewObjectID()
+	lease := time.Now().Add(processingLease)
+	leased.ProcessingLease = &lease
+	for _, f := range []models.File{file, leased} {
+		if _, err := collection.InsertOne(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": []primitive.ObjectID{file.ID, leased.ID}}})
+	})
+
+	load := func(id primitive.ObjectID) models.File {
+		t.Helper()
+		var f models.File
+		if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	processFile(ctx, file.ID)
+	got := load(file.ID)
+	if got.ProcessedAt == nil || got.ProcessingLease != nil {
+		t.Errorf("processed_at = %v, lease = %v; want processed and released", got.ProcessedAt, got.ProcessingLease)
+	}
+	if got.ThumbnailStatus != models.ThumbnailUnsupported {
+		t.Errorf("thumbnail status %q, want %q", got.ThumbnailStatus, models.ThumbnailUnsupported)
+	}
+
+	// another worker holds this one
+	processFile(ctx, leased.ID)
+	if got := load(leased.ID); got.ProcessedAt != nil || got.ThumbnailStatus != "" {
+		t.Errorf("a leased file was processed: %+v", got)
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxTokenLifetime = 365 * 24 * time.Hour
+
+// CreateAPIToken creates a personal access token. The plaintext token is
+// returned once and cannot be retrieved again.
+func CreateAPIToken(c *gin.Context) {
+	var req struct {
+		Name          string   `json:"name" binding:"required"`
+		Scopes        []string `json:"scopes" binding:"required,min=1"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.APITokenScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":        "Unknown scope: " + scope,
+				"valid_scopes": models.APITokenScopes,
+			})
+			return
+		}
+	}
+
+	if req.ExpiresInDays < 0 || time.Duration(req.ExpiresInDays)*24*time.Hour > maxTokenLifetime {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days must be between 0 and 365"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	plaintext, err := utils.GenerateOpaqueToken(models.APITokenPrefix)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+
+	token := models.APIToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Name:      req.Name,
+		Prefix:    plaintext[:len(models.APITokenPrefix)+6],
+		TokenHash: utils.HashSecret(plaintext),
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		CreatedAt: time.Now(),
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := token.CreatedAt.Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if _, err := utils.GetCollection("api_tokens").InsertOne(c, token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":   "Token created. Copy it now, it will not be shown again",
+		"token":     plaintext,
+		"api_token": token,
+	})
+}
+
+// GetAPITokens lists the user's tokens, including revoked and expired ones
+func GetAPITokens(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	collection := utils.GetCollection("api_tokens")
+	cursor, err := collection.Find(c, bson.M{"user_id": userID},
+		options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve tokens"})
+		return
+	}
+	defer cursor.Close(c)
+
+	tokens := []models.APIToken{}
+	if err = cursor.All(c, &tokens); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not decode tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// RevokeAPIToken revokes a token; it stops working on the next request
+func RevokeAPIToken(c *gin.Context) {
+	tokenObjID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	result, err := utils.GetCollection("api_tokens").UpdateOne(c, bson.M{
+		"_id":        tokenObjID,
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke token"})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultTrashRetention = 30 * 24 * time.Hour
+	trashPurgeInterval    = time.Hour
+	trashPurgeBatch       = 500
+)
+
+// trashFile moves a file to the trash. Trashed files are hidden everywhere
+// but the trash and still count against the quota until they are purged.
+// It reports false when there was no such file outside the trash.
+func trashFile(ctx context.Context, userID, fileID primitive.ObjectID) (bool, error) {
+	now := time.Now()
+	result, err := utils.GetCollection("files").UpdateOne(ctx, bson.M{
+		"_id":        fileID,
+		"user_id":    userID,
+		"vault_id":   bson.M{"$exists": false},
+		"trashed_at": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"trashed_at": now, "updated_at": now}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// TrashFile moves one of the caller's files to the trash
+func TrashFile(c *gin.Context) {
+	fileID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	moved, err := trashFile(c, userID, fileID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not move file to trash"})
+		return
+	}
+	if !moved {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "File moved to trash",
+		"purge_after": time.Now().Add(trashRetentionPeriod()),
+	})
+}
+
+// GetTrash lists the caller's trashed files, most recently trashed first
+func GetTrash(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	cursor, err := utils.GetCollection("files").Find(c, bson.M{
+		"user_id":    userID,
+		"trashed_at": bson.M{"$exists": true},
+	}, options.Find().SetSort(bson.M{"trashed_at": -1}))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve trash"})
+		return
+	}
+	files := []models.File{}
+	if err := cursor.All(c, &files); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve trash"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"files":     files,
+		"retention": trashRetentionPeriod().String(),
+	})
+}
+
+// RestoreFile takes a file out of the trash. A file whose folder was
+// deleted meanwhile is restored to the root.
+func RestoreFile(c *gin.Context) {
+	fileID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	collection := utils.GetCollection("files")
+	filter := bson.M{"_id": fileID, "user_id": userID, "trashed_at": bson.M{"$exists": true}}
+
+	var file models.File
+	if err := collection.FindOne(c, filter).Decode(&file); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in trash"})
+		return
+	}
+
+	unset := bson.M{"trashed_at": ""}
+	if file.FolderID != nil {
+		count, err := utils.GetCollection("folders").CountDocuments(c, bson.M{"_id": *file.FolderID, "user_id": userID})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not restore file"})
+			return
+		}
+		if count == 0 {
+			unset["folder_id"] = ""
+			file.FolderID = nil
+		}
+	}
+
+	result, err := collection.UpdateOne(c, filter, bson.M{
+		"$unset": unset,
+		"$set":   bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not restore file"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		// purged or restored meanwhile
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in trash"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File restored", "folder_id": file.FolderID})
+}
+
+// StartTrashPurger deletes files that have been in the trash longer than
+// the retention period (TRASH_RETENTION, default 30 days)
+func StartTrashPurger(ctx context.Context) {
+	runPeriodically(ctx, "trash purge", trashPurgeInterval, purgeTrash)
+}
+
+func purgeTrash(ctx context.Context) error {
+	cutoff := time.Now().Add(-trashRetentionPeriod())
+
+	var files []models.File
+	cursor, err := utils.GetCollection("files").Find(ctx,
+		bson.M{"trashed_at": bson.M{"$lte": cutoff}},
+		options.Find().SetLimit(trashPurgeBatch))
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+
+	purged := 0
+	for i := range files {
+		// a file restored since it was listed no longer matches
+		deleted, err := removeFile(ctx, &files[i], bson.M{"_id": files[i].ID, "trashed_at": bson.M{"$lte": cutoff}})
+		if err != nil {
+			log.Printf("Could not purge trashed file %s: %v", files[i].ID.Hex(), err)
+			continue
+		}
+		if deleted {
+			purged++
+		}
+	}
+	if purged > 0 {
+		log.Printf("Purged %d file(s) from the trash", purged)
+	}
+	return nil
+}
+
+func trashRetentionPeriod() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("TRASH_RETENTION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultTrashRetention
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const recoveryCodeCount = 10
+
+// EnrollTwoFactor starts TOTP enrollment by generating a pending secret.
+// The secret only becomes active once ConfirmTwoFactor sees a valid code.
+func EnrollTwoFactor(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	collection := utils.GetCollection("users")
+	var user models.User
+	if err := collection.FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate secret"})
+		return
+	}
+
+	uri := utils.TOTPProvisioningURI(secret, user.Email)
+	qr, err := utils.TOTPQRCode(uri)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate QR code"})
+		return
+	}
+
+	_, err = collection.UpdateOne(c, bson.M{"_id": userID}, bson.M{
+		"$set": bson.M{"two_factor.pending_secret": secret, "two_factor.enabled": false},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": uri,
+		"qr_code":          "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr),
+	})
+}
+
+// ConfirmTwoFactor activates the pending secret and hands out recovery codes.
+// The plaintext recovery codes are only ever returned from this call.
+func ConfirmTwoFactor(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	collection := utils.GetCollection("users")
+	var user models.User
+	if err := collection.FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.TwoFactor == nil || user.TwoFactor.PendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No two-factor enrollment in progress"})
+		return
+	}
+
+	step, ok := utils.ValidateTOTP(user.TwoFactor.PendingSecret, req.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid verification code"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate recovery codes"})
+		return
+	}
+
+	now := time.Now()
+	_, err = collection.UpdateOne(c, bson.M{"_id": userID}, bson.M{
+		"$set": bson.M{
+			"two_factor": models.TwoFactor{
+				Enabled:       true,
+				Secret:        user.TwoFactor.PendingSecret,
+				RecoveryCodes: hashes,
+				LastUsedStep:  step,
+				EnabledAt:     &now,
+			},
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor turns 2FA off. The caller has to re-authenticate (with
+// their password, or a recent login for accounts without one) and give a
+// current code or recovery code.
+func DisableTwoFactor(c *gin.Context) {
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	collection := utils.GetCollection("users")
+	var user models.User
+	if err := collection.FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	// the second factor is what a stolen session lacks, so it is required
+	// whether or not the account has a password
+	if req.Code == "" && req.RecoveryCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A current code or recovery code is required"})
+		return
+	}
+
+	if !reauthenticate(c, &user, req.Password) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Re-authentication required"})
+		return
+	}
+
+	if !verifySecondFactor(c, &user, req.Code, req.RecoveryCode) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid verification code"})
+		return
+	}
+
+	_, err := collection.UpdateOne(c, bson.M{"_id": userID}, bson.M{"$unset": bson.M{"two_factor": ""}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after checking a current TOTP code
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	collection := utils.GetCollection("users")
+	var user models.User
+	if err := collection.FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	if !verifySecondFactor(c, &user, req.Code, "") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid verification code"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate recovery codes"})
+		return
+	}
+
+	_, err = collection.UpdateOne(c, bson.M{"_id": userID}, bson.M{
+		"$set": bson.M{"two_factor.recovery_codes": hashes},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// VerifyTwoFactorLogin completes the second step of a login that returned mfa_required
+func VerifyTwoFactorLogin(c *gin.Context) {
+	var req struct {
+		MFAToken     string `json:"mfa_token" binding:"required"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := utils.ValidatePurposeToken(req.MFAToken, utils.PurposeMFA)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	userIDString, _ := claims["userID"].(string)
+	userID, err := primitive.ObjectIDFromHex(userIDString)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	var user models.User
+	if err := utils.GetCollection("users").FindOne(c, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	if !checkLoginAllowed(c, user.Email) {
+		return
+	}
+
+	if !verifySecondFactor(c, &user, req.Code, req.RecoveryCode) {
+		recordLoginFailure(c, user.Email)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid verification code"})
+		return
+	}
+	clearLoginFailures(c, user.Email)
+
+	method, _ := claims["method"].(string)
+	token, err := startSession(c, user.ID, method)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token": token,
+		"user":  loginUserPayload(&user),
+	})
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+// Both are consumed atomically so a code can't be replayed.
+func verifySecondFactor(c *gin.Context, user *models.User, code, recoveryCode string) bool {
+	collection := utils.GetCollection("users")
+
+	if code != "" {
+		step, ok := utils.ValidateTOTP(user.TwoFactor.Secret, code, time.Now())
+		if !ok {
+			return false
+		}
+
+		result, err := collection.UpdateOne(c, bson.M{
+			"_id":                       user.ID,
+			"two_factor.last_used_step": bson.M{"$lt": step},
+		}, bson.M{"$set": bson.M{"two_factor.last_used_step": step}})
+		return err == nil && result.MatchedCount == 1
+	}
+
+	if recoveryCode != "" {
+		hash := utils.HashSecret(strings.ToLower(strings.TrimSpace(recoveryCode)))
+		result, err := collection.UpdateOne(c, bson.M{
+			"_id":                       user.ID,
+			"two_factor.recovery_codes": hash,
+		}, bson.M{"$pull": bson.M{"two_factor.recovery_codes": hash}})
+		return err == nil && result.MatchedCount == 1
+	}
+
+	return false
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = utils.HashSecret(code)
+	}
+	return codes, hashes, nil
+}
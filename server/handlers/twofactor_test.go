@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDisableTwoFactorPasswordless(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+
+	const recoveryCode = "abcde-fghjk"
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := primitive.NewObjectID()
+	_, err = utils.GetCollection("users").InsertOne(ctx, models.User{
+		ID:           userID,
+		Email:        userID.Hex() + "@example.com",
+		AuthProvider: "google",
+		TwoFactor: &models.TwoFactor{
+			Enabled:       true,
+			Secret:        secret,
+			RecoveryCodes: []string{utils.HashSecret(recoveryCode)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.GetCollection("users").DeleteOne(ctx, bson.M{"_id": userID}) })
+
+	disable := func(body string, authTime time.Time) int {
+		gin.SetMode(gin.TestMode)
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/account/2fa/disable", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Set("userID", userID.Hex())
+		c.Set("authTime", authTime)
+		DisableTwoFactor(c)
+		return w.Code
+	}
+
+	// a stolen session of an account without a password has nothing else
+	// to offer, so the second factor is what stops it
+	if code := disable(`{}`, time.Now()); code != http.StatusBadRequest {
+		t.Errorf("without a code: status %d, want 400", code)
+	}
+	if code := disable(`{"recovery_code": "`+recoveryCode+`"}`, time.Now().Add(-time.Hour)); code != http.StatusUnauthorized {
+		t.Errorf("with an old login: status %d, want 401", code)
+	}
+	if code := disable(`{"recovery_code": "zzzzz-zzzzz"}`, time.Now()); code != http.StatusUnauthorized {
+		t.Errorf("with a wrong recovery code: status %d, want 401", code)
+	}
+	if code := disable(`{"recovery_code": "`+recoveryCode+`"}`, time.Now()); code != http.StatusOK {
+		t.Errorf("with a recent login and a recovery code: status %d, want 200", code)
+	}
+}
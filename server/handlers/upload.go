@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errFileTooLarge = errors.New("file size exceeds limit")
+	errStorageFull  = errors.New("upload would exceed storage limit")
+	errVaultGone    = errors.New("vault was deleted")
+)
+
+// fileUpload describes new content to store for a user. Content is read
+// more than once (sniff, hash, upload), so it has to be seekable.
+// ContentType is what the client claimed; the stored type is sniffed.
+type fileUpload struct {
+	UserID      primitive.ObjectID
+	FolderID    *primitive.ObjectID
+	Name        string
+	ContentType string
+	Size        int64
+	Content     io.ReadSeeker
+
+	// checksums the client sent with the content, if any
+	Expected expectedChecksums
+
+	// set for ciphertext uploaded into an end-to-end encrypted vault, which
+	// is not sniffed, checked against upload policies or deduped
+	Vault *vaultUpload
+}
+
+type vaultUpload struct {
+	VaultID           primitive.ObjectID
+	UploadedBy        primitive.ObjectID
+	EncryptedName     string
+	EncryptedMetadata string
+	KeyVersion        int
+}
+
+// saveFile applies the size and quota rules, stores the content and records
+// the file. Every path that creates files goes through here, so every path
+// that adds bytes reserves its quota here first. Content that is already
+// stored, by anyone, only gets a new file record.
+func saveFile(ctx context.Context, upload fileUpload) (file *models.File, err error) {
+	limits, err := userLimits(ctx, upload.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("could not load plan limits: %v", err)
+	}
+	if upload.Size > limits.MaxFileSize {
+		return nil, errFileTooLarge
+	}
+
+	reservation, err := reserveQuota(ctx, upload.UserID, upload.Size, limits.MaxStorage)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			// the request may be gone already, the bytes still go back
+			if rerr := releaseReservation(context.WithoutCancel(ctx), reservation); rerr != nil {
+				log.Printf("Could not release quota reservation %s: %v", reservation.ID.Hex(), rerr)
+			}
+		}
+	}()
+
+	detectedType := "application/octet-stream"
+	if upload.Vault == nil {
+		if detectedType, err = inspectUpload(ctx, upload); err != nil {
+			return nil, err
+		}
+	}
+
+	// vault files are hashed as the ciphertext they are stored as
+	hashes, err := hashContent(upload.Content, upload.Expected)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	fileRecord := models.File{
+		ID:           primitive.NewObjectID(),
+		Name:         upload.Name,
+		OriginalName: upload.Name,
+		Size:         upload.Size,
+		ContentType:  detectedType,
+		UserID:       upload.UserID,
+		FolderID:     upload.FolderID,
+		SHA256:       hashes.SHA256,
+		CRC32C:       hashes.CRC32C,
+		IsFavorite:   false,
+		CreatedAt:    now,
+
+		ClaimedContentType:  upload.ContentType,
+		DetectedContentType: detectedType,
+		UpdatedAt:           now,
+
+		ThumbnailStatus: models.ThumbnailPending,
+	}
+
+	var pending *models.StorageIntent
+	if vault := upload.Vault; vault != nil {
+		// vault ciphertext is unique per upload, so it isn't content
+		// addressed; the real name is encrypted, so the record gets a
+		// meaningless one
+		fileRecord.Name = fileRecord.ID.Hex()
+		fileRecord.OriginalName = fileRecord.Name
+		fileRecord.Path = fmt.Sprintf("users/%s/files/%s", upload.UserID.Hex(), fileRecord.ID.Hex())
+		fileRecord.URL = fileRecord.Path
+
+		// nothing in the post-upload pipeline can work on ciphertext
+		fileRecord.VaultID = &vault.VaultID
+		fileRecord.EncryptedName = vault.EncryptedName
+		fileRecord.EncryptedMetadata = vault.EncryptedMetadata
+		fileRecord.KeyVersion = vault.KeyVersion
+		fileRecord.UploadedBy = &vault.UploadedBy
+		fileRecord.ThumbnailStatus = models.ThumbnailUnsupported
+		fileRecord.ProcessedAt = &now
+
+		var dataKey []byte
+		fileRecord.Encryption, dataKey, err = newFileEncryption(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not create data key: %v", err)
+		}
+
+		// removes the object should the record never be saved; saving it
+		// cancels the intent
+		intent := newDeleteIntent(fileRecord.Path, orphanUploadDelay)
+		if err := queueIntents(ctx, intent); err != nil {
+			return nil, err
+		}
+		pending = &intent
+		if err := storeObject(ctx, fileRecord.Path, upload.Content, upload.Size, detectedType, dataKey); err != nil {
+			runIntents(ctx, intent)
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		var blob *models.Blob
+		if upload.Vault == nil {
+			// identical content, from anyone, is stored once
+			blob, err = ensureBlob(ctx, hashes.SHA256, upload.Size, detectedType, upload.Content)
+			if err != nil {
+				return nil, err
+			}
+			fileRecord.BlobID = blob.ID
+			fileRecord.Path = blob.Path
+			fileRecord.URL = blob.Path
+			fileRecord.Encryption = blob.Encryption
+			inheritBlobScan(&fileRecord, blob)
+		}
+
+		// the record, its blob reference and the usage counters change together
+		err = utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+			if upload.Vault != nil {
+				// writing the vault conflicts with a concurrent delete of
+				// it, so a file can't land in a vault that is going away
+				if err := touchVault(sessCtx, upload.Vault.VaultID); err != nil {
+					return err
+				}
+			}
+			if blob != nil {
+				if err := takeBlobRef(sessCtx, blob.ID); err != nil {
+					return err
+				}
+			}
+			if _, err := utils.GetCollection("files").InsertOne(sessCtx, fileRecord); err != nil {
+				return fmt.Errorf("could not save file record: %v", err)
+			}
+			if err := commitReservation(sessCtx, reservation); err != nil {
+				return err
+			}
+			if err := updateUserStorage(sessCtx, upload.UserID, 0, 0, 1); err != nil {
+				return err
+			}
+			if pending != nil {
+				return cancelIntent(sessCtx, pending.ID)
+			}
+			return nil
+		})
+		if errors.Is(err, errBlobGone) && attempt < blobWaitAttempts {
+			continue
+		}
+		break
+	}
+	if err != nil {
+		if pending != nil {
+			// only runs if the transaction really didn't commit
+			runIntents(ctx, *pending)
+		}
+		return nil, err
+	}
+
+	if fileRecord.Quarantined() {
+		// the same content was found infected before
+		announceQuarantine(ctx, &fileRecord)
+	}
+	if upload.Vault == nil {
+		queueFileProcessing(fileRecord.ID)
+	}
+
+	return &fileRecord, nil
+}
+
+// removeFile deletes the file record matching filter, which should name
+// file, along with its blob reference and usage counters in one
+// transaction, then removes its objects. It reports false when nothing
+// matched, e.g. because the file was deleted meanwhile.
+func removeFile(ctx context.Context, file *models.File, filter bson.M) (bool, error) {
+	var intents []models.StorageIntent
+	if file.BlobID == "" {
+		// shared content is left to the blob collector
+		intents = append(intents, newDeleteIntent(file.Path, 0))
+	}
+	for _, size := range file.Thumbnails {
+		intents = append(intents, newDeleteIntent(thumbnailPath(file, size), 0))
+	}
+
+	deleted := false
+	err := utils.WithTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		result, err := utils.GetCollection("files").DeleteOne(sessCtx, filter)
+		if err != nil {
+			return fmt.Errorf("could not delete file record: %v", err)
+		}
+		deleted = result.DeletedCount == 1
+		if !deleted {
+			return nil
+		}
+		if file.BlobID != "" {
+			if err := releaseBlob(sessCtx, file.BlobID); err != nil {
+				return err
+			}
+		}
+		if err := updateUserStorage(sessCtx, file.UserID, -file.Size, 0, -1); err != nil {
+			return err
+		}
+		return queueIntents(sessCtx, intents...)
+	})
+	if err != nil || !deleted {
+		return false, err
+	}
+
+	runIntents(ctx, intents...)
+	return true, nil
+}
+
+// inspectUpload sniffs the content type and applies the upload policies.
+// It returns the detected type.
+func inspectUpload(ctx context.Context, upload fileUpload) (string, error) {
+	if _, err := upload.Content.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("could not rewind file: %v", err)
+	}
+	head := make([]byte, utils.SniffLength)
+	n, err := io.ReadFull(upload.Content, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("could not read file: %v", err)
+	}
+	// an empty file has nothing to sniff, and the type the client claimed
+	// can't be trusted instead: stored as text/html it would be served inline
+	detectedType := "application/octet-stream"
+	if n > 0 {
+		detectedType = utils.DetectContentType(head[:n])
+		if utils.ContentTypeMismatch(detectedType, upload.ContentType, upload.Name) {
+			return "", &uploadPolicyError{Reason: fmt.Sprintf("content is %s, which does not match the file name or declared type", utils.BaseMediaType(detectedType))}
+		}
+	}
+
+	if err := checkUploadPolicy(ctx, upload.UserID, upload.Name, detectedType); err != nil {
+		return "", err
+	}
+	return detectedType, nil
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// uploadPolicyError is returned by saveFile when a policy refuses the file
+type uploadPolicyError struct {
+	Reason string
+}
+
+func (e *uploadPolicyError) Error() string {
+	return e.Reason
+}
+
+type uploadPolicyRequest struct {
+	AllowedTypes      []string `json:"allowed_types"`
+	DeniedTypes       []string `json:"denied_types"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+	DeniedExtensions  []string `json:"denied_extensions"`
+}
+
+// GetUploadPolicy shows the caller the policies that apply to their uploads
+func GetUploadPolicy(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	global, user, err := loadUploadPolicies(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve upload policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"global": global, "user": user})
+}
+
+// GetGlobalUploadPolicy returns the policy applied to every user
+func GetGlobalUploadPolicy(c *gin.Context) {
+	policy, err := findUploadPolicy(c, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve upload policy"})
+		return
+	}
+	if policy == nil {
+		policy = &models.DefaultUploadPolicy
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+// UpdateGlobalUploadPolicy replaces the global policy
+func UpdateGlobalUploadPolicy(c *gin.Context) {
+	saveUploadPolicy(c, nil)
+}
+
+// GetUserUploadPolicy returns one user's own policy, if any
+func GetUserUploadPolicy(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	policy, err := findUploadPolicy(c, &userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve upload policy"})
+		return
+	}
+	if policy == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User has no upload policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policy})
+}
+
+// UpdateUserUploadPolicy sets a user's policy, applied on top of the global one
+func UpdateUserUploadPolicy(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	count, err := utils.GetCollection("users").CountDocuments(c, bson.M{"_id": userID})
+	if err != nil || count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	saveUploadPolicy(c, &userID)
+}
+
+// DeleteUserUploadPolicy removes a user's policy so only the global one applies
+func DeleteUserUploadPolicy(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	result, err := utils.GetCollection("upload_policies").DeleteOne(c, bson.M{"user_id": userID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete upload policy"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User has no upload policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Upload policy deleted"})
+}
+
+func saveUploadPolicy(c *gin.Context, userID *primitive.ObjectID) {
+	var req uploadPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy := models.UploadPolicy{
+		UserID:            userID,
+		AllowedTypes:      normalizeTypes(req.AllowedTypes),
+		DeniedTypes:       normalizeTypes(req.DeniedTypes),
+		AllowedExtensions: normalizeExtensions(req.AllowedExtensions),
+		DeniedExtensions:  normalizeExtensions(req.DeniedExtensions),
+		UpdatedAt:         time.Now(),
+	}
+
+	filter := bson.M{"user_id": bson.M{"$exists": false}}
+	if userID != nil {
+		filter = bson.M{"user_id": *userID}
+	}
+
+	err := utils.GetCollection("upload_policies").FindOneAndReplace(c, filter, policy,
+		options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.After)).Decode(&policy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save upload policy"})
+		return
+	}
+
+	adminIDInterface, _ := c.Get("userID")
+	adminID, _ := primitive.ObjectIDFromHex(adminIDInterface.(string))
+	recordAudit(c, adminID, "admin.upload_policy_updated", map[string]interface{}{
+		"policy_id": policy.ID,
+		"user_id":   userID,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Upload policy saved", "policy": policy})
+}
+
+// findUploadPolicy loads the global policy (userID nil) or a user's policy.
+// It returns nil without an error when none is stored.
+func findUploadPolicy(ctx context.Context, userID *primitive.ObjectID) (*models.UploadPolicy, error) {
+	filter := bson.M{"user_id": bson.M{"$exists": false}}
+	if userID != nil {
+		filter = bson.M{"user_id": *userID}
+	}
+
+	var policy models.UploadPolicy
+	err := utils.GetCollection("upload_policies").FindOne(ctx, filter).Decode(&policy)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// loadUploadPolicies returns the global policy (falling back to the default)
+// and the user's own policy, which may be nil
+func loadUploadPolicies(ctx context.Context, userID primitive.ObjectID) (*models.UploadPolicy, *models.UploadPolicy, error) {
+	global, err := findUploadPolicy(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if global == nil {
+		global = &models.DefaultUploadPolicy
+	}
+
+	user, err := findUploadPolicy(ctx, &userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return global, user, nil
+}
+
+// checkUploadPolicy decides whether the policies allow a file, based on the
+// type detected from its content and its name
+func checkUploadPolicy(ctx context.Context, userID primitive.ObjectID, name, detected string) error {
+	global, user, err := loadUploadPolicies(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("could not load upload policy: %v", err)
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, policy := range []*models.UploadPolicy{global, user} {
+		if policy == nil {
+			continue
+		}
+		if matchesAnyType(detected, policy.DeniedTypes) {
+			return &uploadPolicyError{Reason: fmt.Sprintf("files of type %s are not allowed", utils.BaseMediaType(detected))}
+		}
+		if len(policy.AllowedTypes) > 0 && !matchesAnyType(detected, policy.AllowedTypes) {
+			return &uploadPolicyError{Reason: fmt.Sprintf("files of type %s are not allowed", utils.BaseMediaType(detected))}
+		}
+		if ext != "" && slices.Contains(policy.DeniedExtensions, ext) {
+			return &uploadPolicyError{Reason: fmt.Sprintf("%s files are not allowed", ext)}
+		}
+		if len(policy.AllowedExtensions) > 0 && !slices.Contains(policy.AllowedExtensions, ext) {
+			return &uploadPolicyError{Reason: fmt.Sprintf("%s files are not allowed", ext)}
+		}
+	}
+	return nil
+}
+
+func matchesAnyType(detected string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if utils.MatchesContentType(detected, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeTypes(types []string) []string {
+	var out []string
+	for _, t := range types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func normalizeExtensions(exts []string) []string {
+	var out []string
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		out = append(out, ext)
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNormalizePolicyLists(t *testing.T) {
+	if got, want := normalizeTypes([]string{" Image/PNG ", "", "text/*"}), []string{"image/png", "text/*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeTypes = %q, want %q", got, want)
+	}
+	if got, want := normalizeExtensions([]string{"EXE", " .Bat", "", "  "}), []string{".exe", ".bat"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeExtensions = %q, want %q", got, want)
+	}
+	if got := normalizeTypes(nil); got != nil {
+		t.Errorf("normalizeTypes(nil) = %q, want nil so the field is omitted", got)
+	}
+}
+
+func TestDefaultUploadPolicyDeniesExecutables(t *testing.T) {
+	for _, detected := range []string{
+		"application/vnd.microsoft.portable-executable",
+		"application/x-executable",
+		"application/x-mach-binary",
+	} {
+		if !matchesAnyType(detected, models.DefaultUploadPolicy.DeniedTypes) {
+			t.Errorf("default policy allows %s", detected)
+		}
+	}
+	if matchesAnyType("image/png", models.DefaultUploadPolicy.DeniedTypes) {
+		t.Error("default policy denies image/png")
+	}
+}
+
+// TestCheckUploadPolicy only relies on the global policy allowing PNGs and
+// text, as the default one does
+func TestCheckUploadPolicy(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	userID := primitive.NewObjectID()
+
+	check := func(name, detected string) error {
+		t.Helper()
+		err := checkUploadPolicy(ctx, userID, name, detected)
+		var policyErr *uploadPolicyError
+		if err != nil && !errors.As(err, &policyErr) {
+			t.Fatalf("checkUploadPolicy(%s): %v", name, err)
+		}
+		return err
+	}
+
+	if err := check("notes.txt", "text/plain; charset=utf-8"); err != nil {
+		t.Fatalf("text refused without a user policy: %v", err)
+	}
+
+	_, err := utils.GetCollection("upload_policies").InsertOne(ctx, models.UploadPolicy{
+		UserID:           &userID,
+		AllowedTypes:     []string{"image/*"},
+		DeniedExtensions: []string{".gif"},
+		UpdatedAt:        time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { utils.GetCollection("upload_policies").DeleteOne(ctx, bson.M{"user_id": userID}) })
+
+	tests := []struct {
+		name     string
+		detected string
+		want     string
+	}{
+		{"photo.png", "image/png", ""},
+		{"photo", "image/png", ""},
+		{"notes.txt", "text/plain; charset=utf-8", "files of type text/plain are not allowed"},
+		// the content decides the type, not the name
+		{"notes.png", "text/plain; charset=utf-8", "files of type text/plain are not allowed"},
+		{"anim.GIF", "image/gif", ".gif files are not allowed"},
+	}
+	for _, tt := range tests {
+		err := check(tt.name, tt.detected)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s (%s): %q, want %q", tt.name, tt.detected, got, tt.want)
+		}
+	}
+}
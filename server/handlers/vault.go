@@ -0,0 +1,872 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Encrypted vaults are folders whose content the server can't read. Clients
+// generate a key pair per user and register the public half; a vault key is
+// generated by the client that creates the vault and handed to each member
+// wrapped for their public key. The server stores and hands out these opaque
+// values and enforces who may fetch what, nothing more.
+
+// errVaultKeyChanged means another rotation claimed the next key version first
+var errVaultKeyChanged = errors.New("vault key changed")
+
+// wrappedKeyInput is a vault key wrapped for one member
+type wrappedKeyInput struct {
+	UserID     string `json:"user_id"`
+	KeyVersion int    `json:"key_version"`
+	WrappedKey string `json:"wrapped_key" binding:"required"`
+}
+
+// PutUserKey registers or replaces the caller's public key
+func PutUserKey(c *gin.Context) {
+	var req struct {
+		Algorithm           string `json:"algorithm" binding:"required"`
+		PublicKey           string `json:"public_key" binding:"required"`
+		EncryptedPrivateKey string `json:"encrypted_private_key"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	now := time.Now()
+	key := models.UserKey{
+		UserID:              userID,
+		Algorithm:           req.Algorithm,
+		PublicKey:           req.PublicKey,
+		Fingerprint:         keyFingerprint(req.PublicKey),
+		EncryptedPrivateKey: req.EncryptedPrivateKey,
+		UpdatedAt:           now,
+	}
+
+	var previous models.UserKey
+	err := utils.GetCollection("user_keys").FindOne(c, bson.M{"user_id": userID}).Decode(&previous)
+	if err == nil {
+		key.ID = previous.ID
+		key.CreatedAt = previous.CreatedAt
+	} else if err == mongo.ErrNoDocuments {
+		key.ID = primitive.NewObjectID()
+		key.CreatedAt = now
+	} else {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save key"})
+		return
+	}
+
+	_, err = utils.GetCollection("user_keys").ReplaceOne(c, bson.M{"user_id": userID}, key, options.Replace().SetUpsert(true))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save key"})
+		return
+	}
+
+	// vault keys wrapped for the old public key can't be opened any more and
+	// have to be wrapped again by each vault's owner
+	stale, _ := utils.GetCollection("vault_keys").CountDocuments(c, bson.M{
+		"user_id":         userID,
+		"key_fingerprint": bson.M{"$ne": key.Fingerprint},
+	})
+
+	recordAudit(c, userID, "vault.user_key_updated", map[string]interface{}{
+		"fingerprint": key.Fingerprint,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Key saved", "key": key, "stale_vault_keys": stale})
+}
+
+// GetUserKey returns the caller's own key, including the encrypted private
+// key if one was stored
+func GetUserKey(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var key models.UserKey
+	err := utils.GetCollection("user_keys").FindOne(c, bson.M{"user_id": userID}).Decode(&key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No key registered"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"key": key})
+}
+
+// GetPublicKey looks up another user's public key by email or user_id so a
+// vault key can be wrapped for them
+func GetPublicKey(c *gin.Context) {
+	filter := bson.M{}
+	if email := c.Query("email"); email != "" {
+		var user models.User
+		err := utils.GetCollection("users").FindOne(c, bson.M{"email": normalizeEmail(email)}).Decode(&user)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No key registered"})
+			return
+		}
+		filter["user_id"] = user.ID
+	} else if id, err := primitive.ObjectIDFromHex(c.Query("user_id")); err == nil {
+		filter["user_id"] = id
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email or user_id is required"})
+		return
+	}
+
+	var key models.UserKey
+	if err := utils.GetCollection("user_keys").FindOne(c, filter).Decode(&key); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No key registered"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":     key.UserID,
+		"algorithm":   key.Algorithm,
+		"public_key":  key.PublicKey,
+		"fingerprint": key.Fingerprint,
+	})
+}
+
+// CreateVault creates an encrypted vault owned by the caller. The request
+// carries the vault key already wrapped for the caller's own public key.
+func CreateVault(c *gin.Context) {
+	var req struct {
+		EncryptedName string `json:"encrypted_name" binding:"required"`
+		Algorithm     string `json:"algorithm" binding:"required"`
+		WrappedKey    string `json:"wrapped_key" binding:"required"`
+		ParentID      string `json:"parent_id,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var ownerKey models.UserKey
+	if err := utils.GetCollection("user_keys").FindOne(c, bson.M{"user_id": userID}).Decode(&ownerKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Register a public key before creating a vault"})
+		return
+	}
+
+	now := time.Now()
+	vaultID := primitive.NewObjectID()
+	folder := models.Folder{
+		ID: vaultID,
+		// the real name is encrypted; this only has to be unique
+		Name:      vaultID.Hex(),
+		UserID:    userID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Vault: &models.FolderVault{
+			EncryptedName: req.EncryptedName,
+			Algorithm:     req.Algorithm,
+			KeyVersion:    1,
+		},
+	}
+
+	parentID, ok := resolveFolderParam(c, userID, req.ParentID)
+	if !ok {
+		return
+	}
+	folder.Path = "/" + folder.Name
+	if parentID != nil {
+		var parent models.Folder
+		if err := utils.GetCollection("folders").FindOne(c, bson.M{"_id": *parentID, "user_id": userID}).Decode(&parent); err != nil {
+			if err == mongo.ErrNoDocuments {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Parent folder not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create vault"})
+			return
+		}
+		folder.ParentID = parentID
+		folder.Path = parent.Path + "/" + folder.Name
+	}
+
+	member := models.VaultMember{
+		ID:        primitive.NewObjectID(),
+		VaultID:   vaultID,
+		UserID:    userID,
+		Role:      models.VaultRoleOwner,
+		AddedBy:   userID,
+		CreatedAt: now,
+	}
+	key := models.VaultKey{
+		ID:             primitive.NewObjectID(),
+		VaultID:        vaultID,
+		UserID:         userID,
+		KeyVersion:     1,
+		WrappedKey:     req.WrappedKey,
+		KeyFingerprint: ownerKey.Fingerprint,
+		WrappedBy:      userID,
+		CreatedAt:      now,
+	}
+	err := utils.WithTransaction(c, func(sessCtx mongo.SessionContext) error {
+		if _, err := utils.GetCollection("folders").InsertOne(sessCtx, folder); err != nil {
+			return err
+		}
+		if _, err := utils.GetCollection("vault_members").InsertOne(sessCtx, member); err != nil {
+			return err
+		}
+		if _, err := utils.GetCollection("vault_keys").InsertOne(sessCtx, key); err != nil {
+			return err
+		}
+		return updateUserStorage(sessCtx, userID, 0, 1, 0)
+	})
+	if err != nil {
+		log.Printf("Could not create vault for user %s: %v", userID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create vault"})
+		return
+	}
+	recordAudit(c, userID, "vault.created", map[string]interface{}{"vault_id": vaultID})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Vault created successfully",
+		"vault":   folder,
+		"keys":    []models.VaultKey{key},
+	})
+}
+
+// GetVaults lists the vaults the caller owns or is a member of, with the
+// caller's wrapped keys for each
+func GetVaults(c *gin.Context) {
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var memberships []models.VaultMember
+	if err := findAll(c, "vault_members", bson.M{"user_id": userID}, &memberships); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve vaults"})
+		return
+	}
+
+	vaultIDs := make([]primitive.ObjectID, 0, len(memberships))
+	roles := map[primitive.ObjectID]string{}
+	for _, m := range memberships {
+		vaultIDs = append(vaultIDs, m.VaultID)
+		roles[m.VaultID] = m.Role
+	}
+
+	var folders []models.Folder
+	var keys []models.VaultKey
+	err := findAll(c, "folders", bson.M{"_id": bson.M{"$in": vaultIDs}, "vault": bson.M{"$exists": true}}, &folders)
+	if err == nil {
+		err = findAll(c, "vault_keys", bson.M{"vault_id": bson.M{"$in": vaultIDs}, "user_id": userID}, &keys)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve vaults"})
+		return
+	}
+
+	keysByVault := map[primitive.ObjectID][]models.VaultKey{}
+	for _, key := range keys {
+		keysByVault[key.VaultID] = append(keysByVault[key.VaultID], key)
+	}
+
+	vaults := []gin.H{}
+	for _, folder := range folders {
+		vaults = append(vaults, gin.H{
+			"vault": folder,
+			"role":  roles[folder.ID],
+			"keys":  keysByVault[folder.ID],
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"vaults": vaults})
+}
+
+// GetVault returns one vault with its members and the caller's wrapped keys
+func GetVault(c *gin.Context) {
+	vault, member, ok := loadVaultAccess(c)
+	if !ok {
+		return
+	}
+
+	var members []models.VaultMember
+	var keys []models.VaultKey
+	err := findAll(c, "vault_members", bson.M{"vault_id": vault.ID}, &members)
+	if err == nil {
+		err = findAll(c, "vault_keys", bson.M{"vault_id": vault.ID, "user_id": member.UserID}, &keys)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve vault"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"vault":   vault,
+		"role":    member.Role,
+		"members": members,
+		"keys":    keys,
+	})
+}
+
+// AddVaultMember gives another user access. The owner wraps every key
+// version for the new member's public key so older files stay readable.
+func AddVaultMember(c *gin.Context) {
+	vault, member, ok := loadVaultAccess(c)
+	if !ok || !requireVaultOwner(c, member) {
+		return
+	}
+
+	var req struct {
+		UserID      string            `json:"user_id" binding:"required"`
+		WrappedKeys []wrappedKeyInput `json:"wrapped_keys" binding:"required,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	newMemberID, err := primitive.ObjectIDFromHex(req.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var memberKey models.UserKey
+	if err := utils.GetCollection("user_keys").FindOne(c, bson.M{"user_id": newMemberID}).Decode(&memberKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User has not registered a public key"})
+		return
+	}
+
+	count, err := utils.GetCollection("vault_members").CountDocuments(c, bson.M{"vault_id": vault.ID, "user_id": newMemberID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add member"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a member"})
+		return
+	}
+
+	for i := range req.WrappedKeys {
+		req.WrappedKeys[i].UserID = req.UserID
+	}
+	keys, ok := buildVaultKeys(c, vault, member.UserID, req.WrappedKeys, map[primitive.ObjectID]string{newMemberID: memberKey.Fingerprint})
+	if !ok {
+		return
+	}
+
+	newMember := models.VaultMember{
+		ID:        primitive.NewObjectID(),
+		VaultID:   vault.ID,
+		UserID:    newMemberID,
+		Role:      models.VaultRoleMember,
+		AddedBy:   member.UserID,
+		CreatedAt: time.Now(),
+	}
+	// a member without their keys would see the vault but not be able to
+	// open it, so both are stored or neither is
+	err = utils.WithTransaction(c, func(sessCtx mongo.SessionContext) error {
+		if _, err := utils.GetCollection("vault_members").InsertOne(sessCtx, newMember); err != nil {
+			return err
+		}
+		_, err := utils.GetCollection("vault_keys").InsertMany(sessCtx, keys)
+		return err
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a member"})
+		return
+	}
+	if err != nil {
+		log.Printf("Could not add member %s to vault %s: %v", newMemberID.Hex(), vault.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add member"})
+		return
+	}
+
+	recordAudit(c, member.UserID, "vault.member_added", map[string]interface{}{
+		"vault_id": vault.ID,
+		"user_id":  newMemberID,
+	})
+	notifyUser(c, newMemberID, "vault_shared", "You were added to an encrypted vault",
+		"You now have access to an encrypted vault.", fmt.Sprintf("/api/vaults/%s", vault.ID.Hex()), nil)
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Member added"})
+}
+
+// RemoveVaultMember revokes a member's access. The owner can remove anyone
+// but themselves; members can leave. The key should be rotated afterwards,
+// since the removed member may have kept it.
+func RemoveVaultMember(c *gin.Context) {
+	vault, member, ok := loadVaultAccess(c)
+	if !ok {
+		return
+	}
+
+	removeID, err := primitive.ObjectIDFromHex(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if removeID != member.UserID && !requireVaultOwner(c, member) {
+		return
+	}
+	if removeID == vault.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The owner can't leave a vault; delete it instead"})
+		return
+	}
+
+	result, err := utils.GetCollection("vault_members").DeleteOne(c, bson.M{"vault_id": vault.ID, "user_id": removeID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not remove member"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+	utils.GetCollection("vault_keys").DeleteMany(c, bson.M{"vault_id": vault.ID, "user_id": removeID})
+	utils.GetCollection("folders").UpdateOne(c, bson.M{"_id": vault.ID}, bson.M{
+		"$set": bson.M{"vault.rotation_needed": true, "updated_at": time.Now()},
+	})
+
+	recordAudit(c, member.UserID, "vault.member_removed", map[string]interface{}{
+		"vault_id": vault.ID,
+		"user_id":  removeID,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed", "rotation_needed": true})
+}
+
+// RotateVaultKey stores a new key version, wrapped for every current
+// member. New uploads must use it; files keep the version they were
+// encrypted with.
+func RotateVaultKey(c *gin.Context) {
+	vault, member, ok := loadVaultAccess(c)
+	if !ok || !requireVaultOwner(c, member) {
+		return
+	}
+
+	var req struct {
+		WrappedKeys []wrappedKeyInput `json:"wrapped_keys" binding:"required,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var members []models.VaultMember
+	if err := findAll(c, "vault_members", bson.M{"vault_id": vault.ID}, &members); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not rotate key"})
+		return
+	}
+	fingerprints, ok := memberFingerprints(c, members)
+	if !ok {
+		return
+	}
+
+	newVersion := vault.Vault.KeyVersion + 1
+	for i := range req.WrappedKeys {
+		req.WrappedKeys[i].KeyVersion = newVersion
+	}
+	rotated := *vault
+	rotated.Vault = &models.FolderVault{KeyVersion: newVersion}
+	keys, ok := buildVaultKeys(c, &rotated, member.UserID, req.WrappedKeys, fingerprints)
+	if !ok {
+		return
+	}
+	if len(keys) != len(members) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A wrapped key is required for every member"})
+		return
+	}
+
+	// the version is claimed against the one the keys were built for, so two
+	// rotations can't both succeed, and in the same transaction as the keys
+	// so the vault never points at a version nobody can open
+	err := utils.WithTransaction(c, func(sessCtx mongo.SessionContext) error {
+		result, err := utils.GetCollection("folders").UpdateOne(sessCtx, bson.M{
+			"_id":               vault.ID,
+			"vault.key_version": vault.Vault.KeyVersion,
+		}, bson.M{
+			"$set":   bson.M{"vault.key_version": newVersion, "updated_at": time.Now()},
+			"$unset": bson.M{"vault.rotation_needed": ""},
+		})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			return errVaultKeyChanged
+		}
+		_, err = utils.GetCollection("vault_keys").InsertMany(sessCtx, keys)
+		return err
+	})
+	if errors.Is(err, errVaultKeyChanged) || mongo.IsDuplicateKeyError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Vault key changed, reload and try again"})
+		return
+	}
+	if err != nil {
+		log.Printf("Could not rotate key of vault %s: %v", vault.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not rotate key"})
+		return
+	}
+
+	recordAudit(c, member.UserID, "vault.key_rotated", map[string]interface{}{
+		"vault_id":    vault.ID,
+		"key_version": newVersion,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Vault key rotated", "key_version": newVersion})
+}
+
+// UpdateVaultMemberKeys replaces a member's wrapped keys, for when they
+// registered a new public key and the old wrapping can't be opened any more
+func UpdateVaultMemberKeys(c *gin.Context) {
+	vault, member, ok := loadVaultAccess(c)
+	if !ok || !requireVaultOwner(c, member) {
+		return
+	}
+
+	targetID, err := primitive.ObjectIDFromHex(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req struct {
+		WrappedKeys []wrappedKeyInput `json:"wrapped_keys" binding:"required,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var target models.VaultMember
+	if err := utils.GetCollection("vault_members").FindOne(c, bson.M{"vault_id": vault.ID, "user_id": targetID}).Decode(&target); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+	fingerprints, ok := memberFingerprints(c, []models.VaultMember{target})
+	if !ok {
+		return
+	}
+
+	for i := range req.WrappedKeys {
+		req.WrappedKeys[i].UserID = targetID.Hex()
+	}
+	keys, ok := buildVaultKeys(c, vault, member.UserID, req.WrappedKeys, fingerprints)
+	if !ok {
+		return
+	}
+
+	collection := utils.GetCollection("vault_keys")
+	for _, doc := range keys {
+		key := doc.(models.VaultKey)
+		_, err := collection.UpdateOne(c, bson.M{
+			"vault_id":    key.VaultID,
+			"user_id":     key.UserID,
+			"key_version": key.KeyVersion,
+		}, bson.M{
+			"$set": bson.M{
+				"wrapped_key":     key.WrappedKey,
+				"key_fingerprint": key.KeyFingerprint,
+				"wrapped_by":      key.WrappedBy,
+				"created_at":      key.CreatedAt,
+			},
+			"$setOnInsert": bson.M{"_id": key.ID},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not store keys"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member keys updated"})
+}
+
+// UploadVaultFile stores client-encrypted content in a vault. It counts
+// against the owner's storage.
+func UploadVaultFile(c *gin.Context) {
+	vault, member, ok := loadVaultAccess(c)
+	if !ok {
+		return
+	}
+
+	if err := c.Request.ParseMultipartForm(maxMultipartMemory); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large or invalid form data"})
+		return
+	}
+	file, fileHeader, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+		return
+	}
+	defer file.Close()
+
+	encryptedName := c.PostForm("encrypted_name")
+	if encryptedName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "encrypted_name is required"})
+		return
+	}
+	keyVersion, err := strconv.Atoi(c.PostForm("key_version"))
+	if err != nil || keyVersion != vault.Vault.KeyVersion {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":       "Content must be encrypted with the current vault key",
+			"key_version": vault.Vault.KeyVersion,
+		})
+		return
+	}
+
+	// checksums cover the ciphertext as uploaded
+	expected, ok := uploadChecksums(c, fileHeader.Header)
+	if !ok {
+		return
+	}
+
+	fileRecord, err := saveFile(c, fileUpload{
+		UserID:   vault.UserID,
+		FolderID: &vault.ID,
+		Size:     fileHeader.Size,
+		Content:  file,
+		Expected: expected,
+		Vault: &vaultUpload{
+			VaultID:           vault.ID,
+			UploadedBy:        member.UserID,
+			EncryptedName:     encryptedName,
+			EncryptedMetadata: c.PostForm("encrypted_metadata"),
+			KeyVersion:        keyVersion,
+		},
+	})
+	if err != nil {
+		respondSaveFileError(c, vault.UserID, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "File uploaded successfully",
+		"file":    fileRecord,
+	})
+}
+
+// GetVaultFiles lists a vault's files; names and metadata are ciphertext
+func GetVaultFiles(c *gin.Context) {
+	vault, _, ok := loadVaultAccess(c)
+	if !ok {
+		return
+	}
+
+	var files []models.File
+	if err := findAll(c, "files", bson.M{"vault_id": vault.ID}, &files); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve files"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"files": files})
+}
+
+// DownloadVaultFile streams a vault file's ciphertext
+func DownloadVaultFile(c *gin.Context) {
+	vault, _, ok := loadVaultAccess(c)
+	if !ok {
+		return
+	}
+	file, ok := loadVaultFile(c, vault)
+	if !ok {
+		return
+	}
+
+	serveFileContent(c, file, false)
+}
+
+// DeleteVaultFile removes a vault file. The owner can delete anything,
+// members only what they uploaded.
+func DeleteVaultFile(c *gin.Context) {
+	vault, member, ok := loadVaultAccess(c)
+	if !ok {
+		return
+	}
+	file, ok := loadVaultFile(c, vault)
+	if !ok {
+		return
+	}
+	if member.Role != models.VaultRoleOwner && (file.UploadedBy == nil || *file.UploadedBy != member.UserID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner or the uploader can delete this file"})
+		return
+	}
+
+	if _, err := removeFile(c, file, bson.M{"_id": file.ID}); err != nil {
+		log.Printf("Could not delete vault file %s: %v", file.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete file record"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
+}
+
+// loadVaultAccess loads the vault named by :id and the caller's membership.
+// Non-members get the same 404 as a missing vault.
+func loadVaultAccess(c *gin.Context) (*models.Folder, *models.VaultMember, bool) {
+	vaultID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid vault ID"})
+		return nil, nil, false
+	}
+
+	userIDInterface, _ := c.Get("userID")
+	userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+	var member models.VaultMember
+	err = utils.GetCollection("vault_members").FindOne(c, bson.M{"vault_id": vaultID, "user_id": userID}).Decode(&member)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found"})
+		return nil, nil, false
+	}
+
+	var vault models.Folder
+	err = utils.GetCollection("folders").FindOne(c, bson.M{"_id": vaultID, "vault": bson.M{"$exists": true}}).Decode(&vault)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vault not found"})
+		return nil, nil, false
+	}
+
+	return &vault, &member, true
+}
+
+func requireVaultOwner(c *gin.Context, member *models.VaultMember) bool {
+	if member.Role == models.VaultRoleOwner {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Only the vault owner can do this"})
+	return false
+}
+
+func loadVaultFile(c *gin.Context, vault *models.Folder) (*models.File, bool) {
+	fileID, err := primitive.ObjectIDFromHex(c.Param("fileId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		return nil, false
+	}
+
+	var file models.File
+	err = utils.GetCollection("files").FindOne(c, bson.M{"_id": fileID, "vault_id": vault.ID}).Decode(&file)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+	return &file, true
+}
+
+// memberFingerprints returns the current public key fingerprint of each
+// member; a member without a key can't be given one
+func memberFingerprints(c *gin.Context, members []models.VaultMember) (map[primitive.ObjectID]string, bool) {
+	ids := make([]primitive.ObjectID, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.UserID)
+	}
+
+	var keys []models.UserKey
+	if err := findAll(c, "user_keys", bson.M{"user_id": bson.M{"$in": ids}}, &keys); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not load member keys"})
+		return nil, false
+	}
+
+	fingerprints := map[primitive.ObjectID]string{}
+	for _, key := range keys {
+		fingerprints[key.UserID] = key.Fingerprint
+	}
+	for _, id := range ids {
+		if _, ok := fingerprints[id]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A member has no registered public key", "user_id": id})
+			return nil, false
+		}
+	}
+	return fingerprints, true
+}
+
+// buildVaultKeys validates wrapped keys against the vault's key versions and
+// the allowed recipients. Every recipient must get the current version.
+func buildVaultKeys(c *gin.Context, vault *models.Folder, wrappedBy primitive.ObjectID, inputs []wrappedKeyInput, fingerprints map[primitive.ObjectID]string) ([]interface{}, bool) {
+	now := time.Now()
+	seen := map[string]bool{}
+	hasCurrent := map[primitive.ObjectID]bool{}
+
+	var keys []interface{}
+	for _, in := range inputs {
+		userID, err := primitive.ObjectIDFromHex(in.UserID)
+		fingerprint, allowed := fingerprints[userID]
+		if err != nil || !allowed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Wrapped key for a user who isn't a recipient", "user_id": in.UserID})
+			return nil, false
+		}
+		if in.KeyVersion < 1 || in.KeyVersion > vault.Vault.KeyVersion {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key version", "key_version": in.KeyVersion})
+			return nil, false
+		}
+		dedupe := fmt.Sprintf("%s/%d", in.UserID, in.KeyVersion)
+		if seen[dedupe] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Duplicate wrapped key", "user_id": in.UserID, "key_version": in.KeyVersion})
+			return nil, false
+		}
+		seen[dedupe] = true
+		if in.KeyVersion == vault.Vault.KeyVersion {
+			hasCurrent[userID] = true
+		}
+
+		keys = append(keys, models.VaultKey{
+			ID:             primitive.NewObjectID(),
+			VaultID:        vault.ID,
+			UserID:         userID,
+			KeyVersion:     in.KeyVersion,
+			WrappedKey:     in.WrappedKey,
+			KeyFingerprint: fingerprint,
+			WrappedBy:      wrappedBy,
+			CreatedAt:      now,
+		})
+	}
+
+	for userID := range fingerprints {
+		if !hasCurrent[userID] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The current key version is required", "key_version": vault.Vault.KeyVersion})
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+// touchVault marks the vault as changed. Transactions that add to a vault
+// call it so they conflict with one deleting the vault. It returns
+// errVaultGone when the vault no longer exists.
+func touchVault(ctx context.Context, vaultID primitive.ObjectID) error {
+	result, err := utils.GetCollection("folders").UpdateOne(ctx,
+		bson.M{"_id": vaultID, "vault": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errVaultGone
+	}
+	return nil
+}
+
+// deleteVaultRecords removes the memberships and wrapped keys of a vault
+func deleteVaultRecords(ctx context.Context, vaultID primitive.ObjectID) error {
+	if _, err := utils.GetCollection("vault_members").DeleteMany(ctx, bson.M{"vault_id": vaultID}); err != nil {
+		return err
+	}
+	_, err := utils.GetCollection("vault_keys").DeleteMany(ctx, bson.M{"vault_id": vaultID})
+	return err
+}
+
+// keyFingerprint identifies a public key so wrapped keys can be matched to
+// the key they were made for
+func keyFingerprint(publicKey string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(publicKey)))
+	return fmt.Sprintf("%x", sum)
+}
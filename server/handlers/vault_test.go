@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// vaultContext builds the context of a vault request by userID with a JSON
+// body
+func vaultContext(userID, vaultID primitive.ObjectID, body interface{}) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	payload, _ := json.Marshal(body)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/vaults/"+vaultID.Hex(), bytes.NewReader(payload))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set("userID", userID.Hex())
+	c.Params = gin.Params{{Key: "id", Value: vaultID.Hex()}}
+	return c, w
+}
+
+func TestBuildVaultKeys(t *testing.T) {
+	owner, member := primitive.NewObjectID(), primitive.NewObjectID()
+	vault := &models.Folder{ID: primitive.NewObjectID(), Vault: &models.FolderVault{KeyVersion: 2}}
+	fingerprints := map[primitive.ObjectID]string{owner: "owner-fp", member: "member-fp"}
+	key := func(userID primitive.ObjectID, version int) wrappedKeyInput {
+		return wrappedKeyInput{UserID: userID.Hex(), KeyVersion: version, WrappedKey: "wrapped"}
+	}
+
+	tests := []struct {
+		name   string
+		inputs []wrappedKeyInput
+		want   int // keys built, or -1 when refused
+	}{
+		{"current version for everyone", []wrappedKeyInput{key(owner, 2), key(member, 2)}, 2},
+		{"older versions alongside", []wrappedKeyInput{key(owner, 2), key(member, 2), key(member, 1)}, 3},
+		{"member missing current version", []wrappedKeyInput{key(owner, 2), key(member, 1)}, -1},
+		{"not a recipient", []wrappedKeyInput{key(owner, 2), key(member, 2), key(primitive.NewObjectID(), 2)}, -1},
+		{"future version", []wrappedKeyInput{key(owner, 2), key(member, 2), key(member, 3)}, -1},
+		{"version zero", []wrappedKeyInput{key(owner, 2), key(member, 2), key(member, 0)}, -1},
+		{"duplicate", []wrappedKeyInput{key(owner, 2), key(member, 2), key(member, 2)}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := vaultContext(owner, vault.ID, nil)
+			keys, ok := buildVaultKeys(c, vault, owner, tt.inputs, fingerprints)
+			if tt.want < 0 {
+				if ok || w.Code != http.StatusBadRequest {
+					t.Errorf("ok = %v, status %d; want refused with 400", ok, w.Code)
+				}
+				return
+			}
+			if !ok || len(keys) != tt.want {
+				t.Fatalf("ok = %v, %d keys; want %d (%s)", ok, len(keys), tt.want, w.Body.String())
+			}
+			for _, k := range keys {
+				vk := k.(models.VaultKey)
+				if vk.KeyFingerprint != fingerprints[vk.UserID] || vk.WrappedBy != owner || vk.VaultID != vault.ID {
+					t.Errorf("key %+v not bound to its recipient", vk)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyFingerprintIgnoresSurroundingSpace(t *testing.T) {
+	if keyFingerprint("key\n") != keyFingerprint(" key") {
+		t.Error("fingerprint depends on surrounding whitespace")
+	}
+	if keyFingerprint("key") == keyFingerprint("other") {
+		t.Error("different keys share a fingerprint")
+	}
+}
+
+// testVault stores a vault at key version 1 owned by owner, with a
+// registered public key for owner and each of members
+func testVault(t *testing.T, owner primitive.ObjectID, members ...primitive.ObjectID) primitive.ObjectID {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+
+	vaultID := primitive.NewObjectID()
+	folder := models.Folder{ID: vaultID, UserID: owner, Vault: &models.FolderVault{KeyVersion: 1}, CreatedAt: now, UpdatedAt: now}
+	if _, err := utils.GetCollection("folders").InsertOne(ctx, folder); err != nil {
+		t.Fatal(err)
+	}
+	users := append([]primitive.ObjectID{owner}, members...)
+	for _, id := range users {
+		_, err := utils.GetCollection("user_keys").InsertOne(ctx, models.UserKey{
+			ID: primitive.NewObjectID(), UserID: id, PublicKey: id.Hex(), Fingerprint: keyFingerprint(id.Hex()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := utils.GetCollection("vault_members").InsertOne(ctx, models.VaultMember{
+		ID: primitive.NewObjectID(), VaultID: vaultID, UserID: owner, Role: models.VaultRoleOwner, AddedBy: owner, CreatedAt: now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		utils.GetCollection("folders").DeleteOne(ctx, bson.M{"_id": vaultID})
+		utils.GetCollection("user_keys").DeleteMany(ctx, bson.M{"user_id": bson.M{"$in": users}})
+		utils.GetCollection("vault_members").DeleteMany(ctx, bson.M{"vault_id": vaultID})
+		utils.GetCollection("vault_keys").DeleteMany(ctx, bson.M{"vault_id": vaultID})
+		utils.GetCollection("audit_log").DeleteMany(ctx, bson.M{"user_id": owner})
+		utils.GetCollection("notifications").DeleteMany(ctx, bson.M{"user_id": bson.M{"$in": users}})
+	})
+	return vaultID
+}
+
+func TestAddVaultMemberStoresKeys(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	owner, member := primitive.NewObjectID(), primitive.NewObjectID()
+	vaultID := testVault(t, owner, member)
+
+	body := gin.H{
+		"user_id":      member.Hex(),
+		"wrapped_keys": []gin.H{{"key_version": 1, "wrapped_key": "wrapped-for-member"}},
+	}
+	c, w := vaultContext(owner, vaultID, body)
+	AddVaultMember(c)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("adding a member: status %d, want 201 (%s)", w.Code, w.Body.String())
+	}
+	count, _ := utils.GetCollection("vault_keys").CountDocuments(ctx, bson.M{"vault_id": vaultID, "user_id": member})
+	if count != 1 {
+		t.Errorf("%d keys stored for the new member, want 1", count)
+	}
+
+	c, w = vaultContext(owner, vaultID, body)
+	AddVaultMember(c)
+	if w.Code != http.StatusConflict {
+		t.Errorf("adding them again: status %d, want 409", w.Code)
+	}
+}
+
+func TestRotateVaultKeyClaimsVersionOnce(t *testing.T) {
+	testMongo(t)
+	ctx := context.Background()
+	owner := primitive.NewObjectID()
+	vaultID := testVault(t, owner)
+
+	rotate := func() int {
+		c, w := vaultContext(owner, vaultID, gin.H{
+			"wrapped_keys": []gin.H{{"user_id": owner.Hex(), "wrapped_key": "rotated"}},
+		})
+		RotateVaultKey(c)
+		return w.Code
+	}
+	if code := rotate(); code != http.StatusOK {
+		t.Fatalf("first rotation: status %d, want 200", code)
+	}
+
+	var rotated models.Folder
+	if err := utils.GetCollection("folders").FindOne(ctx, bson.M{"_id": vaultID}).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Vault.KeyVersion != 2 {
+		t.Fatalf("key version %d after rotating, want 2", rotated.Vault.KeyVersion)
+	}
+
+	// winding the vault back makes the version claim succeed and the key
+	// insert fail, which must undo the claim
+	utils.GetCollection("folders").UpdateOne(ctx, bson.M{"_id": vaultID}, bson.M{"$set": bson.M{"vault.key_version": 1}})
+	if code := rotate(); code != http.StatusConflict {
+		t.Errorf("rotating onto a version that has keys: status %d, want 409", code)
+	}
+
+	// the failed rotation must not have moved the vault on
+	var after models.Folder
+	if err := utils.GetCollection("folders").FindOne(ctx, bson.M{"_id": vaultID}).Decode(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after.Vault.KeyVersion != 1 {
+		t.Errorf("key version %d after a failed rotation, want it left at 1", after.Vault.KeyVersion)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 
 	"github.com/ayushsarode/DriftBox/handlers"
 	"github.com/ayushsarode/DriftBox/middleware"
+	"github.com/ayushsarode/DriftBox/models"
 	"github.com/ayushsarode/DriftBox/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -23,10 +25,24 @@ func main() {
 		log.Fatalf("failed to connect to MongoDB: %v", err)
 	}
 	log.Println("Connected to MongoDB")
+	utils.EnsureIndexes(context.Background())
 
-	// init oauth google
-	utils.InitGoogleAuth()
-	log.Println("Google OAuth initialized")
+	// encryption at rest; also seals the token signing keys
+	if err := utils.InitKMS(context.Background()); err != nil {
+		log.Fatalf("failed to initialize KMS: %v", err)
+	}
+
+	// token signing keys
+	if err := utils.InitSigningKeys(context.Background()); err != nil {
+		log.Fatalf("failed to initialize signing keys: %v", err)
+	}
+	utils.StartKeyRotation(context.Background())
+	utils.WarnLegacyHS256()
+	log.Println("JWT signing keys initialized")
+
+	// init external login providers (Google and generic OIDC)
+	utils.InitOIDCProviders(context.Background())
+	log.Printf("%d OIDC login provider(s) initialized", len(utils.ListOIDCProviders()))
 
 	// init gcs
 	if err := utils.InitGCS(); err != nil {
@@ -34,6 +50,25 @@ func main() {
 	}
 	log.Println("Google Cloud Storage initialized")
 
+	// malware scanning (clamd)
+	if err := utils.InitScanner(); err != nil {
+		log.Fatalf("failed to initialize malware scanning: %v", err)
+	}
+
+
+	// background jobs
+	handlers.StartAccountPurgeWorker(context.Background())
+	handlers.StartExportWorker(context.Background())
+	handlers.StartFileProcessor(context.Background())
+	handlers.StartKeyRewrapWorker(context.Background())
+	handlers.StartBlobCollector(context.Background())
+	handlers.StartStorageScrubber(context.Background())
+	handlers.StartOutboxWorker(context.Background())
+	handlers.StartReservationSweeper(context.Background())
+	handlers.StartStorageSnapshots(context.Background())
+	handlers.StartTrashPurger(context.Background())
+	handlers.StartPerceptualHashBackfill(context.Background())
+
 	httpPort := os.Getenv("PORT")
 	if httpPort == "" {
 		httpPort = "8000"
@@ -64,12 +99,26 @@ func main() {
 		})
 	})
 
-	route.POST("/register", handlers.Register)
-	route.POST("/login", handlers.Login)
+	route.GET("/.well-known/jwks.json", handlers.GetJWKS)
+
+	// rate limits, configurable per route family
+	limiter := middleware.NewRateLimiter(middleware.RateLimitStoreFromEnv())
+	authLimit := limiter.Limit("auth", middleware.RateLimitFromEnv("RATE_LIMIT_AUTH", "10/1m"))
+	uploadLimit := limiter.Limit("upload", middleware.RateLimitFromEnv("RATE_LIMIT_UPLOAD", "30/1m"))
+	downloadLimit := limiter.Limit("download", middleware.RateLimitFromEnv("RATE_LIMIT_DOWNLOAD", "120/1m"))
+
+	route.POST("/register", authLimit, handlers.Register)
+	route.POST("/login", authLimit, handlers.Login)
+	route.POST("/login/2fa", authLimit, handlers.VerifyTwoFactorLogin)
 
 	// google auth
-	route.GET("/auth/google", handlers.GoogleLogin)
-	route.GET("/auth/google/callback", handlers.GoogleCallback)
+	route.GET("/auth/google", authLimit, handlers.GoogleLogin)
+	route.GET("/auth/google/callback", authLimit, handlers.GoogleCallback)
+
+	// generic OpenID Connect providers
+	route.GET("/auth/providers", handlers.GetAuthProviders)
+	route.GET("/auth/oidc/:provider", authLimit, handlers.OIDCLogin)
+	route.GET("/auth/oidc/:provider/callback", authLimit, handlers.OIDCCallback)
 
 	// (require authentication)
 	protected := route.Group("/api")
@@ -83,17 +132,47 @@ func main() {
 
 	{
 		// Folder management
-		protected.POST("/folders", handlers.CreateFolder)
-		protected.GET("/folders", handlers.GetFolders)
-		protected.DELETE("/folders/:id", handlers.DeleteFolder)
+		foldersRead := protected.Group("", middleware.RequireScope(models.ScopeFilesRead))
+		foldersRead.GET("/folders", handlers.GetFolders)
+
+		foldersWrite := protected.Group("", middleware.RequireScope(models.ScopeFoldersWrite))
+		foldersWrite.POST("/folders", handlers.CreateFolder)
+		foldersWrite.DELETE("/folders/:id", handlers.DeleteFolder)
 
 		// File management
-		protected.POST("/files/upload", handlers.UploadFile)
-		protected.GET("/files", handlers.GetFiles)
-		protected.GET("/files/favorites", handlers.GetFavoriteFiles)
-		protected.POST("/files/toggle-favorite/:id", handlers.ToggleFavorite)
-		protected.GET("/files/:id/download", handlers.DownloadFile)
-		protected.DELETE("/files/:id", handlers.DeleteFile)
+		filesRead := protected.Group("", middleware.RequireScope(models.ScopeFilesRead))
+		filesRead.GET("/files", handlers.GetFiles)
+		filesRead.GET("/files/favorites", handlers.GetFavoriteFiles)
+		filesRead.GET("/files/duplicates", handlers.GetDuplicates)
+		filesRead.GET("/files/trash", handlers.GetTrash)
+		filesRead.GET("/files/:id/download", downloadLimit, handlers.DownloadFile)
+		filesRead.GET("/files/:id/thumbnail", handlers.GetThumbnail)
+		filesRead.GET("/files/:id/archive", handlers.GetArchiveEntries)
+		filesRead.GET("/files/:id/archive/entry", downloadLimit, handlers.DownloadArchiveEntry)
+
+		filesWrite := protected.Group("", middleware.RequireScope(models.ScopeFilesWrite))
+		filesWrite.POST("/files/upload", uploadLimit, handlers.UploadFile)
+		filesWrite.POST("/files/import", uploadLimit, handlers.ImportArchive)
+		filesWrite.POST("/files/:id/archive/extract", uploadLimit, handlers.ExtractArchiveEntries)
+		filesWrite.POST("/files/toggle-favorite/:id", handlers.ToggleFavorite)
+		filesWrite.DELETE("/files/:id", handlers.DeleteFile)
+		filesWrite.POST("/files/duplicates/resolve", handlers.ResolveDuplicates)
+		filesWrite.POST("/files/:id/trash", handlers.TrashFile)
+		filesWrite.POST("/files/:id/restore", handlers.RestoreFile)
+
+		// End-to-end encrypted vaults
+		filesRead.GET("/keys", handlers.GetPublicKey)
+		filesRead.GET("/vaults", handlers.GetVaults)
+		filesRead.GET("/vaults/:id", handlers.GetVault)
+		filesRead.GET("/vaults/:id/files", handlers.GetVaultFiles)
+		filesRead.GET("/vaults/:id/files/:fileId/download", downloadLimit, handlers.DownloadVaultFile)
+		foldersWrite.POST("/vaults", handlers.CreateVault)
+		foldersWrite.POST("/vaults/:id/members", handlers.AddVaultMember)
+		foldersWrite.DELETE("/vaults/:id/members/:userId", handlers.RemoveVaultMember)
+		foldersWrite.PUT("/vaults/:id/members/:userId/keys", handlers.UpdateVaultMemberKeys)
+		foldersWrite.POST("/vaults/:id/rotate", handlers.RotateVaultKey)
+		filesWrite.POST("/vaults/:id/files", uploadLimit, handlers.UploadVaultFile)
+		filesWrite.DELETE("/vaults/:id/files/:fileId", handlers.DeleteVaultFile)
 
 		// Test endpoint
 		protected.GET("/files/test", func(c *gin.Context) {
@@ -104,7 +183,75 @@ func main() {
 		log.Println("Registered route: POST /api/files/:id/favorite")
 
 		// Storage info
-		protected.GET("/storage", handlers.GetStorageInfo)
+		filesRead.GET("/storage", handlers.GetStorageInfo)
+		filesRead.GET("/storage/analytics", handlers.GetStorageAnalytics)
+		filesRead.GET("/upload-policy", handlers.GetUploadPolicy)
+		filesRead.GET("/plan", handlers.GetPlan)
+
+		// Account security: interactive sessions only, never API tokens
+		account := protected.Group("", middleware.RequireUserSession())
+
+		// Two-factor authentication
+		account.POST("/account/2fa/enroll", handlers.EnrollTwoFactor)
+		account.POST("/account/2fa/confirm", handlers.ConfirmTwoFactor)
+		account.POST("/account/2fa/disable", handlers.DisableTwoFactor)
+		account.POST("/account/2fa/recovery-codes", handlers.RegenerateRecoveryCodes)
+
+		// Personal access tokens
+		account.POST("/tokens", handlers.CreateAPIToken)
+		account.GET("/tokens", handlers.GetAPITokens)
+		account.DELETE("/tokens/:id", handlers.RevokeAPIToken)
+
+		// Linked external logins
+		account.GET("/identities", handlers.GetIdentities)
+		account.POST("/identities/:provider/link", handlers.StartIdentityLink)
+		account.DELETE("/identities/:id", handlers.UnlinkIdentity)
+
+		// Login sessions
+		account.GET("/sessions", handlers.GetSessions)
+		account.DELETE("/sessions", handlers.RevokeOtherSessions)
+		account.DELETE("/sessions/:id", handlers.RevokeSession)
+		account.POST("/logout", handlers.Logout)
+
+		// Account deletion
+		account.DELETE("/account", handlers.RequestAccountDeletion)
+		account.GET("/account/deletion", handlers.GetAccountDeletion)
+		account.POST("/account/deletion/cancel", handlers.CancelAccountDeletion)
+
+		// Vault key exchange
+		account.GET("/account/keys", handlers.GetUserKey)
+		account.PUT("/account/keys", handlers.PutUserKey)
+
+		// Notifications link to finished data exports, so they are kept
+		// from API tokens like the exports themselves
+		account.GET("/notifications", handlers.GetNotifications)
+		account.POST("/notifications/:id/read", handlers.MarkNotificationRead)
+
+		// Data export ("takeout")
+		account.POST("/account/export", handlers.RequestExport)
+		account.GET("/account/exports", handlers.GetExports)
+		account.GET("/account/exports/:id/download", downloadLimit, handlers.DownloadExport)
+
+		// Administration
+		admin := account.Group("/admin", middleware.RequireAdmin())
+		admin.GET("/upload-policy", handlers.GetGlobalUploadPolicy)
+		admin.PUT("/upload-policy", handlers.UpdateGlobalUploadPolicy)
+		admin.GET("/users/:id/upload-policy", handlers.GetUserUploadPolicy)
+		admin.PUT("/users/:id/upload-policy", handlers.UpdateUserUploadPolicy)
+		admin.DELETE("/users/:id/upload-policy", handlers.DeleteUserUploadPolicy)
+		admin.POST("/users/:id/storage/recalculate", handlers.RecalculateUserStorage)
+		admin.GET("/encryption", handlers.GetEncryptionStatus)
+		admin.POST("/encryption/rewrap", handlers.RewrapDataKeys)
+		admin.GET("/scrub", handlers.GetScrubStatus)
+		admin.POST("/scrub", handlers.StartScrub)
+		admin.GET("/scrub/issues", handlers.GetScrubIssues)
+		admin.POST("/scrub/repair", handlers.RepairScrubIssues)
+		admin.GET("/plans", handlers.GetPlans)
+		admin.POST("/plans", handlers.CreatePlan)
+		admin.PUT("/plans/:id", handlers.UpdatePlan)
+		admin.DELETE("/plans/:id", handlers.DeletePlan)
+		admin.GET("/users/:id/plan", handlers.GetUserPlan)
+		admin.PUT("/users/:id/plan", handlers.UpdateUserPlan)
 	}
 
 	log.Printf("Starting server on port %s", httpPort)
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ayushsarode/DriftBox/models"
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RequireAdmin restricts a route to users with the admin role or whose email
+// is listed in ADMIN_EMAILS (comma separated)
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userIDInterface, _ := c.Get("userID")
+		userID, _ := primitive.ObjectIDFromHex(userIDInterface.(string))
+
+		var user models.User
+		err := utils.GetCollection("users").FindOne(c, bson.M{"_id": userID}).Decode(&user)
+		if err != nil || !isAdmin(&user) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func isAdmin(user *models.User) bool {
+	if user.Role == models.RoleAdmin {
+		return true
+	}
+	if !user.EmailVerified {
+		return false
+	}
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" && strings.EqualFold(email, user.Email) {
+			return true
+		}
+	}
+	return false
+}
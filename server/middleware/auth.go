@@ -1,15 +1,29 @@
 package middleware
 
 import (
+	"log"
 	"net/http"
+	"slices"
 	"strings"
-	"github.com/golang-jwt/jwt/v5"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/models"
 	"github.com/ayushsarode/DriftBox/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// how often last_used_at is written for an API token
+	tokenLastUsedResolution = time.Minute
+	// how often last_seen_at is written for a session
+	sessionLastSeenResolution = time.Minute
 )
 
 func Authmiddleware() gin.HandlerFunc {
-	return func (c *gin.Context)  {
+	return func(c *gin.Context) {
 		tokenString := c.GetHeader("Authorization")
 
 		if tokenString == "" {
@@ -18,15 +32,20 @@ func Authmiddleware() gin.HandlerFunc {
 			return
 		}
 
-		parts:= strings.Split(tokenString, " ")
+		parts := strings.Split(tokenString, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token format"})
 			c.Abort()
-			return 
+			return
 		}
 
 		tokenString = parts[1]
 
+		if strings.HasPrefix(tokenString, models.APITokenPrefix) {
+			authenticateAPIToken(c, tokenString)
+			return
+		}
+
 		token, err := utils.ValidateToken(tokenString)
 
 		if err != nil || !token.Valid {
@@ -36,8 +55,149 @@ func Authmiddleware() gin.HandlerFunc {
 		}
 
 		claims := token.Claims.(jwt.MapClaims)
+
+		// purpose tokens (e.g. the 2FA challenge) are not API credentials
+		if _, ok := claims["purpose"]; ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		sessionID, _ := claims["sid"].(string)
+		if sessionID == "" {
+			// issued before login sessions existed; such tokens can't be
+			// revoked, so they are only honoured until they would have
+			// expired anyway
+			expiresAt, ok := legacyTokenExpiry(claims)
+			if !ok || !time.Now().Before(expiresAt) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired or revoked"})
+				c.Abort()
+				return
+			}
+			c.Set("legacyTokenExpiresAt", expiresAt)
+		} else if !checkSession(c, sessionID) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired or revoked"})
+			c.Abort()
+			return
+		}
+
 		c.Set("userID", claims["userID"])
+		c.Set("sessionID", sessionID)
+		if issuedAt, err := claims.GetIssuedAt(); err == nil && issuedAt != nil {
+			c.Set("authTime", issuedAt.Time)
+		}
+
+		c.Next()
+	}
+}
+
+// legacyTokenExpiry is when a token without a session stops being honoured:
+// MaxTokenLifetime after it was issued, however far off its own expiry is.
+// Tokens from before sessions existed
+// carry no iat; they were always issued for MaxTokenLifetime, so their issue
+// time is taken from exp.
+func legacyTokenExpiry(claims jwt.MapClaims) (time.Time, bool) {
+	var issued time.Time
+	if issuedAt, err := claims.GetIssuedAt(); err == nil && issuedAt != nil {
+		issued = issuedAt.Time
+	} else if expiresAt, err := claims.GetExpirationTime(); err == nil && expiresAt != nil {
+		issued = expiresAt.Add(-utils.MaxTokenLifetime)
+	} else {
+		return time.Time{}, false
+	}
+	return issued.Add(utils.MaxTokenLifetime), true
+}
+
+// checkSession makes sure the login session behind a JWT is still active and
+// keeps its last-seen time and IP current
+func checkSession(c *gin.Context, sessionID string) bool {
+	sessionObjID, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return false
+	}
+
+	collection := utils.GetCollection("sessions")
+	var session models.Session
+	if err := collection.FindOne(c, bson.M{"_id": sessionObjID}).Decode(&session); err != nil {
+		return false
+	}
+
+	now := time.Now()
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		return false
+	}
+
+	if now.Sub(session.LastSeenAt) > sessionLastSeenResolution || session.IP != c.ClientIP() {
+		_, err := collection.UpdateOne(c, bson.M{"_id": session.ID}, bson.M{
+			"$set": bson.M{"last_seen_at": now, "ip": c.ClientIP()},
+		})
+		if err != nil {
+			log.Printf("Could not update session %s: %v", session.ID.Hex(), err)
+		}
+	}
+
+	return true
+}
+
+// authenticateAPIToken resolves a personal access token and stores its scopes
+// on the context so RequireScope can enforce them
+func authenticateAPIToken(c *gin.Context, tokenString string) {
+	collection := utils.GetCollection("api_tokens")
+
+	var apiToken models.APIToken
+	err := collection.FindOne(c, bson.M{"token_hash": utils.HashSecret(tokenString)}).Decode(&apiToken)
+	if err != nil || apiToken.RevokedAt != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	now := time.Now()
+	if apiToken.ExpiresAt != nil && now.After(*apiToken.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
+		c.Abort()
+		return
+	}
+
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) > tokenLastUsedResolution {
+		_, err := collection.UpdateOne(c, bson.M{"_id": apiToken.ID}, bson.M{"$set": bson.M{"last_used_at": now}})
+		if err != nil {
+			log.Printf("Could not update last_used_at for token %s: %v", apiToken.ID.Hex(), err)
+		}
+	}
+
+	c.Set("userID", apiToken.UserID.Hex())
+	c.Set("apiTokenID", apiToken.ID.Hex())
+	c.Set("apiTokenScopes", apiToken.Scopes)
+
+	c.Next()
+}
+
+// RequireScope rejects API tokens that weren't granted scope. Regular user
+// sessions (JWTs) are not scoped and always pass.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopes, ok := c.Get("apiTokenScopes")
+		if ok && !slices.Contains(scopes.([]string), scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token is missing required scope", "scope": scope})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireUserSession restricts a route to interactive logins, e.g. so an API
+// token can't mint further tokens or change account security settings
+func RequireUserSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("apiTokenScopes"); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API tokens cannot access this endpoint"})
+			c.Abort()
+			return
+		}
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
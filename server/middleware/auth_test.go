@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestLegacyTokenExpiry(t *testing.T) {
+	// parsed claims hold numbers as float64
+	now := time.Now().Truncate(time.Second)
+	at := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+	tests := []struct {
+		name      string
+		claims    jwt.MapClaims
+		want      time.Time
+		wantValid bool
+	}{
+		{"recent iat", jwt.MapClaims{"iat": at(-time.Hour), "exp": at(time.Hour)}, now.Add(23 * time.Hour), true},
+		{"old iat with far expiry", jwt.MapClaims{"iat": at(-25 * time.Hour), "exp": at(time.Hour)}, now.Add(-time.Hour), false},
+		// tokens from before sessions existed only set exp, 24h after issue
+		{"pre-session token", jwt.MapClaims{"userID": "u", "exp": at(23 * time.Hour)}, now.Add(23 * time.Hour), true},
+		{"no times", jwt.MapClaims{"userID": "u"}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := legacyTokenExpiry(tt.claims)
+		if ok != !tt.want.IsZero() || !got.Equal(tt.want) {
+			t.Errorf("%s: legacyTokenExpiry = %v, %v; want %v", tt.name, got, ok, tt.want)
+		}
+		if valid := ok && time.Now().Before(got); valid != tt.wantValid {
+			t.Errorf("%s: honoured = %v, want %v", tt.name, valid, tt.wantValid)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayushsarode/DriftBox/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RateLimit is a token bucket: Burst requests at once, refilled at Rate per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitStore keeps bucket state. The memory store is per instance; the
+// Mongo store shares buckets across instances.
+type RateLimitStore interface {
+	// Take removes one token from the bucket for key. When the bucket is
+	// empty it reports how long until a token is available.
+	Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+// RateLimiter builds per-route limiting middleware on top of a store
+type RateLimiter struct {
+	store RateLimitStore
+}
+
+func NewRateLimiter(store RateLimitStore) *RateLimiter {
+	return &RateLimiter{store: store}
+}
+
+// Limit returns middleware that applies limit separately to the client IP
+// and, on authenticated routes, to the user. Buckets are per route so e.g.
+// downloads don't eat into the upload allowance.
+func (l *RateLimiter) Limit(name string, limit RateLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := name + ":" + c.Request.Method + " " + c.FullPath()
+
+		keys := []string{route + ":ip:" + c.ClientIP()}
+		if userID, ok := c.Get("userID"); ok {
+			keys = append(keys, fmt.Sprintf("%s:user:%v", route, userID))
+		}
+
+		for _, key := range keys {
+			allowed, retryAfter, err := l.store.Take(c, key, limit)
+			if err != nil {
+				// fail open: an unavailable store shouldn't take the API down
+				log.Printf("Rate limit store error for %s: %v", key, err)
+				continue
+			}
+			if !allowed {
+				AbortTooManyRequests(c, retryAfter)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// AbortTooManyRequests sends the standard 429 response with Retry-After
+func AbortTooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many requests",
+		"retry_after": seconds,
+	})
+	c.Abort()
+}
+
+// RateLimitFromEnv parses a limit such as "10/1m" (10 requests per minute,
+// bursting up to 10) from the named variable, falling back to def
+func RateLimitFromEnv(name, def string) RateLimit {
+	value := os.Getenv(name)
+	if value == "" {
+		value = def
+	}
+
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s: %v", name, value, def, err)
+		limit, _ = parseRateLimit(def)
+	}
+	return limit
+}
+
+func parseRateLimit(value string) (RateLimit, error) {
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("expected <count>/<duration>")
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid count")
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(period))
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid duration")
+	}
+
+	return RateLimit{Rate: float64(n) / d.Seconds(), Burst: n}, nil
+}
+
+// RateLimitStoreFromEnv picks the store from RATE_LIMIT_STORE (memory or mongo)
+func RateLimitStoreFromEnv() RateLimitStore {
+	if os.Getenv("RATE_LIMIT_STORE") == "mongo" {
+		return &MongoRateLimitStore{}
+	}
+	return NewMemoryRateLimitStore()
+}
+
+// bucketTTL is how long an idle bucket is kept; after that it is full again anyway
+func bucketTTL(limit RateLimit) time.Duration {
+	return time.Duration(float64(limit.Burst)/limit.Rate*float64(time.Second)) + time.Minute
+}
+
+func retryAfter(tokens float64, limit RateLimit) time.Duration {
+	return time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	expiresAt time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in process memory
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	s := &MemoryRateLimitStore{buckets: map[string]*bucket{}}
+	go s.cleanup()
+	return s
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updatedAt).Seconds()*limit.Rate)
+	b.updatedAt = now
+	b.expiresAt = now.Add(bucketTTL(limit))
+
+	if b.tokens < 1 {
+		return false, retryAfter(b.tokens, limit), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+func (s *MemoryRateLimitStore) cleanup() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		s.mu.Lock()
+		for key, b := range s.buckets {
+			if now.After(b.expiresAt) {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// MongoRateLimitStore keeps buckets in the rate_limits collection. The refill
+// and take happen in a single pipeline update, so concurrent requests on
+// different instances can't both spend the last token.
+type MongoRateLimitStore struct{}
+
+func (s *MongoRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+	burst := float64(limit.Burst)
+
+	elapsed := bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}},
+		1000,
+	}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tokens": bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{
+				bson.M{"$ifNull": bson.A{"$tokens", burst}},
+				bson.M{"$multiply": bson.A{elapsed, limit.Rate}},
+			}}}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"allowed":    bson.M{"$gte": bson.A{"$tokens", 1}},
+			"updated_at": now,
+			"expires_at": now.Add(bucketTTL(limit)),
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"tokens": bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}},
+		}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var result struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+
+	collection := utils.GetCollection("rate_limits")
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&result)
+	if mongo.IsDuplicateKeyError(err) {
+		// two instances raced to create the bucket; the retry updates it
+		err = collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&result)
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	if !result.Allowed {
+		return false, retryAfter(result.Tokens, limit), nil
+	}
+	return true, 0, nil
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    RateLimit
+		wantErr bool
+	}{
+		{"10/1m", RateLimit{Rate: 10.0 / 60, Burst: 10}, false},
+		{"5/1s", RateLimit{Rate: 5, Burst: 5}, false},
+		{" 100 / 1h ", RateLimit{Rate: 100.0 / 3600, Burst: 100}, false},
+		{"1/500ms", RateLimit{Rate: 2, Burst: 1}, false},
+
+		{"", RateLimit{}, true},
+		{"10", RateLimit{}, true},
+		{"10/", RateLimit{}, true},
+		{"/1m", RateLimit{}, true},
+		{"ten/1m", RateLimit{}, true},
+		{"0/1m", RateLimit{}, true},
+		{"-5/1m", RateLimit{}, true},
+		{"10/0s", RateLimit{}, true},
+		{"10/-1m", RateLimit{}, true},
+		{"10/minute", RateLimit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseRateLimit(%q) = (%+v, %v), want (%+v, error %v)", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRateLimitFromEnvFallsBack(t *testing.T) {
+	t.Setenv("TEST_RATE_LIMIT", "often")
+	if got, want := RateLimitFromEnv("TEST_RATE_LIMIT", "3/1m"), (RateLimit{Rate: 3.0 / 60, Burst: 3}); got != want {
+		t.Errorf("RateLimitFromEnv = %+v, want %+v", got, want)
+	}
+}
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	limit := RateLimit{Rate: 1, Burst: 3}
+
+	tests := []struct {
+		name string
+		// how long ago the bucket was last touched before the take
+		elapsed    time.Duration
+		wantOK     bool
+		wantTokens float64
+	}{
+		{"burst 1", 0, true, 2},
+		{"burst 2", 0, true, 1},
+		{"burst 3", 0, true, 0},
+		{"empty", 0, false, 0},
+		{"half refilled", 500 * time.Millisecond, false, 0.5},
+		{"refilled", 500 * time.Millisecond, true, 0},
+		// the bucket never holds more than the burst
+		{"idle", time.Hour, true, 2},
+	}
+
+	store := &MemoryRateLimitStore{buckets: map[string]*bucket{}}
+	for _, tt := range tests {
+		if b, ok := store.buckets["key"]; ok {
+			b.updatedAt = b.updatedAt.Add(-tt.elapsed)
+		}
+
+		ok, retry, err := store.Take(context.Background(), "key", limit)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok != tt.wantOK {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, ok, tt.wantOK)
+		}
+		if ok && retry != 0 {
+			t.Errorf("%s: retry after %v on an allowed request", tt.name, retry)
+		}
+		if !ok && (retry <= 0 || retry > time.Second) {
+			t.Errorf("%s: retry after %v, want within a second", tt.name, retry)
+		}
+		// a few microseconds pass between takes
+		if got := store.buckets["key"].tokens; got < tt.wantTokens || got > tt.wantTokens+0.01 {
+			t.Errorf("%s: tokens = %v, want %v", tt.name, got, tt.wantTokens)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreKeysAreSeparate(t *testing.T) {
+	store := &MemoryRateLimitStore{buckets: map[string]*bucket{}}
+	limit := RateLimit{Rate: 0.001, Burst: 1}
+
+	if ok, _, _ := store.Take(context.Background(), "a", limit); !ok {
+		t.Fatal("first take of a refused")
+	}
+	if ok, _, _ := store.Take(context.Background(), "a", limit); ok {
+		t.Error("second take of a allowed")
+	}
+	if ok, _, _ := store.Take(context.Background(), "b", limit); !ok {
+		t.Error("take of b refused after a was emptied")
+	}
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	limiter := NewRateLimiter(&MemoryRateLimitStore{buckets: map[string]*bucket{}})
+	router := gin.New()
+	router.GET("/login", limiter.Limit("login", RateLimit{Rate: 0.1, Burst: 2}), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func(ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/login", nil)
+		req.RemoteAddr = ip + ":1234"
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("192.0.2.1"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i+1, w.Code)
+		}
+	}
+	w := request("192.0.2.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %q, want 10", got)
+	}
+
+	if w := request("192.0.2.2"); w.Code != http.StatusOK {
+		t.Errorf("other client: status %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DeletionScheduled = "scheduled"
+	DeletionRunning   = "running"
+	DeletionCompleted = "completed"
+	DeletionCancelled = "cancelled"
+	DeletionFailed    = "failed"
+)
+
+// AccountDeletion is a requested account purge. It waits for PurgeAfter so the
+// user can still cancel, then a background job removes all of their data.
+type AccountDeletion struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID      primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Status      string             `bson:"status" json:"status"`
+	RequestedAt time.Time          `bson:"requested_at" json:"requested_at"`
+	PurgeAfter  time.Time          `bson:"purge_after" json:"purge_after"`
+	StartedAt   *time.Time         `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	CompletedAt *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	Error       string             `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// AuditEntry is an append-only record of a security relevant event
+type AuditEntry struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID     `bson:"user_id" json:"user_id"`
+	Action    string                 `bson:"action" json:"action"`
+	Details   map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+	CreatedAt time.Time              `bson:"created_at" json:"created_at"`
+}
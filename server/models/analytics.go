@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StorageSnapshot records a user's usage counters once a day, for the
+// usage-over-time series
+type StorageSnapshot struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	UserID      primitive.ObjectID `bson:"user_id" json:"-"`
+	Date        time.Time          `bson:"date" json:"date"` // midnight UTC
+	UsedSpace   int64              `bson:"used_space" json:"used_space"`
+	FileCount   int                `bson:"file_count" json:"file_count"`
+	FolderCount int                `bson:"folder_count" json:"folder_count"`
+	CreatedAt   time.Time          `bson:"created_at" json:"-"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APITokenPrefix identifies personal access tokens in the Authorization header
+const APITokenPrefix = "dbx_"
+
+const (
+	ScopeFilesRead    = "files:read"
+	ScopeFilesWrite   = "files:write"
+	ScopeFoldersWrite = "folders:write"
+)
+
+// APITokenScopes lists every scope a token can be granted. A scope is only
+// added here together with the routes that require it, so no token holds a
+// grant whose meaning isn't settled yet.
+var APITokenScopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeFoldersWrite}
+
+// APIToken is a user-managed personal access token. Only the SHA-256 of the
+// token is stored; the plaintext is shown once at creation.
+type APIToken struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Name       string             `bson:"name" json:"name"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	TokenHash  string             `bson:"token_hash" json:"-"`
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
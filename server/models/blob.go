@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Blob is stored content addressed by its SHA-256. Any number of files, of
+// any user, can point at the same blob; RefCount tracks how many do.
+type Blob struct {
+	ID          string          `bson:"_id" json:"id"` // hex SHA-256 of the plaintext
+	Path        string          `bson:"path" json:"path"`
+	Size        int64           `bson:"size" json:"size"`
+	ContentType string          `bson:"content_type" json:"content_type"`
+	State       string          `bson:"state" json:"state"`
+	RefCount    int64           `bson:"ref_count" json:"ref_count"`
+	Encryption  *FileEncryption `bson:"encryption,omitempty" json:"-"`
+
+	// the scan verdict is a property of the content, so later uploads of the
+	// same bytes inherit it
+	ScanStatus    string     `bson:"scan_status,omitempty" json:"scan_status,omitempty"`
+	ScanSignature string     `bson:"scan_signature,omitempty" json:"scan_signature,omitempty"`
+	ScannedAt     *time.Time `bson:"scanned_at,omitempty" json:"scanned_at,omitempty"`
+
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	// when RefCount last dropped to zero; the collector waits a while after it
+	UnreferencedAt *time.Time `bson:"unreferenced_at,omitempty" json:"unreferenced_at,omitempty"`
+}
+
+const (
+	BlobUploading = "uploading"
+	BlobReady     = "ready"
+	BlobDeleting  = "deleting"
+)
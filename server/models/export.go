@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+	ExportExpired = "expired"
+)
+
+// Export is a personal data export ("takeout"). The ZIP is kept in the
+// bucket until ExpiresAt and then removed.
+type Export struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Status string             `bson:"status" json:"status"`
+	Path   string             `bson:"path,omitempty" json:"-"`
+	Size   int64              `bson:"size,omitempty" json:"size,omitempty"` // of the ZIP, before encryption
+	// set when the stored archive is encrypted at rest
+	Encryption  *FileEncryption `bson:"encryption,omitempty" json:"-"`
+	FileCount   int             `bson:"file_count,omitempty" json:"file_count,omitempty"`
+	FailedCount int             `bson:"failed_count,omitempty" json:"failed_count,omitempty"` // files the manifest marks as not exported
+	Error       string          `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt   time.Time       `bson:"created_at" json:"created_at"`
+	StartedAt   *time.Time      `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	CompletedAt *time.Time      `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time      `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
@@ -11,22 +11,108 @@ type File struct {
 	Name         string              `bson:"name" json:"name" binding:"required"`
 	OriginalName string              `bson:"original_name" json:"original_name"`
 	Size         int64               `bson:"size" json:"size"`
-	ContentType  string              `bson:"content_type" json:"content_type"`
+	ContentType  string              `bson:"content_type" json:"content_type"` // detected from the content
 	UserID       primitive.ObjectID  `bson:"user_id" json:"user_id"`
 	FolderID     *primitive.ObjectID `bson:"folder_id,omitempty" json:"folder_id,omitempty"`
 	Path         string              `bson:"path" json:"path"`
 	URL          string              `bson:"url" json:"url"`
-	Hash         string              `bson:"hash" json:"hash"`
+	SHA256       string              `bson:"sha256,omitempty" json:"sha256,omitempty"` // hex
+	CRC32C       string              `bson:"crc32c,omitempty" json:"crc32c,omitempty"` // base64, big-endian like GCS
+	Hash         string              `bson:"hash,omitempty" json:"hash,omitempty"`     // legacy MD5, dropped once SHA-256 is known
+	BlobID       string              `bson:"blob_id,omitempty" json:"-"`               // content-addressed blob; empty for older files and vault files
 	IsFavorite   bool                `bson:"is_favorite" json:"is_favorite"`
-	CreatedAt    time.Time           `bson:"created_at" json:"created_at"`
-	UpdatedAt    time.Time           `bson:"updated_at" json:"updated_at"`
+	TrashedAt    *time.Time          `bson:"trashed_at,omitempty" json:"trashed_at,omitempty"` // in the trash until purged or restored
+
+	// what the client said the type was versus what the bytes say
+	ClaimedContentType  string `bson:"claimed_content_type,omitempty" json:"claimed_content_type,omitempty"`
+	DetectedContentType string `bson:"detected_content_type,omitempty" json:"detected_content_type,omitempty"`
+
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+
+	// background processing after upload
+	ProcessedAt     *time.Time `bson:"processed_at,omitempty" json:"-"`
+	ProcessingLease *time.Time `bson:"processing_lease,omitempty" json:"-"`
+	ThumbnailStatus string     `bson:"thumbnail_status,omitempty" json:"thumbnail_status,omitempty"`
+	Thumbnails      []string   `bson:"thumbnails,omitempty" json:"thumbnails,omitempty"`
+	// perceptual hashes of images (hex), for finding ones that look alike
+	AHash string `bson:"ahash,omitempty" json:"-"`
+	DHash string `bson:"dhash,omitempty" json:"-"`
+	// set when the backfill couldn't hash an image, so it isn't retried
+	PerceptualHashError string `bson:"phash_error,omitempty" json:"-"`
+
+	// malware scanning; empty when no scanner is configured
+	ScanStatus    string     `bson:"scan_status,omitempty" json:"scan_status,omitempty"`
+	ScanSignature string     `bson:"scan_signature,omitempty" json:"scan_signature,omitempty"`
+	ScanError     string     `bson:"scan_error,omitempty" json:"-"`
+	ScanAttempts  int        `bson:"scan_attempts,omitempty" json:"-"`
+	ScannedAt     *time.Time `bson:"scanned_at,omitempty" json:"scanned_at,omitempty"`
+	QuarantinedAt *time.Time `bson:"quarantined_at,omitempty" json:"quarantined_at,omitempty"`
+
+	// files in an end-to-end encrypted vault; Name is a placeholder and the
+	// content is ciphertext only the vault members can read
+	VaultID           *primitive.ObjectID `bson:"vault_id,omitempty" json:"vault_id,omitempty"`
+	EncryptedName     string              `bson:"encrypted_name,omitempty" json:"encrypted_name,omitempty"`
+	EncryptedMetadata string              `bson:"encrypted_metadata,omitempty" json:"encrypted_metadata,omitempty"`
+	KeyVersion        int                 `bson:"key_version,omitempty" json:"key_version,omitempty"`
+	UploadedBy        *primitive.ObjectID `bson:"uploaded_by,omitempty" json:"uploaded_by,omitempty"`
+
+	// envelope encryption; nil for files stored while it was disabled
+	Encryption *FileEncryption `bson:"encryption,omitempty" json:"-"`
+}
+
+// FileEncryption records how a file's content is encrypted. The data key is
+// only ever stored wrapped by the KMS key named by KeyID.
+type FileEncryption struct {
+	Algorithm   string     `bson:"algorithm"`
+	ChunkSize   int        `bson:"chunk_size"`
+	KeyID       string     `bson:"key_id"`
+	WrappedKey  []byte     `bson:"wrapped_key"`
+	RewrappedAt *time.Time `bson:"rewrapped_at,omitempty"`
+}
+
+// Quarantined reports whether the file was found to be infected. Its content
+// must not be served or processed.
+func (f *File) Quarantined() bool {
+	return f.ScanStatus == ScanInfected
+}
+
+// AwaitingScan reports whether the file is still queued for its malware
+// scan. Its content is not served until the verdict is in.
+func (f *File) AwaitingScan() bool {
+	return f.ScanStatus == ScanPending
+}
+
+// Unscanned reports whether the file has no verdict and won't get one: its
+// scan kept failing or was skipped. Whether its content is served is a
+// policy decision for the caller.
+func (f *File) Unscanned() bool {
+	return f.ScanStatus == ScanError || f.ScanStatus == ScanSkipped
 }
 
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanError    = "error"
+	// ScanSkipped marks content that was never scanned, e.g. because it is
+	// larger than the scanner accepts
+	ScanSkipped = "skipped"
+)
+
+const (
+	ThumbnailPending     = "pending"
+	ThumbnailReady       = "ready"
+	ThumbnailUnsupported = "unsupported"
+	ThumbnailFailed      = "failed"
+)
+
 type UserStorage struct {
-	UserID      primitive.ObjectID `bson:"user_id" json:"user_id"`
-	UsedSpace   int64              `bson:"used_space" json:"used_space"`
-	MaxSpace    int64              `bson:"max_space" json:"max_space"`
-	FileCount   int                `bson:"file_count" json:"file_count"`
-	FolderCount int                `bson:"folder_count" json:"folder_count"`
-	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+	UserID        primitive.ObjectID `bson:"user_id" json:"user_id"`
+	UsedSpace     int64              `bson:"used_space" json:"used_space"`
+	ReservedSpace int64              `bson:"reserved_space" json:"reserved_space"` // held by uploads in progress
+	MaxSpace      int64              `bson:"-" json:"max_space"`                   // from the user's plan
+	FileCount     int                `bson:"file_count" json:"file_count"`
+	FolderCount   int                `bson:"folder_count" json:"folder_count"`
+	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
 }
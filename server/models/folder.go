@@ -12,6 +12,7 @@ type Folder struct {
 	UserID    primitive.ObjectID  `bson:"user_id" json:"user_id"`
 	ParentID  *primitive.ObjectID `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
 	Path      string              `bson:"path" json:"path"`
+	Vault     *FolderVault        `bson:"vault,omitempty" json:"vault,omitempty"`
 	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time           `bson:"updated_at" json:"updated_at"`
 }
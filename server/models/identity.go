@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Identity is an external login (an OIDC provider account) attached to a
+// user. A user can have any number of identities next to their password.
+type Identity struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID        primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Provider      string             `bson:"provider" json:"provider"`
+	Subject       string             `bson:"subject" json:"-"`
+	Email         string             `bson:"email,omitempty" json:"email,omitempty"`
+	EmailVerified bool               `bson:"email_verified" json:"email_verified"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	LastLoginAt   *time.Time         `bson:"last_login_at,omitempty" json:"last_login_at,omitempty"`
+}
+
+// OIDCLinkRequest tracks an in-flight "link this provider" flow started by a
+// signed-in user. It is keyed by the OAuth state and consumed by the callback.
+type OIDCLinkRequest struct {
+	State     string             `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Provider  string             `bson:"provider"`
+	Nonce     string             `bson:"nonce"`
+	Verifier  string             `bson:"verifier"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
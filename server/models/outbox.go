@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// remove an object from the bucket
+	IntentDeleteObject = "delete_object"
+)
+
+// StorageIntent is a bucket operation that has to follow a metadata change.
+// It is written in the same transaction as the change and removed once the
+// operation succeeded, so a crash in between only delays it.
+type StorageIntent struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Action        string             `bson:"action" json:"action"`
+	Path          string             `bson:"path" json:"path"`
+	Attempts      int                `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time          `bson:"next_attempt_at" json:"next_attempt_at"`
+	LastError     string             `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+}
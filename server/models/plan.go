@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PlanLimits are what a storage plan allows
+type PlanLimits struct {
+	MaxStorage  int64 `bson:"max_storage" json:"max_storage"`     // bytes
+	MaxFileSize int64 `bson:"max_file_size" json:"max_file_size"` // bytes
+}
+
+// Plan is a named set of limits users are assigned to. Users without a plan,
+// or whose plan was deleted, get the default one.
+type Plan struct {
+	ID         string `bson:"_id" json:"id"`
+	Name       string `bson:"name" json:"name"`
+	PlanLimits `bson:",inline"`
+	IsDefault  bool      `bson:"is_default" json:"is_default"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// DefaultPlan is used as the default until an admin marks a plan as default
+var DefaultPlan = Plan{
+	ID:   "free",
+	Name: "Free",
+	PlanLimits: PlanLimits{
+		MaxStorage:  2 * 1024 * 1024 * 1024, // 2GB
+		MaxFileSize: 50 * 1024 * 1024,       // 50MB
+	},
+	IsDefault: true,
+}
+
+// PlanOverrides replace single limits of a user's plan. Nil fields keep the
+// plan's value.
+type PlanOverrides struct {
+	MaxStorage  *int64 `bson:"max_storage,omitempty" json:"max_storage,omitempty"`
+	MaxFileSize *int64 `bson:"max_file_size,omitempty" json:"max_file_size,omitempty"`
+
+	UpdatedBy primitive.ObjectID `bson:"updated_by" json:"updated_by"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// Apply returns limits with the overrides in place
+func (o *PlanOverrides) Apply(limits PlanLimits) PlanLimits {
+	if o == nil {
+		return limits
+	}
+	if o.MaxStorage != nil {
+		limits.MaxStorage = *o.MaxStorage
+	}
+	if o.MaxFileSize != nil {
+		limits.MaxFileSize = *o.MaxFileSize
+	}
+	return limits
+}
@@ -0,0 +1,36 @@
+package models
+
+import "testing"
+
+func TestPlanOverridesApply(t *testing.T) {
+	int64p := func(v int64) *int64 { return &v }
+	plan := DefaultPlan.PlanLimits
+
+	tests := []struct {
+		name      string
+		overrides *PlanOverrides
+		want      PlanLimits
+	}{
+		{"nil overrides", nil, plan},
+		{"empty overrides", &PlanOverrides{}, plan},
+		{
+			"storage only",
+			&PlanOverrides{MaxStorage: int64p(10 << 30)},
+			PlanLimits{MaxStorage: 10 << 30, MaxFileSize: plan.MaxFileSize},
+		},
+		{
+			"every limit",
+			&PlanOverrides{MaxStorage: int64p(1), MaxFileSize: int64p(2)},
+			PlanLimits{MaxStorage: 1, MaxFileSize: 2},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.overrides.Apply(plan); got != tt.want {
+			t.Errorf("%s: Apply = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if DefaultPlan.PlanLimits != plan {
+		t.Error("Apply changed the plan it was given")
+	}
+}
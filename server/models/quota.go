@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// QuotaReservation holds Size bytes of a user's quota for an upload in
+// progress. It is counted in UserStorage.ReservedSpace until the upload is
+// saved, fails, or the reservation expires.
+type QuotaReservation struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Size      int64              `bson:"size" json:"size"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+}
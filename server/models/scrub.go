@@ -0,0 +1,73 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ScrubRunning   = "running"
+	ScrubCompleted = "completed"
+	ScrubFailed    = "failed"
+)
+
+// ScrubRun is one pass of the storage scrubber over the files collection
+// and the bucket
+type ScrubRun struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Status         string             `bson:"status" json:"status"`
+	StartedAt      time.Time          `bson:"started_at" json:"started_at"`
+	HeartbeatAt    time.Time          `bson:"heartbeat_at" json:"-"`
+	FinishedAt     *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	FilesChecked   int64              `bson:"files_checked" json:"files_checked"`
+	ObjectsChecked int64              `bson:"objects_checked" json:"objects_checked"`
+	IssuesFound    int64              `bson:"issues_found" json:"issues_found"`
+	Error          string             `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+const (
+	// a file's object is gone
+	ScrubMissingObject = "missing_object"
+	// the object's size isn't what the file record implies
+	ScrubSizeMismatch = "size_mismatch"
+	// the content doesn't hash to the recorded checksum
+	ScrubChecksumMismatch = "checksum_mismatch"
+	// the content couldn't be read or decrypted
+	ScrubUnreadable = "unreadable"
+	// an object no record refers to
+	ScrubOrphanObject = "orphan_object"
+	// a file whose folder no longer exists
+	ScrubOrphanFile = "orphan_file"
+)
+
+const (
+	ScrubIssueOpen      = "open"
+	ScrubIssueRepaired  = "repaired"
+	ScrubIssueDismissed = "dismissed"
+	// a later run no longer found the problem
+	ScrubIssueResolved = "resolved"
+)
+
+// ScrubIssue is a problem the scrubber found. An issue that keeps showing up
+// stays one open document; LastSeenAt moves with each run.
+type ScrubIssue struct {
+	ID         primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Key        string              `bson:"key" json:"-"`
+	Kind       string              `bson:"kind" json:"kind"`
+	Status     string              `bson:"status" json:"status"`
+	FileID     *primitive.ObjectID `bson:"file_id,omitempty" json:"file_id,omitempty"`
+	UserID     *primitive.ObjectID `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	FolderID   *primitive.ObjectID `bson:"folder_id,omitempty" json:"folder_id,omitempty"`
+	ObjectPath string              `bson:"object_path,omitempty" json:"object_path,omitempty"`
+	Expected   string              `bson:"expected,omitempty" json:"expected,omitempty"`
+	Actual     string              `bson:"actual,omitempty" json:"actual,omitempty"`
+	Detail     string              `bson:"detail,omitempty" json:"detail,omitempty"`
+
+	RunID       primitive.ObjectID  `bson:"run_id" json:"run_id"`
+	FirstSeenAt time.Time           `bson:"first_seen_at" json:"first_seen_at"`
+	LastSeenAt  time.Time           `bson:"last_seen_at" json:"last_seen_at"`
+	ResolvedAt  *time.Time          `bson:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+	ResolvedBy  *primitive.ObjectID `bson:"resolved_by,omitempty" json:"resolved_by,omitempty"`
+	Resolution  string              `bson:"resolution,omitempty" json:"resolution,omitempty"`
+}
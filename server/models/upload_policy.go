@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UploadPolicy restricts which files may be stored. The global policy has no
+// UserID; a user policy is applied on top of it, so something denied by
+// either is refused and both allow lists have to match.
+//
+// Types are media types ("application/pdf") or families ("image/*") and are
+// matched against the type detected from the content, not the one claimed.
+// Extensions include the dot (".exe").
+type UploadPolicy struct {
+	ID                primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	UserID            *primitive.ObjectID `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	AllowedTypes      []string            `bson:"allowed_types,omitempty" json:"allowed_types"`
+	DeniedTypes       []string            `bson:"denied_types,omitempty" json:"denied_types"`
+	AllowedExtensions []string            `bson:"allowed_extensions,omitempty" json:"allowed_extensions"`
+	DeniedExtensions  []string            `bson:"denied_extensions,omitempty" json:"denied_extensions"`
+	UpdatedAt         time.Time           `bson:"updated_at" json:"updated_at"`
+}
+
+// DefaultUploadPolicy is used as the global policy until an admin saves one
+var DefaultUploadPolicy = UploadPolicy{
+	DeniedTypes: []string{
+		"application/vnd.microsoft.portable-executable",
+		"application/x-msdownload",
+		"application/x-dosexec",
+		"application/x-executable",
+		"application/x-elf",
+		"application/x-sharedlib",
+		"application/x-mach-binary",
+	},
+	DeniedExtensions: []string{
+		".exe", ".dll", ".scr", ".com", ".bat", ".cmd", ".msi", ".ps1", ".vbs", ".jar", ".apk",
+	},
+}
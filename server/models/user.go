@@ -1,13 +1,37 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type User struct {
-	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Username     string             `bson:"username" json:"username"`
-	Email        string             `bson:"email" json:"email" binding:"required,email"`
-	Password     string             `bson:"password,omitempty" json:"password,omitempty" binding:"required"`
-	GoogleID     string             `bson:"google_id,omitempty" json:"google_id,omitempty"`
-	Picture      string             `bson:"picture,omitempty" json:"picture,omitempty"`
-	AuthProvider string             `bson:"auth_provider,omitempty" json:"auth_provider,omitempty"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username      string             `bson:"username" json:"username"`
+	Email         string             `bson:"email" json:"email" binding:"required,email"`
+	EmailVerified bool               `bson:"email_verified,omitempty" json:"email_verified"`
+	Password      string             `bson:"password,omitempty" json:"password,omitempty" binding:"required"`
+	GoogleID      string             `bson:"google_id,omitempty" json:"google_id,omitempty"` // legacy, see Identity
+	Picture       string             `bson:"picture,omitempty" json:"picture,omitempty"`
+	AuthProvider  string             `bson:"auth_provider,omitempty" json:"auth_provider,omitempty"` // how the account was created
+	TwoFactor     *TwoFactor         `bson:"two_factor,omitempty" json:"-"`
+	Role          string             `bson:"role,omitempty" json:"-"`    // only set by admins, never from a request
+	PlanID        string             `bson:"plan_id,omitempty" json:"-"` // empty for the default plan; see GetPlan
+	PlanOverrides *PlanOverrides     `bson:"plan_overrides,omitempty" json:"-"`
+}
+
+// RoleAdmin grants access to the /api/admin endpoints. Accounts listed in
+// ADMIN_EMAILS are treated as admins as well.
+const RoleAdmin = "admin"
+
+// TwoFactor holds the TOTP enrollment for a user. Secrets and recovery codes
+// are never serialized to JSON.
+type TwoFactor struct {
+	Enabled       bool       `bson:"enabled"`
+	Secret        string     `bson:"secret,omitempty"`
+	PendingSecret string     `bson:"pending_secret,omitempty"`
+	RecoveryCodes []string   `bson:"recovery_codes,omitempty"` // SHA-256 hashes
+	LastUsedStep  int64      `bson:"last_used_step,omitempty"`
+	EnabledAt     *time.Time `bson:"enabled_at,omitempty"`
 }
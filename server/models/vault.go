@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// FolderVault marks a folder as an end-to-end encrypted vault. Everything in
+// it is encrypted by the members' clients with the vault key; the server
+// only ever sees ciphertext and wrapped copies of that key.
+type FolderVault struct {
+	EncryptedName string `bson:"encrypted_name" json:"encrypted_name"`
+	Algorithm     string `bson:"algorithm" json:"algorithm"` // chosen by the client, opaque to the server
+	KeyVersion    int    `bson:"key_version" json:"key_version"`
+	// set when a member was removed and the key has not been rotated since
+	RotationNeeded bool `bson:"rotation_needed,omitempty" json:"rotation_needed,omitempty"`
+}
+
+const (
+	VaultRoleOwner  = "owner"
+	VaultRoleMember = "member"
+)
+
+// VaultMember gives a user access to a vault owned by someone else (or the
+// owner themselves, with VaultRoleOwner)
+type VaultMember struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	VaultID   primitive.ObjectID `bson:"vault_id" json:"vault_id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Role      string             `bson:"role" json:"role"`
+	AddedBy   primitive.ObjectID `bson:"added_by" json:"added_by"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// VaultKey is one version of a vault key, wrapped by a client for one
+// member's public key
+type VaultKey struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	VaultID        primitive.ObjectID `bson:"vault_id" json:"vault_id"`
+	UserID         primitive.ObjectID `bson:"user_id" json:"user_id"`
+	KeyVersion     int                `bson:"key_version" json:"key_version"`
+	WrappedKey     string             `bson:"wrapped_key" json:"wrapped_key"`
+	KeyFingerprint string             `bson:"key_fingerprint" json:"key_fingerprint"` // the public key it was wrapped for
+	WrappedBy      primitive.ObjectID `bson:"wrapped_by" json:"wrapped_by"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// UserKey is a user's public key for vault key exchange. The private key is
+// generated on the client; it may be stored here encrypted with a secret
+// only the user knows so their other devices can fetch it.
+type UserKey struct {
+	ID                  primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID              primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Algorithm           string             `bson:"algorithm" json:"algorithm"`
+	PublicKey           string             `bson:"public_key" json:"public_key"`
+	Fingerprint         string             `bson:"fingerprint" json:"fingerprint"`
+	EncryptedPrivateKey string             `bson:"encrypted_private_key,omitempty" json:"encrypted_private_key,omitempty"`
+	CreatedAt           time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt           time.Time          `bson:"updated_at" json:"updated_at"`
+}
@@ -52,6 +52,22 @@ func GetCollection(name string) *mongo.Collection {
 	return Client.Database("driftbox").Collection(name)
 }
 
+// WithTransaction runs fn in a multi-document transaction, retrying it on
+// transient errors, so fn must only touch the database (through sessCtx).
+// Transactions need a replica set, which Atlas always is.
+func WithTransaction(ctx context.Context, fn func(sessCtx mongo.SessionContext) error) error {
+	session, err := Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
+}
+
 func Err(msg string) error {
 	log.Println(msg)
 	return &customErr{msg}
@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Content is encrypted in fixed-size chunks, each sealed on its own with
+// AES-256-GCM, so any byte range can be decrypted by fetching only the
+// chunks that cover it. The nonce is the stream number followed by the
+// chunk index: data keys are never reused across files, and the stream
+// number keeps a file's derived objects (thumbnails) from sharing nonces
+// with its content. The last chunk is sealed with different associated
+// data so a truncated object fails to decrypt instead of looking complete.
+const (
+	EncryptionAlgorithm = "AES-256-GCM-CHUNKED"
+	EncryptionChunkSize = 64 * 1024
+	DataKeySize         = 32
+
+	encryptionTagSize = 16
+)
+
+var errDecrypt = errors.New("could not decrypt content: wrong key or corrupted data")
+
+// NewDataKey returns a random key for one file
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("could not generate data key: %v", err)
+	}
+	return key, nil
+}
+
+// EncryptedSize is the stored size of size bytes of plaintext
+func EncryptedSize(size int64) int64 {
+	return size + chunkCount(size)*encryptionTagSize
+}
+
+// PlaintextSize reverses EncryptedSize
+func PlaintextSize(encryptedSize int64) int64 {
+	chunks := (encryptedSize + EncryptionChunkSize + encryptionTagSize - 1) / (EncryptionChunkSize + encryptionTagSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	return encryptedSize - chunks*encryptionTagSize
+}
+
+// ChunkRange locates the stored chunks covering a plaintext byte range
+type ChunkRange struct {
+	First, Last int64 // chunk indexes, inclusive
+	Offset      int64 // where the first chunk starts in the stored object
+	Length      int64 // stored bytes to fetch
+	Skip        int64 // plaintext bytes to drop from the first chunk
+}
+
+// EncryptedRange maps length bytes at offset of a size byte plaintext to the
+// stored chunks holding them
+func EncryptedRange(size, offset, length int64) ChunkRange {
+	last := chunkCount(size) - 1
+	r := ChunkRange{
+		First: offset / EncryptionChunkSize,
+		Last:  (offset + length - 1) / EncryptionChunkSize,
+		Skip:  offset % EncryptionChunkSize,
+	}
+	if length <= 0 {
+		r.Last = r.First
+	}
+	if r.Last > last {
+		r.Last = last
+	}
+	if r.First > r.Last {
+		r.First = r.Last
+	}
+
+	r.Offset = r.First * (EncryptionChunkSize + encryptionTagSize)
+	end := (r.Last + 1) * (EncryptionChunkSize + encryptionTagSize)
+	if total := EncryptedSize(size); end > total {
+		end = total
+	}
+	r.Length = end - r.Offset
+	return r
+}
+
+// NewEncryptingReader encrypts size bytes read from r. size must be exact:
+// it decides where the chunk boundaries and the final chunk are.
+func NewEncryptingReader(r io.Reader, dataKey []byte, stream uint32, size int64) (io.Reader, error) {
+	aead, err := newChunkAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{
+		src:    r,
+		aead:   aead,
+		stream: stream,
+		size:   size,
+		last:   chunkCount(size) - 1,
+		buf:    make([]byte, EncryptionChunkSize+encryptionTagSize),
+	}, nil
+}
+
+// NewStreamEncryptingReader is NewEncryptingReader for content whose size
+// isn't known up front, like an archive being written. It reads one byte
+// ahead to find the final chunk and produces the same output
+// NewEncryptingReader would for the same bytes.
+func NewStreamEncryptingReader(r io.Reader, dataKey []byte, stream uint32) (io.Reader, error) {
+	aead, err := newChunkAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{
+		peek:   bufio.NewReaderSize(r, EncryptionChunkSize),
+		aead:   aead,
+		stream: stream,
+		last:   math.MaxInt64,
+		buf:    make([]byte, EncryptionChunkSize+encryptionTagSize),
+	}, nil
+}
+
+// NewDecryptingReader decrypts chunks first through last of an object whose
+// plaintext is size bytes. r must start at the first chunk, as fetched with
+// EncryptedRange.
+func NewDecryptingReader(r io.Reader, dataKey []byte, stream uint32, size, first, last int64) (io.Reader, error) {
+	aead, err := newChunkAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{
+		src:     r,
+		aead:    aead,
+		stream:  stream,
+		size:    size,
+		chunk:   first,
+		last:    last,
+		final:   chunkCount(size) - 1,
+		decrypt: true,
+		buf:     make([]byte, EncryptionChunkSize+encryptionTagSize),
+	}, nil
+}
+
+// EncryptBytes seals a small object in one go
+func EncryptBytes(dataKey []byte, stream uint32, plaintext []byte) ([]byte, error) {
+	r, err := NewEncryptingReader(bytes.NewReader(plaintext), dataKey, stream, int64(len(plaintext)))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// DecryptBytes opens an object sealed with EncryptBytes
+func DecryptBytes(dataKey []byte, stream uint32, ciphertext []byte) ([]byte, error) {
+	size := PlaintextSize(int64(len(ciphertext)))
+	if size < 0 {
+		return nil, errDecrypt
+	}
+	r, err := NewDecryptingReader(bytes.NewReader(ciphertext), dataKey, stream, size, 0, chunkCount(size)-1)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// chunkReader does both directions: it reads one chunk of input at a time
+// and hands out the sealed or opened result
+type chunkReader struct {
+	src     io.Reader
+	peek    *bufio.Reader // replaces src when the size is unknown
+	aead    cipher.AEAD
+	stream  uint32
+	size    int64
+	chunk   int64 // next chunk to process
+	last    int64 // last chunk this reader covers
+	final   int64 // last chunk of the whole object (decrypt only)
+	decrypt bool
+	buf     []byte
+	out     []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.chunk > r.last {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *chunkReader) next() error {
+	if r.peek != nil {
+		return r.nextUnsized()
+	}
+
+	plainLen := int64(EncryptionChunkSize)
+	if rest := r.size - r.chunk*EncryptionChunkSize; rest < plainLen {
+		plainLen = rest
+	}
+
+	isFinal := r.chunk == r.last
+	if r.decrypt {
+		isFinal = r.chunk == r.final
+	}
+
+	inLen := plainLen
+	if r.decrypt {
+		inLen += encryptionTagSize
+	}
+	in := r.buf[:inLen]
+	if _, err := io.ReadFull(r.src, in); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if r.decrypt {
+				return errDecrypt
+			}
+			return fmt.Errorf("content is shorter than its declared size")
+		}
+		return err
+	}
+
+	nonce := chunkNonce(r.stream, r.chunk)
+	aad := chunkAAD(isFinal)
+	if r.decrypt {
+		out, err := r.aead.Open(in[:0], nonce, in, aad)
+		if err != nil {
+			return errDecrypt
+		}
+		r.out = out
+	} else {
+		// sealing in place needs room for the tag after the plaintext
+		r.out = r.aead.Seal(in[:0], nonce, in, aad)
+	}
+	r.chunk++
+	return nil
+}
+
+// nextUnsized seals the next chunk of a stream of unknown size; the chunk is
+// final when the input ends within it or right after it
+func (r *chunkReader) nextUnsized() error {
+	in := r.buf[:EncryptionChunkSize]
+	n, err := io.ReadFull(r.peek, in)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	in = in[:n]
+
+	isFinal := n < EncryptionChunkSize
+	if !isFinal {
+		if _, err := r.peek.Peek(1); err == io.EOF {
+			isFinal = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.out = r.aead.Seal(in[:0], chunkNonce(r.stream, r.chunk), in, chunkAAD(isFinal))
+	if isFinal {
+		r.last = r.chunk
+	}
+	r.chunk++
+	return nil
+}
+
+func newChunkAEAD(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != DataKeySize {
+		return nil, fmt.Errorf("data key must be %d bytes", DataKeySize)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkCount is at least one so empty content still carries a tag
+func chunkCount(size int64) int64 {
+	if size <= 0 {
+		return 1
+	}
+	return (size + EncryptionChunkSize - 1) / EncryptionChunkSize
+}
+
+func chunkNonce(stream uint32, chunk int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[:4], stream)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(chunk))
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func testContent(t *testing.T, size int) (key, plaintext []byte) {
+	t.Helper()
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext = make([]byte, size)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	return key, plaintext
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, EncryptionChunkSize - 1, EncryptionChunkSize, EncryptionChunkSize + 1, 3*EncryptionChunkSize + 5}
+	for _, size := range sizes {
+		key, plaintext := testContent(t, size)
+
+		ciphertext, err := EncryptBytes(key, 0, plaintext)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if int64(len(ciphertext)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: %d bytes stored, EncryptedSize says %d", size, len(ciphertext), EncryptedSize(int64(size)))
+		}
+		if got := PlaintextSize(int64(len(ciphertext))); got != int64(size) {
+			t.Errorf("size %d: PlaintextSize = %d", size, got)
+		}
+
+		decrypted, err := DecryptBytes(key, 0, ciphertext)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("size %d: round trip changed the content", size)
+		}
+	}
+}
+
+func TestStreamEncryptionMatchesSized(t *testing.T) {
+	sizes := []int{0, 1, EncryptionChunkSize - 1, EncryptionChunkSize, EncryptionChunkSize + 1, 2 * EncryptionChunkSize, 3*EncryptionChunkSize + 5}
+	for _, size := range sizes {
+		key, plaintext := testContent(t, size)
+
+		sized, err := EncryptBytes(key, 0, plaintext)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		// one byte reads exercise the read-ahead
+		r, err := NewStreamEncryptingReader(iotest.OneByteReader(bytes.NewReader(plaintext)), key, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(streamed, sized) {
+			t.Errorf("size %d: streamed encryption differs from sized encryption", size)
+		}
+	}
+}
+
+func TestDecryptRejectsTamperedContent(t *testing.T) {
+	key, plaintext := testContent(t, 2*EncryptionChunkSize+100)
+	ciphertext, err := EncryptBytes(key, 0, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := testContent(t, 0)
+	stored := int64(EncryptionChunkSize + encryptionTagSize)
+
+	flipped := bytes.Clone(ciphertext)
+	flipped[10] ^= 1
+
+	tests := []struct {
+		name       string
+		key        []byte
+		stream     uint32
+		ciphertext []byte
+	}{
+		{"wrong key", otherKey, 0, ciphertext},
+		{"wrong stream", key, 1, ciphertext},
+		{"flipped bit", key, 0, flipped},
+		// dropping whole chunks leaves a valid-looking object whose last
+		// chunk wasn't sealed as the final one
+		{"truncated to one chunk", key, 0, ciphertext[:stored]},
+		{"truncated to two chunks", key, 0, ciphertext[:2*stored]},
+		{"truncated mid chunk", key, 0, ciphertext[:len(ciphertext)-1]},
+		{"shorter than a tag", key, 0, ciphertext[:encryptionTagSize-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecryptBytes(tt.key, tt.stream, tt.ciphertext); err == nil {
+				t.Error("tampered content decrypted")
+			}
+		})
+	}
+}
+
+func TestEncryptingReaderRejectsShortInput(t *testing.T) {
+	key, plaintext := testContent(t, 100)
+	r, err := NewEncryptingReader(bytes.NewReader(plaintext), key, 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("encrypted less content than declared")
+	}
+}
+
+func TestEncryptedRange(t *testing.T) {
+	const chunk = EncryptionChunkSize
+	const stored = chunk + encryptionTagSize
+	size := int64(3*chunk + 100)
+
+	tests := []struct {
+		name           string
+		size           int64
+		offset, length int64
+		want           ChunkRange
+	}{
+		{"first byte", size, 0, 1, ChunkRange{First: 0, Last: 0, Offset: 0, Length: stored}},
+		{"inside a chunk", size, 10, 20, ChunkRange{First: 0, Last: 0, Offset: 0, Length: stored, Skip: 10}},
+		{"last byte of a chunk", size, chunk - 1, 1, ChunkRange{First: 0, Last: 0, Offset: 0, Length: stored, Skip: chunk - 1}},
+		{"across a boundary", size, chunk - 1, 2, ChunkRange{First: 0, Last: 1, Offset: 0, Length: 2 * stored, Skip: chunk - 1}},
+		{"second chunk exactly", size, chunk, chunk, ChunkRange{First: 1, Last: 1, Offset: stored, Length: stored}},
+		{"partial last chunk", size, 3*chunk + 50, 50, ChunkRange{First: 3, Last: 3, Offset: 3 * stored, Length: 100 + encryptionTagSize, Skip: 50}},
+		{"past the end", size, 2 * chunk, 10 * chunk, ChunkRange{First: 2, Last: 3, Offset: 2 * stored, Length: stored + 100 + encryptionTagSize}},
+		{"whole object", size, 0, size, ChunkRange{First: 0, Last: 3, Offset: 0, Length: EncryptedSize(size)}},
+		{"zero length", size, chunk + 5, 0, ChunkRange{First: 1, Last: 1, Offset: stored, Length: stored, Skip: 5}},
+		{"empty object", 0, 0, 0, ChunkRange{First: 0, Last: 0, Offset: 0, Length: encryptionTagSize}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EncryptedRange(tt.size, tt.offset, tt.length); got != tt.want {
+				t.Errorf("EncryptedRange(%d, %d, %d) = %+v, want %+v", tt.size, tt.offset, tt.length, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptingReaderServesRanges(t *testing.T) {
+	key, plaintext := testContent(t, 3*EncryptionChunkSize+100)
+	size := int64(len(plaintext))
+	ciphertext, err := EncryptBytes(key, 0, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := [][2]int64{
+		{0, 1},
+		{EncryptionChunkSize - 1, 2},
+		{EncryptionChunkSize, EncryptionChunkSize},
+		{2*EncryptionChunkSize + 7, EncryptionChunkSize + 93},
+		{size - 1, 1},
+		{0, size},
+	}
+	for _, rng := range ranges {
+		offset, length := rng[0], rng[1]
+		r := EncryptedRange(size, offset, length)
+
+		dr, err := NewDecryptingReader(bytes.NewReader(ciphertext[r.Offset:r.Offset+r.Length]), key, 0, size, r.First, r.Last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.CopyN(io.Discard, dr, r.Skip); err != nil {
+			t.Fatalf("range %d+%d: %v", offset, length, err)
+		}
+		got := make([]byte, length)
+		if _, err := io.ReadFull(dr, got); err != nil {
+			t.Fatalf("range %d+%d: %v", offset, length, err)
+		}
+		if !bytes.Equal(got, plaintext[offset:offset+length]) {
+			t.Errorf("range %d+%d: wrong content", offset, length)
+		}
+	}
+}
@@ -3,11 +3,14 @@ package utils
 import (
 	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -58,7 +61,10 @@ func UploadToGCS(ctx context.Context, fileName string, fileReader io.Reader, con
 		"uploaded": time.Now().Format(time.RFC3339),
 	}
 
-	if _, err := io.Copy(writer, fileReader); err != nil {
+	// GCS reports the CRC32C of what it stored; comparing it with what we
+	// sent catches corruption on the way there
+	checksum := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(io.MultiWriter(writer, checksum), fileReader); err != nil {
 		writer.Close()
 		return "", fmt.Errorf("failed to upload file: %v", err)
 	}
@@ -67,6 +73,13 @@ func UploadToGCS(ctx context.Context, fileName string, fileReader io.Reader, con
 		return "", fmt.Errorf("failed to close writer: %v", err)
 	}
 
+	if stored := writer.Attrs().CRC32C; stored != checksum.Sum32() {
+		if err := object.Delete(ctx); err != nil {
+			log.Printf("Could not delete corrupted upload %s: %v", fileName, err)
+		}
+		return "", fmt.Errorf("stored object checksum mismatch: sent crc32c %08x, stored %08x", checksum.Sum32(), stored)
+	}
+
 	// Return the file path (not a direct URL) - downloads will be handled by our API
 	return fileName, nil
 }
@@ -81,7 +94,7 @@ func DeleteFromGCS(ctx context.Context, fileName string) error {
 	object := bucket.Object(fileName)
 
 	if err := object.Delete(ctx); err != nil {
-		return fmt.Errorf("failed to delete file: %v", err)
+		return fmt.Errorf("failed to delete file: %w", err)
 	}
 
 	return nil
@@ -104,6 +117,56 @@ func DownloadFromGCS(ctx context.Context, fileName string) (io.ReadCloser, error
 	return reader, nil
 }
 
+// DownloadRangeFromGCS returns a reader over length bytes of an object
+// starting at offset. A negative length reads to the end of the object.
+func DownloadRangeFromGCS(ctx context.Context, fileName string, offset, length int64) (io.ReadCloser, error) {
+	if storageClient == nil {
+		return nil, fmt.Errorf("GCS client not initialized")
+	}
+
+	reader, err := storageClient.Bucket(bucketName).Object(fileName).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create range reader: %w", err)
+	}
+
+	return reader, nil
+}
+
+// StatGCSObject returns an object's attributes. A missing object yields an
+// error wrapping storage.ErrObjectNotExist.
+func StatGCSObject(ctx context.Context, fileName string) (*storage.ObjectAttrs, error) {
+	if storageClient == nil {
+		return nil, fmt.Errorf("GCS client not initialized")
+	}
+
+	attrs, err := storageClient.Bucket(bucketName).Object(fileName).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object attributes: %w", err)
+	}
+	return attrs, nil
+}
+
+// ListGCSObjects calls fn for every object whose name starts with prefix
+func ListGCSObjects(ctx context.Context, prefix string, fn func(*storage.ObjectAttrs) error) error {
+	if storageClient == nil {
+		return fmt.Errorf("GCS client not initialized")
+	}
+
+	it := storageClient.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %v", err)
+		}
+		if err := fn(attrs); err != nil {
+			return err
+		}
+	}
+}
+
 // GenerateSignedURL generates a signed URL for file download
 func GenerateSignedURL(ctx context.Context, fileName string, expiration time.Duration) (string, error) {
 	if storageClient == nil {
@@ -1,62 +1,28 @@
 package utils
 
 import (
-	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
 	"os"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	"github.com/coreos/go-oidc/v3/oidc"
 )
 
-var GoogleOAuthConfig *oauth2.Config
+const googleIssuer = "https://accounts.google.com"
 
-func InitGoogleAuth() {
-	GoogleOAuthConfig = &oauth2.Config{
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
-		Scopes:       []string{"openid", "profile", "email"},
-		Endpoint:     google.Endpoint,
-	}
-}
-
-type GoogleUserInfo struct {
-	ID            string `json:"id"`
-	Email         string `json:"email"`
-	VerifiedEmail bool   `json:"verified_email"`
-	Name          string `json:"name"`
-	GivenName     string `json:"given_name"`
-	FamilyName    string `json:"family_name"`
-	Picture       string `json:"picture"`
-}
-
-func GetGoogleUserInfo(token *oauth2.Token) (*GoogleUserInfo, error) {
-	client := GoogleOAuthConfig.Client(context.Background(), token)
-
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
-	if err != nil {
-		return nil, err
+// googleProviderConfig maps the GOOGLE_* variables onto the generic OIDC
+// provider so existing deployments keep working unchanged
+func googleProviderConfig() (oidcProviderConfig, bool) {
+	clientID := os.Getenv("GOOGLE_CLIENT_ID")
+	if clientID == "" {
+		return oidcProviderConfig{}, false
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to get user info: %s", string(body))
-	}
-
-	var googleUser GoogleUserInfo
-	err = json.Unmarshal(body, &googleUser)
-	if err != nil {
-		return nil, err
-	}
-
-	return &googleUser, nil
+	return oidcProviderConfig{
+		Name:         "google",
+		DisplayName:  "Google",
+		Issuer:       googleIssuer,
+		ClientID:     clientID,
+		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}, true
 }
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexes lists the indexes the handlers rely on for correctness (uniqueness,
+// TTL expiry), keyed by collection
+var indexes = map[string][]mongo.IndexModel{
+	"api_tokens": {
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"files": {
+		// sweep for files the post-upload pipeline hasn't handled yet
+		{Keys: bson.D{{Key: "processed_at", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "vault_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+		{Keys: bson.D{{Key: "blob_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+		// the trash purge
+		{Keys: bson.D{{Key: "trashed_at", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+	"blobs": {
+		// the collector's queue
+		{Keys: bson.D{{Key: "state", Value: 1}, {Key: "ref_count", Value: 1}, {Key: "unreferenced_at", Value: 1}}},
+	},
+	"scrub_runs": {
+		// one scrub at a time across instances
+		{Keys: bson.D{{Key: "status", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"status": "running"})},
+		{Keys: bson.D{{Key: "started_at", Value: -1}}},
+	},
+	"scrub_issues": {
+		// a recurring problem stays one open issue
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"status": "open"})},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "last_seen_at", Value: -1}}},
+	},
+	"user_storage": {
+		// counters are upserted
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"plans": {
+		// at most one default plan
+		{Keys: bson.D{{Key: "is_default", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"is_default": true})},
+	},
+	"users": {
+		// emails are stored normalized (trimmed, lowercase)
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "plan_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+	"storage_snapshots": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: 1}}, Options: options.Index().SetUnique(true)},
+		// a bit over a year of history
+		{Keys: bson.D{{Key: "date", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(400 * 24 * 3600)},
+	},
+	"quota_reservations": {
+		// not a TTL index: expiry has to give the bytes back
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	},
+	"storage_intents": {
+		{Keys: bson.D{{Key: "next_attempt_at", Value: 1}}},
+	},
+	"identities": {
+		{Keys: bson.D{{Key: "provider", Value: 1}, {Key: "subject", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	},
+	"exports": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"login_attempts": {
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"rate_limits": {
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"sessions": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		// keep expired sessions around for a week for the session history
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(7 * 24 * 3600)},
+	},
+	"notifications": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+	"upload_policies": {
+		// at most one global policy (no user_id) and one per user
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"user_keys": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"vault_members": {
+		{Keys: bson.D{{Key: "vault_id", Value: 1}, {Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	},
+	"vault_keys": {
+		{Keys: bson.D{{Key: "vault_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "key_version", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"oidc_link_requests": {
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+}
+
+// EnsureIndexes creates missing indexes. Failures are logged, not fatal, so
+// a read-only replica or a permissions issue doesn't block startup.
+func EnsureIndexes(ctx context.Context) {
+	for name, models := range indexes {
+		if _, err := GetCollection(name).Indexes().CreateMany(ctx, models); err != nil {
+			log.Printf("Could not create indexes on %s: %v", name, err)
+		}
+	}
+}
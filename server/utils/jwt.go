@@ -1,31 +1,105 @@
 package utils
 
 import (
+	"context"
 	"errors"
+	"log"
 	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateToken(userID string) (string, error) {
+const (
+	// PurposeMFA marks the short-lived token issued between the password
+	// step and the second factor; it must never grant API access.
+	PurposeMFA = "mfa"
+
+	// MaxTokenLifetime bounds every token we sign; retired signing keys are
+	// kept for this long so tokens issued just before a rotation stay valid
+	MaxTokenLifetime = 24 * time.Hour
+
+	mfaTokenTTL = 5 * time.Minute
+)
+
+// GenerateToken issues the access token for a login session; it is only
+// valid while the session with ID sessionID hasn't been revoked
+func GenerateToken(userID, sessionID string, expiresAt time.Time) (string, error) {
 	claims := jwt.MapClaims{
 		"userID": userID,
-		"exp":    time.Now().Add(time.Hour * 24).Unix(),
+		"sid":    sessionID,
+		"iat":    time.Now().Unix(),
+		"exp":    expiresAt.Unix(),
+	}
+
+	return signClaims(claims)
+}
+
+// GenerateMFAToken issues the intermediate token for the two-step login
+// challenge. method records how the first factor was satisfied.
+func GenerateMFAToken(userID, method string) (string, error) {
+	claims := jwt.MapClaims{
+		"userID":  userID,
+		"method":  method,
+		"purpose": PurposeMFA,
+		"exp":     time.Now().Add(mfaTokenTTL).Unix(),
+	}
+
+	return signClaims(claims)
+}
+
+// signClaims signs with the active asymmetric key and tags the token with its kid
+func signClaims(claims jwt.MapClaims) (string, error) {
+	key, err := signingKeys.signer()
+	if err != nil {
+		return "", err
+	}
+
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		claims["iss"] = issuer
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
 
-	return token.SignedString(getJwtSecret())
+	return token.SignedString(key.private)
+}
+
+// ValidatePurposeToken validates a token and checks that it was issued for purpose
+func ValidatePurposeToken(tokenString, purpose string) (jwt.MapClaims, error) {
+	token, err := ValidateToken(tokenString)
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != purpose {
+		return nil, errors.New("invalid token purpose")
+	}
+
+	return claims, nil
 }
 
 func ValidateToken(tokenString string) (*jwt.Token, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return legacyHS256Secret(time.Now())
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, ok := signingKeys.lookup(kid)
+		if !ok {
+			signingKeys.reloadForUnknown(context.Background())
+			if key, ok = signingKeys.lookup(kid); !ok {
+				return nil, errors.New("unknown signing key")
+			}
+		}
+
+		if token.Method.Alg() != key.method.Alg() {
 			return nil, errors.New("unexpected signing method")
 		}
-		return getJwtSecret(), nil
-	})
+		return key.private.Public(), nil
+	}, jwt.WithValidMethods([]string{"RS256", "EdDSA", "HS256"}), jwt.WithExpirationRequired())
 
 	if err != nil {
 		return nil, err
@@ -34,11 +108,32 @@ func ValidateToken(tokenString string) (*jwt.Token, error) {
 	return token, nil
 }
 
-func getJwtSecret() []byte {
+// legacyHS256Secret returns the shared secret HS256 tokens signed before the
+// switch to key pairs are verified with. They are only honoured until
+// HS256_ACCEPT_UNTIL, so the secret can't be used to mint tokens forever.
+func legacyHS256Secret(now time.Time) (interface{}, error) {
 	secret := os.Getenv("JWT_SECRET")
+	until, ok := legacyHS256Until()
+	if secret == "" || !ok || !now.Before(until) {
+		return nil, errors.New("unexpected signing method")
+	}
+	return []byte(secret), nil
+}
+
+// legacyHS256Until parses HS256_ACCEPT_UNTIL (RFC 3339)
+func legacyHS256Until() (time.Time, bool) {
+	until, err := time.Parse(time.RFC3339, os.Getenv("HS256_ACCEPT_UNTIL"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return until, true
+}
 
-	if secret == "" {
-		panic("JWT_SECRET not set in env")
+// WarnLegacyHS256 logs while HS256 tokens are still being accepted
+func WarnLegacyHS256() {
+	until, ok := legacyHS256Until()
+	if !ok || os.Getenv("JWT_SECRET") == "" || !time.Now().Before(until) {
+		return
 	}
-	return []byte(secret)
+	log.Printf("WARNING: HS256 tokens signed with JWT_SECRET are accepted until %s; unset JWT_SECRET once they have expired", until.Format(time.RFC3339))
 }
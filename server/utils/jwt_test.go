@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestValidateTokenLegacyHS256Window(t *testing.T) {
+	t.Setenv("JWT_SECRET", "shared-secret")
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userID": "u",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("shared-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		until  string
+		wantOK bool
+	}{
+		{"window open", time.Now().Add(time.Hour).Format(time.RFC3339), true},
+		{"window closed", time.Now().Add(-time.Minute).Format(time.RFC3339), false},
+		{"no window", "", false},
+		{"unparseable window", "tomorrow", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("HS256_ACCEPT_UNTIL", tt.until)
+		_, err := ValidateToken(token)
+		if ok := err == nil; ok != tt.wantOK {
+			t.Errorf("%s: ValidateToken error = %v, want ok %v", tt.name, err, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// KMS wraps and unwraps per-file data keys with a key-encryption key that
+// never leaves it. The key ID returned by Wrap is stored next to the wrapped
+// key and handed back to Unwrap, so older keys keep working after rotation.
+type KMS interface {
+	// ActiveKeyID names the key new data keys are wrapped with
+	ActiveKeyID(ctx context.Context) (string, error)
+	Wrap(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+var kms KMS
+
+// InitKMS configures encryption at rest from KMS_PROVIDER: "local" reads the
+// keys from KMS_KEYFILE and "gcp" uses the Cloud KMS key named by
+// GCP_KMS_KEY. New files are stored unencrypted when it is unset.
+func InitKMS(ctx context.Context) error {
+	switch provider := os.Getenv("KMS_PROVIDER"); provider {
+	case "":
+		log.Println("KMS_PROVIDER not set, encryption at rest disabled")
+		return nil
+	case "local":
+		local, err := LoadLocalKMS(os.Getenv("KMS_KEYFILE"))
+		if err != nil {
+			return err
+		}
+		kms = local
+	case "gcp":
+		gcp, err := NewGCPKMS(ctx, os.Getenv("GCP_KMS_KEY"))
+		if err != nil {
+			return err
+		}
+		kms = gcp
+	default:
+		return fmt.Errorf("unknown KMS_PROVIDER %q", provider)
+	}
+	return nil
+}
+
+// GetKMS returns the configured KMS, or nil when encryption is disabled
+func GetKMS() KMS {
+	return kms
+}
+
+// unwrapCacheTTL bounds how long an unwrapped data key stays in memory.
+// Range reads open the same file many times in a row, and with a cloud KMS
+// each unwrap is a network call.
+const (
+	unwrapCacheTTL  = 5 * time.Minute
+	unwrapCacheSize = 1024
+)
+
+type cachedDataKey struct {
+	key       []byte
+	expiresAt time.Time
+}
+
+var (
+	unwrapCacheMu sync.Mutex
+	unwrapCache   = map[string]cachedDataKey{}
+)
+
+// UnwrapDataKey unwraps with whichever KMS is configured, caching the result
+func UnwrapDataKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	if kms == nil {
+		return nil, fmt.Errorf("file is encrypted but no KMS is configured")
+	}
+
+	cacheKey := keyID + "\x00" + string(wrapped)
+	unwrapCacheMu.Lock()
+	cached, ok := unwrapCache[cacheKey]
+	unwrapCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.key, nil
+	}
+
+	key, err := kms.Unwrap(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	unwrapCacheMu.Lock()
+	if len(unwrapCache) >= unwrapCacheSize {
+		unwrapCache = map[string]cachedDataKey{}
+	}
+	unwrapCache[cacheKey] = cachedDataKey{key: key, expiresAt: time.Now().Add(unwrapCacheTTL)}
+	unwrapCacheMu.Unlock()
+	return key, nil
+}
+
+// localKeyfile is the KMS_KEYFILE format:
+//
+//	{"active": "2026-10", "keys": {"2026-10": "<base64 32 bytes>", "2025-04": "..."}}
+//
+// Rotating means adding a key, making it active and keeping the old ones
+// until every data key has been re-wrapped.
+type localKeyfile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LocalKMS keeps key-encryption keys in a file on the server. It is meant
+// for development and single-host deployments.
+type LocalKMS struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+func LoadLocalKMS(path string) (*LocalKMS, error) {
+	if path == "" {
+		return nil, fmt.Errorf("KMS_KEYFILE environment variable not set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read KMS keyfile: %v", err)
+	}
+
+	var keyfile localKeyfile
+	if err := json.Unmarshal(data, &keyfile); err != nil {
+		return nil, fmt.Errorf("could not parse KMS keyfile: %v", err)
+	}
+
+	local := &LocalKMS{active: keyfile.Active, keys: map[string]cipher.AEAD{}}
+	for id, encoded := range keyfile.Keys {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("KMS key %q must be 32 base64 encoded bytes", id)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		local.keys[id] = aead
+	}
+	if _, ok := local.keys[local.active]; !ok {
+		return nil, fmt.Errorf("active KMS key %q is not in the keyfile", local.active)
+	}
+
+	log.Printf("Loaded %d local KMS key(s), active %s", len(local.keys), local.active)
+	return local, nil
+}
+
+func (k *LocalKMS) ActiveKeyID(ctx context.Context) (string, error) {
+	return k.active, nil
+}
+
+func (k *LocalKMS) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	// the key ID is bound in so a wrapped key can't be replayed under another
+	return k.active, aead.Seal(nonce, nonce, dataKey, []byte(k.active)), nil
+}
+
+func (k *LocalKMS) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("KMS key %q is not in the keyfile", keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key with %q: %v", keyID, err)
+	}
+	return key, nil
+}
+
+// gcpPrimaryRefresh is how often GCPKMS asks which key version is primary
+const gcpPrimaryRefresh = 10 * time.Minute
+
+// GCPKMS wraps data keys with a Cloud KMS symmetric key. Key IDs are the
+// crypto key version that did the wrapping, so rotating the key in Cloud KMS
+// shows up as data keys that need re-wrapping.
+type GCPKMS struct {
+	keyName string
+	service *cloudkms.Service
+
+	mu          sync.Mutex
+	primary     string
+	primaryTime time.Time
+}
+
+func NewGCPKMS(ctx context.Context, keyName string) (*GCPKMS, error) {
+	if keyName == "" {
+		return nil, fmt.Errorf("GCP_KMS_KEY environment variable not set")
+	}
+
+	var opts []option.ClientOption
+	if credentialsPath := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); credentialsPath != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsPath))
+	}
+	service, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud KMS client: %v", err)
+	}
+
+	return &GCPKMS{keyName: keyName, service: service}, nil
+}
+
+func (k *GCPKMS) ActiveKeyID(ctx context.Context) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.primary != "" && time.Since(k.primaryTime) < gcpPrimaryRefresh {
+		return k.primary, nil
+	}
+
+	key, err := k.service.Projects.Locations.KeyRings.CryptoKeys.Get(k.keyName).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("could not look up Cloud KMS key: %v", err)
+	}
+	if key.Primary == nil {
+		return "", fmt.Errorf("Cloud KMS key %s has no primary version", k.keyName)
+	}
+	k.primary = key.Primary.Name
+	k.primaryTime = time.Now()
+	return k.primary, nil
+}
+
+func (k *GCPKMS) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	resp, err := k.service.Projects.Locations.KeyRings.CryptoKeys.Encrypt(k.keyName, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", nil, fmt.Errorf("could not wrap data key: %v", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.Name, wrapped, nil
+}
+
+func (k *GCPKMS) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	// decrypt is called on the crypto key; Cloud KMS finds the version
+	keyName := keyID
+	if i := strings.Index(keyName, "/cryptoKeyVersions/"); i >= 0 {
+		keyName = keyName[:i]
+	}
+
+	resp, err := k.service.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyName, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key: %v", err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// OIDCProvider is a configured OpenID Connect issuer that users can sign in with
+type OIDCProvider struct {
+	Name        string
+	DisplayName string
+	OAuth2      *oauth2.Config
+	verifier    *oidc.IDTokenVerifier
+	provider    *oidc.Provider
+}
+
+// OIDCClaims are the identity claims DriftBox uses from a verified ID token
+type OIDCClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Picture           string `json:"picture"`
+	Nonce             string `json:"nonce"`
+}
+
+type oidcProviderConfig struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+var oidcProviders = map[string]*OIDCProvider{}
+
+// InitOIDCProviders runs discovery for every configured provider. Providers
+// are listed in OIDC_PROVIDERS (e.g. "keycloak,authentik") and configured with
+// OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL, _SCOPES and
+// _DISPLAY_NAME. Google is registered automatically from the GOOGLE_* variables.
+// A provider that fails discovery is skipped so one broken IdP can't take
+// the server down.
+func InitOIDCProviders(ctx context.Context) {
+	var configs []oidcProviderConfig
+
+	if google, ok := googleProviderConfig(); ok {
+		configs = append(configs, google)
+	}
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		configs = append(configs, providerConfigFromEnv(name))
+	}
+
+	for _, cfg := range configs {
+		provider, err := newOIDCProvider(ctx, cfg)
+		if err != nil {
+			log.Printf("Skipping OIDC provider %s: %v", cfg.Name, err)
+			continue
+		}
+		oidcProviders[cfg.Name] = provider
+		log.Printf("OIDC provider %s initialized (%s)", cfg.Name, cfg.Issuer)
+	}
+}
+
+func providerConfigFromEnv(name string) oidcProviderConfig {
+	prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+
+	cfg := oidcProviderConfig{
+		Name:         name,
+		DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+		Issuer:       os.Getenv(prefix + "ISSUER"),
+		ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+		ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = name
+	}
+	if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+		cfg.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+	}
+
+	return cfg
+}
+
+func newOIDCProvider(ctx context.Context, cfg oidcProviderConfig) (*OIDCProvider, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("issuer, client ID and redirect URL are required")
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovery failed: %v", err)
+	}
+
+	return &OIDCProvider{
+		Name:        cfg.Name,
+		DisplayName: cfg.DisplayName,
+		OAuth2: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+			Endpoint:     provider.Endpoint(),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		provider: provider,
+	}, nil
+}
+
+// GetOIDCProvider returns a configured provider by name
+func GetOIDCProvider(name string) (*OIDCProvider, bool) {
+	provider, ok := oidcProviders[name]
+	return provider, ok
+}
+
+// ListOIDCProviders returns all configured providers sorted by name
+func ListOIDCProviders() []*OIDCProvider {
+	providers := make([]*OIDCProvider, 0, len(oidcProviders))
+	for _, p := range oidcProviders {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+	return providers
+}
+
+// AuthCodeURL builds the authorization URL with state, nonce and a PKCE challenge
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.OAuth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange trades the authorization code for tokens and returns the claims of
+// the ID token after verifying its signature (against the issuer's JWKS),
+// audience, expiry and nonce.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, nonce, verifier string) (*OIDCClaims, error) {
+	token, err := p.OAuth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("code exchange failed: %v", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token in token response")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %v", err)
+	}
+
+	var claims OIDCClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("could not parse id_token claims: %v", err)
+	}
+
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("id_token nonce mismatch")
+	}
+
+	// Some IdPs only put profile claims in the userinfo response
+	if claims.Email == "" {
+		userInfo, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+		if err == nil && userInfo.Subject == claims.Subject {
+			claims.Email = userInfo.Email
+			claims.EmailVerified = userInfo.EmailVerified
+
+			var profile struct {
+				Name    string `json:"name"`
+				Picture string `json:"picture"`
+			}
+			if userInfo.Claims(&profile) == nil {
+				claims.Name = profile.Name
+				claims.Picture = profile.Picture
+			}
+		}
+	}
+
+	return &claims, nil
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIdP is a minimal OpenID Connect issuer: discovery, JWKS, a token
+// endpoint that hands out idToken and a userinfo endpoint
+type mockIdP struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	idToken  jwt.MapClaims
+	signer   *rsa.PrivateKey // signs the ID token; key unless a test swaps it
+	userInfo map[string]interface{}
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, signer: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"userinfo_endpoint":                     idp.URL + "/userinfo",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{"access_token": "access", "token_type": "Bearer", "expires_in": 3600}
+		if idp.idToken != nil {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.idToken)
+			token.Header["kid"] = "mock"
+			signed, err := token.SignedString(idp.signer)
+			if err != nil {
+				t.Error(err)
+			}
+			response["id_token"] = signed
+		}
+		writeJSON(w, response)
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, idp.userInfo)
+	})
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (idp *mockIdP) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            idp.URL,
+		"aud":            "driftbox",
+		"sub":            "user-1",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada",
+		"nonce":          nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(idp *mockIdP)
+		wantErr string
+		want    OIDCClaims
+	}{
+		{
+			name: "valid token",
+			want: OIDCClaims{Subject: "user-1", Email: "ada@example.com", EmailVerified: true, Name: "Ada", Nonce: "nonce"},
+		},
+		{
+			name:    "nonce mismatch",
+			setup:   func(idp *mockIdP) { idp.idToken["nonce"] = "replayed" },
+			wantErr: "nonce mismatch",
+		},
+		{
+			name:    "other audience",
+			setup:   func(idp *mockIdP) { idp.idToken["aud"] = "someone-else" },
+			wantErr: "invalid id_token",
+		},
+		{
+			name:    "other issuer",
+			setup:   func(idp *mockIdP) { idp.idToken["iss"] = "https://evil.example.com" },
+			wantErr: "invalid id_token",
+		},
+		{
+			name:    "expired",
+			setup:   func(idp *mockIdP) { idp.idToken["exp"] = time.Now().Add(-time.Hour).Unix() },
+			wantErr: "invalid id_token",
+		},
+		{
+			name:    "signed with a key not in the JWKS",
+			setup:   func(idp *mockIdP) { idp.signer = other },
+			wantErr: "invalid id_token",
+		},
+		{
+			name:    "no id_token",
+			setup:   func(idp *mockIdP) { idp.idToken = nil },
+			wantErr: "no id_token",
+		},
+		{
+			name: "email from userinfo",
+			setup: func(idp *mockIdP) {
+				delete(idp.idToken, "email")
+				delete(idp.idToken, "email_verified")
+				delete(idp.idToken, "name")
+				idp.userInfo = map[string]interface{}{"sub": "user-1", "email": "ada@example.com", "email_verified": true, "name": "Ada L."}
+			},
+			want: OIDCClaims{Subject: "user-1", Email: "ada@example.com", EmailVerified: true, Name: "Ada L.", Nonce: "nonce"},
+		},
+		{
+			name: "userinfo for another subject is ignored",
+			setup: func(idp *mockIdP) {
+				delete(idp.idToken, "email")
+				delete(idp.idToken, "email_verified")
+				idp.userInfo = map[string]interface{}{"sub": "user-2", "email": "eve@example.com", "email_verified": true}
+			},
+			want: OIDCClaims{Subject: "user-1", Name: "Ada", Nonce: "nonce"},
+		},
+	}
+
+	ctx := context.Background()
+	provider, err := newOIDCProvider(ctx, oidcProviderConfig{
+		Name:        "mock",
+		Issuer:      idp.URL,
+		ClientID:    "driftbox",
+		RedirectURL: "http://localhost/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.idToken, idp.signer, idp.userInfo = idp.claims("nonce"), idp.key, nil
+			if tt.setup != nil {
+				tt.setup(idp)
+			}
+
+			claims, err := provider.Exchange(ctx, "code", "nonce", "verifier")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *claims != tt.want {
+				t.Errorf("claims = %+v, want %+v", *claims, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitOIDCProvidersSkipsBrokenProviders(t *testing.T) {
+	idp := newMockIdP(t)
+
+	t.Setenv("GOOGLE_CLIENT_ID", "")
+	t.Setenv("OIDC_PROVIDERS", "Mock, no-issuer")
+	t.Setenv("OIDC_MOCK_ISSUER", idp.URL)
+	t.Setenv("OIDC_MOCK_CLIENT_ID", "driftbox")
+	t.Setenv("OIDC_MOCK_REDIRECT_URL", "http://localhost/callback")
+	t.Setenv("OIDC_MOCK_DISPLAY_NAME", "Mock IdP")
+	t.Setenv("OIDC_NO_ISSUER_CLIENT_ID", "driftbox")
+	t.Setenv("OIDC_NO_ISSUER_REDIRECT_URL", "http://localhost/callback")
+
+	oidcProviders = map[string]*OIDCProvider{}
+	t.Cleanup(func() { oidcProviders = map[string]*OIDCProvider{} })
+	InitOIDCProviders(context.Background())
+
+	provider, ok := GetOIDCProvider("mock")
+	if !ok {
+		t.Fatal("mock provider not registered")
+	}
+	if provider.DisplayName != "Mock IdP" || provider.OAuth2.Endpoint.TokenURL != idp.URL+"/token" {
+		t.Errorf("provider = %+v, endpoint %+v", provider, provider.OAuth2.Endpoint)
+	}
+	if _, ok := GetOIDCProvider("no-issuer"); ok {
+		t.Error("provider without an issuer was registered")
+	}
+	if got := ListOIDCProviders(); len(got) != 1 {
+		t.Errorf("%d providers registered, want 1", len(got))
+	}
+}
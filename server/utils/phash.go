@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// AverageHash is the 64-bit aHash of img: each bit of the 8x8 grayscale
+// reduction is set when the pixel is brighter than the mean
+func AverageHash(img image.Image) uint64 {
+	pixels := grayscale(img, 8, 8)
+	sum := 0
+	for _, p := range pixels {
+		sum += int(p)
+	}
+	mean := sum / len(pixels)
+
+	var hash uint64
+	for i, p := range pixels {
+		if int(p) > mean {
+			hash |= 1 << uint(63-i)
+		}
+	}
+	return hash
+}
+
+// DifferenceHash is the 64-bit dHash of img: each bit of the 9x8 grayscale
+// reduction is set when a pixel is brighter than its right neighbour
+func DifferenceHash(img image.Image) uint64 {
+	pixels := grayscale(img, 9, 8)
+
+	var hash uint64
+	bit := 63
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] > pixels[y*9+x+1] {
+				hash |= 1 << uint(bit)
+			}
+			bit--
+		}
+	}
+	return hash
+}
+
+// FormatImageHash encodes a perceptual hash as 16 hex digits. BSON has no
+// unsigned 64-bit integer, so hashes are stored this way.
+func FormatImageHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseImageHash decodes a hash written by FormatImageHash
+func ParseImageHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// HashDistance is the number of bits two perceptual hashes differ in. Images
+// a few bits apart look alike.
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// grayscale scales img to width x height and returns the luminance of each
+// pixel, row by row. Transparent areas count as white.
+func grayscale(img image.Image, width, height int) []uint8 {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	pixels := make([]uint8, 0, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixels = append(pixels, color.GrayModel.Convert(dst.At(x, y)).(color.Gray).Y)
+		}
+	}
+	return pixels
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestHashDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0xffffffffffffffff, 0xffffffffffffffff, 0},
+		{0, 1, 1},
+		{0, 0x8000000000000000, 1},
+		{0, 0xffffffffffffffff, 64},
+		{0x0f0f0f0f0f0f0f0f, 0xf0f0f0f0f0f0f0f0, 64},
+		{0xff00, 0x0ff0, 8},
+	}
+	for _, tt := range tests {
+		if got := HashDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("HashDistance(%016x, %016x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := HashDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("HashDistance(%016x, %016x) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestImageHashFormatting(t *testing.T) {
+	for _, hash := range []uint64{0, 1, 0x0f0f0f0f0f0f0f0f, 0xffffffffffffffff} {
+		s := FormatImageHash(hash)
+		if len(s) != 16 {
+			t.Errorf("FormatImageHash(%x) = %q, want 16 digits", hash, s)
+		}
+		if got, err := ParseImageHash(s); err != nil || got != hash {
+			t.Errorf("ParseImageHash(%q) = (%x, %v), want %x", s, got, err, hash)
+		}
+	}
+	for _, s := range []string{"", "xyz", "1ffffffffffffffff"} {
+		if _, err := ParseImageHash(s); err == nil {
+			t.Errorf("ParseImageHash(%q) succeeded", s)
+		}
+	}
+}
+
+// testImage draws a size x size image with shade(x, y) giving each pixel's
+// brightness for x and y in [0, 1)
+func testImage(size int, shade func(x, y float64) uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetGray(x, y, color.Gray{Y: shade(float64(x)/float64(size), float64(y)/float64(size))})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHashes(t *testing.T) {
+	uniform := func(x, y float64) uint8 { return 128 }
+	rightHalfWhite := func(x, y float64) uint8 {
+		if x >= 0.5 {
+			return 255
+		}
+		return 0
+	}
+	fadeToBlack := func(x, y float64) uint8 { return uint8(255 * (1 - x)) }
+
+	tests := []struct {
+		name      string
+		img       image.Image
+		wantAHash uint64
+		wantDHash uint64
+	}{
+		{"uniform", testImage(64, uniform), 0, 0},
+		{"right half white", testImage(64, rightHalfWhite), 0x0f0f0f0f0f0f0f0f, 0},
+		{"fading to black", testImage(64, fadeToBlack), 0xf0f0f0f0f0f0f0f0, 0xffffffffffffffff},
+	}
+	for _, tt := range tests {
+		if got := AverageHash(tt.img); got != tt.wantAHash {
+			t.Errorf("%s: AverageHash = %016x, want %016x", tt.name, got, tt.wantAHash)
+		}
+		if got := DifferenceHash(tt.img); got != tt.wantDHash {
+			t.Errorf("%s: DifferenceHash = %016x, want %016x", tt.name, got, tt.wantDHash)
+		}
+	}
+}
+
+func TestPerceptualHashesMatchResizedImages(t *testing.T) {
+	shade := func(x, y float64) uint8 {
+		if (x-0.3)*(x-0.3)+(y-0.6)*(y-0.6) < 0.05 {
+			return 230
+		}
+		return uint8(40 + 120*y)
+	}
+	original := testImage(512, shade)
+	thumbnail := testImage(48, shade)
+	different := testImage(512, func(x, y float64) uint8 { return shade(1-y, x) })
+
+	if d := HashDistance(AverageHash(original), AverageHash(thumbnail)); d > 5 {
+		t.Errorf("aHash distance to the thumbnail = %d", d)
+	}
+	if d := HashDistance(DifferenceHash(original), DifferenceHash(thumbnail)); d > 10 {
+		t.Errorf("dHash distance to the thumbnail = %d", d)
+	}
+	if d := HashDistance(AverageHash(original), AverageHash(different)); d <= 10 {
+		t.Errorf("aHash distance to a different image = %d", d)
+	}
+}
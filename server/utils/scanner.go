@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScanResult is the verdict for one scanned stream
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// Scanner checks content for malware
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+// ErrScanTooLarge is returned for content larger than the scanner accepts
+var ErrScanTooLarge = errors.New("content exceeds the scanner's size limit")
+
+var scanner Scanner
+
+// InitScanner configures malware scanning from CLAMD_ADDRESS:
+// "tcp://host:3310", "unix:///run/clamav/clamd.ctl", or "fake" for the
+// in-process test scanner, which also needs ALLOW_FAKE_SCANNER=true.
+// Scanning is disabled when it is unset. CLAMD_STREAM_MAX_LENGTH (bytes)
+// must match clamd's StreamMaxLength if that was changed from 25MB.
+func InitScanner() error {
+	address := os.Getenv("CLAMD_ADDRESS")
+	network := "tcp"
+	switch {
+	case address == "":
+		log.Println("CLAMD_ADDRESS not set, malware scanning disabled")
+		return nil
+	case address == "fake":
+		if os.Getenv("ALLOW_FAKE_SCANNER") != "true" {
+			return errors.New("CLAMD_ADDRESS=fake disables real scanning; set ALLOW_FAKE_SCANNER=true to use it in development")
+		}
+		scanner = FakeScanner{}
+		log.Println("WARNING: using the fake malware scanner, uploads are not really scanned")
+		return nil
+	case strings.HasPrefix(address, "unix://"):
+		network, address = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	}
+
+	clamd := &ClamdScanner{Network: network, Address: address}
+	if raw := os.Getenv("CLAMD_STREAM_MAX_LENGTH"); raw != "" {
+		maxLength, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || maxLength <= 0 {
+			return fmt.Errorf("invalid CLAMD_STREAM_MAX_LENGTH %q", raw)
+		}
+		clamd.MaxStreamLength = maxLength
+	}
+	scanner = clamd
+	return nil
+}
+
+// GetScanner returns the configured scanner, or nil when scanning is disabled
+func GetScanner() Scanner {
+	return scanner
+}
+
+const (
+	// clamdChunkSize is the size of each INSTREAM chunk
+	clamdChunkSize = 64 * 1024
+	// clamd's default StreamMaxLength; longer streams are refused
+	defaultClamdStreamMaxLength = 25 * 1024 * 1024
+)
+
+// ClamdScanner streams content to clamd with the INSTREAM command. Content
+// longer than MaxStreamLength (default 25MB) is not sent and fails with
+// ErrScanTooLarge.
+type ClamdScanner struct {
+	Network         string
+	Address         string
+	Timeout         time.Duration
+	MaxStreamLength int64
+}
+
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("could not connect to clamd: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// the z prefix means commands and replies are NUL terminated
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("could not send INSTREAM: %v", err)
+	}
+
+	maxLength := s.MaxStreamLength
+	if maxLength == 0 {
+		maxLength = defaultClamdStreamMaxLength
+	}
+
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	var streamed int64
+	for {
+		n, readErr := r.Read(buf)
+		if streamed += int64(n); streamed > maxLength {
+			return ScanResult{}, ErrScanTooLarge
+		}
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return ScanResult{}, fmt.Errorf("could not stream to clamd: %v", err)
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return ScanResult{}, fmt.Errorf("could not stream to clamd: %v", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, readErr
+		}
+	}
+
+	// a zero-length chunk ends the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, fmt.Errorf("could not finish stream: %v", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, fmt.Errorf("could not read clamd reply: %v", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// parseClamdReply understands "stream: OK", "stream: <name> FOUND" and
+// "<message> ERROR"
+func parseClamdReply(reply string) (ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return ScanResult{}, ErrScanTooLarge
+	case strings.HasSuffix(reply, " ERROR"):
+		return ScanResult{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	default:
+		return ScanResult{}, fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
+
+// eicarSignature is the marker inside the standard EICAR test file
+var eicarSignature = []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")
+
+// FakeScanner reports the EICAR test file as infected and everything else as
+// clean. It lets the scanning flow run locally without clamd.
+type FakeScanner struct{}
+
+func (FakeScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	if bytes.Contains(data, eicarSignature) {
+		return ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+	}
+	return ScanResult{}, nil
+}
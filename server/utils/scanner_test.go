@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    ScanResult
+		wantErr bool
+	}{
+		{"stream: OK\x00", ScanResult{}, false},
+		{"stream: OK\n", ScanResult{}, false},
+		{"stream: Eicar-Test-Signature FOUND\x00", ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, false},
+		{"stream: Win.Trojan.Agent-1 FOUND", ScanResult{Infected: true, Signature: "Win.Trojan.Agent-1"}, false},
+		{"INSTREAM size limit exceeded. ERROR\x00", ScanResult{}, true},
+		{"", ScanResult{}, true},
+		{"stream: PONG", ScanResult{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseClamdReply(tt.reply)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseClamdReply(%q) = (%+v, %v), want (%+v, error %v)", tt.reply, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// fakeClamd speaks enough of the clamd protocol to answer one INSTREAM per
+// connection, deciding the verdict with FakeScanner
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reply, err := answerInstream(bufio.NewReader(conn))
+				if err != nil {
+					reply = err.Error() + " ERROR"
+				}
+				conn.Write([]byte("stream: " + reply + "\x00"))
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func answerInstream(r *bufio.Reader) (string, error) {
+	command, err := r.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	if command != "zINSTREAM\x00" {
+		return "", fmt.Errorf("unknown command %q", command)
+	}
+
+	var content bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return "", err
+		}
+		if size == 0 {
+			break
+		}
+		if size > clamdChunkSize {
+			return "", fmt.Errorf("chunk of %d bytes", size)
+		}
+		if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+			return "", err
+		}
+	}
+
+	result, err := FakeScanner{}.Scan(context.Background(), &content)
+	if err != nil {
+		return "", err
+	}
+	if result.Infected {
+		return result.Signature + " FOUND", nil
+	}
+	return "OK", nil
+}
+
+func TestClamdScannerStreamsContent(t *testing.T) {
+	scanner := &ClamdScanner{Network: "tcp", Address: fakeClamd(t)}
+	eicar := `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+	tests := []struct {
+		name    string
+		content string
+		want    ScanResult
+	}{
+		{"empty", "", ScanResult{}},
+		{"clean", "hello, world", ScanResult{}},
+		{"eicar", eicar, ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}},
+		// the signature straddles two INSTREAM chunks
+		{"eicar across chunks", strings.Repeat("a", clamdChunkSize-10) + eicar, ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}},
+		{"large clean", strings.Repeat("a", 3*clamdChunkSize+1), ScanResult{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scanner.Scan(context.Background(), strings.NewReader(tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Scan = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClamdScannerUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	scanner := &ClamdScanner{Network: "tcp", Address: address}
+	if _, err := scanner.Scan(context.Background(), strings.NewReader("content")); err == nil {
+		t.Error("Scan succeeded without clamd")
+	}
+}
+
+func TestClamdScannerRefusesOverLimit(t *testing.T) {
+	scanner := &ClamdScanner{Network: "tcp", Address: fakeClamd(t), MaxStreamLength: 2 * clamdChunkSize}
+
+	if _, err := scanner.Scan(context.Background(), strings.NewReader(strings.Repeat("a", 2*clamdChunkSize))); err != nil {
+		t.Errorf("Scan at the limit: %v", err)
+	}
+	_, err := scanner.Scan(context.Background(), strings.NewReader(strings.Repeat("a", 2*clamdChunkSize+1)))
+	if !errors.Is(err, ErrScanTooLarge) {
+		t.Errorf("Scan over the limit: error = %v, want ErrScanTooLarge", err)
+	}
+
+	// clamd configured with a lower limit than ours
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR\x00"); !errors.Is(err, ErrScanTooLarge) {
+		t.Errorf("size limit reply: error = %v, want ErrScanTooLarge", err)
+	}
+}
+
+func TestInitScanner(t *testing.T) {
+	tests := []struct {
+		address   string
+		allowFake string
+		maxLength string
+		want      Scanner
+		wantErr   bool
+	}{
+		{"", "", "", nil, false},
+		{"fake", "true", "", FakeScanner{}, false},
+		{"fake", "", "", nil, true},
+		{"unix:///run/clamav/clamd.ctl", "", "", &ClamdScanner{Network: "unix", Address: "/run/clamav/clamd.ctl"}, false},
+		{"tcp://clamav:3310", "", "", &ClamdScanner{Network: "tcp", Address: "clamav:3310"}, false},
+		{"clamav:3310", "", "", &ClamdScanner{Network: "tcp", Address: "clamav:3310"}, false},
+		{"clamav:3310", "", "104857600", &ClamdScanner{Network: "tcp", Address: "clamav:3310", MaxStreamLength: 104857600}, false},
+		{"clamav:3310", "", "100MB", nil, true},
+	}
+	t.Cleanup(func() { scanner = nil })
+	for _, tt := range tests {
+		scanner = nil
+		t.Setenv("CLAMD_ADDRESS", tt.address)
+		t.Setenv("ALLOW_FAKE_SCANNER", tt.allowFake)
+		t.Setenv("CLAMD_STREAM_MAX_LENGTH", tt.maxLength)
+		if err := InitScanner(); (err != nil) != tt.wantErr {
+			t.Errorf("CLAMD_ADDRESS=%q: InitScanner error = %v, want error %v", tt.address, err, tt.wantErr)
+		}
+
+		got := GetScanner()
+		if clamd, ok := got.(*ClamdScanner); ok {
+			if want, ok := tt.want.(*ClamdScanner); !ok || *clamd != *want {
+				t.Errorf("CLAMD_ADDRESS=%q: scanner = %+v, want %+v", tt.address, clamd, tt.want)
+			}
+		} else if got != tt.want {
+			t.Errorf("CLAMD_ADDRESS=%q: scanner = %#v, want %#v", tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultKeyRotation = 30 * 24 * time.Hour
+	keyRefreshInterval = time.Minute
+	// JWKSMaxAge is how long verifiers may cache the published key set
+	JWKSMaxAge = 5 * time.Minute
+	// a new key is published this long before it signs anything, so every
+	// verifier's cached key set already has it. Instances pick it up within
+	// one refresh.
+	keyPublishLead = JWKSMaxAge + keyRefreshInterval
+	// minimum gap between reloads triggered by tokens with an unknown kid
+	unknownKidReloadGap = 10 * time.Second
+)
+
+// signingKeyDoc is how a key is persisted in the signing_keys collection so
+// every instance signs and verifies with the same set. Anyone holding a
+// private key can mint tokens for any user, so with a KMS configured it is
+// only stored sealed with a data key the KMS wraps: a copy of the database
+// alone is not enough. Without a KMS the PEM is stored as is.
+type signingKeyDoc struct {
+	KID       string `bson:"_id"`
+	Algorithm string `bson:"algorithm"`
+	// PKCS#8 PEM, set only when no KMS was configured
+	PrivateKey string `bson:"private_key,omitempty"`
+	// the PEM sealed with EncryptBytes and its data key wrapped by the KMS
+	EncryptedKey []byte    `bson:"encrypted_key,omitempty"`
+	KMSKeyID     string    `bson:"kms_key_id,omitempty"`
+	WrappedKey   []byte    `bson:"wrapped_key,omitempty"`
+	CreatedAt    time.Time `bson:"created_at"`
+	// NotBefore is when the key starts signing. It is published in the JWKS
+	// from CreatedAt on.
+	NotBefore time.Time `bson:"not_before"`
+	// RetiresAt is when the key stops being used for signing; it keeps
+	// verifying until ExpiresAt so already issued tokens stay valid
+	RetiresAt time.Time `bson:"retires_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	notBefore time.Time
+	retiresAt time.Time
+	expiresAt time.Time
+}
+
+type keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]*signingKey
+	active *signingKey
+	// a published key that hasn't started signing yet
+	pending    bool
+	lastReload time.Time
+}
+
+var signingKeys = &keyring{keys: map[string]*signingKey{}}
+
+// InitSigningKeys loads the signing keys from MongoDB, creating the first key
+// if none is active yet
+func InitSigningKeys(ctx context.Context) error {
+	if err := signingKeys.reload(ctx); err != nil {
+		return err
+	}
+	return signingKeys.rotateIfDue(ctx)
+}
+
+// StartKeyRotation periodically picks up keys created by other instances and
+// rotates the active key once it reaches JWT_KEY_ROTATION (default 30 days)
+func StartKeyRotation(ctx context.Context) {
+	ticker := time.NewTicker(keyRefreshInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := signingKeys.reload(ctx); err != nil {
+					log.Printf("Could not reload signing keys: %v", err)
+					continue
+				}
+				if err := signingKeys.rotateIfDue(ctx); err != nil {
+					log.Printf("Could not rotate signing key: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (k *keyring) reload(ctx context.Context) error {
+	collection := GetCollection("signing_keys")
+	now := time.Now()
+
+	// keys past their verification window are no longer needed
+	if _, err := collection.DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lte": now}}); err != nil {
+		log.Printf("Could not delete expired signing keys: %v", err)
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return fmt.Errorf("could not load signing keys: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var docs []signingKeyDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return fmt.Errorf("could not decode signing keys: %v", err)
+	}
+
+	keys := map[string]*signingKey{}
+	var ordered []*signingKey
+	for _, doc := range docs {
+		key, err := parseSigningKey(ctx, doc)
+		if err != nil {
+			log.Printf("Skipping signing key %s: %v", doc.KID, err)
+			continue
+		}
+		keys[key.kid] = key
+		ordered = append(ordered, key)
+	}
+	active, pending := pickSigningKey(ordered, now)
+
+	k.mu.Lock()
+	k.keys = keys
+	k.active = active
+	k.pending = pending
+	k.lastReload = now
+	k.mu.Unlock()
+	return nil
+}
+
+// reloadForUnknown reloads the keys for a kid we haven't seen, e.g. one just
+// created by another instance. It is rate limited so forged kids can't turn
+// every request into a database round trip.
+func (k *keyring) reloadForUnknown(ctx context.Context) {
+	k.mu.RLock()
+	stale := time.Since(k.lastReload) > unknownKidReloadGap
+	k.mu.RUnlock()
+
+	if stale {
+		if err := k.reload(ctx); err != nil {
+			log.Printf("Could not reload signing keys: %v", err)
+		}
+	}
+}
+
+// pickSigningKey returns the newest of keys (oldest first) that is within
+// its signing window, and whether a newer one is waiting for its NotBefore
+func pickSigningKey(keys []*signingKey, now time.Time) (active *signingKey, pending bool) {
+	for _, key := range keys {
+		if now.Before(key.notBefore) {
+			pending = true
+			continue
+		}
+		if now.Before(key.retiresAt) {
+			active = key
+		}
+	}
+	return active, pending
+}
+
+func (k *keyring) rotateIfDue(ctx context.Context) error {
+	k.mu.RLock()
+	active, pending := k.active, k.pending
+	k.mu.RUnlock()
+
+	// the replacement is created early enough to be published for
+	// keyPublishLead before the current key retires
+	if pending || (active != nil && time.Until(active.retiresAt) > keyPublishLead+keyRefreshInterval*2) {
+		return nil
+	}
+
+	// with no key to sign with at all there is nothing to wait for
+	notBefore := time.Now()
+	if active != nil {
+		notBefore = notBefore.Add(keyPublishLead)
+	}
+
+	doc, err := newSigningKeyDoc(ctx, jwtAlgorithm(), keyRotationInterval(), notBefore)
+	if err != nil {
+		return err
+	}
+	if _, err := GetCollection("signing_keys").InsertOne(ctx, doc); err != nil {
+		return fmt.Errorf("could not store signing key: %v", err)
+	}
+	log.Printf("Created new %s signing key %s", doc.Algorithm, doc.KID)
+
+	return k.reload(ctx)
+}
+
+func (k *keyring) signer() (*signingKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.active == nil {
+		return nil, fmt.Errorf("no active signing key")
+	}
+	return k.active, nil
+}
+
+func (k *keyring) lookup(kid string) (*signingKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok || time.Now().After(key.expiresAt) {
+		return nil, false
+	}
+	return key, true
+}
+
+func newSigningKeyDoc(ctx context.Context, algorithm string, rotation time.Duration, notBefore time.Time) (*signingKeyDoc, error) {
+	var private crypto.Signer
+	var err error
+
+	switch algorithm {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM %q", algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not generate key: %v", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode key: %v", err)
+	}
+
+	kidBytes := make([]byte, 12)
+	rand.Read(kidBytes)
+
+	now := time.Now()
+	doc := &signingKeyDoc{
+		KID:       base64.RawURLEncoding.EncodeToString(kidBytes),
+		Algorithm: algorithm,
+		CreatedAt: now,
+		NotBefore: notBefore,
+		RetiresAt: notBefore.Add(rotation),
+		ExpiresAt: notBefore.Add(rotation + MaxTokenLifetime),
+	}
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if kms == nil {
+		log.Println("WARNING: KMS_PROVIDER not set, storing the JWT signing key unencrypted")
+		doc.PrivateKey = string(privatePEM)
+		return doc, nil
+	}
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	if doc.EncryptedKey, err = EncryptBytes(dataKey, 0, privatePEM); err != nil {
+		return nil, fmt.Errorf("could not encrypt key: %v", err)
+	}
+	if doc.KMSKeyID, doc.WrappedKey, err = kms.Wrap(ctx, dataKey); err != nil {
+		return nil, fmt.Errorf("could not wrap key: %v", err)
+	}
+	return doc, nil
+}
+
+func parseSigningKey(ctx context.Context, doc signingKeyDoc) (*signingKey, error) {
+	privatePEM := []byte(doc.PrivateKey)
+	if doc.EncryptedKey != nil {
+		dataKey, err := UnwrapDataKey(ctx, doc.KMSKeyID, doc.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		if privatePEM, err = DecryptBytes(dataKey, 0, doc.EncryptedKey); err != nil {
+			return nil, fmt.Errorf("could not decrypt key: %v", err)
+		}
+	}
+
+	block, _ := pem.Decode(privatePEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{kid: doc.KID, notBefore: doc.NotBefore, retiresAt: doc.RetiresAt, expiresAt: doc.ExpiresAt}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.method, key.private = jwt.SigningMethodRS256, private
+	case ed25519.PrivateKey:
+		key.method, key.private = jwt.SigningMethodEdDSA, private
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	return key, nil
+}
+
+// PublicJWKS returns every key that can still verify tokens as a JWK set,
+// including the next key before it starts signing
+func PublicJWKS() map[string]interface{} {
+	signingKeys.mu.RLock()
+	defer signingKeys.mu.RUnlock()
+
+	keys := []map[string]string{}
+	for _, key := range signingKeys.keys {
+		jwk := map[string]string{
+			"kid": key.kid,
+			"use": "sig",
+			"alg": key.method.Alg(),
+		}
+
+		switch public := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		}
+
+		keys = append(keys, jwk)
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
+
+func jwtAlgorithm() string {
+	if alg := os.Getenv("JWT_ALGORITHM"); alg != "" {
+		return alg
+	}
+	return "RS256"
+}
+
+func keyRotationInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("JWT_KEY_ROTATION")); err == nil && d > 0 {
+		return d
+	}
+	return defaultKeyRotation
+}
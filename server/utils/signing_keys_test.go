@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+	"time"
+)
+
+func TestPickSigningKey(t *testing.T) {
+	now := time.Now()
+	key := func(kid string, notBefore, retiresAt time.Duration) *signingKey {
+		return &signingKey{kid: kid, notBefore: now.Add(notBefore), retiresAt: now.Add(retiresAt)}
+	}
+
+	tests := []struct {
+		name        string
+		keys        []*signingKey
+		wantKID     string
+		wantPending bool
+	}{
+		{"none", nil, "", false},
+		{"one active", []*signingKey{key("a", -time.Hour, time.Hour)}, "a", false},
+		{"retired", []*signingKey{key("a", -2*time.Hour, -time.Hour)}, "", false},
+		// the next key is published but the current one keeps signing
+		{"next not yet valid", []*signingKey{key("a", -time.Hour, time.Hour), key("b", 5*time.Minute, time.Hour)}, "a", true},
+		{"next valid", []*signingKey{key("a", -time.Hour, time.Hour), key("b", -time.Second, time.Hour)}, "b", false},
+		// keys stored before not_before existed have a zero value
+		{"legacy key", []*signingKey{{kid: "a", retiresAt: now.Add(time.Hour)}}, "a", false},
+	}
+	for _, tt := range tests {
+		active, pending := pickSigningKey(tt.keys, now)
+		kid := ""
+		if active != nil {
+			kid = active.kid
+		}
+		if kid != tt.wantKID || pending != tt.wantPending {
+			t.Errorf("%s: pickSigningKey = (%q, %v), want (%q, %v)", tt.name, kid, pending, tt.wantKID, tt.wantPending)
+		}
+	}
+}
+
+func TestNewSigningKeyDocWindows(t *testing.T) {
+	notBefore := time.Now().Add(keyPublishLead)
+	doc, err := newSigningKeyDoc(context.Background(), "EdDSA", time.Hour, notBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !doc.NotBefore.Equal(notBefore) {
+		t.Errorf("NotBefore = %v, want %v", doc.NotBefore, notBefore)
+	}
+	if want := notBefore.Add(time.Hour); !doc.RetiresAt.Equal(want) {
+		t.Errorf("RetiresAt = %v, want %v", doc.RetiresAt, want)
+	}
+	if want := notBefore.Add(time.Hour + MaxTokenLifetime); !doc.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", doc.ExpiresAt, want)
+	}
+	if keyPublishLead <= JWKSMaxAge {
+		t.Errorf("keys are published %v ahead, less than the JWKS cache age %v", keyPublishLead, JWKSMaxAge)
+	}
+
+	key, err := parseSigningKey(context.Background(), *doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.method.Alg() != "EdDSA" || !key.notBefore.Equal(notBefore) {
+		t.Errorf("parsed key %s with notBefore %v", key.method.Alg(), key.notBefore)
+	}
+}
+
+func TestSigningKeySealedWithKMS(t *testing.T) {
+	block, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kms = &LocalKMS{active: "test", keys: map[string]cipher.AEAD{"test": aead}}
+	t.Cleanup(func() { kms = nil })
+
+	doc, err := newSigningKeyDoc(context.Background(), "RS256", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.PrivateKey != "" {
+		t.Error("private key stored in the clear with a KMS configured")
+	}
+	if doc.KMSKeyID != "test" || len(doc.WrappedKey) == 0 || len(doc.EncryptedKey) == 0 {
+		t.Fatalf("key not sealed: kms key %q, wrapped %d bytes, encrypted %d bytes", doc.KMSKeyID, len(doc.WrappedKey), len(doc.EncryptedKey))
+	}
+
+	key, err := parseSigningKey(context.Background(), *doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.method.Alg() != "RS256" {
+		t.Errorf("parsed a %s key, want RS256", key.method.Alg())
+	}
+
+	doc.EncryptedKey[len(doc.EncryptedKey)-1] ^= 1
+	if _, err := parseSigningKey(context.Background(), *doc); err == nil {
+		t.Error("parsed a tampered key")
+	}
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// SniffLength is how many leading bytes DetectContentType looks at
+const SniffLength = 3072
+
+// DetectContentType identifies content from its leading bytes (magic numbers
+// and text heuristics), ignoring whatever the client claimed
+func DetectContentType(head []byte) string {
+	return mimetype.Detect(head).String()
+}
+
+// BaseMediaType strips parameters such as charset from a content type
+func BaseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mediaType
+}
+
+// executableTypes are native program formats; their children (e.g.
+// application/x-executable under application/x-elf) match too
+var executableTypes = []string{
+	"application/vnd.microsoft.portable-executable",
+	"application/x-msdownload",
+	"application/x-msdos-program",
+	"application/x-elf",
+	"application/x-mach-binary",
+}
+
+// MatchesContentType reports whether detected is pattern, one of its aliases
+// or a more specific type beneath it. "image/*" style families are allowed.
+func MatchesContentType(detected, pattern string) bool {
+	detected = strings.ToLower(BaseMediaType(detected))
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(detected, family+"/")
+	}
+	if detected == pattern {
+		return true
+	}
+
+	for m := mimetype.Lookup(detected); m != nil; m = m.Parent() {
+		if m.Is(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExecutableType reports whether contentType is a native executable format
+func IsExecutableType(contentType string) bool {
+	for _, t := range executableTypes {
+		if MatchesContentType(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentTypeMismatch reports whether the detected type contradicts the type
+// the client claimed or the one implied by the file extension, e.g. an
+// executable named photo.png. Only formats with reliable magic bytes are
+// checked, so a .csv detected as text/plain is fine.
+func ContentTypeMismatch(detected, claimed, name string) bool {
+	expected := []string{BaseMediaType(claimed)}
+	if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(name))); byExt != "" {
+		expected = append(expected, BaseMediaType(byExt))
+	}
+
+	for _, want := range expected {
+		if want == "" || want == "application/octet-stream" {
+			continue
+		}
+		if IsExecutableType(detected) && !IsExecutableType(want) {
+			return true
+		}
+		if !hasReliableMagic(want) {
+			continue
+		}
+		if !MatchesContentType(detected, want) && mediaFamily(detected) != mediaFamily(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasReliableMagic is true for types that always start with a signature.
+// SVG is XML text and is left out.
+func hasReliableMagic(contentType string) bool {
+	switch mediaFamily(contentType) {
+	case "image":
+		return contentType != "image/svg+xml"
+	case "media", "pdf":
+		return true
+	}
+	return false
+}
+
+// mediaFamily groups audio and video together since containers like MP4 and
+// Ogg hold either
+func mediaFamily(contentType string) string {
+	mediaType := BaseMediaType(contentType)
+	if mediaType == "application/pdf" {
+		return "pdf"
+	}
+	family, _, _ := strings.Cut(mediaType, "/")
+	if family == "audio" || family == "video" {
+		return "media"
+	}
+	return family
+}
@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	pngHead = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	pdfHead = []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	elfHead = append([]byte("\x7fELF\x02\x01\x01\x00"), append(make([]byte, 8), 0x02, 0x00, 0x3e, 0x00)...)
+)
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"png", pngHead, "image/png"},
+		{"pdf", pdfHead, "application/pdf"},
+		{"text", []byte("hello, world\n"), "text/plain; charset=utf-8"},
+		{"binary", bytes.Repeat([]byte{0x00, 0xff}, 64), "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := DetectContentType(tt.head); got != tt.want {
+			t.Errorf("%s: detected %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := DetectContentType(elfHead); !IsExecutableType(got) {
+		t.Errorf("ELF detected as %q, not an executable", got)
+	}
+}
+
+func TestBaseMediaType(t *testing.T) {
+	for in, want := range map[string]string{
+		"text/plain; charset=utf-8": "text/plain",
+		"image/png":                 "image/png",
+		"not a type;;":              "not a type;;",
+		"":                          "",
+	} {
+		if got := BaseMediaType(in); got != want {
+			t.Errorf("BaseMediaType(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMatchesContentType(t *testing.T) {
+	tests := []struct {
+		detected string
+		pattern  string
+		want     bool
+	}{
+		{"image/png", "image/png", true},
+		{"image/png", " IMAGE/PNG ", true},
+		{"image/png", "image/*", true},
+		{"image/png", "image/jpeg", false},
+		{"text/plain; charset=utf-8", "text/plain", true},
+		{"text/plain", "text/*", true},
+		{"imagex/png", "image/*", false},
+		// a more specific type matches its parent
+		{"application/x-executable", "application/x-elf", true},
+		{"application/x-elf", "application/x-executable", false},
+	}
+	for _, tt := range tests {
+		if got := MatchesContentType(tt.detected, tt.pattern); got != tt.want {
+			t.Errorf("MatchesContentType(%q, %q) = %v, want %v", tt.detected, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestContentTypeMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		detected string
+		claimed  string
+		filename string
+		want     bool
+	}{
+		{"matching image", "image/png", "image/png", "photo.png", false},
+		{"image under another image extension", "image/png", "image/jpeg", "photo.jpg", false},
+		{"executable named as an image", "application/x-executable", "image/png", "photo.png", true},
+		{"executable claimed as anything", "application/x-executable", "", "setup.txt", true},
+		{"executable named as one", "application/x-executable", "application/octet-stream", "tool", false},
+		{"text claimed as a pdf", "text/plain; charset=utf-8", "application/pdf", "paper.pdf", true},
+		{"csv detected as text", "text/plain; charset=utf-8", "text/csv", "data.csv", false},
+		{"svg detected as xml", "text/xml; charset=utf-8", "image/svg+xml", "logo.svg", false},
+		{"audio in a video container", "audio/mp4", "video/mp4", "clip.mp4", false},
+		{"nothing claimed", "image/png", "", "upload", false},
+	}
+	for _, tt := range tests {
+		if got := ContentTypeMismatch(tt.detected, tt.claimed, tt.filename); got != tt.want {
+			t.Errorf("%s: ContentTypeMismatch = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
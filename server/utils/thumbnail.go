@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ThumbnailSizes maps the size names accepted by the API to the longest edge in pixels
+var ThumbnailSizes = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  1024,
+}
+
+// images with more pixels than this are refused before decoding so a tiny
+// file claiming huge dimensions can't exhaust memory
+const maxThumbnailSourcePixels = 50_000_000
+
+func init() {
+	// pdfcpu otherwise writes a config directory under $HOME on first use
+	api.DisableConfigDir()
+}
+
+// DecodeImage decodes a JPEG, PNG, GIF or WebP image after checking its dimensions
+func DecodeImage(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, fmt.Errorf("image dimensions %dx%d not supported", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// ErrNoPDFImage is returned for PDFs whose first page embeds no raster image
+var ErrNoPDFImage = errors.New("no raster image on first page")
+
+// PDFEmbeddedImage returns the largest JPEG or PNG embedded in the first page
+// of a PDF. This is not a rendering of the page: there is no pure-Go PDF
+// rasteriser, so PDFs made only of text and vector graphics have no preview.
+func PDFEmbeddedImage(data []byte) (image.Image, error) {
+	pages, err := api.ExtractImagesRaw(bytes.NewReader(data), []string{"1"}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var best image.Image
+	bestArea := 0
+	for _, images := range pages {
+		for _, img := range images {
+			if img.FileType != "jpg" && img.FileType != "png" {
+				continue
+			}
+			raw, err := io.ReadAll(img)
+			if err != nil {
+				continue
+			}
+			decoded, err := DecodeImage(raw)
+			if err != nil {
+				continue
+			}
+			if area := decoded.Bounds().Dx() * decoded.Bounds().Dy(); area > bestArea {
+				best, bestArea = decoded, area
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoPDFImage
+	}
+	return best, nil
+}
+
+// EncodeThumbnail scales img so its longest edge is at most maxEdge and writes
+// it as a JPEG. Transparent areas are flattened onto white.
+func EncodeThumbnail(w io.Writer, img image.Image, maxEdge int) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxEdge || height > maxEdge {
+		if width >= height {
+			height = max(1, height*maxEdge/width)
+			width = maxEdge
+		} else {
+			width = max(1, width*maxEdge/height)
+			height = maxEdge
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	return jpeg.Encode(w, dst, &jpeg.Options{Quality: 80})
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeImage(t *testing.T) {
+	// a GIF header claiming 65535x65535 pixels and nothing else
+	huge := []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"png", encodePNG(t, 40, 20), false},
+		{"dimensions over the limit", huge, true},
+		{"not an image", []byte("%PDF-1.7"), true},
+		{"empty", nil, true},
+	}
+	for _, tt := range tests {
+		img, err := DecodeImage(tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && img.Bounds().Dx() != 40 {
+			t.Errorf("%s: decoded %v", tt.name, img.Bounds())
+		}
+	}
+}
+
+func TestEncodeThumbnail(t *testing.T) {
+	tests := []struct {
+		width, height int
+		maxEdge       int
+		wantW, wantH  int
+	}{
+		{1000, 500, 128, 128, 64},
+		{500, 1000, 128, 64, 128},
+		{100, 50, 128, 100, 50}, // never scaled up
+		{5000, 1, 128, 128, 1},  // never scaled to nothing
+		{256, 256, 256, 256, 256},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := EncodeThumbnail(&buf, image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height)), tt.maxEdge); err != nil {
+			t.Fatalf("%dx%d: %v", tt.width, tt.height, err)
+		}
+		cfg, err := jpeg.DecodeConfig(&buf)
+		if err != nil {
+			t.Fatalf("%dx%d: thumbnail is not a JPEG: %v", tt.width, tt.height, err)
+		}
+		if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+			t.Errorf("%dx%d at %d: thumbnail is %dx%d, want %dx%d", tt.width, tt.height, tt.maxEdge, cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestEncodeThumbnailFlattensTransparency(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeThumbnail(&buf, image.NewNRGBA(image.Rect(0, 0, 8, 8)), 8); err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(4, 4).RGBA(); r < 0xf000 || g < 0xf000 || b < 0xf000 {
+		t.Errorf("transparent pixel became %v, want white", img.At(4, 4))
+	}
+}
+
+func TestPDFEmbeddedImageRejectsNonPDF(t *testing.T) {
+	if _, err := PDFEmbeddedImage(encodePNG(t, 4, 4)); err == nil {
+		t.Error("a PNG was accepted as a PDF")
+	}
+}
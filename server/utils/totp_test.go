@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA-1 secret from RFC 6238 appendix B
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	// the RFC lists 8-digit codes; ours are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode([]byte("12345678901234567890"), tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfc6238Secret, "081804", step, true},
+		{"surrounding whitespace", rfc6238Secret, " 081804\n", step, true},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "081804", step, true},
+		{"previous step", rfc6238Secret, totpCode([]byte("12345678901234567890"), step-1), step - 1, true},
+		{"next step", rfc6238Secret, totpCode([]byte("12345678901234567890"), step+1), step + 1, true},
+		{"outside the skew", rfc6238Secret, totpCode([]byte("12345678901234567890"), step-2), 0, false},
+		{"wrong code", rfc6238Secret, "000000", 0, false},
+		{"eight digits", rfc6238Secret, "07081804", 0, false},
+		{"invalid secret", "not base32!", "081804", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := ValidateTOTP(tt.secret, tt.code, now)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("ValidateTOTP = (%d, %v), want (%d, %v)", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 50 {
+		t.Fatalf("got %d codes, want 50", len(codes))
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("code %q is not xxxxx-xxxxx", code)
+		}
+		for i, r := range code {
+			if i != 5 && !strings.ContainsRune(recoveryCodeAlphabet, r) {
+				t.Errorf("code %q has %q, outside the alphabet", code, r)
+			}
+		}
+		if seen[code] {
+			t.Errorf("code %q generated twice", code)
+		}
+		seen[code] = true
+	}
+}